@@ -0,0 +1,561 @@
+// Package client talks to a goKVServer over its HTTP API, mapping its
+// statuses back to sentinel errors and retrying requests that are safe to
+// repeat.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	DefaultTimeout      = 10 * time.Second
+	DefaultRetries      = 3
+	DefaultRetryBackoff = 100 * time.Millisecond
+	// the longest wait between retries, which double from the backoff
+	maxRetryBackoff = 2 * time.Second
+	// how long each watch poll waits for an event by default; under the
+	// server's default write timeout, which older servers cut polls off at
+	DefaultWatchPollTimeout = 5 * time.Second
+	// how much of an error response's body is kept
+	maxErrorBody = 512
+)
+
+var (
+	ErrorNoSuchKey       = errors.New("no such key")
+	ErrorKeyExists       = errors.New("existing key")
+	ErrorVersionMismatch = errors.New("version mismatch")
+	ErrorStoreFull       = errors.New("key store is full")
+	ErrorValueTooLarge   = errors.New("value too large")
+	// the server is a read-only follower
+	ErrorReadOnly = errors.New("server is read-only")
+	// the server can't take the request now, as when its cluster has no leader
+	ErrorUnavailable = errors.New("server unavailable")
+	ErrorBadRequest  = errors.New("bad request")
+	// a watch fell behind the server's event history
+	ErrorRevisionCompacted = errors.New("revision no longer in event history")
+)
+
+// StatusError a response the request didn't expect; it unwraps to the
+// sentinel error for its status, if any
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	msg := e.Status
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	if e.Err != nil {
+		return e.Err.Error() + " (" + msg + ")"
+	}
+	return msg
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// Entry a key's value, as stored
+type Entry struct {
+	Key         string     `json:"key"`
+	Value       string     `json:"value"`
+	ContentType string     `json:"contentType,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	// set by Get; listings don't report versions
+	Version uint64 `json:"version,omitempty"`
+}
+
+// the JSON form of an entry, with values that aren't UTF-8 base64 encoded
+type wireEntry struct {
+	Key         string     `json:"key"`
+	Value       string     `json:"value"`
+	Encoding    string     `json:"encoding,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	TTL         int64      `json:"ttl,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+}
+
+func decodeValue(value string, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return value, nil
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		return string(decoded), err
+	}
+	return "", fmt.Errorf("unknown encoding %q", encoding)
+}
+
+// Client a goKVServer's HTTP API. It's safe for concurrent use, and reuses
+// connections across requests.
+type Client struct {
+	baseURL      *url.URL
+	http         *http.Client
+	timeout      time.Duration
+	retries      int
+	retryBackoff time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient send requests with hc, rather than a client of the Client's
+// own
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithTimeout limit each request, retries included, to d; 0 for no limit
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+// WithRetries retry requests that are safe to repeat up to n times after a
+// network error or a 502, 503 or 504, waiting backoff before the first retry
+// and twice as long before each after
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.retryBackoff = n, backoff }
+}
+
+// New a client of the server at baseURL, such as "http://localhost:8000"
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("client: expected an http or https URL, got %q", baseURL)
+	}
+	c := &Client{
+		baseURL:      u,
+		timeout:      DefaultTimeout,
+		retries:      DefaultRetries,
+		retryBackoff: DefaultRetryBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.http == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = 32
+		c.http = &http.Client{Transport: transport}
+	}
+	return c, nil
+}
+
+// a request to the server
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+	// whether repeating it has the same effect as sending it once
+	idempotent bool
+}
+
+// the URL of path, already escaped, with query
+func (c *Client) url(path string, query url.Values) string {
+	u := *c.baseURL
+	u.RawPath = c.baseURL.EscapedPath() + path
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+// send req, retrying it if it's idempotent; the caller closes the response
+// body
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	backoff := c.retryBackoff
+	for attempt := 0; ; attempt++ {
+		httpReq, err := http.NewRequestWithContext(ctx, req.method, c.url(req.path, req.query), bytes.NewReader(req.body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range req.header {
+			httpReq.Header[k] = v
+		}
+
+		resp, err := c.http.Do(httpReq)
+		retry := req.idempotent && attempt < c.retries && ctx.Err() == nil
+		if err == nil {
+			switch resp.StatusCode {
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			default:
+				retry = false
+			}
+		} else {
+			var netErr net.Error
+			retry = retry && (errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF))
+		}
+		if !retry {
+			return resp, err
+		}
+		if resp != nil {
+			drain(resp)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// read the rest of the body so the connection can be reused, then close it
+func drain(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	_ = resp.Body.Close()
+}
+
+// the error for an unexpected response; statuses whose meaning depends on the
+// request are mapped by the caller through byStatus
+func responseError(resp *http.Response, byStatus map[int]error) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	err := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(body))}
+	if sentinel, ok := byStatus[resp.StatusCode]; ok {
+		err.Err = sentinel
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		err.Err = ErrorNoSuchKey
+	case http.StatusPreconditionFailed:
+		err.Err = ErrorVersionMismatch
+	case http.StatusInsufficientStorage:
+		err.Err = ErrorStoreFull
+	case http.StatusRequestEntityTooLarge:
+		err.Err = ErrorValueTooLarge
+	case http.StatusMisdirectedRequest:
+		err.Err = ErrorReadOnly
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		err.Err = ErrorUnavailable
+	case http.StatusBadRequest:
+		err.Err = ErrorBadRequest
+	case http.StatusGone:
+		err.Err = ErrorRevisionCompacted
+	}
+	return err
+}
+
+// the version in an ETag header
+func parseETag(etag string) uint64 {
+	version, _ := strconv.ParseUint(strings.Trim(strings.TrimPrefix(etag, "W/"), `"`), 10, 64)
+	return version
+}
+
+func formatETag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+// Get the key's value, exactly as stored, with its content type, if it has
+// one, and version
+func (c *Client) Get(ctx context.Context, key string) (*Entry, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	// raw, so values stored without a content type, as over the other
+	// protocols, come without the newline the server otherwise adds
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/keys/" + url.PathEscape(key),
+		query: url.Values{"raw": {"true"}}, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, nil)
+	}
+	value, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Key: key, Value: string(value), ContentType: resp.Header.Get("Content-Type"), Version: parseETag(resp.Header.Get("ETag"))}, nil
+}
+
+// WriteOptions optional settings for a new key
+type WriteOptions struct {
+	// the value's media type; application/octet-stream when empty
+	ContentType string
+	// how long the key lives; forever when 0
+	TTL time.Duration
+}
+
+// Create add key, returning its version; ErrorKeyExists if it exists
+func (c *Client) Create(ctx context.Context, key string, value string, opts *WriteOptions) (uint64, error) {
+	e := wireEntry{Key: key, Value: value, ContentType: "application/octet-stream"}
+	if !isText(value) {
+		e.Value, e.Encoding = base64.StdEncoding.EncodeToString([]byte(value)), "base64"
+	}
+	if opts != nil {
+		if opts.ContentType != "" {
+			e.ContentType = opts.ContentType
+		}
+		e.TTL = ttlSeconds(opts.TTL)
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	// the precondition sets an existing key apart from a bad request; a
+	// create isn't retried, as a retry of one that succeeded would fail
+	resp, err := c.do(ctx, request{method: http.MethodPost, path: "/keys", body: body,
+		header: http.Header{"Content-Type": {"application/json"}, "If-None-Match": {"*"}}})
+	if err != nil {
+		return 0, err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusCreated {
+		return 0, responseError(resp, map[int]error{http.StatusPreconditionFailed: ErrorKeyExists})
+	}
+	return parseETag(resp.Header.Get("ETag")), nil
+}
+
+// Update replace the value of an existing key, keeping its content type and
+// expiry, returning its new version; ErrorNoSuchKey if it doesn't exist
+func (c *Client) Update(ctx context.Context, key string, value string) (uint64, error) {
+	return c.update(ctx, key, value, "*", ErrorNoSuchKey)
+}
+
+// UpdateIf Update only if the key is at version; ErrorVersionMismatch if it
+// isn't, or doesn't exist
+func (c *Client) UpdateIf(ctx context.Context, key string, value string, version uint64) (uint64, error) {
+	return c.update(ctx, key, value, formatETag(version), ErrorVersionMismatch)
+}
+
+func (c *Client) update(ctx context.Context, key string, value string, ifMatch string, mismatch error) (uint64, error) {
+	e := wireEntry{Key: key, Value: value}
+	if !isText(value) {
+		e.Value, e.Encoding = base64.StdEncoding.EncodeToString([]byte(value)), "base64"
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.do(ctx, request{method: http.MethodPut, path: "/keys", body: body, idempotent: ifMatch == "*",
+		header: http.Header{"Content-Type": {"application/json"}, "If-Match": {ifMatch}}})
+	if err != nil {
+		return 0, err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return 0, responseError(resp, map[int]error{http.StatusPreconditionFailed: mismatch})
+	}
+	return parseETag(resp.Header.Get("ETag")), nil
+}
+
+// Put create or replace key, returning its new version
+func (c *Client) Put(ctx context.Context, key string, value string, opts *WriteOptions) (uint64, error) {
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	var query url.Values
+	if opts != nil {
+		if opts.ContentType != "" {
+			header.Set("Content-Type", opts.ContentType)
+		}
+		if opts.TTL > 0 {
+			query = url.Values{"ttl": {strconv.FormatInt(ttlSeconds(opts.TTL), 10)}}
+		}
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.do(ctx, request{method: http.MethodPut, path: "/keys/" + url.PathEscape(key), query: query,
+		header: header, body: []byte(value), idempotent: true})
+	if err != nil {
+		return 0, err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, responseError(resp, nil)
+	}
+	return parseETag(resp.Header.Get("ETag")), nil
+}
+
+// Delete remove key; ErrorNoSuchKey if it doesn't exist
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.delete(ctx, key, nil)
+}
+
+// DeleteIf Delete only if the key is at version; ErrorVersionMismatch if it
+// isn't
+func (c *Client) DeleteIf(ctx context.Context, key string, version uint64) error {
+	return c.delete(ctx, key, http.Header{"If-Match": {formatETag(version)}})
+}
+
+func (c *Client) delete(ctx context.Context, key string, header http.Header) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	// a retry of a delete that succeeded gets ErrorNoSuchKey, as the key is
+	// gone either way
+	resp, err := c.do(ctx, request{method: http.MethodDelete, path: "/keys/" + url.PathEscape(key), header: header, idempotent: header == nil})
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusNoContent {
+		return responseError(resp, nil)
+	}
+	return nil
+}
+
+// ListOptions the keys to list: those with Prefix, from Start up to but not
+// including End, in pages of Limit
+type ListOptions struct {
+	Prefix string
+	Start  string
+	End    string
+	// the most keys in a page; the server's default when 0
+	Limit int
+	// where to continue from: a previous page's Next
+	Cursor string
+}
+
+// Page one page of keys, in key order; Next is the cursor for the following
+// page, empty on the last
+type Page struct {
+	Entries []Entry
+	Next    string
+}
+
+// List one page of keys
+func (c *Client) List(ctx context.Context, opts ListOptions) (*Page, error) {
+	query := url.Values{}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Start != "" {
+		query.Set("start", opts.Start)
+	}
+	if opts.End != "" {
+		query.Set("end", opts.End)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+	if opts.Limit <= 0 && opts.Cursor == "" {
+		// ask for a page rather than every key at once
+		query.Set("limit", "100")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/keys", query: query, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, nil)
+	}
+	var page struct {
+		Items []wireEntry `json:"items"`
+		Next  string      `json:"next"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	result := &Page{Entries: make([]Entry, 0, len(page.Items)), Next: page.Next}
+	for _, e := range page.Items {
+		value, err := decodeValue(e.Value, e.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		result.Entries = append(result.Entries, Entry{Key: e.Key, Value: value, ContentType: e.ContentType, ExpiresAt: e.ExpiresAt})
+	}
+	return result, nil
+}
+
+// ListAll every key List would return, following pages to the last
+func (c *Client) ListAll(ctx context.Context, opts ListOptions) ([]Entry, error) {
+	var entries []Entry
+	for {
+		page, err := c.List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, page.Entries...)
+		if page.Next == "" {
+			return entries, nil
+		}
+		opts.Cursor = page.Next
+	}
+}
+
+// Stats a server's key count, size, limits and revision
+type Stats struct {
+	Keys int `json:"keys"`
+	// keys with a TTL
+	Expiring int   `json:"expiring"`
+	Bytes    int64 `json:"bytes"`
+	// capacity limits; 0 is unlimited
+	MaxKeys       int    `json:"maxKeys"`
+	MaxBytes      int64  `json:"maxBytes"`
+	Revision      uint64 `json:"revision"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+}
+
+// Stats the server's Stats; a sharded server reports only its own keys
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/stats", idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, nil)
+	}
+	var stats Stats
+	if err = json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// the server counts TTLs in whole seconds; round up, so a key never expires
+// early
+func ttlSeconds(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// whether value can be sent as JSON text as it is
+func isText(value string) bool {
+	return utf8.ValidString(value)
+}
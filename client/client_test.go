@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a server that responds with statuses in turn, counting requests
+func startStatusServer(t *testing.T, statuses ...int) (*Client, *atomic.Int32) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1)) - 1
+		status := statuses[min(n, len(statuses)-1)]
+		if status == http.StatusOK {
+			w.Header().Set("ETag", `"7"`)
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("v"))
+	}))
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL, WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, &requests
+}
+
+func TestNew(t *testing.T) {
+	for _, url := range []string{"localhost:8000", "ftp://host", "http://"} {
+		if _, err := New(url); err == nil {
+			t.Errorf("%s: expected an error", url)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+
+	c, requests := startStatusServer(t, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK)
+	if e, err := c.Get(ctx, "k"); err != nil || e.Value != "v" || e.Version != 7 || requests.Load() != 3 {
+		t.Errorf("Expected a get retried until it succeeds, got %+v, %v after %d requests", e, err, requests.Load())
+	}
+
+	c, requests = startStatusServer(t, http.StatusServiceUnavailable)
+	if _, err := c.Get(ctx, "k"); !errors.Is(err, ErrorUnavailable) || requests.Load() != 3 {
+		t.Errorf("Expected ErrorUnavailable after 2 retries, got %v after %d requests", err, requests.Load())
+	}
+
+	c, requests = startStatusServer(t, http.StatusServiceUnavailable, http.StatusCreated)
+	if _, err := c.Create(ctx, "k", "v", nil); !errors.Is(err, ErrorUnavailable) || requests.Load() != 1 {
+		t.Errorf("Expected a create not retried, got %v after %d requests", err, requests.Load())
+	}
+
+	c, requests = startStatusServer(t, http.StatusNotFound, http.StatusOK)
+	if _, err := c.Get(ctx, "k"); !errors.Is(err, ErrorNoSuchKey) || requests.Load() != 1 {
+		t.Errorf("Expected ErrorNoSuchKey without retrying, got %v after %d requests", err, requests.Load())
+	}
+
+	// a server that's gone
+	c, _ = startStatusServer(t, http.StatusOK)
+	c.baseURL.Host = "127.0.0.1:1"
+	if _, err := c.Get(ctx, "k"); err == nil {
+		t.Error("Expected an error from an unreachable server")
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		status int
+		call   func(c *Client) error
+		err    error
+	}{
+		{http.StatusPreconditionFailed, func(c *Client) error { _, err := c.Create(ctx, "k", "v", nil); return err }, ErrorKeyExists},
+		{http.StatusBadRequest, func(c *Client) error { _, err := c.Create(ctx, "k", "v", nil); return err }, ErrorBadRequest},
+		{http.StatusPreconditionFailed, func(c *Client) error { _, err := c.Update(ctx, "k", "v"); return err }, ErrorNoSuchKey},
+		{http.StatusPreconditionFailed, func(c *Client) error { _, err := c.UpdateIf(ctx, "k", "v", 3); return err }, ErrorVersionMismatch},
+		{http.StatusNotFound, func(c *Client) error { return c.Delete(ctx, "k") }, ErrorNoSuchKey},
+		{http.StatusInsufficientStorage, func(c *Client) error { _, err := c.Put(ctx, "k", "v", nil); return err }, ErrorStoreFull},
+		{http.StatusRequestEntityTooLarge, func(c *Client) error { _, err := c.Put(ctx, "k", "v", nil); return err }, ErrorValueTooLarge},
+		{http.StatusMisdirectedRequest, func(c *Client) error { return c.Delete(ctx, "k") }, ErrorReadOnly},
+	}
+	for _, tc := range tests {
+		c, _ := startStatusServer(t, tc.status)
+		err := tc.call(c)
+		var statusErr *StatusError
+		if !errors.Is(err, tc.err) || !errors.As(err, &statusErr) || statusErr.StatusCode != tc.status || statusErr.Body != "v" {
+			t.Errorf("%d: expected %v, got %v", tc.status, tc.err, err)
+		}
+	}
+}
+
+func TestWatchStopsOnCompaction(t *testing.T) {
+	c, _ := startStatusServer(t, http.StatusGone)
+	w, err := c.Watch(context.Background(), WatchOptions{Revision: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Fatal("Expected no events")
+	}
+	if !errors.Is(w.Err(), ErrorRevisionCompacted) {
+		t.Errorf("Expected ErrorRevisionCompacted, got %v", w.Err())
+	}
+}
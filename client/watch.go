@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventType what happened to a key
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventUpdate EventType = "update"
+	EventDelete EventType = "delete"
+	// deleted to make room for another key
+	EventEvict EventType = "evict"
+	// deleted when its TTL passed
+	EventExpire EventType = "expire"
+)
+
+// Event a change to a key, at the store revision it made
+type Event struct {
+	Type     EventType `json:"type"`
+	Key      string    `json:"key"`
+	Value    string    `json:"value,omitempty"`
+	Revision uint64    `json:"rev"`
+}
+
+// WatchOptions the changes to watch: those to Key or, when it's empty, to
+// keys with Prefix, which is every key when that's empty too
+type WatchOptions struct {
+	Key    string
+	Prefix string
+	// report changes after this revision; those from now on when 0
+	Revision uint64
+	// how long each request waits for a change; DefaultWatchPollTimeout
+	// when 0. Keep it under the server's write timeout.
+	PollTimeout time.Duration
+}
+
+// Watcher the changes to a key or keys, in order
+type Watcher struct {
+	c           *Client
+	query       url.Values
+	pollTimeout time.Duration
+	events      chan Event
+	cancel      context.CancelFunc
+
+	mu  sync.Mutex
+	rev uint64
+	err error
+}
+
+// Watch follow the changes opts selects until ctx is done or the watcher is
+// closed. Requests that fail are retried, resuming from the last revision
+// seen, so no change is missed or repeated; ErrorRevisionCompacted if the
+// server no longer has the changes since then.
+func (c *Client) Watch(ctx context.Context, opts WatchOptions) (*Watcher, error) {
+	query := url.Values{}
+	if opts.Key != "" {
+		query.Set("key", opts.Key)
+	} else if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Watcher{c: c, query: query, pollTimeout: opts.PollTimeout, events: make(chan Event), cancel: cancel, rev: opts.Revision}
+	if w.pollTimeout <= 0 {
+		w.pollTimeout = DefaultWatchPollTimeout
+	}
+	if opts.Revision == 0 {
+		// a poll that returns at once reports the current revision
+		pollCtx, pollCancel := c.withTimeout(ctx)
+		events, rev, err := w.poll(pollCtx, false, time.Millisecond)
+		pollCancel()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		w.rev = rev
+		if len(events) > 0 {
+			// changes made since the poll began, reported by the first poll
+			w.rev = events[0].Revision - 1
+		}
+	}
+	go w.run(ctx)
+	return w, nil
+}
+
+// Events the changes, closed once the watcher stops; Err then tells why
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err why the watcher stopped: nil while it runs or if it was closed,
+// otherwise the error that stopped it
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Revision the revision of the last change delivered, from which a new
+// watcher could resume
+func (w *Watcher) Revision() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rev
+}
+
+// Close stop watching
+func (w *Watcher) Close() {
+	w.cancel()
+}
+
+func (w *Watcher) run(ctx context.Context) {
+	defer close(w.events)
+	failures := 0
+	backoff := w.c.retryBackoff
+	for {
+		events, rev, err := w.poll(ctx, true, w.pollTimeout)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			var statusErr *StatusError
+			if failures++; failures > w.c.retries || (errors.As(err, &statusErr) && !errors.Is(err, ErrorUnavailable)) {
+				w.mu.Lock()
+				w.err = err
+				w.mu.Unlock()
+				return
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, maxRetryBackoff)
+			continue
+		}
+		failures, backoff = 0, w.c.retryBackoff
+
+		for _, e := range events {
+			select {
+			case w.events <- e:
+			case <-ctx.Done():
+				return
+			}
+			w.mu.Lock()
+			w.rev = e.Revision
+			w.mu.Unlock()
+		}
+		if len(events) == 0 {
+			w.mu.Lock()
+			w.rev = rev
+			w.mu.Unlock()
+		}
+	}
+}
+
+// one long-poll from the watcher's revision, or the current revision if
+// fromRev is false, waiting up to timeout for a change
+func (w *Watcher) poll(ctx context.Context, fromRev bool, timeout time.Duration) ([]Event, uint64, error) {
+	query := url.Values{"timeout": {timeout.String()}}
+	for k, v := range w.query {
+		query[k] = v
+	}
+	if fromRev {
+		query.Set("rev", strconv.FormatUint(w.Revision(), 10))
+	}
+	// the server holds the request for up to timeout; allow it longer
+	ctx, cancel := context.WithTimeout(ctx, timeout+w.c.timeout)
+	defer cancel()
+	resp, err := w.c.do(ctx, request{method: http.MethodGet, path: "/watch", query: query})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, responseError(resp, nil)
+	}
+
+	var res struct {
+		Revision uint64 `json:"rev"`
+		Events   []struct {
+			Event
+			Encoding string `json:"encoding"`
+		} `json:"events"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, 0, err
+	}
+	events := make([]Event, 0, len(res.Events))
+	for _, e := range res.Events {
+		if e.Value, err = decodeValue(e.Value, e.Encoding); err != nil {
+			return nil, 0, err
+		}
+		events = append(events, e.Event)
+	}
+	return events, res.Revision, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"goKVServer/client"
+)
+
+// a client of the HTTP API
+func startTestClient(t *testing.T) *client.Client {
+	InitKeyStore()
+	keyStore.maxKeys = 0
+	t.Cleanup(InitKeyStore)
+	srv := startTestLeader(t)
+	c, err := client.New(srv.URL, client.WithRetries(1, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientKeys(t *testing.T) {
+	c := startTestClient(t)
+	ctx := context.Background()
+
+	version, err := c.Create(ctx, "k", "one", nil)
+	if err != nil || version == 0 {
+		t.Fatalf("Expected the key created, got %d, %v", version, err)
+	}
+	if _, err = c.Create(ctx, "k", "again", nil); !errors.Is(err, client.ErrorKeyExists) {
+		t.Errorf("Expected ErrorKeyExists, got %v", err)
+	}
+	e, err := c.Get(ctx, "k")
+	if err != nil || e.Value != "one" || e.Version != version || e.ContentType != "application/octet-stream" {
+		t.Errorf("Expected the value as created, got %+v, %v", e, err)
+	}
+
+	if _, err = c.UpdateIf(ctx, "k", "two", version+1); !errors.Is(err, client.ErrorVersionMismatch) {
+		t.Errorf("Expected ErrorVersionMismatch, got %v", err)
+	}
+	updated, err := c.UpdateIf(ctx, "k", binaryValue, version)
+	if err != nil || updated <= version {
+		t.Errorf("Expected the update at the current version to succeed, got %d, %v", updated, err)
+	}
+	if e, _ = c.Get(ctx, "k"); e.Value != binaryValue {
+		t.Errorf("Expected the binary value, got %q", e.Value)
+	}
+	if _, err = c.Update(ctx, "missing", "v"); !errors.Is(err, client.ErrorNoSuchKey) {
+		t.Errorf("Expected ErrorNoSuchKey updating a missing key, got %v", err)
+	}
+
+	if _, err = c.Put(ctx, "a/b c", "x", &client.WriteOptions{ContentType: "text/plain", TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if e, err = c.Get(ctx, "a/b c"); err != nil || e.Value != "x" || e.ContentType != "text/plain" {
+		t.Errorf("Expected a key needing escaping stored, got %+v, %v", e, err)
+	}
+	if value, err := Get("a/b c"); err != nil || *value != "x" {
+		t.Errorf("Expected the key stored unescaped, got %v", err)
+	}
+
+	if err = c.DeleteIf(ctx, "k", version); !errors.Is(err, client.ErrorVersionMismatch) {
+		t.Errorf("Expected ErrorVersionMismatch deleting a stale version, got %v", err)
+	}
+	if err = c.Delete(ctx, "k"); err != nil {
+		t.Errorf("Expected the key deleted, got %v", err)
+	}
+	for _, err = range []error{c.Delete(ctx, "k"), func() error { _, err := c.Get(ctx, "k"); return err }()} {
+		if !errors.Is(err, client.ErrorNoSuchKey) {
+			t.Errorf("Expected ErrorNoSuchKey after deleting, got %v", err)
+		}
+	}
+}
+
+func TestClientGetRoundTrip(t *testing.T) {
+	c := startTestClient(t)
+	ctx := context.Background()
+
+	// a value stored without a content type, as the other protocols store
+	// them, comes back as stored
+	_ = Put("plain", "x")
+	if e, err := c.Get(ctx, "plain"); err != nil || e.Value != "x" || e.ContentType != "" {
+		t.Errorf("Expected the value as stored, without a content type, got %+v, %v", e, err)
+	}
+	for _, value := range []string{"x", "line\n", "", binaryValue} {
+		if _, err := c.Put(ctx, "k", value, nil); err != nil {
+			t.Fatal(err)
+		}
+		if e, err := c.Get(ctx, "k"); err != nil || e.Value != value {
+			t.Errorf("Expected %q back, got %+v, %v", value, e, err)
+		}
+		if _, err := c.Update(ctx, "plain", value); err != nil {
+			t.Fatal(err)
+		}
+		if e, err := c.Get(ctx, "plain"); err != nil || e.Value != value {
+			t.Errorf("Expected %q back after an update, got %+v, %v", value, e, err)
+		}
+	}
+}
+
+func TestClientList(t *testing.T) {
+	c := startTestClient(t)
+	ctx := context.Background()
+	for _, key := range []string{"p/1", "p/2", "p/3", "q/1"} {
+		if _, err := c.Create(ctx, key, key, &client.WriteOptions{TTL: time.Minute}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := c.List(ctx, client.ListOptions{Prefix: "p/", Limit: 2})
+	if err != nil || len(page.Entries) != 2 || page.Entries[0].Key != "p/1" || page.Next == "" || page.Entries[0].ExpiresAt == nil {
+		t.Fatalf("Expected the first page of 2, got %+v, %v", page, err)
+	}
+	entries, err := c.ListAll(ctx, client.ListOptions{Prefix: "p/", Limit: 2})
+	if err != nil || len(entries) != 3 || entries[2].Key != "p/3" || entries[2].Value != "p/3" {
+		t.Errorf("Expected every key with the prefix, got %+v, %v", entries, err)
+	}
+	if _, err = c.List(ctx, client.ListOptions{Cursor: "!"}); !errors.Is(err, client.ErrorBadRequest) {
+		t.Errorf("Expected ErrorBadRequest for a bad cursor, got %v", err)
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	c := startTestClient(t)
+	ctx := context.Background()
+	_ = Put("p/old", "1")
+
+	w, err := c.Watch(ctx, client.WatchOptions{Prefix: "p/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_ = Put("q/other", "x")
+	_ = Put("p/new", binaryValue)
+	_ = Delete("p/old")
+
+	expected := []client.Event{{Type: client.EventPut, Key: "p/new", Value: binaryValue}, {Type: client.EventDelete, Key: "p/old"}}
+	for _, e := range expected {
+		select {
+		case got := <-w.Events():
+			if got.Type != e.Type || got.Key != e.Key || got.Value != e.Value {
+				t.Errorf("Expected %+v, got %+v", e, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %+v", e)
+		}
+	}
+	waitFor(t, "the watcher at the current revision", func() bool { return w.Revision() == CurrentRevision() })
+
+	// resuming from an earlier revision replays the changes since
+	resumed, err := c.Watch(ctx, client.WatchOptions{Key: "p/old", Revision: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := <-resumed.Events(); e.Type != client.EventDelete || e.Key != "p/old" {
+		t.Errorf("Expected the delete replayed, got %+v", e)
+	}
+	resumed.Close()
+	if _, ok := <-resumed.Events(); ok || resumed.Err() != nil {
+		t.Errorf("Expected a closed watcher to stop without an error, got %v", resumed.Err())
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	c := startTestClient(t)
+	ctx := context.Background()
+	if _, err := c.Create(ctx, "k", "value", &client.WriteOptions{TTL: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := c.Stats(ctx)
+	if err != nil || stats.Keys != 1 || stats.Expiring != 1 || stats.Bytes != 5 || stats.Revision != CurrentRevision() {
+		t.Errorf("Expected the stats of one key, got %+v, %v", stats, err)
+	}
+}
+
+func TestClientWatchIdleKey(t *testing.T) {
+	InitKeyStore()
+	t.Cleanup(InitKeyStore)
+	srv := httptest.NewUnstartedServer(newRouter())
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	t.Cleanup(srv.Close)
+	c, err := client.New(srv.URL, client.WithRetries(0, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// polls outlasting the write timeout, with no retries to hide a failure
+	w, err := c.Watch(context.Background(), client.WatchOptions{Key: "idle", PollTimeout: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	time.Sleep(time.Second)
+	_ = Put("idle", "v")
+	select {
+	case e, ok := <-w.Events():
+		if !ok || e.Key != "idle" || e.Value != "v" {
+			t.Errorf("Expected the put, got %+v, %v", e, w.Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the put")
+	}
+}
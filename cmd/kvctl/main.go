@@ -0,0 +1,442 @@
+// Command kvctl reads and writes a goKVServer's keys from the command line.
+//
+//	kvctl [-server URL] [-o table|json] [-timeout DURATION] COMMAND [ARGS]
+//
+// Exit codes set apart the failures scripts act on: 3 when a key doesn't
+// exist, 4 when it already does and 5 when it's not at the expected version.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"goKVServer/client"
+)
+
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitNotFound
+	exitExists
+	exitVersionMismatch
+)
+
+const defaultServer = "http://localhost:8000"
+
+// a command's arguments weren't valid; reported with its usage
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+// env what a command runs with
+type env struct {
+	c     *client.Client
+	out   *output
+	stdin io.Reader
+	// where progress and summaries go, apart from the output
+	stderr io.Writer
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, e *env, args []string) error
+}
+
+var commands = map[string]command{
+	"get":    {"get KEY", getCommand},
+	"put":    {"put [-create] [-ttl DURATION] [-content-type TYPE] KEY [VALUE]", putCommand},
+	"update": {"update [-version N] KEY [VALUE]", updateCommand},
+	"delete": {"delete [-version N] KEY", deleteCommand},
+	"list":   {"list [-prefix PREFIX] [-start KEY] [-end KEY] [-limit N]", listCommand},
+	"watch":  {"watch [-prefix PREFIX] [-rev N] [-poll-timeout DURATION] [KEY]", watchCommand},
+	"import": {"import [-create] [-file FILE]", importCommand},
+	"export": {"export [-prefix PREFIX] [-file FILE]", exportCommand},
+	"stats":  {"stats", statsCommand},
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// run kvctl with args, returning its exit code
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("kvctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { usage(stderr, fs) }
+	server := fs.String("server", envOr("KVCTL_SERVER", defaultServer), "the server's URL, or $KVCTL_SERVER")
+	format := fs.String("o", "table", "output format: table or json")
+	timeout := fs.Duration("timeout", client.DefaultTimeout, "limit on each request")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		usage(stderr, fs)
+		return exitUsage
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(stderr, "kvctl: unknown output format %q\n", *format)
+		return exitUsage
+	}
+	name := fs.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "kvctl: unknown command %q\n", name)
+		usage(stderr, fs)
+		return exitUsage
+	}
+
+	c, err := client.New(*server, client.WithTimeout(*timeout))
+	if err != nil {
+		fmt.Fprintf(stderr, "kvctl: %s\n", err)
+		return exitUsage
+	}
+	e := &env{c: c, out: &output{w: stdout, json: *format == "json"}, stdin: stdin, stderr: stderr}
+	err = cmd.run(ctx, e, fs.Args()[1:])
+	if err == nil {
+		return exitOK
+	}
+	var usageErr usageError
+	if errors.As(err, &usageErr) {
+		fmt.Fprintf(stderr, "kvctl %s: %s\nusage: kvctl %s\n", name, err, cmd.usage)
+		return exitUsage
+	}
+	fmt.Fprintf(stderr, "kvctl %s: %s\n", name, err)
+	return exitCode(err)
+}
+
+// exitCode the exit code for a command's error
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, client.ErrorNoSuchKey):
+		return exitNotFound
+	case errors.Is(err, client.ErrorKeyExists):
+		return exitExists
+	case errors.Is(err, client.ErrorVersionMismatch):
+		return exitVersionMismatch
+	}
+	return exitError
+}
+
+func usage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "usage: kvctl [flags] COMMAND [ARGS]\n\nflags:\n")
+	fs.PrintDefaults()
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "\ncommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(w, "\nexit codes: 1 error, 2 usage, 3 no such key, 4 key exists, 5 version mismatch\n")
+}
+
+func envOr(name string, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// parseArgs parse a command's flags, which may come before or after its
+// arguments, checking it has from min to max arguments
+func parseArgs(fs *flag.FlagSet, args []string, min int, max int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, usageError{"flags: " + flagNames(fs)}
+			}
+			return nil, usageError{err.Error()}
+		}
+		rest := fs.Args()
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			// everything after -- is an argument
+			positional = append(positional, rest...)
+			break
+		}
+		if args = rest; len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) < min || len(positional) > max {
+		return nil, usageError{fmt.Sprintf("expected %s", argCount(min, max))}
+	}
+	return positional, nil
+}
+
+func flagNames(fs *flag.FlagSet) string {
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, "-"+f.Name) })
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+func argCount(min int, max int) string {
+	switch {
+	case min == max && min == 0:
+		return "no arguments"
+	case min == max:
+		return fmt.Sprintf("%d argument(s)", min)
+	}
+	return fmt.Sprintf("%d to %d arguments", min, max)
+}
+
+// the value from the arguments, or stdin when it's not among them
+func readValue(e *env, args []string) (string, error) {
+	if len(args) > 1 {
+		return args[1], nil
+	}
+	value, err := io.ReadAll(e.stdin)
+	return string(value), err
+}
+
+func getCommand(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	entry, err := e.c.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return e.out.entries([]client.Entry{*entry}, true)
+}
+
+func putCommand(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	create := fs.Bool("create", false, "fail if the key exists")
+	ttl := fs.Duration("ttl", 0, "how long the key lives")
+	contentType := fs.String("content-type", "", "the value's media type")
+	args, err := parseArgs(fs, args, 1, 2)
+	if err != nil {
+		return err
+	}
+	value, err := readValue(e, args)
+	if err != nil {
+		return err
+	}
+	opts := &client.WriteOptions{ContentType: *contentType, TTL: *ttl}
+	var version uint64
+	if *create {
+		version, err = e.c.Create(ctx, args[0], value, opts)
+	} else {
+		version, err = e.c.Put(ctx, args[0], value, opts)
+	}
+	if err != nil {
+		return err
+	}
+	return e.out.version(args[0], version)
+}
+
+func updateCommand(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	ifVersion := fs.Uint64("version", 0, "update only if the key is at this version")
+	args, err := parseArgs(fs, args, 1, 2)
+	if err != nil {
+		return err
+	}
+	value, err := readValue(e, args)
+	if err != nil {
+		return err
+	}
+	var version uint64
+	if *ifVersion > 0 {
+		version, err = e.c.UpdateIf(ctx, args[0], value, *ifVersion)
+	} else {
+		version, err = e.c.Update(ctx, args[0], value)
+	}
+	if err != nil {
+		return err
+	}
+	return e.out.version(args[0], version)
+}
+
+func deleteCommand(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	ifVersion := fs.Uint64("version", 0, "delete only if the key is at this version")
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *ifVersion > 0 {
+		return e.c.DeleteIf(ctx, args[0], *ifVersion)
+	}
+	return e.c.Delete(ctx, args[0])
+}
+
+func listCommand(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	var opts client.ListOptions
+	fs.StringVar(&opts.Prefix, "prefix", "", "list only keys with this prefix")
+	fs.StringVar(&opts.Start, "start", "", "the first key to list")
+	fs.StringVar(&opts.End, "end", "", "list keys before this one")
+	limit := fs.Int("limit", 0, "the most keys to list; 0 for all")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if *limit < 0 {
+		return usageError{"-limit can't be negative"}
+	}
+
+	var entries []client.Entry
+	for {
+		if *limit > 0 {
+			opts.Limit = min(*limit-len(entries), 100)
+		}
+		page, err := e.c.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, page.Entries...)
+		if page.Next == "" || (*limit > 0 && len(entries) >= *limit) {
+			break
+		}
+		opts.Cursor = page.Next
+	}
+	return e.out.entries(entries, false)
+}
+
+func watchCommand(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	var opts client.WatchOptions
+	fs.StringVar(&opts.Prefix, "prefix", "", "watch the keys with this prefix")
+	fs.Uint64Var(&opts.Revision, "rev", 0, "report the changes after this revision, rather than from now on")
+	fs.DurationVar(&opts.PollTimeout, "poll-timeout", client.DefaultWatchPollTimeout, "how long each request waits for a change; keep it under the server's write timeout")
+	args, err := parseArgs(fs, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		if opts.Prefix != "" {
+			return usageError{"watch a key or a prefix, not both"}
+		}
+		opts.Key = args[0]
+	}
+
+	w, err := e.c.Watch(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	// until interrupted, or the watcher fails
+	for ev := range w.Events() {
+		if err = e.out.event(ev); err != nil {
+			return err
+		}
+	}
+	return w.Err()
+}
+
+func importCommand(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	create := fs.Bool("create", false, "fail on a key that exists, rather than replacing it")
+	file := fs.String("file", "", "read from this file rather than stdin")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	r := e.stdin
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	imported, skipped := 0, 0
+	err := readRecords(r, func(rec record) error {
+		entry, err := rec.entry()
+		if err != nil {
+			return err
+		}
+		opts := &client.WriteOptions{ContentType: entry.ContentType}
+		if entry.ExpiresAt != nil {
+			if opts.TTL = time.Until(*entry.ExpiresAt); opts.TTL <= 0 {
+				skipped++
+				return nil
+			}
+		}
+		if *create {
+			_, err = e.c.Create(ctx, entry.Key, entry.Value, opts)
+		} else {
+			_, err = e.c.Put(ctx, entry.Key, entry.Value, opts)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Key, err)
+		}
+		imported++
+		return nil
+	})
+	fmt.Fprintf(e.stderr, "imported %d keys, skipped %d expired\n", imported, skipped)
+	return err
+}
+
+func exportCommand(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "export only keys with this prefix")
+	file := fs.String("file", "", "write to this file rather than stdout")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	entries, err := e.c.ListAll(ctx, client.ListOptions{Prefix: *prefix})
+	if err != nil {
+		return err
+	}
+	if *file == "" {
+		return writeRecords(e.out.w, entries)
+	}
+	f, err := os.Create(*file)
+	if err != nil {
+		return err
+	}
+	if err = writeRecords(f, entries); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.stderr, "exported %d keys\n", len(entries))
+	return nil
+}
+
+func statsCommand(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	stats, err := e.c.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	return e.out.stats(stats)
+}
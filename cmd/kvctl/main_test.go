@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+// a server with just enough of the HTTP API for kvctl
+type fakeServer struct {
+	mu       sync.Mutex
+	values   map[string]string
+	types    map[string]string
+	versions map[string]uint64
+	revision uint64
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, isKey := strings.CutPrefix(r.URL.Path, "/keys/")
+	switch {
+	case r.URL.Path == "/stats":
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": len(s.values), "revision": s.revision})
+	case r.URL.Path == "/keys" && r.Method == http.MethodGet:
+		var items []map[string]string
+		for k, v := range s.values {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				item := map[string]string{"key": k, "value": v, "contentType": s.types[k]}
+				if !utf8.ValidString(v) {
+					item["value"], item["encoding"] = base64.StdEncoding.EncodeToString([]byte(v)), "base64"
+				}
+				items = append(items, item)
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i]["key"] < items[j]["key"] })
+		_ = json.NewEncoder(w).Encode(map[string]any{"items": items})
+	case r.URL.Path == "/keys" && r.Method == http.MethodPost:
+		var e struct{ Key, Value, ContentType string }
+		_ = json.NewDecoder(r.Body).Decode(&e)
+		if _, ok := s.values[e.Key]; ok {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		s.put(w, e.Key, e.Value, e.ContentType)
+		w.WriteHeader(http.StatusCreated)
+	case r.URL.Path == "/keys" && r.Method == http.MethodPut:
+		var e struct{ Key, Value string }
+		_ = json.NewDecoder(r.Body).Decode(&e)
+		version, ok := s.versions[e.Key]
+		if ifMatch := r.Header.Get("If-Match"); !ok || (ifMatch != "*" && ifMatch != strconv.Quote(strconv.FormatUint(version, 10))) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		s.put(w, e.Key, e.Value, s.types[e.Key])
+	case isKey && r.Method == http.MethodGet:
+		value, ok := s.values[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", s.types[key])
+		w.Header().Set("ETag", strconv.Quote(strconv.FormatUint(s.versions[key], 10)))
+		_, _ = w.Write([]byte(value))
+	case isKey && r.Method == http.MethodPut:
+		value, _ := io.ReadAll(r.Body)
+		s.put(w, key, string(value), r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusNoContent)
+	case isKey && r.Method == http.MethodDelete:
+		if _, ok := s.values[key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.values, key)
+		s.revision++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *fakeServer) put(w http.ResponseWriter, key string, value string, contentType string) {
+	s.revision++
+	s.values[key], s.types[key], s.versions[key] = value, contentType, s.revision
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatUint(s.revision, 10)))
+}
+
+func startFakeServer(t *testing.T) string {
+	srv := httptest.NewServer(&fakeServer{values: map[string]string{}, types: map[string]string{}, versions: map[string]uint64{}})
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// run kvctl against server, returning its exit code and output
+func runKvctl(t *testing.T, server string, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), append([]string{"-server", server}, args...), strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestExitCodes(t *testing.T) {
+	server := startFakeServer(t)
+	tests := []struct {
+		args  []string
+		stdin string
+		code  int
+	}{
+		{[]string{"put", "-create", "k", "v"}, "", exitOK},
+		{[]string{"put", "k", "-create", "again"}, "", exitExists},
+		{[]string{"get", "missing"}, "", exitNotFound},
+		{[]string{"update", "missing", "v"}, "", exitNotFound},
+		{[]string{"update", "-version", "7", "k", "v"}, "", exitVersionMismatch},
+		{[]string{"update", "-version", "1", "k"}, "from stdin", exitOK},
+		{[]string{"delete", "k"}, "", exitOK},
+		{[]string{"delete", "k"}, "", exitNotFound},
+		{[]string{"get"}, "", exitUsage},
+		{[]string{"list", "extra"}, "", exitUsage},
+		{[]string{"list", "-bogus"}, "", exitUsage},
+		{[]string{"frobnicate"}, "", exitUsage},
+		{[]string{"-o", "yaml", "stats"}, "", exitUsage},
+	}
+	for _, tc := range tests {
+		if code, _, stderr := runKvctl(t, server, tc.stdin, tc.args...); code != tc.code {
+			t.Errorf("%v: expected exit code %d, got %d: %s", tc.args, tc.code, code, stderr)
+		}
+	}
+
+	if code, _, _ := runKvctl(t, "http://127.0.0.1:1", "", "get", "k"); code != exitError {
+		t.Errorf("Expected exit code %d from an unreachable server, got %d", exitError, code)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	server := startFakeServer(t)
+	runKvctl(t, server, "", "put", "-content-type", "text/plain", "p/a", "hello")
+	runKvctl(t, server, "\x00\xff", "put", "--", "p/b")
+
+	code, stdout, _ := runKvctl(t, server, "", "get", "p/a")
+	if lines := strings.Split(stdout, "\n"); code != exitOK || len(lines) != 3 || !strings.HasPrefix(lines[0], "KEY") ||
+		strings.Join(strings.Fields(lines[1]), " ") != "p/a hello text/plain - 1" {
+		t.Errorf("Expected a table of the key, got %d %q", code, stdout)
+	}
+
+	code, stdout, _ = runKvctl(t, server, "", "-o", "json", "list", "--prefix", "p/")
+	var records []record
+	if err := json.Unmarshal([]byte(stdout), &records); code != exitOK || err != nil || len(records) != 2 {
+		t.Fatalf("Expected a JSON array of 2 keys, got %d %q", code, stdout)
+	}
+	if records[1].Key != "p/b" || records[1].Encoding != "base64" || records[1].Value != "AP8=" {
+		t.Errorf("Expected the binary value base64 encoded, got %+v", records[1])
+	}
+
+	if code, stdout, _ = runKvctl(t, server, "", "list"); !strings.Contains(stdout, `"\x00\xff"`) {
+		t.Errorf("Expected the binary value quoted in the table, got %d %q", code, stdout)
+	}
+
+	code, stdout, _ = runKvctl(t, server, "", "-o", "json", "stats")
+	var stats struct{ Keys int }
+	if err := json.Unmarshal([]byte(stdout), &stats); code != exitOK || err != nil || stats.Keys != 2 {
+		t.Errorf("Expected the stats as JSON, got %d %q", code, stdout)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	from, to := startFakeServer(t), startFakeServer(t)
+	runKvctl(t, from, "", "put", "-content-type", "text/plain", "a", "1")
+	runKvctl(t, from, "\x00\xff", "put", "b")
+	file := filepath.Join(t.TempDir(), "keys.jsonl")
+
+	if code, _, stderr := runKvctl(t, from, "", "export", "-file", file); code != exitOK || stderr != "exported 2 keys\n" {
+		t.Fatalf("Expected the keys exported, got %d %q", code, stderr)
+	}
+	if code, _, stderr := runKvctl(t, to, "", "import", "-file", file); code != exitOK || !strings.HasPrefix(stderr, "imported 2 keys") {
+		t.Fatalf("Expected the keys imported, got %d %q", code, stderr)
+	}
+	_, exported, _ := runKvctl(t, from, "", "export")
+	_, imported, _ := runKvctl(t, to, "", "export")
+	if exported != imported {
+		t.Errorf("Expected the same keys after importing, got %q and %q", exported, imported)
+	}
+
+	data, _ := os.ReadFile(file)
+	if code, _, _ := runKvctl(t, to, string(data), "import", "-create"); code != exitExists {
+		t.Errorf("Expected exit code %d importing existing keys with -create, got %d", exitExists, code)
+	}
+	if code, _, _ := runKvctl(t, to, "not json", "import"); code != exitError {
+		t.Errorf("Expected exit code %d importing bad input, got %d", exitError, code)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"goKVServer/client"
+)
+
+// output writes results as aligned tables, or as JSON
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+// record an entry as kvctl writes it, with values that aren't UTF-8 base64
+// encoded as the server does; export writes one per line and import reads
+// them back
+type record struct {
+	Key         string     `json:"key"`
+	Value       string     `json:"value"`
+	Encoding    string     `json:"encoding,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	Version     uint64     `json:"version,omitempty"`
+}
+
+func newRecord(e client.Entry) record {
+	rec := record{Key: e.Key, Value: e.Value, ContentType: e.ContentType, ExpiresAt: e.ExpiresAt, Version: e.Version}
+	if !utf8.ValidString(e.Value) {
+		rec.Value, rec.Encoding = base64.StdEncoding.EncodeToString([]byte(e.Value)), "base64"
+	}
+	return rec
+}
+
+func (rec record) entry() (client.Entry, error) {
+	e := client.Entry{Key: rec.Key, Value: rec.Value, ContentType: rec.ContentType, ExpiresAt: rec.ExpiresAt, Version: rec.Version}
+	switch rec.Encoding {
+	case "":
+	case "base64":
+		value, err := base64.StdEncoding.DecodeString(rec.Value)
+		if err != nil {
+			return e, fmt.Errorf("%s: %w", rec.Key, err)
+		}
+		e.Value = string(value)
+	default:
+		return e, fmt.Errorf("%s: unknown encoding %q", rec.Key, rec.Encoding)
+	}
+	return e, nil
+}
+
+// writeRecords write entries as JSON, one per line
+func writeRecords(w io.Writer, entries []client.Entry) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, e := range entries {
+		if err := enc.Encode(newRecord(e)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// readRecords call fn with each record in r, one JSON object per line
+func readRecords(r io.Reader, fn func(rec record) error) error {
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var rec record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("record %d: %w", line, err)
+		}
+		if rec.Key == "" {
+			return fmt.Errorf("record %d: no key", line)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+func (o *output) encode(v any) error {
+	enc := json.NewEncoder(o.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// table write a header and rows, with aligned columns
+func (o *output) table(header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(o.w, 0, 4, 2, ' ', 0)
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, cell)
+		}
+		fmt.Fprint(tw, "\n")
+	}
+	return tw.Flush()
+}
+
+// entries write keys' values; with versions for those from Get, as
+// listings have none
+func (o *output) entries(entries []client.Entry, versions bool) error {
+	if o.json {
+		records := make([]record, 0, len(entries))
+		for _, e := range entries {
+			records = append(records, newRecord(e))
+		}
+		if versions && len(records) == 1 {
+			return o.encode(records[0])
+		}
+		return o.encode(records)
+	}
+
+	header := []string{"KEY", "VALUE", "CONTENT-TYPE", "EXPIRES"}
+	if versions {
+		header = append(header, "VERSION")
+	}
+	rows := make([][]string, 0, len(entries))
+	for _, e := range entries {
+		row := []string{cell(e.Key), cell(e.Value), e.ContentType, "-"}
+		if e.ExpiresAt != nil {
+			row[3] = e.ExpiresAt.Format(time.RFC3339)
+		}
+		if versions {
+			row = append(row, strconv.FormatUint(e.Version, 10))
+		}
+		rows = append(rows, row)
+	}
+	return o.table(header, rows)
+}
+
+// version write a key's new version, after a write
+func (o *output) version(key string, version uint64) error {
+	if o.json {
+		return o.encode(struct {
+			Key     string `json:"key"`
+			Version uint64 `json:"version"`
+		}{key, version})
+	}
+	return o.table([]string{"KEY", "VERSION"}, [][]string{{cell(key), strconv.FormatUint(version, 10)}})
+}
+
+// event write a change as it arrives: a JSON object per line, or a line of
+// columns
+func (o *output) event(e client.Event) error {
+	if o.json {
+		return json.NewEncoder(o.w).Encode(newEventRecord(e))
+	}
+	value := "-"
+	if e.Type == client.EventPut || e.Type == client.EventUpdate {
+		value = cell(e.Value)
+	}
+	_, err := fmt.Fprintf(o.w, "%-8d %-7s %s %s\n", e.Revision, e.Type, cell(e.Key), value)
+	return err
+}
+
+type eventRecord struct {
+	Revision uint64           `json:"rev"`
+	Type     client.EventType `json:"type"`
+	Key      string           `json:"key"`
+	Value    string           `json:"value,omitempty"`
+	Encoding string           `json:"encoding,omitempty"`
+}
+
+func newEventRecord(e client.Event) eventRecord {
+	rec := eventRecord{Revision: e.Revision, Type: e.Type, Key: e.Key, Value: e.Value}
+	if !utf8.ValidString(e.Value) {
+		rec.Value, rec.Encoding = base64.StdEncoding.EncodeToString([]byte(e.Value)), "base64"
+	}
+	return rec
+}
+
+func (o *output) stats(s *client.Stats) error {
+	if o.json {
+		return o.encode(s)
+	}
+	limit := func(n int64) string {
+		if n == 0 {
+			return "-"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return o.table([]string{"KEYS", "EXPIRING", "BYTES", "MAX-KEYS", "MAX-BYTES", "REVISION", "UPTIME"}, [][]string{{
+		strconv.Itoa(s.Keys), strconv.Itoa(s.Expiring), strconv.FormatInt(s.Bytes, 10),
+		limit(int64(s.MaxKeys)), limit(s.MaxBytes), strconv.FormatUint(s.Revision, 10),
+		(time.Duration(s.UptimeSeconds) * time.Second).String(),
+	}})
+}
+
+// a value as a table cell: quoted when it isn't printable text on one line,
+// so it can't break the table
+func cell(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
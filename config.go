@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration a time.Duration read from config files as a string such as "5m"
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config server settings. Each is read, in increasing order of precedence,
+// from its default, the config file, the environment and the command line.
+type Config struct {
+	ListenAddr          string   `json:"listenAddr" yaml:"listenAddr" toml:"listenAddr"`
+	RESPListenAddr      string   `json:"respListenAddr" yaml:"respListenAddr" toml:"respListenAddr"`
+	GRPCListenAddr      string   `json:"grpcListenAddr" yaml:"grpcListenAddr" toml:"grpcListenAddr"`
+	MemcachedListenAddr string   `json:"memcachedListenAddr" yaml:"memcachedListenAddr" toml:"memcachedListenAddr"`
+	MaxKeys             int      `json:"maxKeys" yaml:"maxKeys" toml:"maxKeys"`
+	MaxBytes            int64    `json:"maxBytes" yaml:"maxBytes" toml:"maxBytes"`
+	EvictionPolicy      string   `json:"evictionPolicy" yaml:"evictionPolicy" toml:"evictionPolicy"`
+	DataDir             string   `json:"dataDir" yaml:"dataDir" toml:"dataDir"`
+	WALSync             string   `json:"walSync" yaml:"walSync" toml:"walSync"`
+	WALSyncInterval     Duration `json:"walSyncInterval" yaml:"walSyncInterval" toml:"walSyncInterval"`
+	SnapshotInterval    Duration `json:"snapshotInterval" yaml:"snapshotInterval" toml:"snapshotInterval"`
+	ExpirySweepInterval Duration `json:"expirySweepInterval" yaml:"expirySweepInterval" toml:"expirySweepInterval"`
+	LogLevel            string   `json:"logLevel" yaml:"logLevel" toml:"logLevel"`
+	ReadTimeout         Duration `json:"readTimeout" yaml:"readTimeout" toml:"readTimeout"`
+	WriteTimeout        Duration `json:"writeTimeout" yaml:"writeTimeout" toml:"writeTimeout"`
+	IdleTimeout         Duration `json:"idleTimeout" yaml:"idleTimeout" toml:"idleTimeout"`
+	ShutdownTimeout     Duration `json:"shutdownTimeout" yaml:"shutdownTimeout" toml:"shutdownTimeout"`
+	ReplicateFrom       string   `json:"replicateFrom" yaml:"replicateFrom" toml:"replicateFrom"`
+	RaftID              string   `json:"raftId" yaml:"raftId" toml:"raftId"`
+	RaftPeers           string   `json:"raftPeers" yaml:"raftPeers" toml:"raftPeers"`
+	ShardID             string   `json:"shardId" yaml:"shardId" toml:"shardId"`
+	ShardPeers          string   `json:"shardPeers" yaml:"shardPeers" toml:"shardPeers"`
+	ShardVirtualNodes   int      `json:"shardVirtualNodes" yaml:"shardVirtualNodes" toml:"shardVirtualNodes"`
+}
+
+// DefaultConfig the settings used when nothing else is given
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:          ":8000",
+		MaxKeys:             defaultMaxKeys,
+		EvictionPolicy:      EvictionFIFO,
+		DataDir:             defaultDataDir,
+		WALSync:             string(WALSyncAlways),
+		WALSyncInterval:     Duration(defaultWALInterval),
+		SnapshotInterval:    Duration(defaultSnapshotInterval),
+		ExpirySweepInterval: Duration(defaultExpirySweepInterval),
+		LogLevel:            "info",
+		ReadTimeout:         Duration(10 * time.Second),
+		WriteTimeout:        Duration(10 * time.Second),
+		IdleTimeout:         Duration(time.Minute),
+		// within the 10s docker stop allows before killing the container
+		ShutdownTimeout:   Duration(8 * time.Second),
+		ShardVirtualNodes: defaultShardVirtualNodes,
+	}
+}
+
+// a setting that can be given on the command line or in the environment
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	// the setting's current value, for usage defaults
+	get func(c *Config) string
+	set func(c *Config, v string) error
+}
+
+func durationSetting(flag string, env string, usage string, field func(c *Config) *Duration) setting {
+	return setting{
+		flag: flag, env: env, usage: usage,
+		get: func(c *Config) string { return field(c).String() },
+		set: func(c *Config, v string) error { return field(c).UnmarshalText([]byte(v)) },
+	}
+}
+
+func stringSetting(flag string, env string, usage string, field func(c *Config) *string) setting {
+	return setting{
+		flag: flag, env: env, usage: usage,
+		get: func(c *Config) string { return *field(c) },
+		set: func(c *Config, v string) error { *field(c) = v; return nil },
+	}
+}
+
+var settings = []setting{
+	stringSetting("listen", "KV_LISTEN_ADDR", "address the HTTP server listens on",
+		func(c *Config) *string { return &c.ListenAddr }),
+	stringSetting("resp-listen", "KV_RESP_LISTEN_ADDR", "address the Redis protocol listener listens on, empty to disable",
+		func(c *Config) *string { return &c.RESPListenAddr }),
+	stringSetting("grpc-listen", "KV_GRPC_LISTEN_ADDR", "address the gRPC server listens on, empty to disable",
+		func(c *Config) *string { return &c.GRPCListenAddr }),
+	stringSetting("memcached-listen", "KV_MEMCACHED_LISTEN_ADDR", "address the memcached protocol listener listens on, empty to disable",
+		func(c *Config) *string { return &c.MemcachedListenAddr }),
+	{
+		flag: "max-keys", env: "KV_MAX_KEYS", usage: "maximum number of keys stored, 0 for unlimited",
+		get: func(c *Config) string { return strconv.Itoa(c.MaxKeys) },
+		set: func(c *Config, v string) (err error) { c.MaxKeys, err = strconv.Atoi(v); return },
+	},
+	{
+		flag: "max-bytes", env: "KV_MAX_BYTES", usage: "maximum total bytes of values stored, 0 for unlimited",
+		get: func(c *Config) string { return strconv.FormatInt(c.MaxBytes, 10) },
+		set: func(c *Config, v string) (err error) { c.MaxBytes, err = strconv.ParseInt(v, 10, 64); return },
+	},
+	stringSetting("eviction-policy", "KV_EVICTION_POLICY", "eviction policy when full: fifo, lru, lfu or reject",
+		func(c *Config) *string { return &c.EvictionPolicy }),
+	stringSetting("data-dir", "KV_DATA_DIR", "directory for the write-ahead log and snapshots, empty to run in memory",
+		func(c *Config) *string { return &c.DataDir }),
+	stringSetting("wal-sync", "KV_WAL_SYNC", "when the write-ahead log is fsync'd: always, interval or never",
+		func(c *Config) *string { return &c.WALSync }),
+	durationSetting("wal-sync-interval", "KV_WAL_SYNC_INTERVAL", "fsync interval for -wal-sync=interval",
+		func(c *Config) *Duration { return &c.WALSyncInterval }),
+	durationSetting("snapshot-interval", "KV_SNAPSHOT_INTERVAL", "how often to snapshot the store, 0 to disable",
+		func(c *Config) *Duration { return &c.SnapshotInterval }),
+	durationSetting("expiry-sweep-interval", "KV_EXPIRY_SWEEP_INTERVAL", "how often expired keys are reclaimed",
+		func(c *Config) *Duration { return &c.ExpirySweepInterval }),
+	stringSetting("log-level", "KV_LOG_LEVEL", "minimum level logged: debug, info, warn or error",
+		func(c *Config) *string { return &c.LogLevel }),
+	durationSetting("read-timeout", "KV_READ_TIMEOUT", "maximum duration for reading a request",
+		func(c *Config) *Duration { return &c.ReadTimeout }),
+	durationSetting("write-timeout", "KV_WRITE_TIMEOUT", "maximum duration for writing a response",
+		func(c *Config) *Duration { return &c.WriteTimeout }),
+	durationSetting("idle-timeout", "KV_IDLE_TIMEOUT", "how long idle keep-alive connections are kept open",
+		func(c *Config) *Duration { return &c.IdleTimeout }),
+	durationSetting("shutdown-timeout", "KV_SHUTDOWN_TIMEOUT", "how long active requests may take to finish on shutdown",
+		func(c *Config) *Duration { return &c.ShutdownTimeout }),
+	stringSetting("replicate-from", "KV_REPLICATE_FROM", "base URL of a leader to replicate from as a read-only follower, empty to lead",
+		func(c *Config) *string { return &c.ReplicateFrom }),
+	stringSetting("raft-id", "KV_RAFT_ID", "this server's ID in its Raft cluster, empty to run alone",
+		func(c *Config) *string { return &c.RaftID }),
+	stringSetting("raft-peers", "KV_RAFT_PEERS", "every Raft cluster member as id=url, comma separated",
+		func(c *Config) *string { return &c.RaftPeers }),
+	stringSetting("shard-id", "KV_SHARD_ID", "this server's ID among the shards of a sharded deployment, empty to hold every key",
+		func(c *Config) *string { return &c.ShardID }),
+	stringSetting("shard-peers", "KV_SHARD_PEERS", "every shard as id=url, comma separated",
+		func(c *Config) *string { return &c.ShardPeers }),
+	{
+		flag: "shard-virtual-nodes", env: "KV_SHARD_VIRTUAL_NODES", usage: "points each shard has on the hash ring",
+		get: func(c *Config) string { return strconv.Itoa(c.ShardVirtualNodes) },
+		set: func(c *Config, v string) (err error) { c.ShardVirtualNodes, err = strconv.Atoi(v); return },
+	},
+}
+
+// LoadConfig build the Config from defaults, the config file named by -config
+// or KV_CONFIG, the environment and args, then validate it
+func LoadConfig(args []string, lookupEnv func(string) (string, bool), output io.Writer) (Config, error) {
+	cfg := DefaultConfig()
+	defaults := DefaultConfig()
+
+	fs := flag.NewFlagSet("goKVServer", flag.ContinueOnError)
+	fs.SetOutput(output)
+	configPath := fs.String("config", "", "path to a JSON, YAML or TOML config file (env KV_CONFIG)")
+	flagValues := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flagValues[s.flag] = fs.String(s.flag, s.get(&defaults), fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	path := *configPath
+	if path == "" {
+		path, _ = lookupEnv("KV_CONFIG")
+	}
+	if path != "" {
+		if err := loadConfigFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := lookupEnv(s.env); ok {
+			if err := s.set(&cfg, v); err != nil {
+				return cfg, fmt.Errorf("invalid %s %q: %w", s.env, v, err)
+			}
+		}
+	}
+
+	// only flags given on the command line override the file and environment
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, s := range settings {
+		if !explicit[s.flag] {
+			continue
+		}
+		if err := s.set(&cfg, *flagValues[s.flag]); err != nil {
+			return cfg, fmt.Errorf("invalid -%s %q: %w", s.flag, *flagValues[s.flag], err)
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// decode the file at path into cfg, choosing the format by its extension;
+// settings missing from the file keep their current values
+func loadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+		if err == io.EOF {
+			// empty file
+			err = nil
+		}
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), cfg)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown settings %v", md.Undecoded())
+		}
+	default:
+		return fmt.Errorf("config file %s: unsupported extension %q; expected .json, .yaml, .yml or .toml", path, ext)
+	}
+
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate report every invalid setting at once
+func (c Config) Validate() error {
+	var problems []string
+	addProblem := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		addProblem("listenAddr %q: %s", c.ListenAddr, err)
+	}
+	if c.RESPListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.RESPListenAddr); err != nil {
+			addProblem("respListenAddr %q: %s", c.RESPListenAddr, err)
+		}
+	}
+	if c.GRPCListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.GRPCListenAddr); err != nil {
+			addProblem("grpcListenAddr %q: %s", c.GRPCListenAddr, err)
+		}
+	}
+	if c.MemcachedListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MemcachedListenAddr); err != nil {
+			addProblem("memcachedListenAddr %q: %s", c.MemcachedListenAddr, err)
+		}
+	}
+	if c.ReplicateFrom != "" {
+		if u, err := url.Parse(c.ReplicateFrom); err != nil {
+			addProblem("replicateFrom %q: %s", c.ReplicateFrom, err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			addProblem("replicateFrom %q: expected an http or https URL", c.ReplicateFrom)
+		}
+	}
+	if c.RaftID != "" || c.RaftPeers != "" {
+		if c.RaftID == "" || c.RaftPeers == "" {
+			addProblem("raftId and raftPeers must be given together")
+		} else if c.ReplicateFrom != "" {
+			addProblem("replicateFrom can't be combined with raftId")
+		} else if peers, err := ParsePeers(c.RaftPeers); err != nil {
+			addProblem("raftPeers: %s", err)
+		} else if _, ok := peers[c.RaftID]; !ok {
+			addProblem("raftPeers: missing raftId %q", c.RaftID)
+		}
+	}
+	if c.ShardID != "" || c.ShardPeers != "" {
+		if c.ShardID == "" || c.ShardPeers == "" {
+			addProblem("shardId and shardPeers must be given together")
+		} else if c.ReplicateFrom != "" || c.RaftID != "" {
+			addProblem("shardId can't be combined with replicateFrom or raftId")
+		} else if peers, err := ParsePeers(c.ShardPeers); err != nil {
+			addProblem("shardPeers: %s", err)
+		} else if _, ok := peers[c.ShardID]; !ok {
+			addProblem("shardPeers: missing shardId %q", c.ShardID)
+		}
+	}
+	if c.ShardVirtualNodes < 1 {
+		addProblem("shardVirtualNodes must be positive, got %d", c.ShardVirtualNodes)
+	}
+	if c.MaxKeys < 0 {
+		addProblem("maxKeys must not be negative, got %d", c.MaxKeys)
+	}
+	if c.MaxBytes < 0 {
+		addProblem("maxBytes must not be negative, got %d", c.MaxBytes)
+	}
+	if _, err := NewEvictionPolicy(c.EvictionPolicy); err != nil {
+		addProblem("evictionPolicy: %s", err)
+	}
+	if policy, err := ParseWALSyncPolicy(c.WALSync); err != nil {
+		addProblem("walSync: %s", err)
+	} else if policy == WALSyncInterval && c.WALSyncInterval <= 0 {
+		addProblem("walSyncInterval must be positive when walSync is interval, got %s", c.WALSyncInterval)
+	}
+	if c.SnapshotInterval < 0 {
+		addProblem("snapshotInterval must not be negative, got %s", c.SnapshotInterval)
+	}
+	if c.ExpirySweepInterval <= 0 {
+		addProblem("expirySweepInterval must be positive, got %s", c.ExpirySweepInterval)
+	}
+	if _, err := ParseLogLevel(c.LogLevel); err != nil {
+		addProblem("logLevel: %s", err)
+	}
+	timeouts := []struct {
+		name string
+		d    Duration
+	}{{"readTimeout", c.ReadTimeout}, {"writeTimeout", c.WriteTimeout}, {"idleTimeout", c.IdleTimeout}, {"shutdownTimeout", c.ShutdownTimeout}}
+	for _, timeout := range timeouts {
+		if timeout.d < 0 {
+			addProblem("%s must not be negative, got %s", timeout.name, timeout.d)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+}
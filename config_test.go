@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// an environment lookup backed by env
+func testEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, name string, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig(nil, testEnv(nil), io.Discard)
+	if err != nil {
+		t.Fatalf("Got error loading defaults: %s", err)
+	}
+	if cfg != DefaultConfig() {
+		t.Errorf("Expected defaults %+v, got %+v", DefaultConfig(), cfg)
+	}
+}
+
+func TestLoadConfigFiles(t *testing.T) {
+	files := map[string]string{
+		"kv.json": `{"listenAddr": ":9000", "maxKeys": 100, "snapshotInterval": "1m"}`,
+		"kv.yaml": "listenAddr: \":9000\"\nmaxKeys: 100\nsnapshotInterval: 1m\n",
+		"kv.toml": "listenAddr = \":9000\"\nmaxKeys = 100\nsnapshotInterval = \"1m\"\n",
+	}
+
+	for name, contents := range files {
+		path := writeConfigFile(t, name, contents)
+		cfg, err := LoadConfig([]string{"-config", path}, testEnv(nil), io.Discard)
+		if err != nil {
+			t.Errorf("%s: got error %s", name, err)
+			continue
+		}
+		if cfg.ListenAddr != ":9000" || cfg.MaxKeys != 100 || cfg.SnapshotInterval != Duration(time.Minute) {
+			t.Errorf("%s: settings not loaded, got %+v", name, cfg)
+		}
+		// unset settings keep their defaults
+		if cfg.EvictionPolicy != EvictionFIFO {
+			t.Errorf("%s: expected default eviction policy, got %s", name, cfg.EvictionPolicy)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "kv.json", `{"maxKeys": 100, "maxBytes": 1000, "evictionPolicy": "lru"}`)
+	env := testEnv(map[string]string{"KV_CONFIG": path, "KV_MAX_KEYS": "200", "KV_MAX_BYTES": "2000"})
+
+	cfg, err := LoadConfig([]string{"-max-keys", "300"}, env, io.Discard)
+	if err != nil {
+		t.Fatalf("Got error loading config: %s", err)
+	}
+	// flag beats env beats file beats default
+	if cfg.MaxKeys != 300 {
+		t.Errorf("Expected flag to win with 300 max keys, got %d", cfg.MaxKeys)
+	}
+	if cfg.MaxBytes != 2000 {
+		t.Errorf("Expected env to win with 2000 max bytes, got %d", cfg.MaxBytes)
+	}
+	if cfg.EvictionPolicy != EvictionLRU {
+		t.Errorf("Expected file to win with lru, got %s", cfg.EvictionPolicy)
+	}
+	if cfg.ListenAddr != ":8000" {
+		t.Errorf("Expected default listen address, got %s", cfg.ListenAddr)
+	}
+}
+
+func TestLoadConfigEmptyDataDir(t *testing.T) {
+	cfg, err := LoadConfig(nil, testEnv(map[string]string{"KV_DATA_DIR": ""}), io.Discard)
+	if err != nil {
+		t.Fatalf("Got error loading config: %s", err)
+	}
+	if cfg.DataDir != "" {
+		t.Errorf("Expected empty data dir to disable persistence, got %s", cfg.DataDir)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		contains string
+	}{
+		{"bad flag value", []string{"-max-keys", "lots"}, nil, "-max-keys"},
+		{"bad env value", nil, map[string]string{"KV_SNAPSHOT_INTERVAL": "soon"}, "KV_SNAPSHOT_INTERVAL"},
+		{"unknown flag", []string{"-colour"}, nil, "colour"},
+		{"extra args", []string{"serve"}, nil, "unexpected arguments"},
+		{"missing file", []string{"-config", "/nonexistent/kv.json"}, nil, "unable to read config file"},
+		{"bad extension", []string{"-config", writeConfigFile(t, "kv.ini", "")}, nil, "unsupported extension"},
+		{"unknown file setting", []string{"-config", writeConfigFile(t, "kv.json", `{"maxKey": 1}`)}, nil, "maxKey"},
+	}
+
+	for _, tc := range tests {
+		_, err := LoadConfig(tc.args, testEnv(tc.env), io.Discard)
+		if err == nil || !strings.Contains(err.Error(), tc.contains) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.contains, err)
+		}
+	}
+}
+
+func TestLoadConfigHelp(t *testing.T) {
+	_, err := LoadConfig([]string{"-h"}, testEnv(nil), io.Discard)
+	if !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("Expected flag.ErrHelp, got %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = "8000"
+	cfg.MaxKeys = -1
+	cfg.EvictionPolicy = "random"
+	cfg.WALSync = string(WALSyncInterval)
+	cfg.WALSyncInterval = 0
+	cfg.LogLevel = "loud"
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected validation error")
+	}
+	// every problem is reported together
+	for _, setting := range []string{"listenAddr", "maxKeys", "evictionPolicy", "walSyncInterval", "logLevel"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("Expected error to mention %s, got %s", setting, err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ErrorNotANumber = errors.New("value is not a number")
+var ErrorNotAnInteger = errors.New("value is not an integer")
+var ErrorCounterOverflow = errors.New("counter overflow")
+var ErrorOutOfBounds = errors.New("counter out of bounds")
+
+// Number a counter value: an integer, unless IsFloat
+type Number struct {
+	Int     int64
+	Float   float64
+	IsFloat bool
+}
+
+func IntNumber(i int64) Number {
+	return Number{Int: i}
+}
+
+func FloatNumber(f float64) Number {
+	return Number{Float: f, IsFloat: true}
+}
+
+// ParseNumber parse a decimal integer, or failing that a finite float
+func ParseNumber(s string) (Number, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return IntNumber(i), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return Number{}, ErrorNotANumber
+	}
+	return FloatNumber(f), nil
+}
+
+func (n Number) String() string {
+	if n.IsFloat {
+		return strconv.FormatFloat(n.Float, 'f', -1, 64)
+	}
+	return strconv.FormatInt(n.Int, 10)
+}
+
+func (n Number) float() float64 {
+	if n.IsFloat {
+		return n.Float
+	}
+	return float64(n.Int)
+}
+
+// add integers exactly, failing on overflow; anything plus a float is a float
+func (n Number) add(d Number) (Number, error) {
+	if n.IsFloat || d.IsFloat {
+		f := n.float() + d.float()
+		if math.IsInf(f, 0) {
+			return Number{}, ErrorCounterOverflow
+		}
+		return FloatNumber(f), nil
+	}
+	if (d.Int > 0 && n.Int > math.MaxInt64-d.Int) || (d.Int < 0 && n.Int < math.MinInt64-d.Int) {
+		return Number{}, ErrorCounterOverflow
+	}
+	return IntNumber(n.Int + d.Int), nil
+}
+
+func (n Number) less(o Number) bool {
+	if !n.IsFloat && !o.IsFloat {
+		return n.Int < o.Int
+	}
+	return n.float() < o.float()
+}
+
+// IncrOptions how IncrBy treats a missing key and which results it allows
+type IncrOptions struct {
+	// the value a missing key starts from, when set; otherwise incrementing
+	// a missing key fails with ErrorNoSuchKey
+	Initial *Number
+	// when a key is created from Initial, it expires at ExpiresAt; the zero
+	// time never expires
+	ExpiresAt time.Time
+	// a result below Min or above Max fails with ErrorOutOfBounds, leaving
+	// the key unchanged
+	Min *Number
+	Max *Number
+	// the key's value must be an integer, ErrorNotAnInteger otherwise
+	integer bool
+}
+
+// IncrBy add delta to key's value, an integer or a float, atomically under the
+// keyStore lock, returning the new value and version. An existing key keeps
+// its expiry and metadata.
+func IncrBy(key string, delta Number, opts IncrOptions) (Number, uint64, error) {
+	lockWrites()
+	defer unlockWrites()
+	if err := expireKey(key); err != nil {
+		return Number{}, 0, err
+	}
+
+	old, exists := keyStore.m[key]
+	var current Number
+	switch {
+	case exists:
+		var err error
+		if current, err = ParseNumber(old); err != nil {
+			return Number{}, 0, err
+		}
+	case opts.Initial != nil:
+		current = *opts.Initial
+	default:
+		return Number{}, 0, ErrorNoSuchKey
+	}
+	if opts.integer && current.IsFloat {
+		return Number{}, 0, ErrorNotAnInteger
+	}
+
+	next, err := current.add(delta)
+	if err != nil {
+		return Number{}, 0, err
+	}
+	if (opts.Min != nil && next.less(*opts.Min)) || (opts.Max != nil && opts.Max.less(next)) {
+		return Number{}, 0, ErrorOutOfBounds
+	}
+
+	value := next.String()
+	var version uint64
+	if !exists {
+		if err = makeRoom(1, int64(len(value)), key); err != nil {
+			return Number{}, 0, err
+		}
+		entry := walEntry{Op: walOpPut, Key: key, Value: value}
+		if !opts.ExpiresAt.IsZero() {
+			entry.ExpiresAt = &opts.ExpiresAt
+		}
+		version, err = commit(entry)
+	} else {
+		if growth := int64(len(value)) - int64(len(old)); growth > 0 {
+			if err = makeRoom(0, growth, key); err != nil {
+				return Number{}, 0, err
+			}
+		}
+		version, err = commit(walEntry{Op: walOpUpdate, Key: key, Value: value})
+	}
+	if err != nil {
+		return Number{}, 0, err
+	}
+	return next, version, nil
+}
+
+// Incr add delta to key's integer value, a missing key starting from 0,
+// returning the new value
+func Incr(key string, delta int64) (int64, error) {
+	zero := IntNumber(0)
+	n, _, err := IncrBy(key, IntNumber(delta), IncrOptions{Initial: &zero, integer: true})
+	return n.Int, err
+}
+
+// Decr subtract delta from key's integer value, as Incr
+func Decr(key string, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, ErrorCounterOverflow
+	}
+	return Incr(key, -delta)
+}
+
+// incrRequest the body of POST /keys/{key}/incr; every field is optional and
+// delta defaults to 1
+type incrRequest struct {
+	Delta   json.Number  `json:"delta"`
+	Initial *json.Number `json:"initial"`
+	Min     *json.Number `json:"min"`
+	Max     *json.Number `json:"max"`
+	// seconds until a key created from initial expires
+	TTL int64 `json:"ttl"`
+}
+
+type incrResponse struct {
+	Key     string      `json:"key"`
+	Value   json.Number `json:"value"`
+	Version uint64      `json:"version"`
+}
+
+// parse an optional number from a request
+func parseOptionalNumber(n *json.Number) (*Number, error) {
+	if n == nil {
+		return nil, nil
+	}
+	parsed, err := ParseNumber(n.String())
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+func IncrKeyHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	key := pathVar(r, "key")
+	var req incrRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	delta := IntNumber(1)
+	opts := IncrOptions{}
+	var err error
+	if req.Delta != "" {
+		delta, err = ParseNumber(req.Delta.String())
+	}
+	initial, initialErr := parseOptionalNumber(req.Initial)
+	min, minErr := parseOptionalNumber(req.Min)
+	max, maxErr := parseOptionalNumber(req.Max)
+	if err != nil || initialErr != nil || minErr != nil || maxErr != nil || req.TTL < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	opts.Initial, opts.Min, opts.Max = initial, min, max
+	if req.TTL > 0 {
+		opts.ExpiresAt = time.Now().Add(time.Duration(req.TTL) * time.Second)
+	}
+
+	n, version, err := IncrBy(key, delta, opts)
+	switch {
+	case errors.Is(err, ErrorNoSuchKey):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, ErrorOutOfBounds):
+		// the bound is a condition the caller set, as If-Match is
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	case errors.Is(err, ErrorNotANumber), errors.Is(err, ErrorCounterOverflow):
+		w.WriteHeader(http.StatusConflict)
+		return
+	case err != nil:
+		w.WriteHeader(storeErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", formatETag(version))
+	err = json.NewEncoder(w).Encode(incrResponse{Key: key, Value: json.Number(n.String()), Version: version})
+	if err != nil {
+		logErrorf("incrKeyHandlerFunc - Error %s", err)
+	}
+}
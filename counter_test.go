@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected Number
+		err      error
+	}{
+		{"42", IntNumber(42), nil},
+		{"-7", IntNumber(-7), nil},
+		{"1.5", FloatNumber(1.5), nil},
+		{"9223372036854775807", IntNumber(math.MaxInt64), nil},
+		{"abc", Number{}, ErrorNotANumber},
+		{"NaN", Number{}, ErrorNotANumber},
+		{"", Number{}, ErrorNotANumber},
+	}
+	for _, tc := range tests {
+		if got, err := ParseNumber(tc.s); got != tc.expected || !errors.Is(err, tc.err) {
+			t.Errorf("%q: expected %v, %v, got %v, %v", tc.s, tc.expected, tc.err, got, err)
+		}
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	InitKeyStore()
+
+	if n, err := Incr("count", 5); n != 5 || err != nil {
+		t.Errorf("Expected a missing key to start from 0, got %d, %v", n, err)
+	}
+	if n, err := Decr("count", 7); n != -2 || err != nil {
+		t.Errorf("Expected -2, got %d, %v", n, err)
+	}
+
+	_ = Put("text", "abc")
+	if _, err := Incr("text", 1); !errors.Is(err, ErrorNotANumber) {
+		t.Errorf("Expected ErrorNotANumber, got %v", err)
+	}
+	_ = Put("float", "1.5")
+	if _, err := Incr("float", 1); !errors.Is(err, ErrorNotAnInteger) {
+		t.Errorf("Expected ErrorNotAnInteger, got %v", err)
+	}
+	_ = Put("max", "9223372036854775807")
+	if _, err := Incr("max", 1); !errors.Is(err, ErrorCounterOverflow) {
+		t.Errorf("Expected ErrorCounterOverflow, got %v", err)
+	}
+	if value, _ := Get("max"); *value != "9223372036854775807" {
+		t.Errorf("Expected a failed increment to leave the key unchanged, got %s", *value)
+	}
+}
+
+func TestIncrByOptions(t *testing.T) {
+	InitKeyStore()
+
+	if _, _, err := IncrBy("missing", IntNumber(1), IncrOptions{}); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected ErrorNoSuchKey without an initial value, got %v", err)
+	}
+
+	initial, max := IntNumber(10), IntNumber(12)
+	opts := IncrOptions{Initial: &initial, Max: &max}
+	for _, expected := range []int64{11, 12} {
+		if n, _, err := IncrBy("limited", IntNumber(1), opts); n.Int != expected || err != nil {
+			t.Errorf("Expected %d, got %v, %v", expected, n, err)
+		}
+	}
+	if _, _, err := IncrBy("limited", IntNumber(1), opts); !errors.Is(err, ErrorOutOfBounds) {
+		t.Errorf("Expected ErrorOutOfBounds, got %v", err)
+	}
+
+	n, _, err := IncrBy("limited", FloatNumber(-0.5), IncrOptions{})
+	if err != nil || n != FloatNumber(11.5) {
+		t.Errorf("Expected the float 11.5, got %v, %v", n, err)
+	}
+	if value, _ := Get("limited"); *value != "11.5" {
+		t.Errorf("Expected 11.5 stored, got %s", *value)
+	}
+}
+
+func TestIncrConcurrent(t *testing.T) {
+	InitKeyStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, _ = Incr("hits", 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _ := Get("hits"); *value != "1000" {
+		t.Errorf("Expected 1000 increments, got %s", *value)
+	}
+}
+
+func TestHandlerIncr(t *testing.T) {
+	InitKeyStore()
+
+	tests := []struct {
+		key    string
+		body   string
+		status int
+		value  string
+	}{
+		{"c", ``, http.StatusNotFound, ""},
+		{"c", `{"initial":0}`, http.StatusOK, "1"},
+		{"c", `{"delta":4}`, http.StatusOK, "5"},
+		{"c", `{"delta":-10,"min":0}`, http.StatusPreconditionFailed, ""},
+		{"c", `{"delta":0.25}`, http.StatusOK, "5.25"},
+		{"c", `{"delta":"x"}`, http.StatusBadRequest, ""},
+		{"c", `{"ttl":-1}`, http.StatusBadRequest, ""},
+		{"rate", `{"initial":0,"max":1,"ttl":60}`, http.StatusOK, "1"},
+		{"rate", `{"max":1}`, http.StatusPreconditionFailed, ""},
+	}
+	for _, tc := range tests {
+		rr := sendRequest(t, "POST", "/keys/"+tc.key+"/incr", []byte(tc.body), nil)
+		if rr.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.body, tc.status, rr.Code)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		var res incrResponse
+		if err := json.NewDecoder(rr.Body).Decode(&res); err != nil || res.Value.String() != tc.value {
+			t.Errorf("%s: expected value %s, got %+v, %v", tc.body, tc.value, res, err)
+		}
+	}
+
+	if expiresAt, _ := GetExpiry("rate"); expiresAt.IsZero() {
+		t.Error("Expected a counter created with a ttl to expire")
+	}
+	_ = Put("word", "abc")
+	if rr := sendRequest(t, "POST", "/keys/word/incr", nil, nil); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for a non-numeric value, got %d", rr.Code)
+	}
+}
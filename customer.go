@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
 )
 
 type Customer struct {
@@ -15,82 +17,244 @@ type Customer struct {
 	zip           string
 }
 
-func checkAndLogError(err error, keyname string) {
-	if err != nil {
-		log.Printf("Error: %s - Unable to retrieve for key: %s", err, keyname)
+// the fields of a customer record, each stored under its genCustomerKey
+var customerFields = []string{"firstName", "lastName", "streetAddress", "city", "state", "zip"}
+
+// the prefix of every customer key
+const customerKeyPrefix = "cust:"
+
+var ErrorNoSuchCustomer = errors.New("no such customer")
+var ErrorCustomerExists = errors.New("existing customer")
+var ErrorInvalidCustomer = errors.New("invalid customer")
+
+// MissingFieldsError names the fields a customer record lacks
+type MissingFieldsError struct {
+	Fields []string
+}
+
+func (e *MissingFieldsError) Error() string {
+	return "missing fields: " + strings.Join(e.Fields, ", ")
+}
+
+// the customer field called name
+func (c *Customer) field(name string) *string {
+	switch name {
+	case "firstName":
+		return &c.firstName
+	case "lastName":
+		return &c.lastName
+	case "streetAddress":
+		return &c.streetAddress
+	case "city":
+		return &c.city
+	case "state":
+		return &c.state
+	case "zip":
+		return &c.zip
 	}
+	return nil
 }
 
-func (c *Customer) asStr() string {
-	return fmt.Sprintf("%d, %s, %s, %s, %s, %s, %s", c.custId, c.firstName, c.lastName, c.streetAddress, c.city, c.state, c.zip)
+// Validate the customer has an ID and every field, returning a
+// *MissingFieldsError naming the empty fields
+func (c *Customer) Validate() error {
+	if c.custId <= 0 {
+		return fmt.Errorf("%w: id must be positive", ErrorInvalidCustomer)
+	}
+	var missing []string
+	for _, name := range customerFields {
+		if strings.TrimSpace(*c.field(name)) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingFieldsError{Fields: missing}
+	}
+	return nil
 }
 
-// Generate the customer key
-// where K = `cust:CUST_ID:_CUST_FIELD_NAME`
-func genCustomerKey(id int64, fieldName string) string {
-	strtKey := "cust"
-	return fmt.Sprintf("%s:%d:%s", strtKey, id, fieldName)
+// storedCustomer a customer as read from the keyStore, with the version of
+// each field it has a key for
+type storedCustomer struct {
+	Customer
+	versions map[string]uint64
 }
 
-// Add K:V pairs for each field of the Customer provided
-// such that K = `cust:CUST_ID:_CUST_FIELD_NAME`, eg `cust:123:firstName`
-// for each field
-func (c *Customer) AddCustomerRecord() (err error) {
-	err = Put(genCustomerKey(c.custId, "firstName"), c.firstName)
-	err = Put(genCustomerKey(c.custId, "lastName"), c.lastName)
-	err = Put(genCustomerKey(c.custId, "streetAddress"), c.streetAddress)
-	err = Put(genCustomerKey(c.custId, "city"), c.city)
-	err = Put(genCustomerKey(c.custId, "state"), c.state)
-	err = Put(genCustomerKey(c.custId, "zip"), c.zip)
-	return
+func (s *storedCustomer) missing() []string {
+	var missing []string
+	for _, name := range customerFields {
+		if _, ok := s.versions[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	return missing
 }
 
-func GetCustomerRecord(custId int64) *Customer {
-	c := Customer{custId: custId}
-	var err error
-	var s *string
+// split a customer key into its ID and field; false for other keys
+func parseCustomerKey(key string) (int64, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(key, customerKeyPrefix), ":")
+	if !strings.HasPrefix(key, customerKeyPrefix) || len(parts) != 2 {
+		return 0, "", false
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || id <= 0 || (&Customer{}).field(parts[1]) == nil {
+		return 0, "", false
+	}
+	return id, parts[1], true
+}
+
+// read every field of the customer in one scan, so the record is consistent
+func readCustomer(custId int64) *storedCustomer {
+	s := &storedCustomer{Customer: Customer{custId: custId}, versions: make(map[string]uint64)}
+	for _, kv := range Scan(genCustomerKey(custId, ""), "", "") {
+		if _, name, ok := parseCustomerKey(kv.Key); ok {
+			*s.field(name) = kv.Value
+			s.versions[name] = kv.version
+		}
+	}
+	return s
+}
+
+// GetCustomer the customer's record. ErrorNoSuchCustomer if it has no fields;
+// if it lacks some, the record is returned with a *MissingFieldsError naming
+// them.
+func GetCustomer(custId int64) (*Customer, error) {
+	s := readCustomer(custId)
+	if len(s.versions) == 0 {
+		return nil, ErrorNoSuchCustomer
+	}
+	if missing := s.missing(); len(missing) > 0 {
+		return &s.Customer, &MissingFieldsError{Fields: missing}
+	}
+	return &s.Customer, nil
+}
 
-	firstNameKey := genCustomerKey(custId, "firstName")
-	s, err = Get(firstNameKey)
-	checkAndLogError(err, firstNameKey)
-	if err == nil && s != nil {
-		c.firstName = *s
+// UpdateCustomer set the given fields of an existing customer in one
+// transaction, adding any the record lacks, and return the updated record.
+// A concurrent change to the record fails with ErrorVersionMismatch.
+func UpdateCustomer(custId int64, fields map[string]string) (*Customer, error) {
+	s := readCustomer(custId)
+	if len(s.versions) == 0 {
+		return nil, ErrorNoSuchCustomer
 	}
 
-	lastNameKey := genCustomerKey(custId, "lastName")
-	s, err = Get(lastNameKey)
-	checkAndLogError(err, lastNameKey)
-	if err == nil && s != nil {
-		c.lastName = *s
+	var ops []TxnOp
+	for _, name := range customerFields {
+		value, ok := fields[name]
+		if !ok {
+			continue
+		}
+		key := genCustomerKey(custId, name)
+		if version, exists := s.versions[name]; exists {
+			ops = append(ops, TxnOp{Op: TxnUpdate, Key: key, Value: value, Version: version})
+		} else {
+			ops = append(ops, TxnOp{Op: TxnPut, Key: key, Value: value})
+		}
+		*s.field(name) = value
+	}
+	if len(ops) != len(fields) {
+		return nil, fmt.Errorf("%w: unknown field", ErrorInvalidCustomer)
 	}
+	if _, err := Txn(ops); err != nil {
+		return nil, customerTxnError(err)
+	}
+	return &s.Customer, nil
+}
 
-	streetAddrKey := genCustomerKey(custId, "streetAddress")
-	s, err = Get(streetAddrKey)
-	checkAndLogError(err, streetAddrKey)
-	if err == nil && s != nil {
-		c.streetAddress = *s
+// DeleteCustomer delete every field of the customer in one transaction
+func DeleteCustomer(custId int64) error {
+	s := readCustomer(custId)
+	if len(s.versions) == 0 {
+		return ErrorNoSuchCustomer
 	}
+	var ops []TxnOp
+	for _, name := range customerFields {
+		if version, ok := s.versions[name]; ok {
+			ops = append(ops, TxnOp{Op: TxnDelete, Key: genCustomerKey(custId, name), Version: version})
+		}
+	}
+	_, err := Txn(ops)
+	return customerTxnError(err)
+}
 
-	cityKey := genCustomerKey(custId, "city")
-	s, err = Get(cityKey)
-	checkAndLogError(err, cityKey)
-	if err == nil && s != nil {
-		c.city = *s
+// a customer write's transaction failed its checks because the record
+// changed since it was read
+func customerTxnError(err error) error {
+	if errors.Is(err, ErrorVersionMismatch) || errors.Is(err, ErrorNoSuchKey) || errors.Is(err, ErrorKeyExists) {
+		return fmt.Errorf("customer changed concurrently: %w", ErrorVersionMismatch)
 	}
+	return err
+}
 
-	stateKey := genCustomerKey(custId, "state")
-	s, err = Get(stateKey)
-	checkAndLogError(err, stateKey)
-	if err == nil && s != nil {
-		c.state = *s
+// listCustomers up to limit customers in key order, starting from the first
+// whose keys sort at or after start, and whether more follow
+func listCustomers(start string, limit int) ([]*storedCustomer, bool) {
+	var customers []*storedCustomer
+	after := ""
+	for {
+		kvs, more := ScanPage(customerKeyPrefix, start, "", after, (limit+1)*len(customerFields))
+		for _, kv := range kvs {
+			id, name, ok := parseCustomerKey(kv.Key)
+			if !ok {
+				continue
+			}
+			if n := len(customers); n == 0 || customers[n-1].custId != id {
+				if n == limit {
+					return customers, true
+				}
+				customers = append(customers, &storedCustomer{Customer: Customer{custId: id}, versions: make(map[string]uint64)})
+			}
+			c := customers[len(customers)-1]
+			*c.field(name) = kv.Value
+			c.versions[name] = kv.version
+		}
+		if !more {
+			return customers, false
+		}
+		after = kvs[len(kvs)-1].Key
 	}
+}
 
-	zipKey := genCustomerKey(custId, "zip")
-	s, err = Get(zipKey)
-	checkAndLogError(err, zipKey)
-	if err == nil && s != nil {
-		c.zip = *s
+func checkAndLogError(err error, keyname string) {
+	if err != nil {
+		logWarnf("Error: %s - Unable to retrieve for key: %s", err, keyname)
 	}
+}
+
+func (c *Customer) asStr() string {
+	return fmt.Sprintf("%d, %s, %s, %s, %s, %s, %s", c.custId, c.firstName, c.lastName, c.streetAddress, c.city, c.state, c.zip)
+}
 
-	return &c
+// Generate the customer key
+// where K = `cust:CUST_ID:_CUST_FIELD_NAME`
+func genCustomerKey(id int64, fieldName string) string {
+	strtKey := "cust"
+	return fmt.Sprintf("%s:%d:%s", strtKey, id, fieldName)
+}
+
+// Add K:V pairs for each field of the Customer provided
+// such that K = `cust:CUST_ID:_CUST_FIELD_NAME`, eg `cust:123:firstName`
+// for each field. The fields are added in one transaction, so either the
+// whole record is added or none of it is.
+func (c *Customer) AddCustomerRecord() error {
+	_, err := Txn([]TxnOp{
+		{Op: TxnPut, Key: genCustomerKey(c.custId, "firstName"), Value: c.firstName},
+		{Op: TxnPut, Key: genCustomerKey(c.custId, "lastName"), Value: c.lastName},
+		{Op: TxnPut, Key: genCustomerKey(c.custId, "streetAddress"), Value: c.streetAddress},
+		{Op: TxnPut, Key: genCustomerKey(c.custId, "city"), Value: c.city},
+		{Op: TxnPut, Key: genCustomerKey(c.custId, "state"), Value: c.state},
+		{Op: TxnPut, Key: genCustomerKey(c.custId, "zip"), Value: c.zip},
+	})
+	return err
+}
+
+// GetCustomerRecord the customer's record, logging which fields it lacks;
+// use GetCustomer to handle them
+func GetCustomerRecord(custId int64) *Customer {
+	c, err := GetCustomer(custId)
+	checkAndLogError(err, genCustomerKey(custId, ""))
+	if c == nil {
+		return &Customer{custId: custId}
+	}
+	return c
 }
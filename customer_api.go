@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CustomerRecord a customer as the /customers endpoints send and receive it.
+// Fields are pointers so a PATCH can tell an absent field from an empty one.
+type CustomerRecord struct {
+	ID            int64   `json:"id"`
+	FirstName     *string `json:"firstName,omitempty"`
+	LastName      *string `json:"lastName,omitempty"`
+	StreetAddress *string `json:"streetAddress,omitempty"`
+	City          *string `json:"city,omitempty"`
+	State         *string `json:"state,omitempty"`
+	Zip           *string `json:"zip,omitempty"`
+	// the fields the stored record lacks
+	Missing []string `json:"missing,omitempty"`
+}
+
+// CustomerPage one page of GET /customers; Next is the cursor for the
+// following page, empty on the last
+type CustomerPage struct {
+	Items []CustomerRecord `json:"items"`
+	Next  string           `json:"next,omitempty"`
+}
+
+// customerError the body of a failed /customers request
+type customerError struct {
+	Error  string   `json:"error"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+// the record field called name
+func (r *CustomerRecord) field(name string) **string {
+	switch name {
+	case "firstName":
+		return &r.FirstName
+	case "lastName":
+		return &r.LastName
+	case "streetAddress":
+		return &r.StreetAddress
+	case "city":
+		return &r.City
+	case "state":
+		return &r.State
+	case "zip":
+		return &r.Zip
+	}
+	return nil
+}
+
+// the fields the request gave
+func (r *CustomerRecord) given() map[string]string {
+	fields := make(map[string]string)
+	for _, name := range customerFields {
+		if value := *r.field(name); value != nil {
+			fields[name] = *value
+		}
+	}
+	return fields
+}
+
+// the record of a stored customer, naming the fields it lacks
+func newCustomerRecord(s *storedCustomer) CustomerRecord {
+	r := CustomerRecord{ID: s.custId, Missing: s.missing()}
+	for _, name := range customerFields {
+		if _, ok := s.versions[name]; ok {
+			value := *s.field(name)
+			*r.field(name) = &value
+		}
+	}
+	return r
+}
+
+func writeCustomerJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logErrorf("writeCustomerJSON - Error %s", err)
+	}
+}
+
+// write err as a customerError, with the fields a *MissingFieldsError names
+func writeCustomerError(w http.ResponseWriter, status int, err error) {
+	body := customerError{Error: err.Error()}
+	var missing *MissingFieldsError
+	if errors.As(err, &missing) {
+		body.Fields = missing.Fields
+	}
+	writeCustomerJSON(w, status, body)
+}
+
+// the status for a failed customer operation
+func customerErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrorNoSuchCustomer):
+		return http.StatusNotFound
+	case errors.Is(err, ErrorCustomerExists), errors.Is(err, ErrorVersionMismatch):
+		return http.StatusConflict
+	}
+	return storeErrorStatus(err, http.StatusInternalServerError)
+}
+
+// decode a customer record, rejecting unknown fields
+func decodeCustomerRecord(r *http.Request) (CustomerRecord, error) {
+	var rec CustomerRecord
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rec); err != nil {
+		return rec, fmt.Errorf("%w: %s", ErrorInvalidCustomer, err)
+	}
+	if rec.Missing != nil {
+		return rec, fmt.Errorf("%w: missing is read only", ErrorInvalidCustomer)
+	}
+	return rec, nil
+}
+
+func customerIdVar(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(pathVar(r, "id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%w: id must be a positive integer", ErrorInvalidCustomer)
+	}
+	return id, nil
+}
+
+// CreateCustomerHandlerFunc POST /customers: every field is required
+func CreateCustomerHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	rec, err := decodeCustomerRecord(r)
+	if err != nil {
+		writeCustomerError(w, http.StatusBadRequest, err)
+		return
+	}
+	c := Customer{custId: rec.ID}
+	for name, value := range rec.given() {
+		*c.field(name) = value
+	}
+	if err = c.Validate(); err != nil {
+		writeCustomerError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err = c.AddCustomerRecord(); errors.Is(err, ErrorKeyExists) {
+		err = fmt.Errorf("%w: %d", ErrorCustomerExists, c.custId)
+	}
+	if err != nil {
+		writeCustomerError(w, customerErrorStatus(err), err)
+		return
+	}
+	w.Header().Set("Location", "/customers/"+strconv.FormatInt(c.custId, 10))
+	writeCustomerJSON(w, http.StatusCreated, newCustomerRecord(readCustomer(c.custId)))
+}
+
+// GetCustomerHandlerFunc GET /customers/{id}, listing the fields the record
+// lacks in missing
+func GetCustomerHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	id, err := customerIdVar(r)
+	if err != nil {
+		writeCustomerError(w, http.StatusBadRequest, err)
+		return
+	}
+	s := readCustomer(id)
+	if len(s.versions) == 0 {
+		writeCustomerError(w, http.StatusNotFound, ErrorNoSuchCustomer)
+		return
+	}
+	writeCustomerJSON(w, http.StatusOK, newCustomerRecord(s))
+}
+
+// PatchCustomerHandlerFunc PATCH /customers/{id}: sets the fields given,
+// which can't be empty
+func PatchCustomerHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	id, err := customerIdVar(r)
+	if err != nil {
+		writeCustomerError(w, http.StatusBadRequest, err)
+		return
+	}
+	rec, err := decodeCustomerRecord(r)
+	if err != nil {
+		writeCustomerError(w, http.StatusBadRequest, err)
+		return
+	}
+	if rec.ID != 0 && rec.ID != id {
+		writeCustomerError(w, http.StatusBadRequest, fmt.Errorf("%w: id doesn't match the path", ErrorInvalidCustomer))
+		return
+	}
+	fields := rec.given()
+	var empty []string
+	for _, name := range customerFields {
+		if value, ok := fields[name]; ok && strings.TrimSpace(value) == "" {
+			empty = append(empty, name)
+		}
+	}
+	if len(empty) > 0 {
+		writeCustomerError(w, http.StatusBadRequest, &MissingFieldsError{Fields: empty})
+		return
+	}
+
+	if _, err = UpdateCustomer(id, fields); err != nil {
+		writeCustomerError(w, customerErrorStatus(err), err)
+		return
+	}
+	writeCustomerJSON(w, http.StatusOK, newCustomerRecord(readCustomer(id)))
+}
+
+// DeleteCustomerHandlerFunc DELETE /customers/{id}
+func DeleteCustomerHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	id, err := customerIdVar(r)
+	if err != nil {
+		writeCustomerError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = DeleteCustomer(id); err != nil {
+		writeCustomerError(w, customerErrorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListCustomersHandlerFunc GET /customers?limit=&cursor=, a page of
+// customers in key order
+func ListCustomersHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	_, after, limit, err := parsePage(r.URL.Query())
+	if err != nil {
+		writeCustomerError(w, http.StatusBadRequest, err)
+		return
+	}
+	if limit == 0 {
+		limit = defaultPageLimit
+	}
+	// the cursor is the last customer's key prefix; the next page starts
+	// past every key under it
+	start := ""
+	if after != "" {
+		if _, start = prefixRange(after); start == "" {
+			writeCustomerError(w, http.StatusBadRequest, ErrorInvalidPage)
+			return
+		}
+	}
+
+	customers, more := listCustomers(start, limit)
+	page := CustomerPage{Items: make([]CustomerRecord, 0, len(customers))}
+	for _, s := range customers {
+		page.Items = append(page.Items, newCustomerRecord(s))
+	}
+	if more {
+		page.Next = encodeCursor(genCustomerKey(customers[len(customers)-1].custId, ""))
+	}
+	writeCustomerJSON(w, http.StatusOK, page)
+}
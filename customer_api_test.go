@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+const customerBody = `{"id":7,"firstName":"Ada","lastName":"Lovelace","streetAddress":"12 St James's Square","city":"London","state":"LN","zip":"SW1Y"}`
+
+func decodeCustomer(t *testing.T, body []byte) CustomerRecord {
+	var rec CustomerRecord
+	if err := json.Unmarshal(body, &rec); err != nil {
+		t.Fatalf("Error decoding %s: %s", body, err)
+	}
+	return rec
+}
+
+func TestGetCustomerMissingFields(t *testing.T) {
+	InitKeyStore()
+
+	if _, err := GetCustomer(1); !errors.Is(err, ErrorNoSuchCustomer) {
+		t.Errorf("Expected ErrorNoSuchCustomer, got %v", err)
+	}
+
+	_ = Put(genCustomerKey(1, "firstName"), "Ada")
+	_ = Put(genCustomerKey(1, "zip"), "SW1Y")
+	c, err := GetCustomer(1)
+	var missing *MissingFieldsError
+	if !errors.As(err, &missing) || !reflect.DeepEqual(missing.Fields, []string{"lastName", "streetAddress", "city", "state"}) {
+		t.Fatalf("Expected the missing fields named, got %v", err)
+	}
+	if c.firstName != "Ada" || c.zip != "SW1Y" {
+		t.Errorf("Expected the fields present returned, got %s", c.asStr())
+	}
+
+	// keys of customer 10 share customer 1's key prefix up to the id
+	_ = Put(genCustomerKey(10, "firstName"), "Ten")
+	if c, _ = GetCustomer(1); c.firstName != "Ada" {
+		t.Errorf("Expected customer 1's first name, got %s", c.firstName)
+	}
+}
+
+func TestHandlerCustomerCRUD(t *testing.T) {
+	InitKeyStore()
+
+	rr := sendRequest(t, "POST", "/customers", []byte(customerBody), nil)
+	if rr.Code != http.StatusCreated || rr.Header().Get("Location") != "/customers/7" {
+		t.Fatalf("Expected status 201 with a Location, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr = sendRequest(t, "POST", "/customers", []byte(customerBody), nil); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 creating an existing customer, got %d", rr.Code)
+	}
+
+	rr = sendRequest(t, "GET", "/customers/7", nil, nil)
+	rec := decodeCustomer(t, rr.Body.Bytes())
+	if rr.Code != http.StatusOK || rec.FirstName == nil || *rec.FirstName != "Ada" || rec.Missing != nil {
+		t.Errorf("Expected the whole record, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = sendRequest(t, "PATCH", "/customers/7", []byte(`{"city":"Marylebone"}`), nil)
+	rec = decodeCustomer(t, rr.Body.Bytes())
+	if rr.Code != http.StatusOK || *rec.City != "Marylebone" || *rec.LastName != "Lovelace" {
+		t.Errorf("Expected the city changed and the rest kept, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// a patch restores a missing field
+	_ = Delete(genCustomerKey(7, "zip"))
+	rr = sendRequest(t, "GET", "/customers/7", nil, nil)
+	if rec = decodeCustomer(t, rr.Body.Bytes()); !reflect.DeepEqual(rec.Missing, []string{"zip"}) || rec.Zip != nil {
+		t.Errorf("Expected zip reported missing, got %s", rr.Body.String())
+	}
+	sendRequest(t, "PATCH", "/customers/7", []byte(`{"zip":"NW1"}`), nil)
+	if value, err := Get(genCustomerKey(7, "zip")); err != nil || *value != "NW1" {
+		t.Errorf("Expected the zip added, got %v", err)
+	}
+
+	if rr = sendRequest(t, "DELETE", "/customers/7", nil, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", rr.Code)
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		if rr = sendRequest(t, method, "/customers/7", nil, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404 after deleting, got %d", method, rr.Code)
+		}
+	}
+	if rr = sendRequest(t, "PATCH", "/customers/7", []byte(`{"city":"Paris"}`), nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 patching a deleted customer, got %d", rr.Code)
+	}
+}
+
+func TestHandlerCustomerValidation(t *testing.T) {
+	InitKeyStore()
+	sendRequest(t, "POST", "/customers", []byte(customerBody), nil)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		fields []string
+	}{
+		{"POST", "/customers", `{"id":8,"firstName":"Grace","city":" "}`, []string{"lastName", "streetAddress", "city", "state", "zip"}},
+		{"POST", "/customers", `{"id":0,"firstName":"x","lastName":"x","streetAddress":"x","city":"x","state":"x","zip":"x"}`, nil},
+		{"POST", "/customers", `{"id":8,"nickname":"x"}`, nil},
+		{"POST", "/customers", `{"id":8,"missing":[]}`, nil},
+		{"POST", "/customers", `not json`, nil},
+		{"PATCH", "/customers/7", `{"lastName":"","zip":""}`, []string{"lastName", "zip"}},
+		{"PATCH", "/customers/7", `{"id":8,"city":"x"}`, nil},
+		{"GET", "/customers/abc", ``, nil},
+		{"GET", "/customers/-1", ``, nil},
+	}
+	for _, tc := range tests {
+		rr := sendRequest(t, tc.method, tc.path, []byte(tc.body), nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: expected status 400, got %d", tc.method, tc.body, rr.Code)
+			continue
+		}
+		var body customerError
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil || body.Error == "" || !reflect.DeepEqual(body.Fields, tc.fields) {
+			t.Errorf("%s %s: expected fields %v, got %+v, %v", tc.method, tc.body, tc.fields, body, err)
+		}
+	}
+	if c, err := GetCustomer(7); err != nil || c.lastName != "Lovelace" {
+		t.Errorf("Expected a rejected patch to leave the customer unchanged, got %v", err)
+	}
+}
+
+func TestHandlerListCustomers(t *testing.T) {
+	InitKeyStore()
+	keyStore.maxKeys = 0
+	t.Cleanup(InitKeyStore)
+	for _, id := range []int64{3, 1, 20, 2} {
+		c := Customer{id, "F" + strconv.FormatInt(id, 10), "L", "S", "C", "ST", "Z"}
+		if err := c.AddCustomerRecord(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = Put("cust:nonsense", "ignored")
+	_ = Put(genCustomerKey(2, "nickname"), "ignored")
+
+	// customers come in key order, where cust:20: sorts before cust:2:, and a
+	// page never splits one
+	var ids []int64
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		rr := sendRequest(t, "GET", "/customers?limit=3&cursor="+cursor, nil, nil)
+		var page CustomerPage
+		if err := json.NewDecoder(rr.Body).Decode(&page); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("Expected a page, got %d, %v", rr.Code, err)
+		}
+		for _, rec := range page.Items {
+			ids = append(ids, rec.ID)
+			if rec.Missing != nil || *rec.FirstName != "F"+strconv.FormatInt(rec.ID, 10) {
+				t.Errorf("Expected customer %d whole, got %+v", rec.ID, rec)
+			}
+		}
+		if cursor = page.Next; cursor == "" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(ids, []int64{1, 20, 2, 3}) {
+		t.Errorf("Expected customers 1, 20, 2, 3, got %v", ids)
+	}
+
+	for _, query := range []string{"limit=0", "limit=abc", "cursor=!"} {
+		if rr := sendRequest(t, "GET", "/customers?"+query, nil, nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	// how many recent events are kept for watchers resuming from a revision
+	eventHistorySize = 1024
+	// events buffered per watcher before it's considered too slow and closed
+	watchBufferSize = 256
+)
+
+// EventType the kind of change an Event reports
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventUpdate EventType = "update"
+	EventDelete EventType = "delete"
+	// removed by the eviction policy to make room
+	EventEvict EventType = "evict"
+	// removed when its TTL passed
+	EventExpire EventType = "expire"
+)
+
+// Event a change to one key. Value is set for puts and updates; Revision is
+// the key's new version, or the revision that removed it.
+type Event struct {
+	Type     EventType `json:"type"`
+	Key      string    `json:"key"`
+	Value    string    `json:"value,omitempty"`
+	Encoding string    `json:"encoding,omitempty"`
+	Revision uint64    `json:"rev"`
+}
+
+var ErrorRevisionCompacted = errors.New("revision no longer in event history")
+
+// EventFilter selects the events a watcher receives: those for Key, or when
+// Key is empty, those for keys with Prefix
+type EventFilter struct {
+	Key    string
+	Prefix string
+}
+
+func (f EventFilter) matches(key string) bool {
+	if f.Key != "" {
+		return key == f.Key
+	}
+	return strings.HasPrefix(key, f.Prefix)
+}
+
+// Watch a subscription to the events matching its filter
+type Watch struct {
+	filter EventFilter
+	events chan Event
+	bus    *EventBus
+}
+
+// Events the watched events, in revision order. The channel is closed when
+// the watch is, or when the watcher falls too far behind, after which it
+// should resubscribe from the last revision it saw.
+func (w *Watch) Events() <-chan Event {
+	return w.events
+}
+
+// Close stop delivering events
+func (w *Watch) Close() {
+	w.bus.mu.Lock()
+	defer w.bus.mu.Unlock()
+	w.bus.removeLocked(w)
+}
+
+// EventBus fans keyStore changes out to watchers and keeps a bounded history
+// so watchers can resume from a recent revision
+type EventBus struct {
+	mu sync.Mutex
+	// ring of the most recent events, oldest at start
+	history []Event
+	start   int
+	// history holds every event after this revision
+	floor    uint64
+	watchers map[*Watch]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{watchers: make(map[*Watch]struct{})}
+}
+
+// the bus keyStore changes are published to
+var keyStoreEvents = NewEventBus()
+
+func (b *EventBus) removeLocked(w *Watch) {
+	if _, ok := b.watchers[w]; ok {
+		delete(b.watchers, w)
+		close(w.events)
+	}
+}
+
+// publish events without blocking; watchers too slow to keep up are closed
+func (b *EventBus) publish(events ...Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, e := range events {
+		if len(b.history) < eventHistorySize {
+			b.history = append(b.history, e)
+		} else {
+			b.floor = b.history[b.start].Revision
+			b.history[b.start] = e
+			b.start = (b.start + 1) % eventHistorySize
+		}
+
+		for w := range b.watchers {
+			if !w.filter.matches(e.Key) {
+				continue
+			}
+			select {
+			case w.events <- e:
+			default:
+				logWarnf("Watcher for %+v fell behind; closing it", w.filter)
+				b.removeLocked(w)
+			}
+		}
+	}
+}
+
+// reset forget the history and close every watcher, after the keyStore is
+// replaced wholesale as of revision floor; resuming from before it fails
+// with ErrorRevisionCompacted
+func (b *EventBus) reset(floor uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.history, b.start, b.floor = nil, 0, floor
+	for w := range b.watchers {
+		b.removeLocked(w)
+	}
+}
+
+// Subscribe watch for events matching filter after revision since, which
+// the keyStore is currently at revision current; past events still in the
+// history are returned, and later ones are delivered on the Watch.
+// ErrorRevisionCompacted when events after since are no longer kept.
+func (b *EventBus) Subscribe(filter EventFilter, since uint64, current uint64) (*Watch, []Event, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	floor := b.floor
+	if len(b.history) == 0 {
+		// nothing published since the keyStore was loaded
+		floor = current
+	}
+	if since < floor {
+		return nil, nil, ErrorRevisionCompacted
+	}
+
+	var backlog []Event
+	for i := 0; i < len(b.history); i++ {
+		e := b.history[(b.start+i)%len(b.history)]
+		if e.Revision > since && filter.matches(e.Key) {
+			backlog = append(backlog, e)
+		}
+	}
+
+	w := &Watch{filter: filter, events: make(chan Event, watchBufferSize), bus: b}
+	b.watchers[w] = struct{}{}
+	return w, backlog, nil
+}
+
+// WatchKeys subscribe to keyStore events matching filter after revision
+// since, returning any already in the history; see EventBus.Subscribe
+func WatchKeys(filter EventFilter, since uint64) (*Watch, []Event, error) {
+	// hold the keyStore still so no event is published between reading the
+	// revision and subscribing
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+	return keyStoreEvents.Subscribe(filter, since, keyStore.revision)
+}
+
+// CurrentRevision the keyStore's latest revision
+func CurrentRevision() uint64 {
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+	return keyStore.revision
+}
+
+// the events a committed mutation produces
+func entryEvents(entry walEntry) []Event {
+	switch entry.Op {
+	case walOpPut:
+		return []Event{{Type: EventPut, Key: entry.Key, Value: entry.Value, Revision: entry.Revision}}
+	case walOpUpdate:
+		return []Event{{Type: EventUpdate, Key: entry.Key, Value: entry.Value, Revision: entry.Revision}}
+	case walOpDelete:
+		eventType := EventDelete
+		if entry.reason != "" {
+			eventType = entry.reason
+		}
+		return []Event{{Type: eventType, Key: entry.Key, Revision: entry.Revision}}
+	case walOpTxn:
+		var events []Event
+		for _, op := range entry.Batch {
+			op.Revision = entry.Revision
+			events = append(events, entryEvents(op)...)
+		}
+		return events
+	}
+	return nil
+}
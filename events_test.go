@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// read n events from w, failing the test if they don't arrive promptly
+func receiveEvents(t *testing.T, w *Watch, n int) []Event {
+	t.Helper()
+	var events []Event
+	for len(events) < n {
+		select {
+		case e, ok := <-w.Events():
+			if !ok {
+				t.Fatalf("Watch closed after %d of %d events", len(events), n)
+			}
+			events = append(events, e)
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out after %d of %d events", len(events), n)
+		}
+	}
+	return events
+}
+
+func eventTypes(events []Event) []EventType {
+	types := []EventType{}
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestWatchEventTypes(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionFIFO, 2, 0)
+	w, _, err := WatchKeys(EventFilter{}, 0)
+	if err != nil {
+		t.Fatalf("Got error watching: %s", err)
+	}
+	defer w.Close()
+
+	_ = Put("ev1", "a")
+	_ = Update("ev1", "b")
+	_ = Put("ev2", "c")
+	_ = Put("ev3", "d")
+	_ = Delete("ev2")
+	_ = PutWithExpiry("ev4", "e", time.Now().Add(-time.Second))
+	lockWrites()
+	_ = expireKeys(time.Now())
+	unlockWrites()
+
+	events := receiveEvents(t, w, 8)
+	expected := []EventType{EventPut, EventUpdate, EventPut, EventEvict, EventPut, EventDelete, EventPut, EventExpire}
+	if got := eventTypes(events); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected events %v, got %v", expected, got)
+	}
+	if events[1].Value != "b" || events[1].Revision != 2 {
+		t.Errorf("Expected update of ev1 to b at revision 2, got %+v", events[1])
+	}
+	if events[3].Key != "ev1" {
+		t.Errorf("Expected ev1 evicted, got %+v", events[3])
+	}
+}
+
+func TestWatchFilter(t *testing.T) {
+	InitKeyStore()
+	byKey, _, _ := WatchKeys(EventFilter{Key: "cust:1"}, 0)
+	defer byKey.Close()
+	byPrefix, _, _ := WatchKeys(EventFilter{Prefix: "cust:"}, 0)
+	defer byPrefix.Close()
+
+	_ = Put("cust:1", "a")
+	_ = Put("cust:10", "b")
+	_ = Put("order:1", "c")
+	_ = Put("cust:2", "d")
+
+	if got := receiveEvents(t, byPrefix, 3); got[2].Key != "cust:2" {
+		t.Errorf("Expected prefix watch to skip order:1, got %+v", got)
+	}
+	if got := receiveEvents(t, byKey, 1); got[0].Key != "cust:1" {
+		t.Errorf("Expected key watch to see cust:1, got %+v", got)
+	}
+	select {
+	case e := <-byKey.Events():
+		t.Errorf("Expected no more events for cust:1, got %+v", e)
+	default:
+	}
+}
+
+func TestWatchTxnSharesRevision(t *testing.T) {
+	InitKeyStore()
+	w, _, _ := WatchKeys(EventFilter{}, 0)
+	defer w.Close()
+
+	_, err := Txn([]TxnOp{{Op: TxnPut, Key: "t1", Value: "a"}, {Op: TxnPut, Key: "t2", Value: "b"}})
+	if err != nil {
+		t.Fatalf("Got error committing transaction: %s", err)
+	}
+	events := receiveEvents(t, w, 2)
+	if events[0].Revision != events[1].Revision {
+		t.Errorf("Expected a transaction's events to share a revision, got %+v", events)
+	}
+}
+
+func TestWatchHistory(t *testing.T) {
+	InitKeyStore()
+	keyStore.maxKeys = 0
+	_ = Put("hist1", "a")
+	_ = Put("hist2", "b")
+	_ = Update("hist1", "c")
+
+	// resume after the first put
+	w, backlog, err := WatchKeys(EventFilter{Key: "hist1"}, 1)
+	if err != nil {
+		t.Fatalf("Got error watching: %s", err)
+	}
+	w.Close()
+	if len(backlog) != 1 || backlog[0].Type != EventUpdate {
+		t.Errorf("Expected the update of hist1 in the backlog, got %+v", backlog)
+	}
+
+	for i := 0; i < eventHistorySize; i++ {
+		_ = Put(fmt.Sprintf("fill%d", i), "v")
+	}
+	if _, _, err := WatchKeys(EventFilter{}, 1); !errors.Is(err, ErrorRevisionCompacted) {
+		t.Errorf("Expected ErrorRevisionCompacted, got %v", err)
+	}
+	if _, backlog, err := WatchKeys(EventFilter{}, keyStore.revision-1); err != nil || len(backlog) != 1 {
+		t.Errorf("Expected the latest event, got %+v, %v", backlog, err)
+	}
+}
+
+func TestWatchAfterRestart(t *testing.T) {
+	InitKeyStore()
+	keyStore.revision = 10
+
+	// events before the keyStore was loaded were never published
+	if _, _, err := WatchKeys(EventFilter{}, 5); !errors.Is(err, ErrorRevisionCompacted) {
+		t.Errorf("Expected ErrorRevisionCompacted, got %v", err)
+	}
+	if _, _, err := WatchKeys(EventFilter{}, 10); err != nil {
+		t.Errorf("Expected watching from the current revision to succeed, got %v", err)
+	}
+}
+
+func TestWatchSlowWatcherClosed(t *testing.T) {
+	InitKeyStore()
+	keyStore.maxKeys = 0
+	w, _, _ := WatchKeys(EventFilter{}, 0)
+	defer w.Close()
+
+	for i := 0; i < watchBufferSize+1; i++ {
+		_ = Put(fmt.Sprintf("slow%d", i), "v")
+	}
+	receiveEvents(t, w, watchBufferSize)
+	if _, ok := <-w.Events(); ok {
+		t.Error("Expected a watcher that fell behind to be closed")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// EvictionPolicy chooses which key is removed when the keyStore reaches its
+// capacity. Every method is called with the keyStore lock held; Accessed may
+// be called concurrently under the read lock, so policies tracking reads must
+// synchronise it themselves.
+type EvictionPolicy interface {
+	// Added is called once key has been inserted
+	Added(key string)
+	// Accessed is called when an existing key is used
+	Accessed(key string)
+	// Removed is called once key has been deleted or evicted
+	Removed(key string)
+	// Victim returns the next key to evict, or false when writes should be
+	// rejected instead
+	Victim() (string, bool)
+}
+
+const (
+	EvictionFIFO   = "fifo"
+	EvictionLRU    = "lru"
+	EvictionLFU    = "lfu"
+	EvictionReject = "reject"
+)
+
+// NewEvictionPolicy returns the policy registered under name
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch strings.ToLower(name) {
+	case EvictionFIFO:
+		return fifoPolicy{}, nil
+	case EvictionLRU:
+		return newLRUPolicy(), nil
+	case EvictionLFU:
+		return newLFUPolicy(), nil
+	case EvictionReject:
+		return rejectPolicy{}, nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q; expected one of fifo, lru, lfu, reject", name)
+}
+
+// fifoPolicy evicts the oldest inserted key, using the insertion-ordered
+// KeyMinHeap the keyStore already maintains
+type fifoPolicy struct{}
+
+func (fifoPolicy) Added(string)    {}
+func (fifoPolicy) Accessed(string) {}
+func (fifoPolicy) Removed(string)  {}
+
+func (fifoPolicy) Victim() (string, bool) {
+	if keyStore.kmh.Len() == 0 {
+		return "", false
+	}
+	return keyStore.kmh.At(0).Key, true
+}
+
+// lruPolicy evicts the least recently used key, where reads and writes both
+// count as a use. Keys are kept in a list ordered most recent first, so every
+// operation is O(1).
+type lruPolicy struct {
+	// Get calls Accessed under the keyStore read lock
+	mu       sync.Mutex
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{order: list.New(), elements: make(map[string]*list.Element)}
+}
+
+func (p *lruPolicy) Added(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.elements[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) Accessed(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.elements[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Removed(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.elements[key]; ok {
+		p.order.Remove(e)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+type lfuEntry struct {
+	key   string
+	count uint64
+	// ticks break count ties in favour of evicting the older access
+	tick  uint64
+	index int
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	e.index = -1
+	*h = old[0 : n-1]
+	return e
+}
+
+// lfuPolicy evicts the least frequently used key
+type lfuPolicy struct {
+	// Get calls Accessed under the keyStore read lock
+	mu      sync.Mutex
+	h       lfuHeap
+	entries map[string]*lfuEntry
+	tick    uint64
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{entries: make(map[string]*lfuEntry)}
+}
+
+func (p *lfuPolicy) Added(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tick++
+	e := &lfuEntry{key: key, count: 1, tick: p.tick}
+	p.entries[key] = e
+	heap.Push(&p.h, e)
+}
+
+func (p *lfuPolicy) Accessed(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	p.tick++
+	e.count++
+	e.tick = p.tick
+	heap.Fix(&p.h, e.index)
+}
+
+func (p *lfuPolicy) Removed(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&p.h, e.index)
+	delete(p.entries, key)
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.h.Len() == 0 {
+		return "", false
+	}
+	return p.h[0].key, true
+}
+
+// rejectPolicy never evicts; writes fail once the keyStore is full
+type rejectPolicy struct{}
+
+func (rejectPolicy) Added(string)           {}
+func (rejectPolicy) Accessed(string)        {}
+func (rejectPolicy) Removed(string)         {}
+func (rejectPolicy) Victim() (string, bool) { return "", false }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// reset the keyStore with the named policy and limits
+func initKeyStoreWithPolicy(t *testing.T, name string, maxKeys int, maxBytes int64) {
+	InitKeyStore()
+	policy, err := NewEvictionPolicy(name)
+	if err != nil {
+		t.Fatalf("Got error creating policy %s: %s", name, err)
+	}
+	if err = ConfigureKeyStore(maxKeys, maxBytes, policy); err != nil {
+		t.Fatalf("Got error configuring key store: %s", err)
+	}
+	t.Cleanup(InitKeyStore)
+}
+
+func assertKeys(t *testing.T, present []string, absent []string) {
+	t.Helper()
+	for _, k := range present {
+		if _, contains := keyStore.m[k]; !contains {
+			t.Errorf("Expected key %s to be present", k)
+		}
+	}
+	for _, k := range absent {
+		if _, contains := keyStore.m[k]; contains {
+			t.Errorf("Expected key %s to be evicted", k)
+		}
+	}
+}
+
+func TestNewEvictionPolicy(t *testing.T) {
+	for _, name := range []string{"fifo", "LRU", "lfu", "reject"} {
+		if _, err := NewEvictionPolicy(name); err != nil {
+			t.Errorf("Expected policy %s, got error %s", name, err)
+		}
+	}
+	if _, err := NewEvictionPolicy("random"); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+func TestConfigureKeyStoreInvalid(t *testing.T) {
+	InitKeyStore()
+	if err := ConfigureKeyStore(-1, 0, fifoPolicy{}); err == nil {
+		t.Error("Expected error for negative max keys")
+	}
+}
+
+func TestFIFOEviction(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionFIFO, 3, 0)
+
+	for _, k := range []string{"a", "b", "c"} {
+		_ = Put(k, "val")
+	}
+	// updates don't change insertion order
+	_ = Update("a", "newval")
+	_ = Put("d", "val")
+
+	assertKeys(t, []string{"b", "c", "d"}, []string{"a"})
+}
+
+func TestLRUEviction(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionLRU, 3, 0)
+
+	for _, k := range []string{"a", "b", "c"} {
+		_ = Put(k, "val")
+	}
+	_ = Update("a", "newval")
+	_ = Put("d", "val")
+
+	assertKeys(t, []string{"a", "c", "d"}, []string{"b"})
+}
+
+func TestLFUEviction(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionLFU, 3, 0)
+
+	for _, k := range []string{"a", "b", "c"} {
+		_ = Put(k, "val")
+	}
+	_ = Update("a", "val1")
+	_ = Update("a", "val2")
+	_ = Update("b", "val1")
+	// c has the fewest uses
+	_ = Put("d", "val")
+	assertKeys(t, []string{"a", "b", "d"}, []string{"c"})
+
+	// d and b tie on count; b was used longer ago
+	_ = Update("d", "val1")
+	_ = Put("e", "val")
+	assertKeys(t, []string{"a", "d", "e"}, []string{"b"})
+}
+
+func TestRejectWhenFull(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionReject, 2, 0)
+
+	_ = Put("a", "val")
+	_ = Put("b", "val")
+	err := Put("c", "val")
+	if !errors.Is(err, ErrorStoreFull) {
+		t.Errorf("Expected ErrorStoreFull, got %v", err)
+	}
+	assertKeys(t, []string{"a", "b"}, []string{"c"})
+
+	// room is made by deleting
+	_ = Delete("a")
+	if err = Put("c", "val"); err != nil {
+		t.Errorf("Expected Put to succeed after Delete, got %s", err)
+	}
+}
+
+func TestMaxBytesEviction(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionFIFO, 0, 10)
+
+	_ = Put("a", "1234")
+	_ = Put("b", "1234")
+	// 4 + 4 + 4 > 10, so a goes
+	_ = Put("c", "1234")
+	assertKeys(t, []string{"b", "c"}, []string{"a"})
+	if keyStore.bytes != 8 {
+		t.Errorf("Expected 8 bytes stored, got %d", keyStore.bytes)
+	}
+
+	// growing c pushes out b
+	if err := Update("c", "12345678"); err != nil {
+		t.Errorf("Got error updating c: %s", err)
+	}
+	assertKeys(t, []string{"c"}, []string{"b"})
+
+	err := Put("big", strings.Repeat("x", 11))
+	if !errors.Is(err, ErrorValueTooLarge) {
+		t.Errorf("Expected ErrorValueTooLarge, got %v", err)
+	}
+}
+
+func TestUnlimitedKeys(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionFIFO, 0, 0)
+
+	n := 3 * defaultMaxKeys
+	for i := 0; i < n; i++ {
+		if err := Put(fmt.Sprintf("Key:%d", i), "val"); err != nil {
+			t.Fatalf("Got error during Put: %s", err)
+		}
+	}
+	if lenKeyStore() != n {
+		t.Errorf("Expected %d keys, got %d", n, lenKeyStore())
+	}
+}
+
+func TestLRUEvictionTracksReads(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionLRU, 3, 0)
+
+	for _, k := range []string{"a", "b", "c"} {
+		_ = Put(k, "val")
+	}
+	// a hot key that is only ever read survives
+	for i := 0; i < 10; i++ {
+		_, _ = Get("a")
+	}
+	_ = Put("d", "val")
+	assertKeys(t, []string{"a", "c", "d"}, []string{"b"})
+
+	_, _ = Get("c")
+	_ = Put("e", "val")
+	assertKeys(t, []string{"c", "d", "e"}, []string{"a"})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+const defaultExpirySweepInterval = time.Second
+
+// check whether key has a TTL that has passed; caller holds the keyStore lock
+func isExpired(key string, now time.Time) bool {
+	expiresAt, ok := keyStore.expires[key]
+	return ok && !now.Before(expiresAt)
+}
+
+// remove key if it has expired so writes treat it as absent, unless this is a
+// follower; caller holds the keyStore write lock
+func expireKey(key string) error {
+	if !writable() || !isExpired(key, time.Now()) {
+		return nil
+	}
+	return removeExpired(key)
+}
+
+// remove every key expired as of now, soonest first; caller holds the
+// keyStore write lock. A follower leaves this to its leader, whose deletes it
+// replicates, hiding expired keys from reads meanwhile.
+func expireKeys(now time.Time) error {
+	if !writable() {
+		return nil
+	}
+	for keyStore.expiryKmh.Len() > 0 {
+		next := keyStore.expiryKmh.At(0)
+		if now.Before(next.timestamp) {
+			return nil
+		}
+		if err := removeExpired(next.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeExpired(key string) error {
+	if _, err := commit(walEntry{Op: walOpDelete, Key: key, reason: EventExpire}); err != nil {
+		return err
+	}
+	logDebugf("Expired key %s", key)
+	return nil
+}
+
+// replace key's expiry with expiresAt, or clear it when that's the zero time;
+// caller holds the keyStore write lock
+func applyExpire(key string, expiresAt time.Time, rev uint64) {
+	keyStore.revision = rev
+	if _, ok := keyStore.m[key]; !ok {
+		return
+	}
+	if _, ok := keyStore.expires[key]; ok {
+		delete(keyStore.expires, key)
+		_ = keyStore.expiryKmh.Delete(key)
+	}
+	if !expiresAt.IsZero() {
+		keyStore.expires[key] = expiresAt
+		heap.Push(&keyStore.expiryKmh, KeyDate{Key: key, timestamp: expiresAt})
+	}
+}
+
+// Expire set when key expires, or make it persistent with the zero time,
+// without changing its value or version
+func Expire(key string, expiresAt time.Time) error {
+	lockWrites()
+	defer unlockWrites()
+	if err := expireKey(key); err != nil {
+		return err
+	}
+	if _, ok := keyStore.m[key]; !ok {
+		return ErrorNoSuchKey
+	}
+
+	entry := walEntry{Op: walOpExpire, Key: key}
+	if !expiresAt.IsZero() {
+		entry.ExpiresAt = &expiresAt
+	}
+	_, err := commit(entry)
+	return err
+}
+
+// GetExpiry when key expires; the zero time if it never does
+func GetExpiry(key string) (time.Time, error) {
+	if err := keyStoreShards.checkOwnedKey(key); err != nil {
+		return time.Time{}, err
+	}
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+	if _, ok := keyStore.m[key]; !ok || isExpired(key, time.Now()) {
+		return time.Time{}, ErrorNoSuchKey
+	}
+	return keyStore.expires[key], nil
+}
+
+// StartExpirySweeper reclaims expired keys every interval until the returned
+// stop function is called
+func StartExpirySweeper(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				lockWrites()
+				err := expireKeys(time.Now())
+				unlockWrites()
+				if err != nil {
+					logErrorf("Expiry sweep failed: %s", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// the time a new key expires, from an entry's TTL or absolute ExpiresAt; the
+// zero time if it has neither
+func entryExpiry(kvEntry KeyValEntry, now time.Time) time.Time {
+	if kvEntry.ExpiresAt != nil {
+		return *kvEntry.ExpiresAt
+	}
+	if kvEntry.TTL > 0 {
+		return now.Add(time.Duration(kvEntry.TTL) * time.Second)
+	}
+	return time.Time{}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestExpiredKeyInvisible(t *testing.T) {
+	InitKeyStore()
+	key := "session"
+
+	if err := PutWithExpiry(key, "token", time.Now().Add(20*time.Millisecond)); err != nil {
+		t.Fatalf("Got error during PutWithExpiry: %s", err)
+	}
+	if _, err := Get(key); err != nil {
+		t.Errorf("Expected key %s before expiry, got %s", key, err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, err := Get(key); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected ErrorNoSuchKey after expiry, got %v", err)
+	}
+	for _, kv := range GetAll() {
+		if kv.Key == key {
+			t.Errorf("Expired key %s returned by GetAll", key)
+		}
+	}
+	if err := Update(key, "newtoken"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected ErrorNoSuchKey updating expired key, got %v", err)
+	}
+
+	// the key can be created again once expired
+	if err := Put(key, "token2"); err != nil {
+		t.Errorf("Expected Put of expired key to succeed, got %s", err)
+	}
+	if _, contains := keyStore.expires[key]; contains {
+		t.Error("Re-created key should not inherit the old expiry")
+	}
+}
+
+func TestGetWithExpiry(t *testing.T) {
+	InitKeyStore()
+	expiresAt := time.Now().Add(time.Hour)
+	version, err := SetIf("k", "v", KeyMeta{Flags: 3}, expiresAt, SetAlways, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, meta, gotVersion, gotExpiry, err := GetWithExpiry("k")
+	if err != nil || value != "v" || meta.Flags != 3 || gotVersion != version || !gotExpiry.Equal(expiresAt) {
+		t.Errorf("Expected the key's value, metadata, version and expiry, got %q %+v %d %s, %v", value, meta, gotVersion, gotExpiry, err)
+	}
+
+	_ = Expire("k", time.Time{})
+	if _, _, _, gotExpiry, _ = GetWithExpiry("k"); !gotExpiry.IsZero() {
+		t.Errorf("Expected no expiry once persistent, got %s", gotExpiry)
+	}
+	if _, _, _, _, err = GetWithExpiry("missing"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected ErrorNoSuchKey, got %v", err)
+	}
+}
+
+func TestExpirySweeper(t *testing.T) {
+	InitKeyStore()
+	_ = PutWithExpiry("short", "val", time.Now().Add(10*time.Millisecond))
+	_ = PutWithExpiry("long", "val", time.Now().Add(time.Hour))
+	_ = Put("forever", "val")
+
+	stop := StartExpirySweeper(5 * time.Millisecond)
+	defer stop()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		keyStore.RLock()
+		_, contains := keyStore.m["short"]
+		keyStore.RUnlock()
+		if !contains {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+	assertKeys(t, []string{"long", "forever"}, []string{"short"})
+	if keyStore.expiryKmh.Len() != 1 {
+		t.Errorf("Expected 1 key in expiry heap, got %d", keyStore.expiryKmh.Len())
+	}
+}
+
+func TestExpiredKeysMakeRoom(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionReject, 2, 0)
+	_ = PutWithExpiry("a", "val", time.Now().Add(10*time.Millisecond))
+	_ = Put("b", "val")
+	time.Sleep(20 * time.Millisecond)
+
+	if err := Put("c", "val"); err != nil {
+		t.Errorf("Expected expired key to make room, got %s", err)
+	}
+	assertKeys(t, []string{"b", "c"}, []string{"a"})
+}
+
+func TestExpiryReplay(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	w := openTestWAL(t, dir)
+
+	expiresAt := time.Now().Add(time.Hour).Round(0)
+	_ = PutWithExpiry("ttlkey", "val", expiresAt)
+	keyStoreWAL = nil
+	_ = w.Close()
+
+	InitKeyStore()
+	openTestWAL(t, dir)
+	if got := keyStore.expires["ttlkey"]; !got.Equal(expiresAt) {
+		t.Errorf("Expected expiry %s after replay, got %s", expiresAt, got)
+	}
+}
+
+func TestExpireReplay(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	w := openTestWAL(t, dir)
+
+	expiresAt := time.Now().Add(time.Hour).Round(0)
+	_ = Put("expirekey", "val")
+	_ = Put("persistkey", "val")
+	_, version, _ := GetWithVersion("expirekey")
+	if err := Expire("expirekey", expiresAt); err != nil {
+		t.Fatalf("Got error setting expiry: %s", err)
+	}
+	_, _ = Set("persistkey", "new", expiresAt, SetIfPresent)
+	_, _ = Set("persistkey", "newer", time.Time{}, SetAlways)
+	if err := Expire("missing", expiresAt); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected ErrorNoSuchKey expiring a missing key, got %v", err)
+	}
+	keyStoreWAL = nil
+	_ = w.Close()
+
+	InitKeyStore()
+	openTestWAL(t, dir)
+	if got, _ := GetExpiry("expirekey"); !got.Equal(expiresAt) {
+		t.Errorf("Expected expiry %s after replay, got %s", expiresAt, got)
+	}
+	if _, replayed, _ := GetWithVersion("expirekey"); replayed != version {
+		t.Errorf("Expected setting an expiry to keep version %d, got %d", version, replayed)
+	}
+	if got, _ := GetExpiry("persistkey"); !got.IsZero() || keyStore.m["persistkey"] != "newer" {
+		t.Errorf("Expected persistkey set to newer without expiry, got %s expiring %s", keyStore.m["persistkey"], got)
+	}
+}
+
+func TestPostHandlerTTL(t *testing.T) {
+	InitKeyStore()
+	router := mux.NewRouter()
+	router.HandleFunc("/keys", AddKeyHandlerFunc).Methods("POST")
+
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	tests := []struct {
+		body     string
+		expected int
+	}{
+		{`{"key":"ttl1","value":"val","ttl":60}`, http.StatusCreated},
+		{fmt.Sprintf(`{"key":"ttl2","value":"val","expiresAt":"%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339)), http.StatusCreated},
+		{`{"key":"ttl3","value":"val","ttl":-1}`, http.StatusBadRequest},
+		{fmt.Sprintf(`{"key":"ttl4","value":"val","expiresAt":"%s"}`, past), http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest("POST", "/keys", bytes.NewBuffer([]byte(tc.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tc.expected {
+			t.Errorf("%s: expected StatusCode %d, got %d", tc.body, tc.expected, rr.Code)
+		}
+	}
+
+	expiresAt, ok := keyStore.expires["ttl1"]
+	if !ok || time.Until(expiresAt) > time.Minute || time.Until(expiresAt) < 50*time.Second {
+		t.Errorf("Expected ttl1 to expire in about a minute, got %s", expiresAt)
+	}
+	if _, ok = keyStore.expires["ttl2"]; !ok {
+		t.Error("Expected ttl2 to have an expiry")
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"goKVServer/kvpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var ErrorInvalidGRPCRequest = errors.New("invalid request")
+
+// grpcServer serves the KV service defined in kvpb/kv.proto
+type grpcServer struct {
+	kvpb.UnimplementedKVServer
+	server *grpc.Server
+
+	// closed when shutdown begins, ending open watches so the drain isn't
+	// held up by them
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func newGRPCServer() *grpcServer {
+	s := &grpcServer{server: grpc.NewServer(), done: make(chan struct{})}
+	kvpb.RegisterKVServer(s.server, s)
+	return s
+}
+
+// Serve accept connections on l until Shutdown is called
+func (s *grpcServer) Serve(l net.Listener) error {
+	if err := s.server.Serve(l); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return fmt.Errorf("grpc: %w", err)
+	}
+	return nil
+}
+
+// ListenAndServe listen on addr and serve in the background
+func (s *grpcServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logInfof("grpc listening on %s", l.Addr())
+	go func() {
+		if err := s.Serve(l); err != nil {
+			logErrorf("grpc stopped: %s", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stop accepting connections and wait, until ctx is done, for
+// running calls to finish; watches are ended straight away
+func (s *grpcServer) Shutdown(ctx context.Context) error {
+	s.doneOnce.Do(func() { close(s.done) })
+
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		<-stopped
+		return fmt.Errorf("grpc: %w", errDrainTimeout)
+	}
+}
+
+// map keyStore errors to their status code
+func grpcError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, ErrorNoSuchKey):
+		code = codes.NotFound
+	case errors.Is(err, ErrorKeyExists):
+		code = codes.AlreadyExists
+	case errors.Is(err, ErrorVersionMismatch), errors.Is(err, ErrorReadOnly), errors.Is(err, ErrorNotOwner):
+		code = codes.FailedPrecondition
+	case errors.Is(err, ErrorStoreFull):
+		code = codes.ResourceExhausted
+	case errors.Is(err, ErrorNotLeader):
+		code = codes.Unavailable
+	case errors.Is(err, ErrorValueTooLarge), errors.Is(err, ErrorInvalidGRPCRequest),
+		errors.Is(err, ErrorInvalidTxn), errors.Is(err, ErrorInvalidPage), errors.Is(err, ErrorInvalidWatch):
+		code = codes.InvalidArgument
+	case errors.Is(err, ErrorRevisionCompacted):
+		code = codes.OutOfRange
+	}
+	return status.Error(code, err.Error())
+}
+
+func requireKey(key string) error {
+	if key == "" {
+		return grpcError(fmt.Errorf("%w: missing key", ErrorInvalidGRPCRequest))
+	}
+	return nil
+}
+
+// a precondition on the key's version, or none when version is 0
+func versionCondition(version uint64) *Precondition {
+	if version == 0 {
+		return nil
+	}
+	return &Precondition{IfMatch: []uint64{version}}
+}
+
+func (s *grpcServer) Get(_ context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	if err := requireKey(req.Key); err != nil {
+		return nil, err
+	}
+	value, meta, version, expiresAt, err := GetWithExpiry(req.Key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	kv := &kvpb.KeyValue{Key: req.Key, Value: []byte(value), Version: version, ContentType: meta.ContentType}
+	if !expiresAt.IsZero() {
+		kv.ExpiresAt = timestamppb.New(expiresAt)
+	}
+	return &kvpb.GetResponse{Kv: kv}, nil
+}
+
+func (s *grpcServer) Put(_ context.Context, req *kvpb.PutRequest) (*kvpb.PutResponse, error) {
+	if err := requireKey(req.Key); err != nil {
+		return nil, err
+	}
+
+	var expiresAt time.Time
+	now := time.Now()
+	switch {
+	case req.Ttl != nil && req.ExpiresAt != nil:
+		return nil, grpcError(fmt.Errorf("%w: ttl and expires_at are exclusive", ErrorInvalidGRPCRequest))
+	case req.Ttl != nil:
+		expiresAt = now.Add(req.Ttl.AsDuration())
+	case req.ExpiresAt != nil:
+		expiresAt = req.ExpiresAt.AsTime()
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(now) {
+		// a key that is already expired can never be read
+		return nil, grpcError(fmt.Errorf("%w: expiry in the past", ErrorInvalidGRPCRequest))
+	}
+
+	version, err := SetIf(req.Key, string(req.Value), KeyMeta{ContentType: req.ContentType}, expiresAt, SetIfAbsent, nil)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.PutResponse{Version: version}, nil
+}
+
+func (s *grpcServer) Update(_ context.Context, req *kvpb.UpdateRequest) (*kvpb.UpdateResponse, error) {
+	if err := requireKey(req.Key); err != nil {
+		return nil, err
+	}
+	version, err := UpdateIf(req.Key, string(req.Value), versionCondition(req.ExpectedVersion))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.UpdateResponse{Version: version}, nil
+}
+
+func (s *grpcServer) Delete(_ context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	if err := requireKey(req.Key); err != nil {
+		return nil, err
+	}
+	if err := DeleteIf(req.Key, versionCondition(req.ExpectedVersion)); err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.DeleteResponse{}, nil
+}
+
+func (s *grpcServer) List(_ context.Context, req *kvpb.ListRequest) (*kvpb.ListResponse, error) {
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultPageLimit
+	}
+	if limit < 1 || limit > maxPageLimit {
+		return nil, grpcError(fmt.Errorf("%w: limit must be between 1 and %d", ErrorInvalidPage, maxPageLimit))
+	}
+	var after string
+	if req.PageToken != "" {
+		var err error
+		if after, err = decodeCursor(req.PageToken); err != nil {
+			return nil, grpcError(err)
+		}
+	}
+
+	kvs, more := ScanPage(req.Prefix, req.Start, req.End, after, limit)
+	res := &kvpb.ListResponse{Kvs: make([]*kvpb.KeyValue, 0, len(kvs))}
+	for _, kv := range kvs {
+		pb := &kvpb.KeyValue{Key: kv.Key, Value: []byte(kv.Value), Version: kv.version, ContentType: kv.ContentType}
+		if kv.ExpiresAt != nil {
+			pb.ExpiresAt = timestamppb.New(*kv.ExpiresAt)
+		}
+		res.Kvs = append(res.Kvs, pb)
+	}
+	if more {
+		res.NextPageToken = encodeCursor(kvs[len(kvs)-1].Key)
+	}
+	return res, nil
+}
+
+var grpcEventTypes = map[EventType]kvpb.Event_Type{
+	EventPut:    kvpb.Event_PUT,
+	EventUpdate: kvpb.Event_UPDATE,
+	EventDelete: kvpb.Event_DELETE,
+	EventEvict:  kvpb.Event_EVICT,
+	EventExpire: kvpb.Event_EXPIRE,
+}
+
+func grpcEvent(e Event) *kvpb.Event {
+	return &kvpb.Event{Type: grpcEventTypes[e.Type], Key: e.Key, Value: []byte(e.Value), Revision: e.Revision}
+}
+
+// Watch stream events until the client cancels or the server shuts down. A
+// watcher too slow to keep up is ended with Aborted, and should watch again
+// after the last revision it received.
+func (s *grpcServer) Watch(req *kvpb.WatchRequest, stream kvpb.KV_WatchServer) error {
+	if req.Key != "" && req.Prefix != "" {
+		return grpcError(fmt.Errorf("%w: key and prefix are exclusive", ErrorInvalidWatch))
+	}
+
+	since := CurrentRevision()
+	if req.AfterRevision != nil {
+		since = *req.AfterRevision
+	}
+	watch, backlog, err := WatchKeys(EventFilter{Key: req.Key, Prefix: req.Prefix}, since)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer watch.Close()
+
+	for _, e := range backlog {
+		if err := stream.Send(grpcEvent(e)); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case e, ok := <-watch.Events():
+			if !ok {
+				return status.Error(codes.Aborted, "watcher fell behind")
+			}
+			if err := stream.Send(grpcEvent(e)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-s.done:
+			return status.Error(codes.Unavailable, "server shutting down")
+		}
+	}
+}
+
+var grpcTxnOps = map[kvpb.TxnOp_Op]TxnOpType{
+	kvpb.TxnOp_PUT:    TxnPut,
+	kvpb.TxnOp_UPDATE: TxnUpdate,
+	kvpb.TxnOp_DELETE: TxnDelete,
+	kvpb.TxnOp_CHECK:  TxnCheck,
+}
+
+// Txn fails with the status of the operation that aborted it, such as
+// AlreadyExists for a failed absence check, its message naming the
+// operation; nothing is applied
+func (s *grpcServer) Txn(_ context.Context, req *kvpb.TxnRequest) (*kvpb.TxnResponse, error) {
+	ops := make([]TxnOp, len(req.Ops))
+	for i, op := range req.Ops {
+		opType, ok := grpcTxnOps[op.Op]
+		if !ok {
+			return nil, grpcError(fmt.Errorf("%w: operation %d has no op", ErrorInvalidTxn, i))
+		}
+		ops[i] = TxnOp{Op: opType, Key: op.Key, Value: string(op.Value), Version: op.ExpectedVersion, Absent: op.Absent}
+	}
+
+	results, err := Txn(ops)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &kvpb.TxnResponse{Results: make([]*kvpb.TxnResult, len(results))}
+	for i, r := range results {
+		res.Results[i] = &kvpb.TxnResult{Key: r.Key, Value: []byte(r.Value), Version: r.Version}
+	}
+	return res, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"goKVServer/kvpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// start a gRPC server on an in-memory listener and connect a client to it
+func dialTestGRPC(t *testing.T) (kvpb.KVClient, *grpcServer) {
+	l := bufconn.Listen(1 << 20)
+	s := newGRPCServer()
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(func() { _ = s.Shutdown(contextWithTimeout(t, time.Second)) })
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return kvpb.NewKVClient(conn), s
+}
+
+func assertCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Errorf("Expected %s, got %v", code, err)
+	}
+}
+
+func TestGRPCKeyOperations(t *testing.T) {
+	InitKeyStore()
+	client, _ := dialTestGRPC(t)
+	ctx := contextWithTimeout(t, time.Second)
+
+	put, err := client.Put(ctx, &kvpb.PutRequest{Key: "g", Value: []byte("a")})
+	if err != nil {
+		t.Fatalf("Unable to put: %s", err)
+	}
+	_, err = client.Put(ctx, &kvpb.PutRequest{Key: "g", Value: []byte("a")})
+	assertCode(t, err, codes.AlreadyExists)
+
+	get, err := client.Get(ctx, &kvpb.GetRequest{Key: "g"})
+	if err != nil || string(get.Kv.Value) != "a" || get.Kv.Version != put.Version || get.Kv.ExpiresAt != nil {
+		t.Errorf("Expected g=a at version %d, got %v, %v", put.Version, get, err)
+	}
+
+	_, err = client.Update(ctx, &kvpb.UpdateRequest{Key: "g", Value: []byte("b"), ExpectedVersion: put.Version + 100})
+	assertCode(t, err, codes.FailedPrecondition)
+	if _, err = client.Update(ctx, &kvpb.UpdateRequest{Key: "g", Value: []byte("b"), ExpectedVersion: put.Version}); err != nil {
+		t.Errorf("Unable to update at the current version: %s", err)
+	}
+	_, err = client.Update(ctx, &kvpb.UpdateRequest{Key: "missing", Value: []byte("b")})
+	assertCode(t, err, codes.NotFound)
+
+	if _, err = client.Delete(ctx, &kvpb.DeleteRequest{Key: "g"}); err != nil {
+		t.Errorf("Unable to delete: %s", err)
+	}
+	_, err = client.Get(ctx, &kvpb.GetRequest{Key: "g"})
+	assertCode(t, err, codes.NotFound)
+	_, err = client.Get(ctx, &kvpb.GetRequest{})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestGRPCPutExpiry(t *testing.T) {
+	InitKeyStore()
+	client, _ := dialTestGRPC(t)
+	ctx := contextWithTimeout(t, time.Second)
+
+	if _, err := client.Put(ctx, &kvpb.PutRequest{Key: "ttl", Value: []byte("a"), Ttl: durationpb.New(time.Minute)}); err != nil {
+		t.Fatalf("Unable to put: %s", err)
+	}
+	get, err := client.Get(ctx, &kvpb.GetRequest{Key: "ttl"})
+	if err != nil || get.Kv.ExpiresAt == nil || time.Until(get.Kv.ExpiresAt.AsTime()) <= 0 {
+		t.Errorf("Expected a future expiry, got %v, %v", get, err)
+	}
+
+	_, err = client.Put(ctx, &kvpb.PutRequest{Key: "past", Value: []byte("a"), Ttl: durationpb.New(-time.Second)})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestGRPCStoreFull(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionReject, 1, 0)
+	client, _ := dialTestGRPC(t)
+	ctx := contextWithTimeout(t, time.Second)
+
+	_, _ = client.Put(ctx, &kvpb.PutRequest{Key: "full1", Value: []byte("a")})
+	_, err := client.Put(ctx, &kvpb.PutRequest{Key: "full2", Value: []byte("a")})
+	assertCode(t, err, codes.ResourceExhausted)
+}
+
+func TestGRPCList(t *testing.T) {
+	InitKeyStore()
+	client, _ := dialTestGRPC(t)
+	ctx := contextWithTimeout(t, time.Second)
+	for _, key := range []string{"l:a", "l:b", "l:c", "other"} {
+		_ = Put(key, "v")
+	}
+
+	var keys []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("List did not terminate")
+		}
+		res, err := client.List(ctx, &kvpb.ListRequest{Prefix: "l:", Limit: 2, PageToken: token})
+		if err != nil {
+			t.Fatalf("Unable to list: %s", err)
+		}
+		for _, kv := range res.Kvs {
+			if kv.Version == 0 {
+				t.Errorf("Expected %s listed with its version", kv.Key)
+			}
+			keys = append(keys, kv.Key)
+		}
+		if token = res.NextPageToken; token == "" {
+			break
+		}
+	}
+	if len(keys) != 3 || keys[0] != "l:a" || keys[2] != "l:c" {
+		t.Errorf("Expected l:a, l:b and l:c, got %v", keys)
+	}
+
+	_, err := client.List(ctx, &kvpb.ListRequest{Limit: maxPageLimit + 1})
+	assertCode(t, err, codes.InvalidArgument)
+	_, err = client.List(ctx, &kvpb.ListRequest{PageToken: "!"})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestGRPCTxn(t *testing.T) {
+	InitKeyStore()
+	client, _ := dialTestGRPC(t)
+	ctx := contextWithTimeout(t, time.Second)
+	_ = Put("from", "10")
+
+	res, err := client.Txn(ctx, &kvpb.TxnRequest{Ops: []*kvpb.TxnOp{
+		{Op: kvpb.TxnOp_CHECK, Key: "to", Absent: true},
+		{Op: kvpb.TxnOp_UPDATE, Key: "from", Value: []byte("5")},
+		{Op: kvpb.TxnOp_PUT, Key: "to", Value: []byte("5")},
+	}})
+	if err != nil || len(res.Results) != 3 || res.Results[2].Version == 0 {
+		t.Fatalf("Expected the transaction applied, got %v, %v", res, err)
+	}
+
+	// the check fails now, so nothing is applied
+	_, err = client.Txn(ctx, &kvpb.TxnRequest{Ops: []*kvpb.TxnOp{
+		{Op: kvpb.TxnOp_DELETE, Key: "from"},
+		{Op: kvpb.TxnOp_CHECK, Key: "to", Absent: true},
+	}})
+	assertCode(t, err, codes.AlreadyExists)
+	if _, err := Get("from"); err != nil {
+		t.Error("Expected the aborted transaction not applied")
+	}
+
+	_, err = client.Txn(ctx, &kvpb.TxnRequest{Ops: []*kvpb.TxnOp{{Key: "from"}}})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestGRPCWatch(t *testing.T) {
+	InitKeyStore()
+	client, _ := dialTestGRPC(t)
+	_ = Put("w:1", "a")
+	_ = Update("w:1", "b")
+
+	after := uint64(1)
+	stream, err := client.Watch(contextWithTimeout(t, time.Second), &kvpb.WatchRequest{Prefix: "w:", AfterRevision: &after})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the backlog after revision 1, then live events
+	event, err := stream.Recv()
+	if err != nil || event.Type != kvpb.Event_UPDATE || string(event.Value) != "b" {
+		t.Fatalf("Expected the update of w:1, got %v, %v", event, err)
+	}
+	_ = Put("skipped", "a")
+	_ = Delete("w:1")
+	event, err = stream.Recv()
+	if err != nil || event.Type != kvpb.Event_DELETE || event.Key != "w:1" {
+		t.Errorf("Expected the delete of w:1, got %v, %v", event, err)
+	}
+
+	// stream errors arrive on the first receive
+	invalid, err := client.Watch(contextWithTimeout(t, time.Second), &kvpb.WatchRequest{Key: "a", Prefix: "b"})
+	if err == nil {
+		_, err = invalid.Recv()
+	}
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestGRPCWatchEndsOnShutdown(t *testing.T) {
+	InitKeyStore()
+	client, s := dialTestGRPC(t)
+
+	// from the current revision, so the put isn't missed however soon the
+	// server registers the watch
+	after := CurrentRevision()
+	stream, err := client.Watch(contextWithTimeout(t, time.Second), &kvpb.WatchRequest{Key: "w", AfterRevision: &after})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = Put("w", "a")
+	if _, err = stream.Recv(); err != nil {
+		t.Fatalf("Expected an event, got %s", err)
+	}
+
+	if err = s.Shutdown(contextWithTimeout(t, time.Second)); err != nil {
+		t.Errorf("Expected the watch not to hold up shutdown, got %s", err)
+	}
+	_, err = stream.Recv()
+	assertCode(t, err, codes.Unavailable)
+}
+
+func TestGRPCBinaryValues(t *testing.T) {
+	InitKeyStore()
+	client, _ := dialTestGRPC(t)
+	ctx := contextWithTimeout(t, time.Second)
+
+	if _, err := client.Put(ctx, &kvpb.PutRequest{Key: "bin", Value: []byte(binaryValue), ContentType: "image/png"}); err != nil {
+		t.Fatalf("Unable to put: %s", err)
+	}
+	get, err := client.Get(ctx, &kvpb.GetRequest{Key: "bin"})
+	if err != nil || string(get.Kv.Value) != binaryValue || get.Kv.ContentType != "image/png" {
+		t.Errorf("Expected the exact bytes as image/png, got %v, %v", get, err)
+	}
+}
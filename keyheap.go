@@ -3,6 +3,7 @@ package main
 import (
 	"container/heap"
 	"errors"
+	"fmt"
 	"time"
 )
 
@@ -12,68 +13,81 @@ type KeyDate struct {
 	index     int
 }
 
-type KeyMinHeap []KeyDate
+// KeyMinHeap orders keys by timestamp, oldest first. Each key's position is
+// indexed so lookups are O(1) and deletes O(log n).
+type KeyMinHeap struct {
+	items []KeyDate
+	// position of each key in items, kept current by Swap, Push and Pop
+	pos map[string]int
+}
 
 func (kmh KeyMinHeap) Len() int {
-	return len(kmh)
+	return len(kmh.items)
 }
 
 func (kmh KeyMinHeap) idxOf(key string) int {
-	for i, kd := range kmh {
-		if kd.Key == key {
-			return i
-		}
+	idx, ok := kmh.pos[key]
+	if !ok {
+		return -1
 	}
-	return -1
+	return idx
 }
 
 func (kmh *KeyMinHeap) At(idx int) (keyDate KeyDate) {
-	keyDate = (*kmh)[idx]
+	keyDate = kmh.items[idx]
 	return
 }
 
+// Delete remove key from the heap, preserving the heap ordering
 func (kmh *KeyMinHeap) Delete(key string) (err error) {
 	if kmh.Len() == 0 {
 		err = errors.New("KeyMinHeap has length 0; not instantiated prior to Delete")
 		return
 	}
 
-	h := make(KeyMinHeap, kmh.Len()-1)
-	j := 0
-
-	for i := 0; i < kmh.Len()-1; i++ {
-		keyMinHeap := *kmh
-		if keyMinHeap[i].Key == key {
-			continue
-		}
-		h[j] = keyMinHeap[i]
-		j++
+	idx := kmh.idxOf(key)
+	if idx == -1 {
+		err = fmt.Errorf("key %s not present in KeyMinHeap", key)
+		return
 	}
 
-	heap.Init(&h)
-	*kmh = h
+	heap.Remove(kmh, idx)
 	return
 }
 
 func (kmh KeyMinHeap) Less(i, j int) bool {
-	return kmh[i].timestamp.Before(kmh[j].timestamp)
+	return kmh.items[i].timestamp.Before(kmh.items[j].timestamp)
 }
 
 func (kmh KeyMinHeap) Swap(i, j int) {
-	kmh[i], kmh[j] = kmh[j], kmh[i]
-	kmh[i].index = i
-	kmh[j].index = j
+	kmh.items[i], kmh.items[j] = kmh.items[j], kmh.items[i]
+	kmh.items[i].index = i
+	kmh.items[j].index = j
+	kmh.pos[kmh.items[i].Key] = i
+	kmh.pos[kmh.items[j].Key] = j
 }
 
-func (kmh *KeyMinHeap) Push(keyStr interface{}) {
-	*kmh = append(*kmh, KeyDate{Key: keyStr.(string), timestamp: time.Now()})
+// Push accepts either a key string, timestamped now, or a KeyDate carrying an
+// existing timestamp (eg when replaying a log)
+func (kmh *KeyMinHeap) Push(x interface{}) {
+	keyDate, ok := x.(KeyDate)
+	if !ok {
+		keyDate = KeyDate{Key: x.(string), timestamp: time.Now()}
+	}
+	if kmh.pos == nil {
+		kmh.pos = make(map[string]int)
+	}
+	keyDate.index = len(kmh.items)
+	kmh.pos[keyDate.Key] = keyDate.index
+	kmh.items = append(kmh.items, keyDate)
 }
 
 func (kmh *KeyMinHeap) Pop() interface{} {
-	old := *kmh
+	old := kmh.items
 	n := len(old)
 	item := old[n-1]
 	item.index = -1
-	*kmh = old[0 : n-1]
+	delete(kmh.pos, item.Key)
+	kmh.items = old[0 : n-1]
 	return item
 }
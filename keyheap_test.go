@@ -136,3 +136,66 @@ func TestKeyHeapKeyStoreLimit(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyMinHeapDelete(t *testing.T) {
+	keyMinHeap := &KeyMinHeap{}
+	heap.Init(keyMinHeap)
+
+	if err := keyMinHeap.Delete("Key:0"); err == nil {
+		t.Error("Expected error deleting from empty heap")
+	}
+
+	n := 10
+	for i := 0; i < n; i++ {
+		heap.Push(keyMinHeap, fmt.Sprintf("Key:%d", i))
+		time.Sleep(time.Millisecond)
+	}
+
+	// delete from the middle and the end of the heap
+	for _, key := range []string{"Key:4", "Key:9"} {
+		if err := keyMinHeap.Delete(key); err != nil {
+			t.Errorf("Got error deleting %s: %s", key, err)
+		}
+	}
+
+	if err := keyMinHeap.Delete("Key:100"); err == nil {
+		t.Error("Expected error deleting key not in heap")
+	}
+
+	if keyMinHeap.Len() != n-2 {
+		t.Errorf("Expected Len %d, got %d", n-2, keyMinHeap.Len())
+	}
+
+	// remaining keys still pop oldest first
+	for _, i := range []int{0, 1, 2, 3, 5, 6, 7, 8} {
+		popVal := heap.Pop(keyMinHeap).(KeyDate)
+		if popVal.Key != fmt.Sprintf("Key:%d", i) {
+			t.Errorf("Expected Key:%d, got %s", i, popVal.Key)
+		}
+	}
+}
+
+func TestKeyMinHeapIdxOfAfterRemove(t *testing.T) {
+	keyMinHeap := &KeyMinHeap{}
+	heap.Init(keyMinHeap)
+
+	n := 50
+	for i := 0; i < n; i++ {
+		heap.Push(keyMinHeap, fmt.Sprintf("Key:%d", i))
+	}
+	for i := 0; i < n; i += 3 {
+		_ = keyMinHeap.Delete(fmt.Sprintf("Key:%d", i))
+	}
+	heap.Pop(keyMinHeap)
+
+	// every remaining key's indexed position matches the heap
+	for i := 0; i < keyMinHeap.Len(); i++ {
+		keyDate := keyMinHeap.At(i)
+		if idx := keyMinHeap.idxOf(keyDate.Key); idx != i {
+			t.Errorf("Expected idxOf %s to be %d, got %d", keyDate.Key, i, idx)
+		}
+	}
+	if keyMinHeap.idxOf("Key:0") != -1 {
+		t.Error("Deleted key still indexed")
+	}
+}
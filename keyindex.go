@@ -0,0 +1,119 @@
+package main
+
+import "math/rand"
+
+const (
+	// enough levels for billions of keys at the 1/4 promotion rate
+	keyIndexMaxLevel = 16
+	keyIndexP        = 4
+)
+
+type keyIndexNode struct {
+	key  string
+	next []*keyIndexNode
+}
+
+// KeyIndex keeps keys in lexicographic order for prefix and range scans, as a
+// skip list: inserts, deletes and seeks are O(log n) on average, and scans
+// walk the bottom level in order.
+type KeyIndex struct {
+	head  *keyIndexNode
+	level int
+	len   int
+}
+
+func NewKeyIndex() *KeyIndex {
+	return &KeyIndex{head: &keyIndexNode{next: make([]*keyIndexNode, keyIndexMaxLevel)}, level: 1}
+}
+
+func (ki *KeyIndex) Len() int {
+	return ki.len
+}
+
+func randomKeyIndexLevel() int {
+	level := 1
+	for level < keyIndexMaxLevel && rand.Intn(keyIndexP) == 0 {
+		level++
+	}
+	return level
+}
+
+// find the last node before key on every level
+func (ki *KeyIndex) predecessors(key string) []*keyIndexNode {
+	update := make([]*keyIndexNode, keyIndexMaxLevel)
+	n := ki.head
+	for i := ki.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+		update[i] = n
+	}
+	return update
+}
+
+// Insert add key to the index; a no-op if it's already present
+func (ki *KeyIndex) Insert(key string) {
+	update := ki.predecessors(key)
+	if n := update[0].next[0]; n != nil && n.key == key {
+		return
+	}
+
+	level := randomKeyIndexLevel()
+	for i := ki.level; i < level; i++ {
+		update[i] = ki.head
+	}
+	if level > ki.level {
+		ki.level = level
+	}
+
+	n := &keyIndexNode{key: key, next: make([]*keyIndexNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	ki.len++
+}
+
+// Delete remove key from the index, returning whether it was present
+func (ki *KeyIndex) Delete(key string) bool {
+	update := ki.predecessors(key)
+	n := update[0].next[0]
+	if n == nil || n.key != key {
+		return false
+	}
+
+	for i := 0; i < len(n.next); i++ {
+		update[i].next[i] = n.next[i]
+	}
+	for ki.level > 1 && ki.head.next[ki.level-1] == nil {
+		ki.level--
+	}
+	ki.len--
+	return true
+}
+
+// Ascend call fn with each key in [start, end) in order until it returns
+// false. An empty end is unbounded.
+func (ki *KeyIndex) Ascend(start string, end string, fn func(key string) bool) {
+	for n := ki.predecessors(start)[0].next[0]; n != nil; n = n.next[0] {
+		if end != "" && n.key >= end {
+			return
+		}
+		if !fn(n.key) {
+			return
+		}
+	}
+}
+
+// the range [start, end) holding every key with prefix; end is empty, so
+// unbounded, when no key sorts after all of them
+func prefixRange(prefix string) (start string, end string) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return prefix, string(b[:i+1])
+		}
+	}
+	return prefix, ""
+}
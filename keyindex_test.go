@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func indexKeys(ki *KeyIndex, start string, end string) []string {
+	keys := []string{}
+	ki.Ascend(start, end, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func scanKeys(kvs KVList) []string {
+	keys := []string{}
+	for _, kv := range kvs {
+		keys = append(keys, kv.Key)
+	}
+	return keys
+}
+
+func TestKeyIndexOrder(t *testing.T) {
+	ki := NewKeyIndex()
+	present := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", rand.Intn(500))
+		if rand.Intn(3) == 0 {
+			if ki.Delete(key) != present[key] {
+				t.Fatalf("Delete %s: expected present %v", key, present[key])
+			}
+			delete(present, key)
+		} else {
+			ki.Insert(key)
+			present[key] = true
+		}
+	}
+
+	expected := []string{}
+	for key := range present {
+		expected = append(expected, key)
+	}
+	sort.Strings(expected)
+
+	if ki.Len() != len(expected) {
+		t.Errorf("Expected %d keys, got %d", len(expected), ki.Len())
+	}
+	if got := indexKeys(ki, "", ""); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected keys in order %v, got %v", expected, got)
+	}
+}
+
+func TestKeyIndexAscend(t *testing.T) {
+	ki := NewKeyIndex()
+	for _, key := range []string{"d", "b", "a", "c", "e"} {
+		ki.Insert(key)
+	}
+
+	tests := []struct {
+		start    string
+		end      string
+		expected []string
+	}{
+		{"b", "d", []string{"b", "c"}},
+		{"bb", "", []string{"c", "d", "e"}},
+		{"", "c", []string{"a", "b"}},
+		{"f", "", []string{}},
+		{"d", "b", []string{}},
+	}
+	for _, tc := range tests {
+		if got := indexKeys(ki, tc.start, tc.end); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("[%q, %q): expected %v, got %v", tc.start, tc.end, tc.expected, got)
+		}
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	tests := []struct {
+		prefix string
+		end    string
+	}{
+		{"cust:123:", "cust:123;"},
+		{"a\xff", "b"},
+		{"\xff\xff", ""},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		if start, end := prefixRange(tc.prefix); start != tc.prefix || end != tc.end {
+			t.Errorf("%q: expected [%q, %q), got [%q, %q)", tc.prefix, tc.prefix, tc.end, start, end)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	InitKeyStore()
+	t.Cleanup(InitKeyStore)
+	keyStore.maxKeys = 0
+	for _, key := range []string{"cust:2:zip", "cust:1:zip", "cust:12:city", "cust:1:city", "order:1"} {
+		_ = Put(key, "val")
+	}
+	_ = Delete("order:1")
+
+	tests := []struct {
+		prefix   string
+		start    string
+		end      string
+		expected []string
+	}{
+		{"cust:1:", "", "", []string{"cust:1:city", "cust:1:zip"}},
+		{"cust:", "", "", []string{"cust:12:city", "cust:1:city", "cust:1:zip", "cust:2:zip"}},
+		{"", "cust:1:", "cust:2", []string{"cust:1:city", "cust:1:zip"}},
+		{"cust:1", "cust:1:", "", []string{"cust:1:city", "cust:1:zip"}},
+		{"order:", "", "", []string{}},
+	}
+	for _, tc := range tests {
+		if got := scanKeys(Scan(tc.prefix, tc.start, tc.end)); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("prefix %q [%q, %q): expected %v, got %v", tc.prefix, tc.start, tc.end, tc.expected, got)
+		}
+	}
+}
+
+func TestHandlerPrefixScan(t *testing.T) {
+	InitKeyStore()
+	t.Cleanup(InitKeyStore)
+	_ = Put("cust:1:zip", "12345")
+	_ = Put("cust:1:city", "Nowhere")
+	_ = Put("cust:2:city", "Elsewhere")
+
+	req, err := http.NewRequest("GET", "/keys?prefix=cust:1:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+
+	expected := `[{"key":"cust:1:city","value":"Nowhere"},{"key":"cust:1:zip","value":"12345"}]`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v expected %v", rr.Body.String(), expected)
+	}
+}
@@ -3,128 +3,563 @@ package main
 import (
 	"container/heap"
 	"errors"
-	"log"
+	"fmt"
 	"sync"
+	"time"
 )
 
-const maxKeys int = 12
+const defaultMaxKeys int = 12
 
 var keyStore = struct {
 	m   map[string]string
 	kmh KeyMinHeap
+	// total bytes of all values in m
+	bytes int64
+	// capacity limits; 0 is unlimited
+	maxKeys  int
+	maxBytes int64
+	policy   EvictionPolicy
+	// expiry time of each key with a TTL, also ordered soonest first
+	expires   map[string]time.Time
+	expiryKmh KeyMinHeap
+	// revision counts every mutation; each key's version is the revision
+	// that last wrote it
+	revision uint64
+	versions map[string]uint64
+	// the keys of m in lexicographic order
+	index *KeyIndex
+	// metadata of the keys that have any
+	meta map[string]KeyMeta
+	// set on followers, which only change through replication
+	readOnly bool
+	// held by writers for as long as they hold the keyStore lock, which
+	// commit gives up while a Raft majority logs the mutation
+	writes sync.Mutex
 	sync.RWMutex
-}{m: make(map[string]string), kmh: KeyMinHeap{}}
+}{
+	m: make(map[string]string), kmh: KeyMinHeap{}, maxKeys: defaultMaxKeys, policy: fifoPolicy{},
+	expires: make(map[string]time.Time), versions: make(map[string]uint64), index: NewKeyIndex(),
+	meta: make(map[string]KeyMeta),
+}
+
+// KeyMeta what a key stores besides its value. Writes that replace a whole
+// key, such as Set, replace its metadata; other updates keep it.
+type KeyMeta struct {
+	// opaque flags, as memcached clients store
+	Flags uint32 `json:"flags,omitempty"`
+	// the value's media type, as given when it was stored over HTTP
+	ContentType string `json:"contentType,omitempty"`
+}
 
 var ErrorNoSuchKey = errors.New("no such key")
 var ErrorKeyExists = errors.New("existing key")
+var ErrorStoreFull = errors.New("key store full")
+var ErrorValueTooLarge = errors.New("value exceeds key store capacity")
+var ErrorReadOnly = errors.New("key store is a read-only follower")
 
-func popKeyHeap() string {
-	popVal := heap.Pop(&keyStore.kmh)
-	return popVal.(KeyDate).Key
+func pushKeyHeap(key string, ts time.Time) {
+	heap.Push(&keyStore.kmh, KeyDate{Key: key, timestamp: ts})
 }
 
-func pushKeyHeap(key string) {
-	heap.Push(&keyStore.kmh, key)
+// InitKeyStore create the heap associated with the keystore, with the default
+// capacity and FIFO eviction
+func InitKeyStore() {
+	keyStore.maxKeys = defaultMaxKeys
+	keyStore.maxBytes = 0
+	keyStore.policy = fifoPolicy{}
+	keyStore.readOnly = false
+	clearKeyStore()
+	keyStoreEvents = NewEventBus()
+	keyStoreReplication = NewReplicationLog()
 }
 
-// InitKeyStore create the heap associated with the keystore
-func InitKeyStore() {
+// remove every key and reset the revision, keeping the capacity settings;
+// caller holds the keyStore lock or has it to itself
+func clearKeyStore() {
+	for key := range keyStore.m {
+		keyStore.policy.Removed(key)
+	}
 	keyStore.m = make(map[string]string)
+	keyStore.kmh = KeyMinHeap{}
 	heap.Init(&keyStore.kmh)
+	keyStore.bytes = 0
+	keyStore.expires = make(map[string]time.Time)
+	keyStore.expiryKmh = KeyMinHeap{}
+	keyStore.revision = 0
+	keyStore.versions = make(map[string]uint64)
+	keyStore.index = NewKeyIndex()
+	keyStore.meta = make(map[string]KeyMeta)
+}
+
+// ConfigureKeyStore set the capacity limits, where 0 is unlimited, and the
+// eviction policy; call after InitKeyStore and before any keys are added
+func ConfigureKeyStore(maxKeys int, maxBytes int64, policy EvictionPolicy) error {
+	if maxKeys < 0 || maxBytes < 0 {
+		return fmt.Errorf("invalid key store capacity: max keys %d, max bytes %d", maxKeys, maxBytes)
+	}
+
+	keyStore.Lock()
+	defer keyStore.Unlock()
+	keyStore.maxKeys = maxKeys
+	keyStore.maxBytes = maxBytes
+	keyStore.policy = policy
+	return nil
+}
+
+// whether this server takes writes: not a follower, whether replicating
+// from a leader or in a Raft cluster; caller holds the keyStore lock
+func writable() bool {
+	return !keyStore.readOnly && (keyStoreRaft == nil || keyStoreRaft.IsLeader())
+}
+
+// take the keyStore lock for a write, once any other writer is done
+func lockWrites() {
+	keyStore.writes.Lock()
+	keyStore.Lock()
+}
+
+func unlockWrites() {
+	keyStore.Unlock()
+	keyStore.writes.Unlock()
 }
 
 func lenKeyStore() int {
 	return len(keyStore.m)
 }
 
+// log the mutation, then apply it as the next revision, which is returned,
+// and notify watchers and followers; caller holds the keyStore lock, taken
+// with lockWrites
+func commit(entry walEntry) (uint64, error) {
+	if keyStore.readOnly {
+		return 0, ErrorReadOnly
+	}
+	if err := keyStoreShards.checkOwned(entry); err != nil {
+		return 0, err
+	}
+	entry.Revision = keyStore.revision + 1
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	if keyStoreRaft != nil {
+		// the apply loop applies it once a majority has logged it; readers
+		// needn't wait on that round trip, and other writers wait for the
+		// writes lock
+		keyStore.Unlock()
+		err := keyStoreRaft.Propose(entry)
+		keyStore.Lock()
+		if err != nil {
+			return 0, err
+		}
+		return entry.Revision, nil
+	}
+	if err := logMutation(entry); err != nil {
+		return 0, err
+	}
+	applyWALEntry(entry)
+	keyStoreReplication.publish(entry)
+	keyStoreEvents.publish(entryEvents(entry)...)
+	return entry.Revision, nil
+}
+
+// the apply functions mutate the keyStore without logging; the caller holds
+// the keyStore lock and has already logged the mutation (or is replaying it)
+func applyPut(key string, value string, ts time.Time, expiresAt time.Time, rev uint64) {
+	keyStore.revision = rev
+	keyStore.versions[key] = rev
+	keyStore.m[key] = value
+	keyStore.bytes += int64(len(value))
+	keyStore.index.Insert(key)
+	pushKeyHeap(key, ts)
+	keyStore.policy.Added(key)
+	if !expiresAt.IsZero() {
+		keyStore.expires[key] = expiresAt
+		heap.Push(&keyStore.expiryKmh, KeyDate{Key: key, timestamp: expiresAt})
+	}
+}
+
+func applyUpdate(key string, value string, rev uint64) {
+	keyStore.revision = rev
+	keyStore.versions[key] = rev
+	keyStore.bytes += int64(len(value)) - int64(len(keyStore.m[key]))
+	keyStore.m[key] = value
+	keyStore.policy.Accessed(key)
+}
+
+func applyMeta(key string, meta KeyMeta) {
+	if meta == (KeyMeta{}) {
+		delete(keyStore.meta, key)
+		return
+	}
+	keyStore.meta[key] = meta
+}
+
+func applyDelete(key string, rev uint64) {
+	keyStore.revision = rev
+	delete(keyStore.versions, key)
+	delete(keyStore.meta, key)
+	keyStore.bytes -= int64(len(keyStore.m[key]))
+	delete(keyStore.m, key)
+	keyStore.index.Delete(key)
+	err := keyStore.kmh.Delete(key)
+	if err != nil {
+		logWarnf("Got error attempting to delete from MKH: %s", err)
+	}
+	keyStore.policy.Removed(key)
+	if _, ok := keyStore.expires[key]; ok {
+		delete(keyStore.expires, key)
+		_ = keyStore.expiryKmh.Delete(key)
+	}
+}
+
+// check whether adding needKeys keys holding needBytes bytes would exceed
+// the keyStore's limits
+func overCapacity(needKeys int, needBytes int64) bool {
+	if keyStore.maxKeys > 0 && lenKeyStore()+needKeys > keyStore.maxKeys {
+		return true
+	}
+	return keyStore.maxBytes > 0 && keyStore.bytes+needBytes > keyStore.maxBytes
+}
+
+// evict keys chosen by the eviction policy until needKeys keys holding
+// needBytes bytes fit, never evicting the keys in keep. Evictions are logged
+// so replay doesn't depend on the limits in effect at the time. Caller holds
+// the keyStore lock.
+func makeRoom(needKeys int, needBytes int64, keep ...string) error {
+	if keyStore.maxBytes > 0 && needBytes > keyStore.maxBytes {
+		return ErrorValueTooLarge
+	}
+
+	if overCapacity(needKeys, needBytes) {
+		// expired keys go before any live key is evicted
+		if err := expireKeys(time.Now()); err != nil {
+			return err
+		}
+	}
+
+	for overCapacity(needKeys, needBytes) {
+		victim, ok := keyStore.policy.Victim()
+		if !ok || containsKey(keep, victim) {
+			logWarnf("Key Store reached limit; unable to make room for %v", keep)
+			return ErrorStoreFull
+		}
+		if _, err := commit(walEntry{Op: walOpDelete, Key: victim, reason: EventEvict}); err != nil {
+			return err
+		}
+		logInfof("Key Store reached limit; evicted %s", victim)
+	}
+	return nil
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
 // Delete the key from the map; err if not found
 func Delete(key string) (err error) {
-	log.Printf("Delete: Request to delete for Key: %s\n", key)
+	return DeleteIf(key, nil)
+}
+
+// DeleteIf Delete the key only if cond holds, ErrorVersionMismatch otherwise
+func DeleteIf(key string, cond *Precondition) (err error) {
+	logDebugf("Delete: Request to delete for Key: %s\n", key)
 	// delete doesn't return err, but inform the user of a bad req
-	keyStore.Lock()
+	lockWrites()
+	defer unlockWrites()
+	if err = expireKey(key); err != nil {
+		return
+	}
+	if err = cond.check(key); err != nil {
+		return
+	}
 	_, contains := keyStore.m[key]
 	if !contains {
-		keyStore.Unlock()
-		log.Printf("Delete: Cannot delete non-existant key %s\n", key)
+		logDebugf("Delete: Cannot delete non-existant key %s\n", key)
 		return ErrorNoSuchKey
 	}
-	delete(keyStore.m, key)
 
-	err = keyStore.kmh.Delete(key)
-	if err != nil {
-		log.Printf("Got error attempting to delete from MKH: %s", err)
+	if _, err = commit(walEntry{Op: walOpDelete, Key: key}); err != nil {
 		return
 	}
 
-	log.Printf("Deleted key %s", key)
-	delete(keyStore.m, key)
-	keyStore.Unlock()
-
+	logDebugf("Deleted key %s", key)
 	return nil
 }
 
 // Get Return the key from the map if found, err otherwise
 func Get(key string) (*string, error) {
-	log.Printf("Get: Request to get key %s\n", key)
+	value, _, err := GetWithVersion(key)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// GetWithVersion Get the key's value along with its current version
+func GetWithVersion(key string) (string, uint64, error) {
+	logDebugf("Get: Request to get key %s\n", key)
+	if err := keyStoreShards.checkOwnedKey(key); err != nil {
+		return "", 0, err
+	}
 	keyStore.RLock()
 	value, ok := keyStore.m[key]
+	version := keyStore.versions[key]
+	if ok && isExpired(key, time.Now()) {
+		// invisible until the sweeper reclaims it
+		ok = false
+	}
+	if ok {
+		keyStore.policy.Accessed(key)
+	}
 	keyStore.RUnlock()
 
 	if !ok {
-		log.Printf("Get: No Key %s found\n", key)
-		return nil, ErrorNoSuchKey
+		logDebugf("Get: No Key %s found\n", key)
+		return "", 0, ErrorNoSuchKey
 	}
-	return &value, nil
+	return value, version, nil
+}
+
+// GetWithMeta GetWithVersion, along with the key's metadata
+func GetWithMeta(key string) (value string, meta KeyMeta, version uint64, err error) {
+	value, meta, version, _, err = GetWithExpiry(key)
+	return
+}
+
+// GetWithExpiry GetWithMeta, along with when the key expires, the zero time
+// if it never does, all as of the same revision
+func GetWithExpiry(key string) (value string, meta KeyMeta, version uint64, expiresAt time.Time, err error) {
+	if err = keyStoreShards.checkOwnedKey(key); err != nil {
+		return
+	}
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+	value, ok := keyStore.m[key]
+	if !ok || isExpired(key, time.Now()) {
+		return "", KeyMeta{}, 0, time.Time{}, ErrorNoSuchKey
+	}
+	keyStore.policy.Accessed(key)
+	return value, keyStore.meta[key], keyStore.versions[key], keyStore.expires[key], nil
 }
 
 // Update key to value, only if key exists
 func Update(key string, value string) (err error) {
-	keyStore.Lock()
+	_, err = UpdateIf(key, value, nil)
+	return
+}
+
+// UpdateIf Update the key only if cond holds, ErrorVersionMismatch otherwise,
+// returning the key's new version
+func UpdateIf(key string, value string, cond *Precondition) (version uint64, err error) {
+	lockWrites()
+	defer unlockWrites()
+	if err = expireKey(key); err != nil {
+		return
+	}
+	if err = cond.check(key); err != nil {
+		return
+	}
 	_, contains := keyStore.m[key]
 	if !contains {
 		// key doesn't exist, cannot update
-		keyStore.Unlock()
-		log.Printf("Update: Error updating key %s, does not exist in store\n", key)
-		return ErrorNoSuchKey
+		logDebugf("Update: Error updating key %s, does not exist in store\n", key)
+		return 0, ErrorNoSuchKey
 	}
 
-	keyStore.m[key] = value
-	keyStore.Unlock()
-	return nil
+	delta := int64(len(value)) - int64(len(keyStore.m[key]))
+	if delta > 0 {
+		if err = makeRoom(0, delta, key); err != nil {
+			return
+		}
+	}
+
+	return commit(walEntry{Op: walOpUpdate, Key: key, Value: value})
+}
+
+// CompareAndSwap Update key to value only if its version is expectedVersion,
+// returning the new version
+func CompareAndSwap(key string, expectedVersion uint64, value string) (uint64, error) {
+	return UpdateIf(key, value, &Precondition{IfMatch: []uint64{expectedVersion}})
 }
 
 func GetAll() KVList {
 	kvs := KVList{}
+	now := time.Now()
 	keyStore.RLock()
 	for k, v := range keyStore.m {
-		kvs = append(kvs, KeyValEntry{Key: k, Value: v})
+		if isExpired(k, now) {
+			continue
+		}
+		kv := KeyValEntry{Key: k, Value: v, ContentType: keyStore.meta[k].ContentType}
+		if expiresAt, ok := keyStore.expires[k]; ok {
+			kv.ExpiresAt = &expiresAt
+		}
+		kvs = append(kvs, kv)
 	}
 	keyStore.RUnlock()
 	return kvs
 }
 
+// Scan the keys in [start, end) that have prefix, in lexicographic order. An
+// empty prefix, start or end leaves that side of the range unbounded.
+func Scan(prefix string, start string, end string) KVList {
+	kvs, _ := ScanPage(prefix, start, end, "", 0)
+	return kvs
+}
+
+// ScanPage Scan at most limit keys after the key after, returning them and
+// whether more follow; a limit of 0 is unlimited. Paging by the last key
+// returned, each key present throughout is returned exactly once, whatever
+// is written between pages.
+func ScanPage(prefix string, start string, end string, after string, limit int) (KVList, bool) {
+	from, to := prefixRange(prefix)
+	if start > from {
+		from = start
+	}
+	if after != "" && after+"\x00" > from {
+		// the smallest key sorting after it
+		from = after + "\x00"
+	}
+	if end != "" && (to == "" || end < to) {
+		to = end
+	}
+
+	kvs := KVList{}
+	more := false
+	now := time.Now()
+	keyStore.RLock()
+	keyStore.index.Ascend(from, to, func(k string) bool {
+		if isExpired(k, now) {
+			return true
+		}
+		if limit > 0 && len(kvs) == limit {
+			more = true
+			return false
+		}
+		kv := KeyValEntry{Key: k, Value: keyStore.m[k], ContentType: keyStore.meta[k].ContentType, version: keyStore.versions[k]}
+		if expiresAt, ok := keyStore.expires[k]; ok {
+			kv.ExpiresAt = &expiresAt
+		}
+		kvs = append(kvs, kv)
+		return true
+	})
+	keyStore.RUnlock()
+	return kvs, more
+}
+
 // Put Only allow put to succeed when the key does not exist
 func Put(key string, value string) (err error) {
-	log.Printf("Put: Request to put key %s\n", key)
-	keyStore.Lock()
+	return PutWithExpiry(key, value, time.Time{})
+}
+
+// PutWithExpiry Put a key that expires at expiresAt; the zero time never expires
+func PutWithExpiry(key string, value string, expiresAt time.Time) (err error) {
+	_, err = PutIf(key, value, expiresAt, nil)
+	return
+}
+
+// PutIf PutWithExpiry only if cond holds, ErrorVersionMismatch otherwise,
+// returning the new key's version
+func PutIf(key string, value string, expiresAt time.Time, cond *Precondition) (version uint64, err error) {
+	return PutIfWithMeta(key, value, KeyMeta{}, expiresAt, cond)
+}
 
+// PutIfWithMeta PutIf, storing metadata meta with the new key
+func PutIfWithMeta(key string, value string, meta KeyMeta, expiresAt time.Time, cond *Precondition) (version uint64, err error) {
+	logDebugf("Put: Request to put key %s\n", key)
+	lockWrites()
+	defer unlockWrites()
+
+	if err = expireKey(key); err != nil {
+		return
+	}
+	if err = cond.check(key); err != nil {
+		return
+	}
 	_, contains := keyStore.m[key]
 	if contains {
-		keyStore.Unlock()
-		log.Printf("Put: Key: %s already exits; not adding", key)
-		return ErrorKeyExists
+		logDebugf("Put: Key: %s already exits; not adding", key)
+		return 0, ErrorKeyExists
+	}
+
+	if err = makeRoom(1, int64(len(value)), key); err != nil {
+		return
 	}
 
 	// otherwise, add the key
-	keyStore.m[key] = value
-	if lenKeyStore() > maxKeys {
-		popVal := popKeyHeap()
-		log.Printf("Key Store reached limit; popped and removed %s", popVal)
-		delete(keyStore.m, popVal)
+	entry := walEntry{Op: walOpPut, Key: key, Value: value}
+	if !expiresAt.IsZero() {
+		entry.ExpiresAt = &expiresAt
 	}
-	pushKeyHeap(key)
+	if meta != (KeyMeta{}) {
+		entry.Meta = &meta
+	}
+	return commit(entry)
+}
 
-	keyStore.m[key] = value
-	keyStore.Unlock()
-	return nil
+// SetMode the existing state of a key Set requires
+type SetMode int
+
+const (
+	SetAlways SetMode = iota
+	// the key must not exist, as for Put
+	SetIfAbsent
+	// the key must exist, as for Update
+	SetIfPresent
+)
+
+// Set Put or Update key in one step, depending on mode, replacing any expiry
+// with expiresAt, where the zero time never expires, and clearing any
+// metadata. Returns the key's new version.
+func Set(key string, value string, expiresAt time.Time, mode SetMode) (version uint64, err error) {
+	return SetIf(key, value, KeyMeta{}, expiresAt, mode, nil)
+}
+
+// SetIf Set key with metadata meta only if cond holds, ErrorVersionMismatch
+// otherwise
+func SetIf(key string, value string, meta KeyMeta, expiresAt time.Time, mode SetMode, cond *Precondition) (version uint64, err error) {
+	lockWrites()
+	defer unlockWrites()
+	if err = expireKey(key); err != nil {
+		return
+	}
+
+	old, contains := keyStore.m[key]
+	if contains && mode == SetIfAbsent {
+		return 0, ErrorKeyExists
+	}
+	if !contains && mode == SetIfPresent {
+		return 0, ErrorNoSuchKey
+	}
+	if err = cond.check(key); err != nil {
+		return
+	}
+
+	var expiry *time.Time
+	if !expiresAt.IsZero() {
+		expiry = &expiresAt
+	}
+	if !contains {
+		if err = makeRoom(1, int64(len(value)), key); err != nil {
+			return
+		}
+		return commit(walEntry{Op: walOpPut, Key: key, Value: value, ExpiresAt: expiry, Meta: &meta})
+	}
+
+	if delta := int64(len(value)) - int64(len(old)); delta > 0 {
+		if err = makeRoom(0, delta, key); err != nil {
+			return
+		}
+	}
+	entry := walEntry{Op: walOpUpdate, Key: key, Value: value, Meta: &meta}
+	if _, hasExpiry := keyStore.expires[key]; hasExpiry || expiry != nil {
+		// update and re-expire together
+		entry = walEntry{Op: walOpTxn, Batch: []walEntry{entry, {Op: walOpExpire, Key: key, ExpiresAt: expiry}}}
+	}
+	return commit(entry)
 }
@@ -146,7 +146,7 @@ func TestGetAll(t *testing.T) {
 
 	ok := testEq(kvList, results)
 	if !ok {
-		t.Errorf("Contents not equal, expected: %s, got: %s", kvList, results)
+		t.Errorf("Contents not equal, expected: %v, got: %v", kvList, results)
 	}
 }
 
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// LogLevel the minimum severity of messages written to the log
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = map[string]LogLevel{"debug": LogDebug, "info": LogInfo, "warn": LogWarn, "error": LogError}
+
+var logLevel = LogInfo
+
+// ParseLogLevel returns the level named by s
+func ParseLogLevel(s string) (LogLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q; expected one of debug, info, warn, error", s)
+	}
+	return level, nil
+}
+
+// SetLogLevel discard messages below level
+func SetLogLevel(level LogLevel) {
+	logLevel = level
+}
+
+func logf(level LogLevel, format string, v ...interface{}) {
+	if level >= logLevel {
+		log.Printf(format, v...)
+	}
+}
+
+func logDebugf(format string, v ...interface{}) { logf(LogDebug, format, v...) }
+func logInfof(format string, v ...interface{})  { logf(LogInfo, format, v...) }
+func logWarnf(format string, v ...interface{})  { logf(LogWarn, format, v...) }
+func logErrorf(format string, v ...interface{}) { logf(LogError, format, v...) }
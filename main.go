@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -12,9 +22,28 @@ import (
 
 var applicationStartTime time.Time
 
+const (
+	defaultDataDir     = "data"
+	defaultWALInterval = time.Second
+	// how often the keyStore is snapshotted and the log compacted
+	defaultSnapshotInterval = 5 * time.Minute
+	// the largest raw value accepted, and its type when the request has none
+	maxValueBodyBytes       = 64 << 20
+	defaultValueContentType = "application/octet-stream"
+)
+
 type KeyValEntry struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
+	// "base64" when Value is base64 encoded, as values that aren't UTF-8
+	// text are
+	Encoding    string `json:"encoding,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	// optional expiry for new keys: seconds to live, or an absolute time
+	TTL       int64      `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// the key's version, set by scans for clients other than HTTP
+	version uint64
 }
 
 type KVList []KeyValEntry
@@ -23,34 +52,110 @@ func getUptime() time.Duration {
 	return time.Since(applicationStartTime).Round(time.Second)
 }
 
+// map keyStore capacity and version errors to their status, otherwise fallback
+func storeErrorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, ErrorVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrorStoreFull):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrorValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrorReadOnly):
+		// writes belong on the leader
+		return http.StatusMisdirectedRequest
+	case errors.Is(err, ErrorNotLeader):
+		// no leader to forward to, or it lost its quorum; retry later
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrorNotOwner):
+		// written while the shards' membership changed; retry
+		return http.StatusConflict
+	}
+	return fallback
+}
+
+// pathVar the request's path variable name, unescaped, as the router matches
+// escaped paths so keys can hold slashes
+func pathVar(r *http.Request, name string) string {
+	v := mux.Vars(r)[name]
+	if unescaped, err := url.PathUnescape(v); err == nil {
+		return unescaped
+	}
+	return v
+}
+
 func GetKeyHandlerFunc(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
-	keyRes, err := Get(key)
-	if err != nil {
+	key := pathVar(r, "key")
+	value, meta, version, err := GetWithMeta(key)
+	if errors.Is(err, ErrorNoSuchKey) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		w.WriteHeader(storeErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(version))
+	if cond := requestPrecondition(r); cond != nil && (cond.IfNoneMatchAny || containsVersion(cond.IfNoneMatch, version)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	// values stored with a content type are returned exactly as stored;
+	// others as a line of text, unless ?raw=true asks for them as stored too,
+	// without a content type
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	} else if raw, _ := strconv.ParseBool(r.URL.Query().Get("raw")); raw {
+		// don't let the server sniff one
+		w.Header()["Content-Type"] = nil
+	} else {
+		value += "\n"
+	}
 	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte(*keyRes + "\n"))
+	_, err = w.Write([]byte(value))
 	if err != nil {
-		log.Printf("getKeyHandlerFunc - Error %s", err)
+		logErrorf("getKeyHandlerFunc - Error %s", err)
 	}
 }
 
-func GetAllKeyHandlerFunc(w http.ResponseWriter, _ *http.Request) {
-	contents := GetAll()
+func GetAllKeyHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	paged, after, limit, err := parsePage(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// pages, a prefix or a range list keys in order; otherwise everything,
+	// unordered, as a bare array
+	var contents interface{}
+	switch {
+	case paged:
+		page := KVPage{}
+		var more bool
+		page.Items, more = ScanPage(query.Get("prefix"), query.Get("start"), query.Get("end"), after, limit)
+		if more {
+			page.Next = encodeCursor(page.Items[len(page.Items)-1].Key)
+		}
+		contents = page
+	case query.Has("prefix") || query.Has("start") || query.Has("end"):
+		contents = Scan(query.Get("prefix"), query.Get("start"), query.Get("end"))
+	default:
+		contents = GetAll()
+	}
+
 	kvlist, err := json.Marshal(contents)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		_, err := w.Write([]byte("Error"))
 		if err != nil {
-			log.Printf("getAllKeyHandlerFunc - Error %s", err)
+			logErrorf("getAllKeyHandlerFunc - Error %s", err)
 		}
 	}
 	_, err = w.Write(kvlist)
 	if err != nil {
-		log.Printf("getAllKeyHandlerFunc - Error %s", err)
+		logErrorf("getAllKeyHandlerFunc - Error %s", err)
 	}
 }
 
@@ -61,57 +166,160 @@ func AddKeyHandlerFunc(w http.ResponseWriter, r *http.Request) {
 	// add new key
 	case http.MethodPost:
 		// if exists, error thrown
-		_ = json.NewDecoder(r.Body).Decode(&kvEntry)
+		if err := json.NewDecoder(r.Body).Decode(&kvEntry); errors.Is(err, ErrorInvalidEncoding) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-		err := Put(kvEntry.Key, kvEntry.Value)
-		if err != nil {
+		now := time.Now()
+		if kvEntry.TTL < 0 || (kvEntry.ExpiresAt != nil && !kvEntry.ExpiresAt.After(now)) {
+			// a key that is already expired can never be read
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		w.WriteHeader(http.StatusCreated)
+		version, err := PutIfWithMeta(kvEntry.Key, kvEntry.Value, KeyMeta{ContentType: kvEntry.ContentType}, entryExpiry(kvEntry, now), requestPrecondition(r))
+		if err != nil {
+			w.WriteHeader(storeErrorStatus(err, http.StatusBadRequest))
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", formatETag(version))
+		w.WriteHeader(http.StatusCreated)
 		jsonKv, err := json.Marshal(kvEntry)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			_, err := w.Write([]byte("Error"))
 			if err != nil {
-				log.Printf("addKeyHandlerFunc - Error %s", err)
+				logErrorf("addKeyHandlerFunc - Error %s", err)
 			}
 		}
 		_, err = w.Write(jsonKv)
 		if err != nil {
-			log.Printf("addKeyHandlerFunc - Error %s", err)
+			logErrorf("addKeyHandlerFunc - Error %s", err)
 		}
 
 	case http.MethodPut:
 		// update the key; if exists, put isn't valid
-		_ = json.NewDecoder(r.Body).Decode(&kvEntry)
+		if err := json.NewDecoder(r.Body).Decode(&kvEntry); errors.Is(err, ErrorInvalidEncoding) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-		err := Update(kvEntry.Key, kvEntry.Value)
+		version, err := UpdateIf(kvEntry.Key, kvEntry.Value, requestPrecondition(r))
 		if err != nil {
 			// key does not exist; cannot update
-			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(storeErrorStatus(err, http.StatusNotFound))
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", formatETag(version))
+		w.WriteHeader(http.StatusOK)
 		jsonKv, err := json.Marshal(kvEntry)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			_, err := w.Write([]byte("Error"))
 			if err != nil {
-				log.Printf("Error: %s", err)
+				logErrorf("Error: %s", err)
 			}
 		}
 		_, err = w.Write(jsonKv)
 		if err != nil {
-			log.Printf("Error: %s", err)
+			logErrorf("Error: %s", err)
 		}
 	}
 }
 
+// PutKeyHandlerFunc store the request body as the key's value, exactly as
+// sent, with the request's Content-Type, creating or replacing the key
+func PutKeyHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	key := pathVar(r, "key")
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = defaultValueContentType
+	}
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var expiresAt time.Time
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		ttl, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || ttl <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		expiresAt = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueBodyBytes))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	version, err := SetIf(key, string(value), KeyMeta{ContentType: contentType}, expiresAt, SetAlways, requestPrecondition(r))
+	if err != nil {
+		w.WriteHeader(storeErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("ETag", formatETag(version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func DeleteKeyHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	err := DeleteIf(pathVar(r, "key"), requestPrecondition(r))
+	if errors.Is(err, ErrorNoSuchKey) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(storeErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type txnRequest struct {
+	Ops []TxnOp `json:"ops"`
+}
+
+type txnResponse struct {
+	Succeeded bool        `json:"succeeded"`
+	Results   []TxnResult `json:"results"`
+}
+
+func TxnHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	var req txnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	results, err := Txn(req.Ops)
+	status := http.StatusOK
+	var txnErr *TxnError
+	switch {
+	case errors.Is(err, ErrorInvalidTxn):
+		status = http.StatusBadRequest
+	case errors.As(err, &txnErr):
+		// an operation's condition didn't hold; nothing was applied
+		status = http.StatusConflict
+	case err != nil:
+		status = storeErrorStatus(err, http.StatusInternalServerError)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(txnResponse{Succeeded: err == nil, Results: results})
+	if err != nil {
+		logErrorf("txnHandlerFunc - Error %s", err)
+	}
+}
+
 func BaseHandlerFunc(w http.ResponseWriter, r *http.Request) {
 	// only allow GET requests
 	if r.Method != http.MethodGet {
@@ -122,16 +330,186 @@ func BaseHandlerFunc(w http.ResponseWriter, r *http.Request) {
 	s := fmt.Sprintf("Uptime: %s", getUptime())
 	_, err := w.Write([]byte(s))
 	if err != nil {
-		log.Printf("baseHandlerFunc - Error: %s", err)
+		logErrorf("baseHandlerFunc - Error: %s", err)
 	}
 }
 
-func main() {
-	applicationStartTime = time.Now()
-	r := mux.NewRouter()
+// newRouter register every handler on a new router
+func newRouter() *mux.Router {
+	r := mux.NewRouter().UseEncodedPath()
+	r.Use(raftForward)
+	r.Use(shardForward)
 	r.HandleFunc("/", BaseHandlerFunc)
 	r.HandleFunc("/keys", GetAllKeyHandlerFunc).Methods("GET")
 	r.HandleFunc("/keys", AddKeyHandlerFunc).Methods("PUT", "POST")
 	r.HandleFunc("/keys/{key}", GetKeyHandlerFunc).Methods("GET")
-	log.Fatal(http.ListenAndServe(":8000", r))
+	r.HandleFunc("/keys/{key}", PutKeyHandlerFunc).Methods("PUT")
+	r.HandleFunc("/keys/{key}", DeleteKeyHandlerFunc).Methods("DELETE")
+	r.HandleFunc("/keys/{key}/incr", IncrKeyHandlerFunc).Methods("POST")
+	r.HandleFunc("/txn", TxnHandlerFunc).Methods("POST")
+	r.HandleFunc("/stats", StatsHandlerFunc).Methods("GET")
+	r.HandleFunc("/customers", ListCustomersHandlerFunc).Methods("GET")
+	r.HandleFunc("/customers", CreateCustomerHandlerFunc).Methods("POST")
+	r.HandleFunc("/customers/{id}", GetCustomerHandlerFunc).Methods("GET")
+	r.HandleFunc("/customers/{id}", PatchCustomerHandlerFunc).Methods("PATCH")
+	r.HandleFunc("/customers/{id}", DeleteCustomerHandlerFunc).Methods("DELETE")
+	r.HandleFunc("/watch", WatchHandlerFunc).Methods("GET")
+	r.HandleFunc("/ws", WSHandlerFunc).Methods("GET")
+	r.HandleFunc("/replication/stream", ReplicationStreamHandlerFunc).Methods("GET")
+	r.HandleFunc("/replication/status", ReplicationStatusHandlerFunc).Methods("GET")
+	r.PathPrefix("/raft/").HandlerFunc(RaftHandlerFunc)
+	r.HandleFunc("/shards", ShardStatusHandlerFunc).Methods("GET")
+	r.HandleFunc("/shards/members", ShardMembersHandlerFunc).Methods("PUT")
+	r.HandleFunc("/shards/import", ShardImportHandlerFunc).Methods("POST")
+	return r
+}
+
+// run the server until it's signalled to stop, returning the exit code
+func run(args []string) int {
+	applicationStartTime = time.Now()
+
+	cfg, err := LoadConfig(args, os.LookupEnv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitShutdown
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitConfigError
+	}
+
+	level, _ := ParseLogLevel(cfg.LogLevel)
+	SetLogLevel(level)
+
+	InitKeyStore()
+	policy, _ := NewEvictionPolicy(cfg.EvictionPolicy)
+	if err = ConfigureKeyStore(cfg.MaxKeys, cfg.MaxBytes, policy); err != nil {
+		logErrorf("%s", err)
+		return exitConfigError
+	}
+
+	// an empty data dir disables persistence
+	if cfg.DataDir != "" {
+		syncPolicy, _ := ParseWALSyncPolicy(cfg.WALSync)
+		keyStoreWAL, err = OpenWAL(cfg.DataDir, syncPolicy, time.Duration(cfg.WALSyncInterval))
+		if err != nil {
+			logErrorf("Unable to open write-ahead log in %s: %s", cfg.DataDir, err)
+			return exitServerError
+		}
+
+		if cfg.SnapshotInterval > 0 {
+			keyStoreWAL.StartSnapshots(time.Duration(cfg.SnapshotInterval))
+		}
+	}
+
+	// listeners for the other protocols, and replication, stopped alongside
+	// the HTTP server
+	var servers []protocolServer
+	if cfg.ReplicateFrom != "" {
+		// read-only before any client can write
+		keyStoreFollower = StartFollower(cfg.ReplicateFrom)
+		servers = append(servers, keyStoreFollower)
+	}
+	if cfg.RaftID != "" {
+		// before any client can write, so every write goes through the log
+		if err = startRaft(cfg); err != nil {
+			logErrorf("Unable to start Raft: %s", err)
+			_ = flushPersistence(false)
+			return exitServerError
+		}
+		servers = append(servers, keyStoreRaft)
+	}
+	if cfg.ShardID != "" {
+		peers, _ := ParsePeers(cfg.ShardPeers)
+		keyStoreShards = StartSharding(cfg.ShardID, peers, cfg.ShardVirtualNodes)
+		servers = append(servers, keyStoreShards)
+	}
+
+	stopSweeper := StartExpirySweeper(time.Duration(cfg.ExpirySweepInterval))
+
+	srv := &http.Server{
+		Handler:      newRouter(),
+		ReadTimeout:  time.Duration(cfg.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.WriteTimeout),
+		IdleTimeout:  time.Duration(cfg.IdleTimeout),
+	}
+	l, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		logErrorf("Unable to listen on %s: %s", cfg.ListenAddr, err)
+		_ = shutdownProtocolServers(servers, 0)
+		stopSweeper()
+		_ = flushPersistence(false)
+		return exitServerError
+	}
+	logInfof("Listening on %s", l.Addr())
+
+	if cfg.RESPListenAddr != "" {
+		resp := newRESPServer()
+		if err = resp.ListenAndServe(cfg.RESPListenAddr); err != nil {
+			logErrorf("Unable to listen on %s: %s", cfg.RESPListenAddr, err)
+			_ = shutdownProtocolServers(servers, 0)
+			_ = l.Close()
+			stopSweeper()
+			_ = flushPersistence(false)
+			return exitServerError
+		}
+		servers = append(servers, resp)
+	}
+	if cfg.MemcachedListenAddr != "" {
+		memcached := newMemcachedServer()
+		if err = memcached.ListenAndServe(cfg.MemcachedListenAddr); err != nil {
+			logErrorf("Unable to listen on %s: %s", cfg.MemcachedListenAddr, err)
+			_ = shutdownProtocolServers(servers, 0)
+			_ = l.Close()
+			stopSweeper()
+			_ = flushPersistence(false)
+			return exitServerError
+		}
+		servers = append(servers, memcached)
+	}
+	if cfg.GRPCListenAddr != "" {
+		grpcSrv := newGRPCServer()
+		if err = grpcSrv.ListenAndServe(cfg.GRPCListenAddr); err != nil {
+			logErrorf("Unable to listen on %s: %s", cfg.GRPCListenAddr, err)
+			_ = shutdownProtocolServers(servers, 0)
+			_ = l.Close()
+			stopSweeper()
+			_ = flushPersistence(false)
+			return exitServerError
+		}
+		servers = append(servers, grpcSrv)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serversShutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		serversShutdown <- shutdownProtocolServers(servers, time.Duration(cfg.ShutdownTimeout))
+	}()
+
+	serveErr := serve(ctx, srv, l, time.Duration(cfg.ShutdownTimeout))
+	// the HTTP server may have stopped by itself; stop the rest too
+	stop()
+	if err = <-serversShutdown; serveErr == nil {
+		serveErr = err
+	}
+	if serveErr != nil {
+		logErrorf("Server stopped: %s", serveErr)
+	}
+
+	// nothing can write to the store now, so flush it
+	stopSweeper()
+	flushErr := flushPersistence(cfg.SnapshotInterval > 0)
+	if flushErr != nil {
+		logErrorf("Unable to flush persistence: %s", flushErr)
+	}
+
+	code := shutdownExitCode(serveErr, flushErr)
+	logInfof("Exiting with status %d", code)
+	return code
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
 }
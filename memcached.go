@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// memcached's own limits on keys, command lines and item size
+	memcachedMaxKeyLen   = 250
+	memcachedMaxLineLen  = 2048
+	memcachedMaxValueLen = 1 << 20
+	// exptimes beyond 30 days are unix times rather than seconds from now
+	memcachedMaxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+// memcachedServer serves the memcached text protocol from the keyStore
+type memcachedServer struct {
+	*tcpServer
+}
+
+func newMemcachedServer() *memcachedServer {
+	s := &memcachedServer{}
+	s.tcpServer = newTCPServer("memcached", s.handleConn)
+	return s
+}
+
+func (s *memcachedServer) handleConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readRESPLine(r, memcachedMaxLineLen)
+		if errors.Is(err, ErrorRESPProtocol) {
+			w.WriteString("CLIENT_ERROR line too long\r\n")
+			_ = w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		cmd := args[0]
+		if cmd == "quit" {
+			_ = w.Flush()
+			return
+		}
+		reply, ok := s.execute(r, cmd, args[1:])
+		if !ok {
+			// the command's data block can't be found, so neither can the
+			// next command
+			w.WriteString(reply)
+			_ = w.Flush()
+			return
+		}
+		w.WriteString(reply)
+		// flush once a pipeline of commands has been answered
+		if r.Buffered() == 0 {
+			if err = w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// run one command, reading its data block from r, returning its reply or
+// false when the connection can't continue
+func (s *memcachedServer) execute(r *bufio.Reader, cmd string, args []string) (string, bool) {
+	switch cmd {
+	case "get", "gets":
+		return memcachedGet(args, cmd == "gets"), true
+	case "set", "add", "replace", "cas":
+		return memcachedStore(r, cmd, args)
+	case "delete":
+		return memcachedDelete(args), true
+	case "incr", "decr":
+		return memcachedIncr(args, cmd == "incr"), true
+	case "touch":
+		return memcachedTouch(args), true
+	case "version":
+		return "VERSION goKVServer\r\n", true
+	}
+	return "ERROR\r\n", true
+}
+
+const memcachedBadFormat = "CLIENT_ERROR bad command line format\r\n"
+
+func validMemcachedKey(key string) bool {
+	if len(key) > memcachedMaxKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// strip a trailing noreply, reporting whether it was there
+func memcachedNoreply(args []string) ([]string, bool) {
+	if len(args) > 0 && args[len(args)-1] == "noreply" {
+		return args[:len(args)-1], true
+	}
+	return args, false
+}
+
+// the reply, or nothing for a noreply command
+func memcachedReply(reply string, noreply bool) string {
+	if noreply {
+		return ""
+	}
+	return reply
+}
+
+// the expiry time an exptime means: 0 never expires, up to 30 days is
+// seconds from now, more is a unix time and negative is already expired
+func memcachedExpiry(exptime int64, now time.Time) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return now
+	case exptime <= memcachedMaxRelativeExptime:
+		return now.Add(time.Duration(exptime) * time.Second)
+	}
+	return time.Unix(exptime, 0)
+}
+
+// map keyStore errors to server errors
+func memcachedStoreError(err error) string {
+	switch {
+	case errors.Is(err, ErrorValueTooLarge):
+		return "SERVER_ERROR object too large for cache\r\n"
+	case errors.Is(err, ErrorStoreFull):
+		return "SERVER_ERROR out of memory storing object\r\n"
+	}
+	return "SERVER_ERROR " + err.Error() + "\r\n"
+}
+
+func memcachedGet(keys []string, withCAS bool) string {
+	if len(keys) == 0 {
+		return "ERROR\r\n"
+	}
+	var b strings.Builder
+	for _, key := range keys {
+		if !validMemcachedKey(key) {
+			return memcachedBadFormat
+		}
+		value, meta, version, err := GetWithMeta(key)
+		if errors.Is(err, ErrorNoSuchKey) {
+			continue
+		}
+		if err != nil {
+			return memcachedStoreError(err)
+		}
+		b.WriteString("VALUE " + key + " " + strconv.FormatUint(uint64(meta.Flags), 10) + " " + strconv.Itoa(len(value)))
+		if withCAS {
+			b.WriteString(" " + strconv.FormatUint(version, 10))
+		}
+		b.WriteString("\r\n" + value + "\r\n")
+	}
+	b.WriteString("END\r\n")
+	return b.String()
+}
+
+// set, add, replace and cas: <key> <flags> <exptime> <bytes> [<cas>]
+// [noreply], then the data block
+func memcachedStore(r *bufio.Reader, cmd string, args []string) (string, bool) {
+	args, noreply := memcachedNoreply(args)
+	want := 4
+	if cmd == "cas" {
+		want = 5
+	}
+	if len(args) != want {
+		return "ERROR\r\n", true
+	}
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		return memcachedBadFormat, false
+	}
+	if size > memcachedMaxValueLen {
+		if _, err = io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+			return "", false
+		}
+		return memcachedReply("SERVER_ERROR object too large for cache\r\n", noreply), true
+	}
+	data := make([]byte, size+2)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return "", false
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		return "CLIENT_ERROR bad data chunk\r\n", false
+	}
+
+	key := args[0]
+	flags, flagsErr := strconv.ParseUint(args[1], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[2], 10, 64)
+	if !validMemcachedKey(key) || flagsErr != nil || exptimeErr != nil {
+		return memcachedBadFormat, true
+	}
+
+	// add creates, like Put, and replace and cas update, like Update
+	mode := SetAlways
+	var cond *Precondition
+	switch cmd {
+	case "add":
+		mode = SetIfAbsent
+	case "replace":
+		mode = SetIfPresent
+	case "cas":
+		unique, err := strconv.ParseUint(args[4], 10, 64)
+		if err != nil {
+			return memcachedBadFormat, true
+		}
+		mode = SetIfPresent
+		cond = &Precondition{IfMatch: []uint64{unique}}
+	}
+
+	_, err = SetIf(key, string(data[:size]), KeyMeta{Flags: uint32(flags)}, memcachedExpiry(exptime, time.Now()), mode, cond)
+	switch {
+	case err == nil:
+		return memcachedReply("STORED\r\n", noreply), true
+	case errors.Is(err, ErrorVersionMismatch):
+		return memcachedReply("EXISTS\r\n", noreply), true
+	case errors.Is(err, ErrorNoSuchKey) && cmd == "cas":
+		return memcachedReply("NOT_FOUND\r\n", noreply), true
+	case errors.Is(err, ErrorKeyExists), errors.Is(err, ErrorNoSuchKey):
+		return memcachedReply("NOT_STORED\r\n", noreply), true
+	}
+	return memcachedReply(memcachedStoreError(err), noreply), true
+}
+
+// delete <key> [0] [noreply]
+func memcachedDelete(args []string) string {
+	args, noreply := memcachedNoreply(args)
+	if len(args) == 2 && args[1] == "0" {
+		// the obsolete hold time, accepted when 0
+		args = args[:1]
+	}
+	if len(args) != 1 || !validMemcachedKey(args[0]) {
+		return memcachedBadFormat
+	}
+
+	err := Delete(args[0])
+	switch {
+	case err == nil:
+		return memcachedReply("DELETED\r\n", noreply)
+	case errors.Is(err, ErrorNoSuchKey):
+		return memcachedReply("NOT_FOUND\r\n", noreply)
+	}
+	return memcachedReply(memcachedStoreError(err), noreply)
+}
+
+// incr and decr <key> <delta> [noreply]. The value must be a decimal 64-bit
+// unsigned integer; incr wraps and decr stops at 0. The key's flags and
+// expiry are kept.
+func memcachedIncr(args []string, incr bool) string {
+	args, noreply := memcachedNoreply(args)
+	if len(args) != 2 || !validMemcachedKey(args[0]) {
+		return "ERROR\r\n"
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return memcachedReply("CLIENT_ERROR invalid numeric delta argument\r\n", noreply)
+	}
+
+	for {
+		value, _, version, err := GetWithMeta(args[0])
+		if errors.Is(err, ErrorNoSuchKey) {
+			return memcachedReply("NOT_FOUND\r\n", noreply)
+		}
+		if err != nil {
+			return memcachedReply(memcachedStoreError(err), noreply)
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return memcachedReply("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n", noreply)
+		}
+		switch {
+		case incr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+
+		value = strconv.FormatUint(n, 10)
+		_, err = UpdateIf(args[0], value, &Precondition{IfMatch: []uint64{version}})
+		switch {
+		case err == nil:
+			return memcachedReply(value+"\r\n", noreply)
+		case errors.Is(err, ErrorVersionMismatch):
+			// written since it was read; try again
+			continue
+		case errors.Is(err, ErrorNoSuchKey):
+			return memcachedReply("NOT_FOUND\r\n", noreply)
+		}
+		return memcachedReply(memcachedStoreError(err), noreply)
+	}
+}
+
+// touch <key> <exptime> [noreply]
+func memcachedTouch(args []string) string {
+	args, noreply := memcachedNoreply(args)
+	if len(args) != 2 || !validMemcachedKey(args[0]) {
+		return "ERROR\r\n"
+	}
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return memcachedBadFormat
+	}
+
+	err = Expire(args[0], memcachedExpiry(exptime, time.Now()))
+	switch {
+	case err == nil:
+		return memcachedReply("TOUCHED\r\n", noreply)
+	case errors.Is(err, ErrorNoSuchKey):
+		return memcachedReply("NOT_FOUND\r\n", noreply)
+	}
+	return memcachedReply(memcachedStoreError(err), noreply)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// start a memcached server on a local port and connect to it
+func dialTestMemcached(t *testing.T) (net.Conn, *bufio.Reader) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newMemcachedServer()
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(func() { _ = s.Shutdown(contextWithTimeout(t, time.Second)) })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// send a command, with any data block, and read its reply: each VALUE
+// through END for retrievals, otherwise one line
+func memcachedCommand(t *testing.T, conn net.Conn, r *bufio.Reader, command string) string {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte(command)); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unable to read reply to %q: %s", command, err)
+		}
+		reply += line
+		if !strings.HasPrefix(line, "VALUE ") {
+			return reply
+		}
+		data, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unable to read reply to %q: %s", command, err)
+		}
+		reply += data
+	}
+}
+
+func TestMemcachedCommands(t *testing.T) {
+	InitKeyStore()
+	conn, r := dialTestMemcached(t)
+
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{"get m1\r\n", "END\r\n"},
+		{"set m1 5 0 1\r\na\r\n", "STORED\r\n"},
+		{"get m1 missing\r\n", "VALUE m1 5 1\r\na\r\nEND\r\n"},
+		{"add m1 0 0 1\r\nb\r\n", "NOT_STORED\r\n"},
+		{"replace m2 0 0 1\r\nb\r\n", "NOT_STORED\r\n"},
+		{"add m2 7 0 1\r\nb\r\n", "STORED\r\n"},
+		{"replace m2 8 0 2\r\nbb\r\n", "STORED\r\n"},
+		{"get m1 m2\r\n", "VALUE m1 5 1\r\na\r\nVALUE m2 8 2\r\nbb\r\nEND\r\n"},
+		{"delete m2\r\n", "DELETED\r\n"},
+		{"delete m2\r\n", "NOT_FOUND\r\n"},
+		{"set n 0 0 2\r\n10\r\n", "STORED\r\n"},
+		{"incr n 5\r\n", "15\r\n"},
+		{"decr n 20\r\n", "0\r\n"},
+		{"incr m1 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		{"incr missing 1\r\n", "NOT_FOUND\r\n"},
+		{"touch m1 100\r\n", "TOUCHED\r\n"},
+		{"touch missing 100\r\n", "NOT_FOUND\r\n"},
+		{"set quiet 0 0 1 noreply\r\nq\r\nget quiet\r\n", "VALUE quiet 0 1\r\nq\r\nEND\r\n"},
+		{"set bad 0 0 1\r\nabc\r\n", "CLIENT_ERROR bad data chunk\r\n"},
+	}
+	for _, tc := range tests {
+		if got := memcachedCommand(t, conn, r, tc.command); got != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.command, tc.expected, got)
+		}
+	}
+
+	// the data block was lost, so the connection was closed
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("Expected the connection closed after a bad data chunk")
+	}
+}
+
+func TestMemcachedCAS(t *testing.T) {
+	InitKeyStore()
+	conn, r := dialTestMemcached(t)
+
+	memcachedCommand(t, conn, r, "set c 0 0 1\r\na\r\n")
+	_, _, version, _ := GetWithMeta("c")
+	if got := memcachedCommand(t, conn, r, "gets c\r\n"); !strings.HasPrefix(got, "VALUE c 0 1 "+strconv.FormatUint(version, 10)+"\r\n") {
+		t.Errorf("Expected gets to report version %d, got %q", version, got)
+	}
+
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{"cas c 3 0 1 " + strconv.FormatUint(version+100, 10) + "\r\nb\r\n", "EXISTS\r\n"},
+		{"cas c 3 0 1 " + strconv.FormatUint(version, 10) + "\r\nb\r\n", "STORED\r\n"},
+		// the unique changed with the write
+		{"cas c 3 0 1 " + strconv.FormatUint(version, 10) + "\r\nc\r\n", "EXISTS\r\n"},
+		{"cas missing 0 0 1 1\r\nb\r\n", "NOT_FOUND\r\n"},
+		{"get c\r\n", "VALUE c 3 1\r\nb\r\nEND\r\n"},
+	}
+	for _, tc := range tests {
+		if got := memcachedCommand(t, conn, r, tc.command); got != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.command, tc.expected, got)
+		}
+	}
+}
+
+func TestMemcachedExptime(t *testing.T) {
+	InitKeyStore()
+	conn, r := dialTestMemcached(t)
+
+	memcachedCommand(t, conn, r, "set rel 0 100 1\r\na\r\n")
+	if expiresAt, _ := GetExpiry("rel"); time.Until(expiresAt) <= 90*time.Second {
+		t.Errorf("Expected rel to expire in 100s, got %s", expiresAt)
+	}
+
+	abs := time.Now().Add(time.Hour).Unix()
+	memcachedCommand(t, conn, r, "set abs 0 "+strconv.FormatInt(abs, 10)+" 1\r\na\r\n")
+	if expiresAt, _ := GetExpiry("abs"); expiresAt.Unix() != abs {
+		t.Errorf("Expected abs to expire at %d, got %d", abs, expiresAt.Unix())
+	}
+
+	// a negative exptime is already expired
+	memcachedCommand(t, conn, r, "set gone 0 -1 1\r\na\r\n")
+	if got := memcachedCommand(t, conn, r, "get gone\r\n"); got != "END\r\n" {
+		t.Errorf("Expected gone expired, got %q", got)
+	}
+
+	// incr keeps the flags and expiry
+	memcachedCommand(t, conn, r, "set count 9 100 1\r\n1\r\n")
+	memcachedCommand(t, conn, r, "incr count 1\r\n")
+	if _, meta, _, _ := GetWithMeta("count"); meta.Flags != 9 {
+		t.Errorf("Expected incr to keep the flags, got %d", meta.Flags)
+	}
+	if expiresAt, _ := GetExpiry("count"); expiresAt.IsZero() {
+		t.Error("Expected incr to keep the expiry")
+	}
+}
+
+func TestMemcachedStoreFull(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionReject, 1, 0)
+	conn, r := dialTestMemcached(t)
+
+	memcachedCommand(t, conn, r, "set full1 0 0 1\r\na\r\n")
+	if got := memcachedCommand(t, conn, r, "set full2 0 0 1\r\na\r\n"); got != "SERVER_ERROR out of memory storing object\r\n" {
+		t.Errorf("Expected out of memory, got %q", got)
+	}
+}
+
+func TestFlagsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	w := openTestWAL(t, dir)
+
+	_, _ = SetIf("snapped", "a", KeyMeta{Flags: 1}, time.Time{}, SetAlways, nil)
+	_ = w.Snapshot()
+	_, _ = SetIf("logged", "a", KeyMeta{Flags: 2}, time.Time{}, SetAlways, nil)
+	// updates without flags keep them
+	_ = Update("logged", "b")
+	keyStoreWAL = nil
+	_ = w.Close()
+
+	InitKeyStore()
+	openTestWAL(t, dir)
+	for key, expected := range map[string]uint32{"snapped": 1, "logged": 2} {
+		if _, meta, _, _ := GetWithMeta(key); meta.Flags != expected {
+			t.Errorf("Expected %s to have flags %d after restart, got %d", key, expected, meta.Flags)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// page size when a cursor is given without a limit
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+var ErrorInvalidPage = errors.New("invalid page")
+
+// KVPage one page of a paginated listing; Next is the cursor for the
+// following page, empty on the last
+type KVPage struct {
+	Items KVList `json:"items"`
+	Next  string `json:"next,omitempty"`
+}
+
+// cursors are the last key of the previous page, opaque to clients
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(key) == 0 {
+		return "", ErrorInvalidPage
+	}
+	return string(key), nil
+}
+
+// parse the limit and cursor query parameters, reporting whether either was
+// given; the key to page after is empty for the first page
+func parsePage(query url.Values) (paged bool, after string, limit int, err error) {
+	if !query.Has("limit") && !query.Has("cursor") {
+		return false, "", 0, nil
+	}
+
+	limit = defaultPageLimit
+	if s := query.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return true, "", 0, ErrorInvalidPage
+		}
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		if after, err = decodeCursor(cursor); err != nil {
+			return true, "", 0, err
+		}
+	}
+	return true, after, limit, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func getPage(t *testing.T, query string) (int, KVPage) {
+	req, err := http.NewRequest("GET", "/keys?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+
+	var page KVPage
+	if rr.Code == http.StatusOK {
+		if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+			t.Fatalf("Unable to decode page: %s", err)
+		}
+	}
+	return rr.Code, page
+}
+
+func TestScanPage(t *testing.T) {
+	InitKeyStore()
+	t.Cleanup(InitKeyStore)
+	for i := 0; i < 5; i++ {
+		_ = Put(fmt.Sprintf("page%d", i), "val")
+	}
+
+	kvs, more := ScanPage("page", "", "", "", 2)
+	if got := scanKeys(kvs); !reflect.DeepEqual(got, []string{"page0", "page1"}) || !more {
+		t.Errorf("Expected first page [page0 page1] with more, got %v, %v", got, more)
+	}
+	kvs, more = ScanPage("page", "", "", "page3", 2)
+	if got := scanKeys(kvs); !reflect.DeepEqual(got, []string{"page4"}) || more {
+		t.Errorf("Expected last page [page4], got %v, %v", got, more)
+	}
+}
+
+func TestPaginationStableUnderWrites(t *testing.T) {
+	InitKeyStore()
+	t.Cleanup(InitKeyStore)
+	keyStore.maxKeys = 0
+	for i := 0; i < 10; i++ {
+		_ = Put(fmt.Sprintf("k%02d", i), "val")
+	}
+
+	seen := []string{}
+	query := "limit=3"
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("Pagination did not terminate")
+		}
+		status, page := getPage(t, query)
+		if status != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", status)
+		}
+		seen = append(seen, scanKeys(page.Items)...)
+		if page.Next == "" {
+			break
+		}
+		query = "limit=3&cursor=" + url.QueryEscape(page.Next)
+
+		// writes between pages, both behind and ahead of the cursor
+		_ = Put(fmt.Sprintf("k%02da", pages), "behind")
+		_ = Delete(fmt.Sprintf("k%02d", 9-pages))
+	}
+
+	// keys written behind the cursor are skipped, keys deleted ahead of it
+	// are never seen, and the rest appear once each, in order
+	expected := []string{"k00", "k01", "k02", "k03", "k04", "k05", "k06", "k07"}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Expected %v, got %v", expected, seen)
+	}
+}
+
+func TestPaginationErrors(t *testing.T) {
+	InitKeyStore()
+	for _, query := range []string{"limit=0", "limit=many", fmt.Sprintf("limit=%d", maxPageLimit+1), "cursor=!!!"} {
+		if status, _ := getPage(t, query); status != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, status)
+		}
+	}
+}
+
+func TestPaginationDefaultLimit(t *testing.T) {
+	InitKeyStore()
+	t.Cleanup(InitKeyStore)
+	keyStore.maxKeys = 0
+	for i := 0; i < defaultPageLimit+1; i++ {
+		_ = Put(fmt.Sprintf("key%03d", i), "val")
+	}
+
+	_, page := getPage(t, "cursor=")
+	if len(page.Items) != defaultPageLimit || page.Next == "" {
+		t.Errorf("Expected a full page of %d with a next cursor, got %d items, next %q", defaultPageLimit, len(page.Items), page.Next)
+	}
+}
@@ -0,0 +1,1195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRaftHeartbeatInterval = 50 * time.Millisecond
+	// followers wait between one and two of these without hearing from a
+	// leader before standing for election
+	defaultRaftElectionTimeout = 500 * time.Millisecond
+	// the most entries sent in one append request
+	raftMaxAppendEntries = 256
+	// how long a member has to take a snapshot the leader sends
+	raftSnapshotTimeout = 30 * time.Second
+	// the applied entries a node without a Dir keeps before compacting them
+	raftMemoryLogEntries = 4096
+
+	raftStateFile = "raft-state.json"
+	raftLogFile   = "raft-log.jsonl"
+)
+
+const RoleCandidate = "candidate"
+
+var ErrorNotLeader = errors.New("not the raft leader")
+
+// raftEntry one entry of the Raft log: a keyStore mutation or, when Entry is
+// nil, the no-op a new leader commits to learn which earlier entries are
+// committed
+type raftEntry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Entry *walEntry `json:"entry,omitempty"`
+	// why Entry deleted its key, for watchers
+	Reason EventType `json:"reason,omitempty"`
+}
+
+type raftVoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type raftVoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type raftAppendRequest struct {
+	Term         uint64      `json:"term"`
+	Leader       string      `json:"leader"`
+	PrevLogIndex uint64      `json:"prevLogIndex"`
+	PrevLogTerm  uint64      `json:"prevLogTerm"`
+	Entries      []raftEntry `json:"entries,omitempty"`
+	LeaderCommit uint64      `json:"leaderCommit"`
+}
+
+type raftAppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// on failure, the index the leader should retry from
+	ConflictIndex uint64 `json:"conflictIndex,omitempty"`
+}
+
+// raftSnapshotRequest the leader's applied state, sent in place of entries it
+// has compacted out of its log
+type raftSnapshotRequest struct {
+	Term   uint64 `json:"term"`
+	Leader string `json:"leader"`
+	// the snapshot holds every entry through LastIndex, and maybe some after
+	LastIndex uint64    `json:"lastIndex"`
+	LastTerm  uint64    `json:"lastTerm"`
+	Snapshot  *snapshot `json:"snapshot"`
+}
+
+type raftSnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// the persisted vote, which must survive a restart so a node never votes
+// twice in a term, and the last entry compacted out of the log
+type raftState struct {
+	Term      uint64 `json:"term"`
+	VotedFor  string `json:"votedFor,omitempty"`
+	SnapIndex uint64 `json:"snapIndex,omitempty"`
+	SnapTerm  uint64 `json:"snapTerm,omitempty"`
+}
+
+// RaftConfig a member of a Raft cluster
+type RaftConfig struct {
+	ID string
+	// every member's base URL, by ID, this node's included
+	Peers map[string]string
+	// where the log and vote are kept; empty keeps them in memory
+	Dir               string
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration
+	// applies each committed mutation, in log order, on every member
+	Apply func(walEntry) error
+	// capture and replace the applied state, for a member that needs
+	// entries compacted out of the leader's log; without them the log is
+	// never compacted
+	Snapshot func() *snapshot
+	Restore  func(*snapshot) error
+}
+
+// RaftNode a member of a Raft cluster. Mutations proposed to the leader are
+// committed once a majority of members have logged them, then applied on
+// every member. A leader that loses touch with a majority steps down, and
+// the others elect a new one.
+type RaftNode struct {
+	cfg            RaftConfig
+	client         *http.Client
+	snapshotClient *http.Client
+
+	mu       sync.Mutex
+	role     string
+	term     uint64
+	votedFor string
+	// log[i] has index snapIndex+i+1; the entries through snapIndex, which
+	// had term snapTerm, have been compacted away
+	log         []raftEntry
+	snapIndex   uint64
+	snapTerm    uint64
+	commitIndex uint64
+	lastApplied uint64
+	leader      string
+	// when a follower stands for election
+	electionDeadline time.Time
+
+	// leader state, per peer
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	lastAck    map[string]time.Time
+	inflight   map[string]bool
+	// when to next try sending a snapshot, after one failed
+	snapshotRetry map[string]time.Time
+	// the leader's no-op; it takes writes once that's applied, when its
+	// keyStore holds every earlier committed entry
+	readyIndex uint64
+	ready      bool
+	// why entries failed to apply, by index, until their proposers return
+	applyErrs map[uint64]error
+
+	// closed and replaced whenever the commit index, applied index or role
+	// change
+	changed chan struct{}
+
+	logFile *os.File
+	done    chan struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// the Raft node this server runs as, if any
+var keyStoreRaft *RaftNode
+
+// NewRaftNode restores the node's log and vote from cfg.Dir; call Start to
+// join the cluster
+func NewRaftNode(cfg RaftConfig) (*RaftNode, error) {
+	if _, ok := cfg.Peers[cfg.ID]; !ok {
+		return nil, fmt.Errorf("raft: %s isn't one of the peers", cfg.ID)
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultRaftHeartbeatInterval
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = defaultRaftElectionTimeout
+	}
+
+	n := &RaftNode{
+		cfg:            cfg,
+		client:         &http.Client{Timeout: cfg.ElectionTimeout},
+		snapshotClient: &http.Client{Timeout: raftSnapshotTimeout},
+		role:           RoleFollower,
+		applyErrs:      make(map[uint64]error),
+		changed:        make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	if cfg.Dir == "" {
+		return n, nil
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(cfg.Dir, raftStateFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var state raftState
+		if err = json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("raft: corrupt %s: %w", raftStateFile, err)
+		}
+		n.term, n.votedFor = state.Term, state.VotedFor
+		// the compacted entries were committed and applied, and the state
+		// they built was saved before they were dropped
+		n.snapIndex, n.snapTerm = state.SnapIndex, state.SnapTerm
+		n.commitIndex, n.lastApplied = n.snapIndex, n.snapIndex
+	}
+	if n.log, err = readRaftLog(filepath.Join(cfg.Dir, raftLogFile), n.snapIndex); err != nil {
+		return nil, err
+	}
+	n.logFile, err = os.OpenFile(filepath.Join(cfg.Dir, raftLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	logInfof("Raft: %s restored %d log entries after index %d at term %d", cfg.ID, len(n.log), n.snapIndex, n.term)
+	return n, nil
+}
+
+// read the log at path from the entry after index after; a torn final line
+// is ignored, as in the WAL
+func readRaftLog(path string, after uint64) ([]raftEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var log []raftEntry
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				logWarnf("Raft: ignoring incomplete trailing entry in %s", path)
+			}
+			return log, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e raftEntry
+		if err = json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("raft: corrupt entry in %s: %w", path, err)
+		}
+		if e.Index <= after {
+			// compacted, but the log was left whole by a crash
+			continue
+		}
+		if e.Index != after+uint64(len(log))+1 {
+			return nil, fmt.Errorf("raft: entry %d out of order in %s", e.Index, path)
+		}
+		log = append(log, e)
+	}
+}
+
+// persist the term and vote before acting on them
+func (n *RaftNode) saveStateLocked() error {
+	if n.cfg.Dir == "" || n.stopped {
+		return nil
+	}
+	data, err := json.Marshal(raftState{Term: n.term, VotedFor: n.votedFor, SnapIndex: n.snapIndex, SnapTerm: n.snapTerm})
+	if err == nil {
+		path := filepath.Join(n.cfg.Dir, raftStateFile)
+		if err = os.WriteFile(path+".tmp", data, 0o644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err == nil {
+		err = syncDir(n.cfg.Dir)
+	}
+	if err != nil {
+		logErrorf("Raft: unable to save state: %s", err)
+	}
+	return err
+}
+
+// persist entries appended to the log
+func (n *RaftNode) saveEntriesLocked(entries []raftEntry) error {
+	if n.cfg.Dir == "" || n.stopped {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if _, err := n.logFile.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return n.logFile.Sync()
+}
+
+// drop the entries from index on, rewriting the persisted log
+func (n *RaftNode) truncateLogLocked(index uint64) error {
+	n.log = n.log[:index-n.snapIndex-1]
+	return n.rewriteLogLocked()
+}
+
+// drop the entries through index, which has been applied; the state is
+// saved first, so a crash before the log is rewritten leaves the dropped
+// entries to be skipped
+func (n *RaftNode) compactLocked(index uint64) error {
+	if index <= n.snapIndex {
+		return nil
+	}
+	n.snapTerm = n.termAtLocked(index)
+	n.log = append([]raftEntry(nil), n.log[index-n.snapIndex:]...)
+	n.snapIndex = index
+	if err := n.saveStateLocked(); err != nil {
+		return err
+	}
+	return n.rewriteLogLocked()
+}
+
+// replace the persisted log with the entries in memory
+func (n *RaftNode) rewriteLogLocked() error {
+	if n.cfg.Dir == "" || n.stopped {
+		return nil
+	}
+	path := filepath.Join(n.cfg.Dir, raftLogFile)
+	_ = n.logFile.Close()
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	n.logFile = f
+	if err = n.saveEntriesLocked(n.log); err != nil {
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(n.cfg.Dir)
+}
+
+func (n *RaftNode) lastIndexLocked() uint64 {
+	return n.snapIndex + uint64(len(n.log))
+}
+
+// the term of the entry at index; 0 before the first, or if it's been
+// compacted away
+func (n *RaftNode) termAtLocked(index uint64) uint64 {
+	if index == n.snapIndex {
+		return n.snapTerm
+	}
+	if index < n.snapIndex || index > n.lastIndexLocked() {
+		return 0
+	}
+	return n.log[index-n.snapIndex-1].Term
+}
+
+// the entries from index from through index to, none of them compacted
+func (n *RaftNode) entriesLocked(from uint64, to uint64) []raftEntry {
+	return n.log[from-n.snapIndex-1 : to-n.snapIndex]
+}
+
+// Compact drop the applied entries a snapshot at revision holds from the log,
+// so restarts needn't replay them; members that need them are sent a
+// snapshot instead
+func (n *RaftNode) Compact(revision uint64) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped || n.cfg.Snapshot == nil {
+		return nil
+	}
+	index := n.snapIndex
+	for _, e := range n.entriesLocked(n.snapIndex+1, n.lastApplied) {
+		if e.Entry != nil && e.Entry.Revision > revision {
+			break
+		}
+		index = e.Index
+	}
+	if err := n.compactLocked(index); err != nil {
+		return err
+	}
+	logInfof("Raft: %s compacted its log through index %d", n.cfg.ID, n.snapIndex)
+	return nil
+}
+
+func (n *RaftNode) majority() int {
+	return len(n.cfg.Peers)/2 + 1
+}
+
+// wake everything waiting on a change
+func (n *RaftNode) notifyLocked() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *RaftNode) resetElectionDeadlineLocked() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// Start take part in the cluster until Shutdown
+func (n *RaftNode) Start() {
+	n.mu.Lock()
+	n.resetElectionDeadlineLocked()
+	n.mu.Unlock()
+
+	n.wg.Add(2)
+	go n.tickLoop()
+	go n.applyLoop()
+}
+
+// Shutdown leave the cluster, waiting until ctx is done for requests to
+// peers to finish
+func (n *RaftNode) Shutdown(ctx context.Context) error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil
+	}
+	n.stopped = true
+	n.role = RoleFollower
+	n.ready = false
+	close(n.done)
+	n.notifyLocked()
+	n.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(finished)
+	}()
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		err = errDrainTimeout
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.logFile != nil {
+		if closeErr := n.logFile.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (n *RaftNode) tickLoop() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.done:
+			return
+		}
+
+		n.mu.Lock()
+		switch {
+		case n.role == RoleLeader && !n.hasQuorumLocked():
+			logWarnf("Raft: %s lost touch with a majority; stepping down", n.cfg.ID)
+			n.becomeFollowerLocked(n.term)
+			n.resetElectionDeadlineLocked()
+		case n.role == RoleLeader:
+			n.broadcastLocked()
+		case time.Now().After(n.electionDeadline):
+			n.startElectionLocked()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// whether the leader has heard from a majority within an election timeout
+func (n *RaftNode) hasQuorumLocked() bool {
+	count := 1
+	for id := range n.cfg.Peers {
+		if id != n.cfg.ID && time.Since(n.lastAck[id]) < n.cfg.ElectionTimeout {
+			count++
+		}
+	}
+	return count >= n.majority()
+}
+
+// stand for election in the next term
+func (n *RaftNode) startElectionLocked() {
+	n.term++
+	n.role = RoleCandidate
+	n.votedFor = n.cfg.ID
+	n.leader = ""
+	n.saveStateLocked()
+	n.resetElectionDeadlineLocked()
+	n.notifyLocked()
+	logInfof("Raft: %s standing for election in term %d", n.cfg.ID, n.term)
+
+	req := raftVoteRequest{Term: n.term, Candidate: n.cfg.ID, LastLogIndex: n.lastIndexLocked(), LastLogTerm: n.termAtLocked(n.lastIndexLocked())}
+	votes := 1
+	if votes >= n.majority() {
+		n.becomeLeaderLocked()
+		return
+	}
+	for id := range n.cfg.Peers {
+		if id == n.cfg.ID {
+			continue
+		}
+		n.wg.Add(1)
+		go func(id string) {
+			defer n.wg.Done()
+			var resp raftVoteResponse
+			if err := n.call(n.client, id, "/raft/vote", req, &resp); err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollowerLocked(resp.Term)
+				return
+			}
+			if n.role != RoleCandidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			if votes++; votes >= n.majority() {
+				n.becomeLeaderLocked()
+			}
+		}(id)
+	}
+}
+
+// follow whoever leads term, forgetting the vote of an earlier term
+func (n *RaftNode) becomeFollowerLocked(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.saveStateLocked()
+	}
+	if n.role == RoleLeader {
+		n.leader = ""
+	}
+	n.role = RoleFollower
+	n.ready = false
+	n.notifyLocked()
+}
+
+func (n *RaftNode) becomeLeaderLocked() {
+	if n.stopped {
+		return
+	}
+	n.role = RoleLeader
+	n.leader = n.cfg.ID
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.lastAck = make(map[string]time.Time)
+	n.inflight = make(map[string]bool)
+	n.snapshotRetry = make(map[string]time.Time)
+	for id := range n.cfg.Peers {
+		n.nextIndex[id] = n.lastIndexLocked() + 1
+		// a grace period before the first quorum check
+		n.lastAck[id] = time.Now()
+	}
+
+	noop := raftEntry{Index: n.lastIndexLocked() + 1, Term: n.term}
+	n.log = append(n.log, noop)
+	if err := n.saveEntriesLocked([]raftEntry{noop}); err != nil {
+		logErrorf("Raft: unable to save log: %s", err)
+	}
+	n.readyIndex = noop.Index
+	n.ready = false
+	logInfof("Raft: %s elected leader for term %d", n.cfg.ID, n.term)
+
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+	n.notifyLocked()
+}
+
+// send each peer the entries it's missing, or a heartbeat
+func (n *RaftNode) broadcastLocked() {
+	for id := range n.cfg.Peers {
+		if id == n.cfg.ID || n.inflight[id] {
+			continue
+		}
+		n.inflight[id] = true
+		n.wg.Add(1)
+		go n.replicateTo(id)
+	}
+}
+
+// append to the peer until it has the leader's whole log
+func (n *RaftNode) replicateTo(id string) {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		if n.role != RoleLeader {
+			n.inflight[id] = false
+			n.mu.Unlock()
+			return
+		}
+		next := n.nextIndex[id]
+		if next <= n.snapIndex && time.Now().Before(n.snapshotRetry[id]) {
+			// rather than capture another for a peer that's likely down
+			n.inflight[id] = false
+			n.mu.Unlock()
+			return
+		}
+		if next <= n.snapIndex {
+			req := raftSnapshotRequest{Term: n.term, Leader: n.cfg.ID, LastIndex: n.lastApplied, LastTerm: n.termAtLocked(n.lastApplied)}
+			n.mu.Unlock()
+			if !n.sendSnapshot(id, req) {
+				return
+			}
+			continue
+		}
+		end := n.lastIndexLocked()
+		if end-next+1 > raftMaxAppendEntries {
+			end = next + raftMaxAppendEntries - 1
+		}
+		req := raftAppendRequest{
+			Term: n.term, Leader: n.cfg.ID, PrevLogIndex: next - 1, PrevLogTerm: n.termAtLocked(next - 1),
+			Entries: append([]raftEntry(nil), n.entriesLocked(next, end)...), LeaderCommit: n.commitIndex,
+		}
+		n.mu.Unlock()
+
+		var resp raftAppendResponse
+		err := n.call(n.client, id, "/raft/append", req, &resp)
+
+		n.mu.Lock()
+		behind := false
+		switch {
+		case err != nil:
+		case resp.Term > n.term:
+			n.becomeFollowerLocked(resp.Term)
+		case n.role != RoleLeader || n.term != req.Term:
+		case resp.Success:
+			n.lastAck[id] = time.Now()
+			if match := req.PrevLogIndex + uint64(len(req.Entries)); match > n.matchIndex[id] {
+				n.matchIndex[id] = match
+			}
+			n.nextIndex[id] = n.matchIndex[id] + 1
+			n.advanceCommitLocked()
+			behind = n.nextIndex[id] <= n.lastIndexLocked()
+		default:
+			n.lastAck[id] = time.Now()
+			next = req.PrevLogIndex
+			if resp.ConflictIndex > 0 && resp.ConflictIndex < next {
+				next = resp.ConflictIndex
+			}
+			n.nextIndex[id] = max(next, 1)
+			behind = true
+		}
+		if !behind {
+			n.inflight[id] = false
+		}
+		n.mu.Unlock()
+		if !behind {
+			return
+		}
+	}
+}
+
+// send the peer the leader's state in place of the compacted entries it's
+// missing, returning whether it's still behind. The snapshot is captured
+// after req.LastIndex was applied, so it may hold later entries too, which
+// the peer skips when they're sent.
+func (n *RaftNode) sendSnapshot(id string, req raftSnapshotRequest) bool {
+	req.Snapshot = n.cfg.Snapshot()
+	var resp raftSnapshotResponse
+	err := n.call(n.snapshotClient, id, "/raft/snapshot", req, &resp)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	behind := false
+	switch {
+	case err != nil:
+		logWarnf("Raft: unable to send %s a snapshot: %s", id, err)
+		n.snapshotRetry[id] = time.Now().Add(n.cfg.ElectionTimeout)
+	case resp.Term > n.term:
+		n.becomeFollowerLocked(resp.Term)
+	case n.role != RoleLeader || n.term != req.Term:
+	default:
+		n.lastAck[id] = time.Now()
+		n.matchIndex[id] = max(n.matchIndex[id], req.LastIndex)
+		n.nextIndex[id] = n.matchIndex[id] + 1
+		n.advanceCommitLocked()
+		behind = n.nextIndex[id] <= n.lastIndexLocked()
+	}
+	if !behind {
+		n.inflight[id] = false
+	}
+	return behind
+}
+
+// commit the latest entry of the current term a majority has logged, and
+// every entry before it
+func (n *RaftNode) advanceCommitLocked() {
+	for index := n.lastIndexLocked(); index > n.commitIndex; index-- {
+		if n.termAtLocked(index) != n.term {
+			// earlier terms' entries are only committed by a later one
+			return
+		}
+		count := 1
+		for id, match := range n.matchIndex {
+			if id != n.cfg.ID && match >= index {
+				count++
+			}
+		}
+		if count >= n.majority() {
+			n.commitIndex = index
+			n.notifyLocked()
+			return
+		}
+	}
+}
+
+// apply committed entries in order
+func (n *RaftNode) applyLoop() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for n.lastApplied >= n.commitIndex {
+			changed := n.changed
+			n.mu.Unlock()
+			select {
+			case <-changed:
+			case <-n.done:
+				return
+			}
+			n.mu.Lock()
+		}
+		entries := append([]raftEntry(nil), n.entriesLocked(n.lastApplied+1, n.commitIndex)...)
+		n.mu.Unlock()
+
+		for _, e := range entries {
+			var err error
+			if e.Entry != nil {
+				entry := *e.Entry
+				entry.reason = e.Reason
+				if err = n.cfg.Apply(entry); err != nil {
+					logErrorf("Raft: unable to apply entry %d: %s", e.Index, err)
+				}
+			}
+
+			n.mu.Lock()
+			// unless a snapshot the leader sent has overtaken it
+			n.lastApplied = max(n.lastApplied, e.Index)
+			if err != nil && n.role == RoleLeader && e.Term == n.term {
+				n.applyErrs[e.Index] = err
+			}
+			if n.cfg.Dir == "" && n.cfg.Snapshot != nil && n.lastApplied-n.snapIndex >= raftMemoryLogEntries {
+				// nothing survives a restart, so there's no saved state to wait for
+				_ = n.compactLocked(n.lastApplied)
+			}
+			if n.role == RoleLeader && !n.ready && n.lastApplied >= n.readyIndex {
+				n.ready = true
+				logInfof("Raft: %s ready for writes", n.cfg.ID)
+			}
+			n.notifyLocked()
+			n.mu.Unlock()
+		}
+	}
+}
+
+// Propose commit a mutation through the log, returning once a majority has
+// logged it and this node has applied it. ErrorNotLeader unless this node
+// leads and has applied every earlier entry, or if it stops leading before
+// the mutation is applied, in which case a later leader may still commit it.
+func (n *RaftNode) Propose(entry walEntry) error {
+	n.mu.Lock()
+	if n.role != RoleLeader || !n.ready {
+		n.mu.Unlock()
+		return ErrorNotLeader
+	}
+	e := raftEntry{Index: n.lastIndexLocked() + 1, Term: n.term, Entry: &entry, Reason: entry.reason}
+	n.log = append(n.log, e)
+	if err := n.saveEntriesLocked([]raftEntry{e}); err != nil {
+		n.log = n.log[:len(n.log)-1]
+		n.mu.Unlock()
+		return err
+	}
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+
+	for {
+		// a leader never replaces its own entries
+		leading := n.role == RoleLeader && n.term == e.Term
+		if n.lastApplied >= e.Index && (leading || n.termAtLocked(e.Index) == e.Term) {
+			err := n.applyErrs[e.Index]
+			delete(n.applyErrs, e.Index)
+			n.mu.Unlock()
+			return err
+		}
+		if !leading {
+			n.mu.Unlock()
+			return fmt.Errorf("%w: leadership lost before the write was applied", ErrorNotLeader)
+		}
+		changed := n.changed
+		n.mu.Unlock()
+		<-changed
+		n.mu.Lock()
+	}
+}
+
+// IsLeader whether this node leads the cluster
+func (n *RaftNode) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == RoleLeader
+}
+
+// LeaderURL the base URL of the leader, if one is known
+func (n *RaftNode) LeaderURL() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.cfg.Peers[n.leader]
+}
+
+// post req to the peer's path with client, decoding its response into resp
+func (n *RaftNode) call(client *http.Client, id string, path string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-n.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(n.cfg.Peers[id], "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft: %s responded %s", id, httpResp.Status)
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+func (n *RaftNode) handleVote(req raftVoteRequest) raftVoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term || n.stopped {
+		return raftVoteResponse{Term: n.term}
+	}
+	if req.Term > n.term {
+		n.becomeFollowerLocked(req.Term)
+	}
+	lastIndex := n.lastIndexLocked()
+	lastTerm := n.termAtLocked(lastIndex)
+	upToDate := req.LastLogTerm > lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex >= lastIndex)
+	if (n.votedFor != "" && n.votedFor != req.Candidate) || !upToDate {
+		return raftVoteResponse{Term: n.term}
+	}
+	n.votedFor = req.Candidate
+	n.saveStateLocked()
+	n.resetElectionDeadlineLocked()
+	return raftVoteResponse{Term: n.term, Granted: true}
+}
+
+func (n *RaftNode) handleAppend(req raftAppendRequest) (raftAppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term || n.stopped {
+		return raftAppendResponse{Term: n.term}, nil
+	}
+	if req.Term > n.term || n.role != RoleFollower {
+		n.becomeFollowerLocked(req.Term)
+	}
+	n.leader = req.Leader
+	n.resetElectionDeadlineLocked()
+
+	lastIndex := n.lastIndexLocked()
+	if req.PrevLogIndex > lastIndex {
+		return raftAppendResponse{Term: n.term, ConflictIndex: lastIndex + 1}, nil
+	}
+	if req.PrevLogIndex < n.snapIndex {
+		// the compacted entries were committed, so they match the leader's
+		skip := min(n.snapIndex-req.PrevLogIndex, uint64(len(req.Entries)))
+		req.Entries = req.Entries[skip:]
+		req.PrevLogIndex, req.PrevLogTerm = n.snapIndex, n.snapTerm
+	}
+	if term := n.termAtLocked(req.PrevLogIndex); term != req.PrevLogTerm {
+		// skip back over the whole conflicting term
+		conflict := req.PrevLogIndex
+		for conflict > n.snapIndex+1 && n.termAtLocked(conflict-1) == term {
+			conflict--
+		}
+		return raftAppendResponse{Term: n.term, ConflictIndex: conflict}, nil
+	}
+
+	for i, e := range req.Entries {
+		if e.Index <= n.lastIndexLocked() {
+			if n.termAtLocked(e.Index) == e.Term {
+				continue
+			}
+			if e.Index <= n.commitIndex {
+				return raftAppendResponse{Term: n.term}, fmt.Errorf("raft: leader %s conflicts with committed entry %d", req.Leader, e.Index)
+			}
+			if err := n.truncateLogLocked(e.Index); err != nil {
+				return raftAppendResponse{Term: n.term}, err
+			}
+		}
+		n.log = append(n.log, req.Entries[i:]...)
+		if err := n.saveEntriesLocked(req.Entries[i:]); err != nil {
+			n.log = n.log[:e.Index-n.snapIndex-1]
+			return raftAppendResponse{Term: n.term}, err
+		}
+		break
+	}
+
+	if last := req.PrevLogIndex + uint64(len(req.Entries)); req.LeaderCommit > n.commitIndex && last > n.commitIndex {
+		n.commitIndex = min(req.LeaderCommit, last)
+		n.notifyLocked()
+	}
+	return raftAppendResponse{Term: n.term, Success: true}, nil
+}
+
+// replace the applied state with the leader's snapshot, and the log through
+// its last index
+func (n *RaftNode) handleSnapshot(req raftSnapshotRequest) (raftSnapshotResponse, error) {
+	n.mu.Lock()
+	if req.Term < n.term || n.stopped {
+		defer n.mu.Unlock()
+		return raftSnapshotResponse{Term: n.term}, nil
+	}
+	if req.Term > n.term || n.role != RoleFollower {
+		n.becomeFollowerLocked(req.Term)
+	}
+	n.leader = req.Leader
+	n.resetElectionDeadlineLocked()
+	if req.LastIndex <= n.commitIndex {
+		// it has the entries already
+		defer n.mu.Unlock()
+		return raftSnapshotResponse{Term: n.term}, nil
+	}
+	n.mu.Unlock()
+	if req.Snapshot == nil || n.cfg.Restore == nil {
+		return raftSnapshotResponse{Term: req.Term}, fmt.Errorf("raft: unable to take a snapshot from %s", req.Leader)
+	}
+
+	// entries still being applied are already in the snapshot, and skipped
+	if err := n.cfg.Restore(req.Snapshot); err != nil {
+		return raftSnapshotResponse{Term: req.Term}, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.LastIndex <= n.snapIndex {
+		return raftSnapshotResponse{Term: n.term}, nil
+	}
+	if req.LastIndex < n.lastIndexLocked() && n.termAtLocked(req.LastIndex) == req.LastTerm {
+		// keep the entries after it, which may be the leader's too
+		n.log = append([]raftEntry(nil), n.log[req.LastIndex-n.snapIndex:]...)
+	} else {
+		n.log = nil
+	}
+	n.snapIndex, n.snapTerm = req.LastIndex, req.LastTerm
+	n.commitIndex = max(n.commitIndex, req.LastIndex)
+	n.lastApplied = max(n.lastApplied, req.LastIndex)
+	n.notifyLocked()
+	logInfof("Raft: %s installed a snapshot through index %d", n.cfg.ID, req.LastIndex)
+	if err := n.saveStateLocked(); err != nil {
+		return raftSnapshotResponse{Term: n.term}, err
+	}
+	return raftSnapshotResponse{Term: n.term}, n.rewriteLogLocked()
+}
+
+// RaftPeerStatus a member as the leader sees it
+type RaftPeerStatus struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// the last index the leader knows the member has logged
+	MatchIndex  uint64     `json:"matchIndex"`
+	LastContact *time.Time `json:"lastContact,omitempty"`
+}
+
+// RaftStatus a node's view of the cluster
+type RaftStatus struct {
+	ID          string `json:"id"`
+	Role        string `json:"role"`
+	Term        uint64 `json:"term"`
+	Leader      string `json:"leader,omitempty"`
+	LeaderURL   string `json:"leaderUrl,omitempty"`
+	LastIndex   uint64 `json:"lastIndex"`
+	CommitIndex uint64 `json:"commitIndex"`
+	LastApplied uint64 `json:"lastApplied"`
+	// the last entry compacted out of the log
+	SnapshotIndex uint64 `json:"snapshotIndex,omitempty"`
+	// whether a leader is taking writes
+	Ready bool `json:"ready"`
+	// the members, on the leader
+	Peers []RaftPeerStatus `json:"peers,omitempty"`
+}
+
+// Status the node's view of the cluster
+func (n *RaftNode) Status() RaftStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	s := RaftStatus{
+		ID: n.cfg.ID, Role: n.role, Term: n.term, Leader: n.leader, LeaderURL: n.cfg.Peers[n.leader],
+		LastIndex: n.lastIndexLocked(), CommitIndex: n.commitIndex, LastApplied: n.lastApplied, Ready: n.ready,
+		SnapshotIndex: n.snapIndex,
+	}
+	if n.role == RoleLeader {
+		for id, url := range n.cfg.Peers {
+			peer := RaftPeerStatus{ID: id, URL: url, MatchIndex: n.matchIndex[id]}
+			if id == n.cfg.ID {
+				peer.MatchIndex = n.lastIndexLocked()
+			} else if lastAck := n.lastAck[id]; !lastAck.IsZero() {
+				peer.LastContact = &lastAck
+			}
+			s.Peers = append(s.Peers, peer)
+		}
+		sort.Slice(s.Peers, func(i, j int) bool { return s.Peers[i].ID < s.Peers[j].ID })
+	}
+	return s
+}
+
+// Handler serves the requests peers send this node, and its status
+func (n *RaftNode) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /raft/vote", func(w http.ResponseWriter, r *http.Request) {
+		var req raftVoteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeRaftJSON(w, n.handleVote(req))
+	})
+	mux.HandleFunc("POST /raft/append", func(w http.ResponseWriter, r *http.Request) {
+		var req raftAppendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := n.handleAppend(req)
+		if err != nil {
+			logErrorf("Raft: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeRaftJSON(w, resp)
+	})
+	mux.HandleFunc("POST /raft/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		var req raftSnapshotRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := n.handleSnapshot(req)
+		if err != nil {
+			logErrorf("Raft: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeRaftJSON(w, resp)
+	})
+	mux.HandleFunc("GET /raft/status", func(w http.ResponseWriter, r *http.Request) {
+		writeRaftJSON(w, n.Status())
+	})
+	return mux
+}
+
+func writeRaftJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logErrorf("raftHandler - Error %s", err)
+	}
+}
+
+// ParsePeers parse a list of cluster members such as
+// "n1=http://10.0.0.1:8000,n2=http://10.0.0.2:8000"
+func ParsePeers(s string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, member := range strings.Split(s, ",") {
+		id, peerURL, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || id == "" || peerURL == "" {
+			return nil, fmt.Errorf("expected id=url, got %q", member)
+		}
+		if _, dup := peers[id]; dup {
+			return nil, fmt.Errorf("duplicate member %q", id)
+		}
+		if err := checkPeer(id, peerURL); err != nil {
+			return nil, err
+		}
+		peers[id] = peerURL
+	}
+	return peers, nil
+}
+
+// check a member has an ID and an http or https base URL
+func checkPeer(id string, peerURL string) error {
+	if id == "" {
+		return fmt.Errorf("member %q: expected an ID", peerURL)
+	}
+	if u, err := neturl.Parse(peerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("member %s: expected an http or https URL, got %q", id, peerURL)
+	}
+	return nil
+}
+
+// the header marking a write a follower forwarded to its leader, which
+// handles it rather than forwarding it again
+const raftForwardedHeader = "X-Raft-Forwarded"
+
+// start this server's Raft node, with its log beside the WAL, if any
+func startRaft(cfg Config) error {
+	peers, err := ParsePeers(cfg.RaftPeers)
+	if err != nil {
+		return err
+	}
+	dir := ""
+	if cfg.DataDir != "" {
+		dir = filepath.Join(cfg.DataDir, "raft")
+	}
+	n, err := NewRaftNode(RaftConfig{ID: cfg.RaftID, Peers: peers, Dir: dir, Apply: applyReplicated,
+		Snapshot: raftSnapshot, Restore: installSnapshot})
+	if err != nil {
+		return err
+	}
+	keyStoreRaft = n
+	n.Start()
+	return nil
+}
+
+// RaftHandlerFunc /raft/: requests between cluster members, and GET
+// /raft/status
+func RaftHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	if keyStoreRaft == nil {
+		http.NotFound(w, r)
+		return
+	}
+	keyStoreRaft.Handler().ServeHTTP(w, r)
+}
+
+// raftForward proxy writes a Raft follower receives to its leader; reads are
+// served from the follower's own, possibly stale, keyStore
+func raftForward(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := keyStoreRaft
+		if n == nil || r.Method == http.MethodGet || r.Method == http.MethodHead ||
+			strings.HasPrefix(r.URL.Path, "/raft/") || r.Header.Get(raftForwardedHeader) != "" || n.IsLeader() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		leader := n.LeaderURL()
+		if leader == "" {
+			http.Error(w, ErrorNotLeader.Error()+": no leader elected", http.StatusServiceUnavailable)
+			return
+		}
+		target, err := neturl.Parse(leader)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			logWarnf("Raft: unable to forward %s %s to %s: %s", r.Method, r.URL.Path, leader, err)
+			http.Error(w, ErrorNotLeader.Error()+": leader unreachable", http.StatusServiceUnavailable)
+		}
+		r.Header.Set(raftForwardedHeader, n.cfg.ID)
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// the keyStore, for a Raft member too far behind for the leader's log
+func raftSnapshot() *snapshot {
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+	return captureSnapshot(0)
+}
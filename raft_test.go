@@ -0,0 +1,566 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testRaftHeartbeat = 10 * time.Millisecond
+	testRaftElection  = 100 * time.Millisecond
+)
+
+// the mutations a test node has applied
+type testRaftFSM struct {
+	sync.Mutex
+	applied []walEntry
+	// the latest revision applied; entries with a revision no later are
+	// already in a snapshot, and skipped
+	revision uint64
+	// applies them too, if set
+	next func(walEntry) error
+}
+
+func (f *testRaftFSM) apply(entry walEntry) error {
+	f.Lock()
+	defer f.Unlock()
+	if entry.Revision != 0 && entry.Revision <= f.revision {
+		return nil
+	}
+	f.revision = max(f.revision, entry.Revision)
+	f.applied = append(f.applied, entry)
+	if f.next != nil {
+		return f.next(entry)
+	}
+	return nil
+}
+
+func (f *testRaftFSM) snapshot() *snapshot {
+	f.Lock()
+	defer f.Unlock()
+	snap := &snapshot{Revision: f.revision}
+	for _, e := range f.applied {
+		snap.Entries = append(snap.Entries, snapshotEntry{Key: e.Key, Value: e.Value, Version: e.Revision})
+	}
+	return snap
+}
+
+func (f *testRaftFSM) restore(snap *snapshot) error {
+	f.Lock()
+	defer f.Unlock()
+	f.applied = nil
+	for _, e := range snap.Entries {
+		f.applied = append(f.applied, walEntry{Op: walOpPut, Key: e.Key, Value: e.Value, Revision: e.Version})
+	}
+	f.revision = snap.Revision
+	return nil
+}
+
+func (f *testRaftFSM) keys() []string {
+	f.Lock()
+	defer f.Unlock()
+	var keys []string
+	for _, e := range f.applied {
+		keys = append(keys, e.Key)
+	}
+	return keys
+}
+
+type testRaftMember struct {
+	node *RaftNode
+	fsm  *testRaftFSM
+	srv  *httptest.Server
+	// cut off from the other members while set
+	partitioned atomic.Bool
+}
+
+func (m *testRaftMember) RoundTrip(r *http.Request) (*http.Response, error) {
+	if m.partitioned.Load() {
+		return nil, errors.New("partitioned")
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// stop the member's node and its server, as though it crashed
+func (m *testRaftMember) stop() {
+	_ = m.node.Shutdown(context.Background())
+	m.srv.Close()
+}
+
+// an in-process cluster of nodes on localhost ports; handlers, if given,
+// serve a member's requests other than those to its node
+func startTestRaftCluster(t *testing.T, ids []string, dir string, handlers map[string]http.Handler) map[string]*testRaftMember {
+	members := make(map[string]*testRaftMember)
+	peers := make(map[string]string)
+	for _, id := range ids {
+		m := &testRaftMember{fsm: &testRaftFSM{}}
+		// started once every member's URL is known
+		m.srv = httptest.NewUnstartedServer(nil)
+		peers[id] = "http://" + m.srv.Listener.Addr().String()
+		members[id] = m
+	}
+	for _, id := range ids {
+		m := members[id]
+		cfg := RaftConfig{ID: id, Peers: peers, HeartbeatInterval: testRaftHeartbeat, ElectionTimeout: testRaftElection,
+			Apply: m.fsm.apply, Snapshot: m.fsm.snapshot, Restore: m.fsm.restore}
+		if dir != "" {
+			cfg.Dir = dir + "/" + id
+		}
+		node, err := NewRaftNode(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.node = node
+		node.client.Transport, node.snapshotClient.Transport = m, m
+		mux := http.NewServeMux()
+		raft := node.Handler()
+		mux.HandleFunc("/raft/", func(w http.ResponseWriter, r *http.Request) {
+			if m.partitioned.Load() {
+				http.Error(w, "partitioned", http.StatusServiceUnavailable)
+				return
+			}
+			raft.ServeHTTP(w, r)
+		})
+		if h := handlers[id]; h != nil {
+			mux.Handle("/", h)
+		}
+		m.srv.Config.Handler = mux
+		m.srv.Start()
+		t.Cleanup(m.stop)
+	}
+	for _, m := range members {
+		m.node.Start()
+	}
+	return members
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// wait until exactly one of the running members leads, and is taking writes
+func waitForRaftLeader(t *testing.T, members map[string]*testRaftMember) *testRaftMember {
+	t.Helper()
+	var leader *testRaftMember
+	waitFor(t, "a leader", func() bool {
+		leader = nil
+		for _, m := range members {
+			if s := m.node.Status(); s.Role == RoleLeader && s.Ready {
+				if leader != nil {
+					return false
+				}
+				leader = m
+			}
+		}
+		return leader != nil
+	})
+	return leader
+}
+
+func TestRaftElectsLeader(t *testing.T) {
+	members := startTestRaftCluster(t, []string{"a", "b", "c"}, "", nil)
+	leader := waitForRaftLeader(t, members)
+
+	waitFor(t, "the followers to learn the leader", func() bool {
+		for _, m := range members {
+			if m.node.LeaderURL() != leader.srv.URL {
+				return false
+			}
+		}
+		return true
+	})
+	s := leader.node.Status()
+	if len(s.Peers) != 3 || s.CommitIndex == 0 {
+		t.Errorf("Expected the leader to report 3 members and its no-op committed, got %+v", s)
+	}
+	for id, m := range members {
+		if m != leader && m.node.IsLeader() {
+			t.Errorf("Expected %s to follow", id)
+		}
+	}
+}
+
+func TestRaftReplicatesInOrder(t *testing.T) {
+	members := startTestRaftCluster(t, []string{"a", "b", "c"}, "", nil)
+	leader := waitForRaftLeader(t, members)
+
+	var expected []string
+	for i := 1; i <= 20; i++ {
+		key := "k" + strconv.Itoa(i)
+		if err := leader.node.Propose(walEntry{Op: walOpPut, Key: key, Value: "v", Revision: uint64(i)}); err != nil {
+			t.Fatalf("Expected %s committed, got %v", key, err)
+		}
+		expected = append(expected, key)
+	}
+	for id, m := range members {
+		waitFor(t, id+" to apply every entry", func() bool { return len(m.fsm.keys()) == len(expected) })
+		if got := strings.Join(m.fsm.keys(), ","); got != strings.Join(expected, ",") {
+			t.Errorf("%s: expected %v applied, got %s", id, expected, got)
+		}
+	}
+
+	for id, m := range members {
+		if m != leader {
+			if err := m.node.Propose(walEntry{Op: walOpPut, Key: "x"}); !errors.Is(err, ErrorNotLeader) {
+				t.Errorf("%s: expected ErrorNotLeader proposing to a follower, got %v", id, err)
+			}
+		}
+	}
+}
+
+func TestRaftFailover(t *testing.T) {
+	members := startTestRaftCluster(t, []string{"a", "b", "c"}, "", nil)
+	old := waitForRaftLeader(t, members)
+	if err := old.node.Propose(walEntry{Op: walOpPut, Key: "before"}); err != nil {
+		t.Fatal(err)
+	}
+
+	old.stop()
+	running := make(map[string]*testRaftMember)
+	for id, m := range members {
+		if m != old {
+			running[id] = m
+		}
+	}
+	leader := waitForRaftLeader(t, running)
+	if err := leader.node.Propose(walEntry{Op: walOpPut, Key: "after"}); err != nil {
+		t.Fatalf("Expected the new leader to commit, got %v", err)
+	}
+	for id, m := range running {
+		waitFor(t, id+" to apply both entries", func() bool { return len(m.fsm.keys()) == 2 })
+		if got := m.fsm.keys(); got[0] != "before" || got[1] != "after" {
+			t.Errorf("%s: expected the entries from both leaders, got %v", id, got)
+		}
+	}
+}
+
+func TestRaftMinorityCannotCommit(t *testing.T) {
+	members := startTestRaftCluster(t, []string{"a", "b", "c"}, "", nil)
+	leader := waitForRaftLeader(t, members)
+	for _, m := range members {
+		if m != leader {
+			m.stop()
+		}
+	}
+
+	if err := leader.node.Propose(walEntry{Op: walOpPut, Key: "lost"}); !errors.Is(err, ErrorNotLeader) {
+		t.Errorf("Expected ErrorNotLeader without a quorum, got %v", err)
+	}
+	if s := leader.node.Status(); s.Role == RoleLeader || s.CommitIndex >= s.LastIndex {
+		t.Errorf("Expected the isolated leader to step down with the entry uncommitted, got %+v", s)
+	}
+	if keys := leader.fsm.keys(); len(keys) != 0 {
+		t.Errorf("Expected nothing applied, got %v", keys)
+	}
+}
+
+func TestRaftRestoresLog(t *testing.T) {
+	dir := t.TempDir()
+	members := startTestRaftCluster(t, []string{"a"}, dir, nil)
+	m := waitForRaftLeader(t, members)
+	for _, key := range []string{"x", "y"} {
+		if err := m.node.Propose(walEntry{Op: walOpPut, Key: key, Value: binaryValue}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	term := m.node.Status().Term
+	m.stop()
+
+	members = startTestRaftCluster(t, []string{"a"}, dir, nil)
+	m = waitForRaftLeader(t, members)
+	waitFor(t, "the restored entries applied", func() bool { return len(m.fsm.keys()) == 2 })
+	if s := m.node.Status(); s.Term <= term || s.LastIndex != 4 {
+		t.Errorf("Expected a later term and the log with both no-ops, got %+v", s)
+	}
+	if e := m.fsm.applied[1]; e.Key != "y" || e.Value != binaryValue {
+		t.Errorf("Expected the binary value restored, got %+v", e)
+	}
+}
+
+func TestRaftCompactsLog(t *testing.T) {
+	dir := t.TempDir()
+	members := startTestRaftCluster(t, []string{"a", "b", "c"}, dir, nil)
+	leader := waitForRaftLeader(t, members)
+	var lagging *testRaftMember
+	for _, m := range members {
+		if m != leader {
+			lagging = m
+			break
+		}
+	}
+	lagging.partitioned.Store(true)
+
+	var expected []string
+	for i := 1; i <= 10; i++ {
+		key := "k" + strconv.Itoa(i)
+		if err := leader.node.Propose(walEntry{Op: walOpPut, Key: key, Value: "v", Revision: uint64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, key)
+	}
+	for id, m := range members {
+		if m == lagging {
+			continue
+		}
+		waitFor(t, id+" to apply every entry", func() bool { return len(m.fsm.keys()) == len(expected) })
+		if err := m.node.Compact(10); err != nil {
+			t.Fatal(err)
+		}
+		// the no-op and the ten writes
+		if s := m.node.Status(); s.SnapshotIndex != 11 || s.LastIndex != 11 {
+			t.Errorf("%s: expected the log compacted through 11, got %+v", id, s)
+		}
+		if log, err := readRaftLog(dir+"/"+id+"/"+raftLogFile, 0); err != nil || len(log) != 0 {
+			t.Errorf("%s: expected the persisted log emptied, got %d entries, %v", id, len(log), err)
+		}
+	}
+
+	// the lagging member needs entries no one has, so it's sent a snapshot
+	lagging.partitioned.Store(false)
+	leader = waitForRaftLeader(t, members)
+	if err := leader.node.Propose(walEntry{Op: walOpPut, Key: "k11", Value: "v", Revision: 11}); err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, "k11")
+	waitFor(t, "the lagging member to catch up", func() bool { return len(lagging.fsm.keys()) == len(expected) })
+	if got := strings.Join(lagging.fsm.keys(), ","); got != strings.Join(expected, ",") {
+		t.Errorf("Expected %v applied, got %s", expected, got)
+	}
+	if s := lagging.node.Status(); s.SnapshotIndex < 11 {
+		t.Errorf("Expected the lagging member to take a snapshot, got %+v", s)
+	}
+
+	// a restart replays only what follows the snapshot
+	for _, m := range members {
+		m.stop()
+	}
+	members = startTestRaftCluster(t, []string{"a", "b", "c"}, dir, nil)
+	leader = waitForRaftLeader(t, members)
+	for id, m := range members {
+		waitFor(t, id+" to apply the new leader's no-op", func() bool { return m.node.Status().LastApplied == leader.node.Status().LastIndex })
+		if keys := m.fsm.keys(); len(keys) > 1 || (len(keys) == 1 && keys[0] != "k11") {
+			t.Errorf("%s: expected only the entry after the snapshot replayed, got %v", id, keys)
+		}
+	}
+}
+
+// run a single node cluster behind the keyStore, with its log in dir if given
+func startTestRaftKeyStore(t *testing.T, dir string) *RaftNode {
+	srv := httptest.NewUnstartedServer(newRouter())
+	n, err := NewRaftNode(RaftConfig{ID: "solo", Peers: map[string]string{"solo": "http://" + srv.Listener.Addr().String()}, Dir: dir,
+		HeartbeatInterval: testRaftHeartbeat, ElectionTimeout: testRaftElection, Apply: applyReplicated,
+		Snapshot: raftSnapshot, Restore: installSnapshot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyStoreRaft = n
+	srv.Start()
+	n.Start()
+	t.Cleanup(func() {
+		_ = n.Shutdown(context.Background())
+		srv.Close()
+		keyStoreRaft = nil
+		InitKeyStore()
+	})
+	return n
+}
+
+func TestRaftKeyStore(t *testing.T) {
+	InitKeyStore()
+	n := startTestRaftKeyStore(t, "")
+	if err := Put("early", "1"); !errors.Is(err, ErrorNotLeader) {
+		t.Errorf("Expected ErrorNotLeader before an election, got %v", err)
+	}
+	if rr := sendRequest(t, "PUT", "/keys/early", []byte("1"), nil); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 with no leader, got %d", rr.Code)
+	}
+
+	waitFor(t, "the node to lead", func() bool { return n.Status().Ready })
+	_ = Put("a", "1")
+	_ = PutWithExpiry("b", "2", time.Now().Add(-time.Second))
+	_, _ = Txn([]TxnOp{{Op: TxnPut, Key: "c", Value: "3"}, {Op: TxnUpdate, Key: "a", Value: "one"}})
+	// the expired key's delete goes through the log too
+	lockWrites()
+	err := expireKeys(time.Now())
+	unlockWrites()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "every entry applied", func() bool { s := n.Status(); return s.LastApplied == s.LastIndex })
+	s := n.Status()
+	// the no-op, three writes and the expiry
+	if s.LastIndex != 5 || CurrentRevision() != 4 {
+		t.Errorf("Expected 5 log entries for revision 4, got %+v at %d", s, CurrentRevision())
+	}
+	if value, _ := Get("a"); value == nil || *value != "one" {
+		t.Errorf("Expected a applied once, got %v", value)
+	}
+
+	rr := sendRequest(t, "GET", "/raft/status", nil, nil)
+	var status RaftStatus
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil || status.ID != "solo" || status.Role != RoleLeader {
+		t.Errorf("Expected the node's status, got %+v, %v", status, err)
+	}
+}
+
+func TestRaftCompactsWithSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	w := openTestWAL(t, dir+"/wal")
+	n := startTestRaftKeyStore(t, dir+"/raft")
+	waitFor(t, "the node to lead", func() bool { return n.Status().Ready })
+	_ = Put("a", "1")
+	_ = Put("b", "2")
+	if err := w.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// the no-op and both puts
+	if s := n.Status(); s.SnapshotIndex != 3 || s.LastIndex != 3 {
+		t.Errorf("Expected the log compacted through the snapshot, got %+v", s)
+	}
+	_ = Put("c", "3")
+	_ = n.Shutdown(context.Background())
+	keyStoreWAL = nil
+	_ = w.Close()
+
+	InitKeyStore()
+	openTestWAL(t, dir+"/wal")
+	n = startTestRaftKeyStore(t, dir+"/raft")
+	if s := n.Status(); s.SnapshotIndex != 3 || s.LastIndex != 4 {
+		t.Errorf("Expected the log after the snapshot restored, got %+v", s)
+	}
+	waitFor(t, "the node to lead", func() bool { return n.Status().Ready })
+	if value, _ := Get("c"); value == nil || *value != "3" || CurrentRevision() != 3 {
+		t.Errorf("Expected the WAL and log restored to revision 3, got %v at %d", value, CurrentRevision())
+	}
+}
+
+func TestRaftFollowerForwardsWrites(t *testing.T) {
+	InitKeyStore()
+	t.Cleanup(InitKeyStore)
+
+	// a stands in for every member's HTTP API
+	forwarded := make(chan string, 10)
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Method + " " + r.URL.Path + " " + r.Header.Get(raftForwardedHeader)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	members := startTestRaftCluster(t, []string{"a", "b", "c"}, "", map[string]http.Handler{"a": api, "b": api, "c": api})
+	leader := waitForRaftLeader(t, members)
+	var follower *testRaftMember
+	for _, m := range members {
+		if m != leader {
+			follower = m
+			break
+		}
+	}
+	// the follower's committed mutations go to the keyStore
+	follower.fsm.Lock()
+	follower.fsm.next = applyReplicated
+	follower.fsm.Unlock()
+	keyStoreRaft = follower.node
+	t.Cleanup(func() { keyStoreRaft = nil })
+
+	if err := leader.node.Propose(walEntry{Op: walOpPut, Key: "k", Value: "v", Timestamp: time.Now(), Revision: 1}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the follower to apply the put", func() bool { return CurrentRevision() == 1 })
+	if rr := sendRequest(t, "GET", "/keys/k", nil, nil); rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "v" {
+		t.Errorf("Expected the follower to serve reads, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := sendRequest(t, "PUT", "/keys/k", []byte("w"), nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected the leader's response, got %d", rr.Code)
+	}
+	if got := <-forwarded; got != "PUT /keys/k "+follower.node.cfg.ID {
+		t.Errorf("Expected the write forwarded to the leader, got %s", got)
+	}
+	// a forwarded write isn't forwarded again
+	rr := sendRequest(t, "PUT", "/keys/k", []byte("w"), map[string]string{raftForwardedHeader: "x"})
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 for a write forwarded to a follower, got %d", rr.Code)
+	}
+}
+
+func TestRaftReadsDuringProposal(t *testing.T) {
+	InitKeyStore()
+	t.Cleanup(InitKeyStore)
+	members := startTestRaftCluster(t, []string{"a", "b", "c"}, "", nil)
+	leader := waitForRaftLeader(t, members)
+	leader.fsm.Lock()
+	leader.fsm.next = applyReplicated
+	leader.fsm.Unlock()
+	keyStoreRaft = leader.node
+	t.Cleanup(func() { keyStoreRaft = nil })
+	if err := Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range members {
+		if m != leader {
+			m.stop()
+		}
+	}
+	done := make(chan error, 1)
+	go func() { done <- Update("k", "w") }()
+	waitFor(t, "the update proposed", func() bool { s := leader.node.Status(); return s.LastIndex > s.CommitIndex })
+
+	// the update waits on a majority that's gone, but not under the keyStore lock
+	if value, err := Get("k"); err != nil || value == nil || *value != "v" {
+		t.Errorf("Expected the committed value while the update waits, got %v, %v", value, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the update still waiting, got %v", err)
+	default:
+	}
+	if err := <-done; !errors.Is(err, ErrorNotLeader) {
+		t.Errorf("Expected ErrorNotLeader once the leader steps down, got %v", err)
+	}
+	if value, _ := Get("k"); value == nil || *value != "v" {
+		t.Errorf("Expected the uncommitted update not applied, got %v", value)
+	}
+}
+
+func TestValidateRaft(t *testing.T) {
+	tests := []struct {
+		id, peers, replicateFrom string
+		problem                  string
+	}{
+		{"a", "", "", "together"},
+		{"", "a=http://a:8000", "", "together"},
+		{"a", "a=http://a:8000", "http://leader", "replicateFrom"},
+		{"a", "a=a:8000", "", "http or https"},
+		{"a", "a=http://a:8000,a=http://b:8000", "", "duplicate"},
+		{"a", "b=http://b:8000", "", "missing raftId"},
+	}
+	for _, tc := range tests {
+		cfg := DefaultConfig()
+		cfg.RaftID, cfg.RaftPeers, cfg.ReplicateFrom = tc.id, tc.peers, tc.replicateFrom
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tc.problem) {
+			t.Errorf("%s %s: expected %q, got %v", tc.id, tc.peers, tc.problem, err)
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.RaftID, cfg.RaftPeers = "b", "a=http://a:8000, b=https://b:8000"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected the cluster accepted, got %v", err)
+	}
+}
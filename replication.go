@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how many recent mutations are kept for followers resuming from a
+	// revision; one further behind is sent a snapshot
+	replicationHistorySize = 4096
+	// mutations buffered per follower before it's considered too slow and
+	// disconnected
+	replicationBufferSize = 1024
+	// how often a leader tells idle followers its revision
+	replicationHeartbeatInterval = time.Second
+	// a follower that hears nothing from its leader for this long reconnects
+	replicationTimeout = 5 * replicationHeartbeatInterval
+	// how long a follower waits before reconnecting
+	replicationRetryInterval = time.Second
+)
+
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// replicationMessage one line of a replication stream: a snapshot of the
+// leader's keyStore, a committed mutation or, with neither, a heartbeat
+type replicationMessage struct {
+	Snapshot *snapshot `json:"snapshot,omitempty"`
+	Entry    *walEntry `json:"entry,omitempty"`
+	// why Entry deleted its key, for the follower's watchers
+	Reason EventType `json:"reason,omitempty"`
+	// the leader's revision when the message was sent
+	Revision uint64 `json:"rev"`
+}
+
+// replica a follower's subscription to a ReplicationLog
+type replica struct {
+	addr      string
+	connected time.Time
+	entries   chan walEntry
+	// the revision of the last mutation sent to it
+	sent atomic.Uint64
+}
+
+// ReplicationLog fans committed mutations out to followers and keeps a
+// bounded history so a reconnecting follower can resume from a recent
+// revision
+type ReplicationLog struct {
+	mu sync.Mutex
+	// ring of the most recent mutations, oldest at start
+	history []walEntry
+	start   int
+	// history holds every mutation after this revision
+	floor    uint64
+	replicas map[*replica]struct{}
+}
+
+func NewReplicationLog() *ReplicationLog {
+	return &ReplicationLog{replicas: make(map[*replica]struct{})}
+}
+
+// the log keyStore mutations are published to
+var keyStoreReplication = NewReplicationLog()
+
+func (l *ReplicationLog) removeLocked(r *replica) {
+	if _, ok := l.replicas[r]; ok {
+		delete(l.replicas, r)
+		close(r.entries)
+	}
+}
+
+// publish a committed mutation without blocking; followers too slow to keep
+// up are disconnected, and resume when they reconnect
+func (l *ReplicationLog) publish(entry walEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.history) < replicationHistorySize {
+		l.history = append(l.history, entry)
+	} else {
+		l.floor = l.history[l.start].Revision
+		l.history[l.start] = entry
+		l.start = (l.start + 1) % replicationHistorySize
+	}
+
+	for r := range l.replicas {
+		select {
+		case r.entries <- entry:
+		default:
+			logWarnf("Replication: follower %s fell behind; disconnecting it", r.addr)
+			l.removeLocked(r)
+		}
+	}
+}
+
+// reset forget the history and disconnect every follower, after the keyStore
+// is replaced wholesale as of revision floor
+func (l *ReplicationLog) reset(floor uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.history, l.start, l.floor = nil, 0, floor
+	for r := range l.replicas {
+		l.removeLocked(r)
+	}
+}
+
+// subscribe the follower at addr to mutations after revision since, which
+// the keyStore is currently at revision current, returning those still in
+// the history. ErrorRevisionCompacted when they aren't all kept.
+func (l *ReplicationLog) subscribe(addr string, since uint64, current uint64) (*replica, []walEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	floor := l.floor
+	if len(l.history) == 0 {
+		// nothing published since the keyStore was loaded
+		floor = current
+	}
+	if since < floor {
+		return nil, nil, ErrorRevisionCompacted
+	}
+
+	var backlog []walEntry
+	for i := 0; i < len(l.history); i++ {
+		if entry := l.history[(l.start+i)%len(l.history)]; entry.Revision > since {
+			backlog = append(backlog, entry)
+		}
+	}
+
+	r := &replica{addr: addr, connected: time.Now(), entries: make(chan walEntry, replicationBufferSize)}
+	r.sent.Store(since)
+	l.replicas[r] = struct{}{}
+	return r, backlog, nil
+}
+
+func (l *ReplicationLog) unsubscribe(r *replica) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.removeLocked(r)
+}
+
+// ReplicaStatus a connected follower, as its leader sees it
+type ReplicaStatus struct {
+	Addr        string    `json:"addr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	// the revision of the last mutation sent to it, and how far that is
+	// behind the leader's
+	Revision uint64 `json:"rev"`
+	Lag      uint64 `json:"lag"`
+}
+
+// the connected followers, longest connected first, given the keyStore's
+// current revision
+func (l *ReplicationLog) status(current uint64) []ReplicaStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	statuses := make([]ReplicaStatus, 0, len(l.replicas))
+	for r := range l.replicas {
+		s := ReplicaStatus{Addr: r.addr, ConnectedAt: r.connected, Revision: r.sent.Load()}
+		if current > s.Revision {
+			s.Lag = current - s.Revision
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ConnectedAt.Before(statuses[j].ConnectedAt)
+	})
+	return statuses
+}
+
+// ReplicationStreamHandlerFunc streams the keyStore's mutations after
+// revision rev to a follower, one JSON replicationMessage per line. A
+// follower too far behind for the history, or ahead of this server, is sent
+// a snapshot first. Idle streams carry heartbeats.
+func ReplicationStreamHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if s := r.URL.Query().Get("rev"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("bad revision %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// hold the keyStore still so the snapshot and the subscription meet
+	// without a mutation between them
+	keyStore.RLock()
+	current := keyStore.revision
+	var snap *snapshot
+	var rep *replica
+	var backlog []walEntry
+	err := ErrorRevisionCompacted
+	if since <= current {
+		rep, backlog, err = keyStoreReplication.subscribe(r.RemoteAddr, since, current)
+	}
+	if err != nil {
+		// a revision the follower has can't be from this history
+		snap = captureSnapshot(0)
+		rep, backlog, _ = keyStoreReplication.subscribe(r.RemoteAddr, current, current)
+	}
+	keyStore.RUnlock()
+	defer keyStoreReplication.unsubscribe(rep)
+	logInfof("Replication: follower %s connected at revision %d", r.RemoteAddr, since)
+
+	rc := http.NewResponseController(w)
+	// the stream outlives the server's write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logWarnf("replicationStreamHandlerFunc - unable to clear write deadline: %s", err)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	send := func(msg replicationMessage) error {
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	sendEntry := func(entry walEntry) error {
+		if err := send(replicationMessage{Entry: &entry, Reason: entry.reason, Revision: entry.Revision}); err != nil {
+			return err
+		}
+		rep.sent.Store(entry.Revision)
+		return nil
+	}
+
+	if snap != nil {
+		if err := send(replicationMessage{Snapshot: snap, Revision: snap.Revision}); err != nil {
+			return
+		}
+		rep.sent.Store(snap.Revision)
+	}
+	for _, entry := range backlog {
+		if err := sendEntry(entry); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(replicationHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case entry, ok := <-rep.entries:
+			if !ok {
+				return
+			}
+			if err := sendEntry(entry); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := send(replicationMessage{Revision: CurrentRevision()}); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Follower replicates a leader's keyStore into this one, which is read-only
+// while it follows
+type Follower struct {
+	leader string
+	client *http.Client
+	cancel context.CancelFunc
+	// closed once the follower has stopped
+	finished chan struct{}
+
+	mu             sync.Mutex
+	connected      bool
+	leaderRevision uint64
+	lastContact    time.Time
+}
+
+// the follower this server runs as, if any
+var keyStoreFollower *Follower
+
+// StartFollower make the keyStore read-only and replicate into it from
+// leader, the base URL of the leader's HTTP API, until Shutdown
+func StartFollower(leader string) *Follower {
+	keyStore.Lock()
+	keyStore.readOnly = true
+	keyStore.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Follower{leader: strings.TrimSuffix(leader, "/"), client: &http.Client{}, cancel: cancel, finished: make(chan struct{})}
+	go f.run(ctx)
+	return f
+}
+
+// Shutdown stop replicating, waiting until ctx is done for the follower to
+// finish applying what it's received
+func (f *Follower) Shutdown(ctx context.Context) error {
+	f.cancel()
+	select {
+	case <-f.finished:
+		return nil
+	case <-ctx.Done():
+		return errDrainTimeout
+	}
+}
+
+// follow the leader, reconnecting whenever the stream breaks, until ctx is
+// cancelled
+func (f *Follower) run(ctx context.Context) {
+	defer close(f.finished)
+	for {
+		err := f.follow(ctx)
+		f.mu.Lock()
+		f.connected = false
+		f.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		logWarnf("Replication: lost leader %s: %s; reconnecting", f.leader, err)
+
+		select {
+		case <-time.After(replicationRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// apply one stream from the leader, resuming from the keyStore's revision,
+// until it breaks
+func (f *Follower) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// a leader silent even of heartbeats is presumed gone
+	watchdog := time.AfterFunc(replicationTimeout, cancel)
+	defer watchdog.Stop()
+
+	url := f.leader + "/replication/stream?rev=" + strconv.FormatUint(CurrentRevision(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader responded %s", resp.Status)
+	}
+
+	f.mu.Lock()
+	f.connected = true
+	f.mu.Unlock()
+	logInfof("Replication: following %s", f.leader)
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg replicationMessage
+		if err = dec.Decode(&msg); err != nil {
+			return err
+		}
+		watchdog.Reset(replicationTimeout)
+
+		f.mu.Lock()
+		f.lastContact = time.Now()
+		if msg.Revision > f.leaderRevision {
+			f.leaderRevision = msg.Revision
+		}
+		f.mu.Unlock()
+
+		switch {
+		case msg.Snapshot != nil:
+			err = installSnapshot(msg.Snapshot)
+		case msg.Entry != nil:
+			msg.Entry.reason = msg.Reason
+			err = applyReplicated(*msg.Entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// replace the keyStore with a leader's snapshot. Watchers and this server's
+// own followers are disconnected, as the changes between can't be told.
+func installSnapshot(snap *snapshot) error {
+	keyStore.Lock()
+	defer keyStore.Unlock()
+
+	clearKeyStore()
+	restoreSnapshot(snap)
+	keyStoreEvents.reset(snap.Revision)
+	keyStoreReplication.reset(snap.Revision)
+	logInfof("Replication: installed snapshot of %d keys at revision %d", len(snap.Entries), snap.Revision)
+	if keyStoreWAL != nil {
+		return keyStoreWAL.rewriteLocked()
+	}
+	return nil
+}
+
+// apply a mutation the leader committed, as commit would have, skipping one
+// already applied
+func applyReplicated(entry walEntry) error {
+	keyStore.Lock()
+	defer keyStore.Unlock()
+
+	if entry.Revision <= keyStore.revision {
+		return nil
+	}
+	if entry.Revision != keyStore.revision+1 {
+		return fmt.Errorf("replication gap: at revision %d, received %d", keyStore.revision, entry.Revision)
+	}
+	if err := logMutation(entry); err != nil {
+		return err
+	}
+	applyWALEntry(entry)
+	keyStoreReplication.publish(entry)
+	keyStoreEvents.publish(entryEvents(entry)...)
+	return nil
+}
+
+// ReplicationStatus a server's place in replication. Followers report their
+// leader and how far behind it they are; every server lists the followers
+// streaming from it.
+type ReplicationStatus struct {
+	Role     string `json:"role"`
+	Revision uint64 `json:"rev"`
+	Leader   string `json:"leader,omitempty"`
+	// whether the server's data is current: always on a leader, and on a
+	// follower while it's streaming from its leader
+	Connected bool `json:"connected"`
+	// the latest revision a follower has heard its leader is at, and how
+	// many revisions it has yet to apply
+	LeaderRevision uint64          `json:"leaderRev,omitempty"`
+	Lag            uint64          `json:"lag"`
+	LastContact    *time.Time      `json:"lastContact,omitempty"`
+	Followers      []ReplicaStatus `json:"followers"`
+}
+
+// ReplicationStatusHandlerFunc reports the server's ReplicationStatus
+func ReplicationStatusHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	current := CurrentRevision()
+	status := ReplicationStatus{Role: RoleLeader, Revision: current, Connected: true, Followers: keyStoreReplication.status(current)}
+	if f := keyStoreFollower; f != nil {
+		f.mu.Lock()
+		status.Role = RoleFollower
+		status.Leader = f.leader
+		status.Connected = f.connected
+		status.LeaderRevision = f.leaderRevision
+		if f.leaderRevision > current {
+			status.Lag = f.leaderRevision - current
+		}
+		if !f.lastContact.IsZero() {
+			lastContact := f.lastContact
+			status.LastContact = &lastContact
+		}
+		f.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logErrorf("replicationStatusHandlerFunc - Error %s", err)
+	}
+}
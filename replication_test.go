@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serve the HTTP API, for the keyStore to lead
+func startTestLeader(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(newRouter())
+	// closed after the streams opened from it
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// open a replication stream from the server at url
+func openReplicationStream(t *testing.T, url string, rev string) *json.Decoder {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, "GET", url+"/replication/stream?rev="+rev, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body)
+}
+
+func nextReplicationMessage(t *testing.T, dec *json.Decoder) replicationMessage {
+	var msg replicationMessage
+	if err := dec.Decode(&msg); err != nil {
+		t.Fatalf("Error reading replication stream: %s", err)
+	}
+	return msg
+}
+
+// a leader that sends lines, then heartbeats until the follower goes away,
+// reporting the revision each follower asked for
+func startFakeLeader(t *testing.T, lines []string) (*httptest.Server, chan string) {
+	revs := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		revs <- r.URL.Query().Get("rev")
+		for _, line := range lines {
+			_, _ = w.Write([]byte(line + "\n"))
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, revs
+}
+
+// follow url until the keyStore reaches revision rev
+func startTestFollower(t *testing.T, url string, rev uint64) *Follower {
+	f := StartFollower(url)
+	keyStoreFollower = f
+	t.Cleanup(func() {
+		_ = f.Shutdown(context.Background())
+		keyStoreFollower = nil
+		InitKeyStore()
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for CurrentRevision() != rev {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the follower to reach revision %d, at %d", rev, CurrentRevision())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return f
+}
+
+func TestReplicationStream(t *testing.T) {
+	InitKeyStore()
+	keyStore.maxKeys = 2
+	leader := startTestLeader(t)
+
+	_ = Put("a", "1")
+	_ = Put("b", binaryValue)
+	_ = Put("c", "3")
+	_ = Update("b", "2")
+
+	dec := openReplicationStream(t, leader.URL, "0")
+	expected := []struct {
+		op     walOp
+		key    string
+		value  string
+		reason EventType
+	}{
+		{walOpPut, "a", "1", ""},
+		{walOpPut, "b", binaryValue, ""},
+		{walOpDelete, "a", "", EventEvict},
+		{walOpPut, "c", "3", ""},
+		{walOpUpdate, "b", "2", ""},
+		{walOpDelete, "c", "", ""},
+	}
+	for i, e := range expected {
+		if i == len(expected)-1 {
+			// published while the stream is open
+			_ = Delete("c")
+		}
+		msg := nextReplicationMessage(t, dec)
+		if msg.Entry == nil || msg.Entry.Op != e.op || msg.Entry.Key != e.key || msg.Entry.Value != e.value || msg.Reason != e.reason || msg.Entry.Revision != uint64(i+1) {
+			t.Fatalf("Expected %+v at revision %d, got %+v %+v", e, i+1, msg, msg.Entry)
+		}
+	}
+
+	rr := sendRequest(t, "GET", "/replication/status", nil, nil)
+	var status ReplicationStatus
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Role != RoleLeader || status.Revision != 6 || len(status.Followers) != 1 || status.Followers[0].Revision != 6 || status.Followers[0].Lag != 0 {
+		t.Errorf("Expected one follower caught up, got %+v", status)
+	}
+
+	if msg := nextReplicationMessage(t, dec); msg.Entry != nil || msg.Snapshot != nil || msg.Revision != 6 {
+		t.Errorf("Expected a heartbeat at revision 6, got %+v", msg)
+	}
+}
+
+func TestReplicationStreamSnapshot(t *testing.T) {
+	InitKeyStore()
+	leader := startTestLeader(t)
+
+	_ = Put("a", "1")
+	_ = PutWithExpiry("b", "2", time.Now().Add(time.Hour))
+	// as after a restart, with no history
+	keyStoreReplication = NewReplicationLog()
+
+	// behind the history, and ahead of the leader
+	for _, rev := range []string{"1", "10"} {
+		current := CurrentRevision()
+		dec := openReplicationStream(t, leader.URL, rev)
+		msg := nextReplicationMessage(t, dec)
+		if msg.Snapshot == nil || msg.Snapshot.Revision != current || len(msg.Snapshot.Entries) != 2 {
+			t.Fatalf("rev %s: expected a snapshot at revision %d, got %+v", rev, current, msg)
+		}
+		_ = Put("c", rev)
+		if msg = nextReplicationMessage(t, dec); msg.Entry == nil || msg.Entry.Key != "c" || msg.Entry.Value != rev {
+			t.Errorf("rev %s: expected the put after the snapshot, got %+v", rev, msg)
+		}
+		_ = Delete("c")
+	}
+
+	if rr := sendRequest(t, "GET", "/replication/stream?rev=x", nil, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a bad revision, got %d", rr.Code)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	InitKeyStore()
+	keyStore.maxKeys = 0
+	_ = Put("a", "1")
+	_, _ = SetIf("b", binaryValue, KeyMeta{ContentType: "image/png"}, time.Now().Add(time.Hour), SetAlways, nil)
+	_, _ = Txn([]TxnOp{{Op: TxnPut, Key: "c", Value: "3"}, {Op: TxnUpdate, Key: "a", Value: "one"}})
+	_ = Delete("c")
+	_, _ = Incr("n", 5)
+
+	// record the leader's stream, then replay it to a follower
+	leader := startTestLeader(t)
+	dec := openReplicationStream(t, leader.URL, "0")
+	rev := CurrentRevision()
+	var lines []string
+	for i := uint64(0); i < rev; i++ {
+		data, err := json.Marshal(nextReplicationMessage(t, dec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(data))
+	}
+	expected := Scan("", "", "")
+
+	InitKeyStore()
+	fake, revs := startFakeLeader(t, lines)
+	f := startTestFollower(t, fake.URL, rev)
+	if r := <-revs; r != "0" {
+		t.Errorf("Expected an empty follower to start from revision 0, got %s", r)
+	}
+	got := Scan("", "", "")
+	if len(got) != len(expected) {
+		t.Fatalf("Expected the leader's keys %+v, got %+v", expected, got)
+	}
+	for i, kv := range got {
+		e := expected[i]
+		if kv.Key != e.Key || kv.Value != e.Value || kv.ContentType != e.ContentType || kv.version != e.version ||
+			(kv.ExpiresAt == nil) != (e.ExpiresAt == nil) || (kv.ExpiresAt != nil && !kv.ExpiresAt.Equal(*e.ExpiresAt)) {
+			t.Errorf("Expected %+v, got %+v", e, kv)
+		}
+	}
+
+	if err := Put("x", "1"); !errors.Is(err, ErrorReadOnly) {
+		t.Errorf("Expected ErrorReadOnly writing to a follower, got %v", err)
+	}
+	if rr := sendRequest(t, "PUT", "/keys/x", []byte("1"), nil); rr.Code != http.StatusMisdirectedRequest {
+		t.Errorf("Expected status 421 writing to a follower over HTTP, got %d", rr.Code)
+	}
+
+	rr := sendRequest(t, "GET", "/replication/status", nil, nil)
+	var status ReplicationStatus
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Role != RoleFollower || status.Leader != fake.URL || !status.Connected || status.Revision != rev || status.Lag != 0 || status.LastContact == nil {
+		t.Errorf("Expected a connected follower with no lag, got %+v", status)
+	}
+
+	if err := f.Shutdown(contextWithTimeout(t, time.Second)); err != nil {
+		t.Errorf("Expected the follower to stop, got %v", err)
+	}
+}
+
+func TestFollowerInstallsSnapshot(t *testing.T) {
+	InitKeyStore()
+	dir := t.TempDir()
+	w := openTestWAL(t, dir)
+	_ = Put("stale", "x")
+	watch, _, err := WatchKeys(EventFilter{}, CurrentRevision())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap := replicationMessage{Snapshot: &snapshot{Revision: 40, Entries: []snapshotEntry{
+		{Key: "k", Value: "v", Timestamp: time.Now(), Version: 39},
+	}}, Revision: 41}
+	entry := replicationMessage{Entry: &walEntry{Op: walOpPut, Key: "bin", Value: binaryValue, Timestamp: time.Now(), Revision: 41}, Revision: 41}
+	var lines []string
+	for _, msg := range []replicationMessage{snap, entry} {
+		data, _ := json.Marshal(msg)
+		lines = append(lines, string(data))
+	}
+	fake, revs := startFakeLeader(t, lines)
+	f := startTestFollower(t, fake.URL, 41)
+	if r := <-revs; r != "1" {
+		t.Errorf("Expected the follower to ask from its revision, 1, got %s", r)
+	}
+
+	if _, err = Get("stale"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected the snapshot to replace the follower's keys, got %v", err)
+	}
+	if _, version, _ := GetWithVersion("k"); version != 39 {
+		t.Errorf("Expected the leader's version 39, got %d", version)
+	}
+	if _, ok := <-watch.Events(); ok {
+		t.Error("Expected watchers closed by the snapshot")
+	}
+
+	// the follower's own log restores the replicated store
+	_ = f.Shutdown(context.Background())
+	_ = w.Close()
+	InitKeyStore()
+	openTestWAL(t, dir)
+	if value, _ := Get("bin"); value == nil || *value != binaryValue {
+		t.Errorf("Expected the replicated binary value restored, got %v", value)
+	}
+	if _, err = Get("stale"); !errors.Is(err, ErrorNoSuchKey) || CurrentRevision() != 41 {
+		t.Errorf("Expected the log rewritten at revision 41, got %v at %d", err, CurrentRevision())
+	}
+}
+
+func TestFollowerReconnects(t *testing.T) {
+	InitKeyStore()
+	// a leader that ends each stream after one entry
+	var revs atomic.Uint64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rev := revs.Add(1)
+		data, _ := json.Marshal(replicationMessage{Entry: &walEntry{Op: walOpPut, Key: strings.Repeat("k", int(rev)), Value: "v", Revision: rev}, Revision: rev})
+		_, _ = w.Write(append(data, '\n'))
+	}))
+	defer srv.Close()
+
+	startTestFollower(t, srv.URL, 2)
+	if n := len(Scan("", "", "")); n != 2 {
+		t.Errorf("Expected an entry from each stream, got %d keys", n)
+	}
+}
+
+func TestValidateReplicateFrom(t *testing.T) {
+	for _, leader := range []string{"localhost:8000", "ftp://leader", "http://"} {
+		cfg := DefaultConfig()
+		cfg.ReplicateFrom = leader
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "replicateFrom") {
+			t.Errorf("%s: expected replicateFrom rejected, got %v", leader, err)
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.ReplicateFrom = "http://leader:8000/"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected an http URL accepted, got %v", err)
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the largest bulk string and command accepted from a client
+	respMaxBulkLen   = 64 << 20
+	respMaxArrayLen  = 1 << 20
+	respMaxInlineLen = 64 << 10
+	// keys returned by SCAN when no COUNT is given
+	respDefaultScanCount = 10
+	// SCAN cursors remembered before the oldest is forgotten
+	respMaxScanCursors = 1024
+)
+
+var ErrorRESPProtocol = errors.New("protocol error")
+
+// respError an error reply; Error is sent as is, so starts with its code
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// respStatus a simple string reply, such as PONG
+type respStatus string
+
+// respNull the null bulk string, Redis' nil
+type respNull struct{}
+
+// read one command: an array of bulk strings, as sent by clients, or an
+// inline command of space separated words, as typed into telnet
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r, respMaxInlineLen)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > respMaxArrayLen {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrorRESPProtocol)
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = readRESPLine(r, respMaxInlineLen)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got %q", ErrorRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulkLen {
+			return nil, fmt.Errorf("%w: invalid bulk length", ErrorRESPProtocol)
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated", ErrorRESPProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// read a line up to max bytes, without its CRLF
+func readRESPLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > max {
+			return "", fmt.Errorf("%w: line too long", ErrorRESPProtocol)
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// write a reply: nil is the simple OK, strings are bulk strings and slices
+// are arrays
+func writeRESP(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("+OK\r\n")
+	case respStatus:
+		w.WriteString("+" + string(v) + "\r\n")
+	case respError:
+		w.WriteString("-" + string(v) + "\r\n")
+	case respNull:
+		w.WriteString("$-1\r\n")
+	case int:
+		w.WriteString(":" + strconv.Itoa(v) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case string:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+	case []string:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, s := range v {
+			writeRESP(w, s)
+		}
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, item := range v {
+			writeRESP(w, item)
+		}
+	default:
+		panic(fmt.Sprintf("unsupported RESP reply %T", reply))
+	}
+}
+
+// map keyStore errors to Redis error replies
+func respStoreError(err error) respError {
+	switch {
+	case errors.Is(err, ErrorStoreFull), errors.Is(err, ErrorValueTooLarge):
+		return respError("OOM " + err.Error())
+	case errors.Is(err, ErrorReadOnly):
+		return respError("READONLY You can't write against a read only replica.")
+	}
+	return respError("ERR " + err.Error())
+}
+
+func respWrongArgs(cmd string) respError {
+	return respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+// respScanCursors maps the numeric cursors SCAN hands out, which clients
+// parse as integers, to the last key of the page they follow
+type respScanCursors struct {
+	mu   sync.Mutex
+	next uint64
+	keys map[uint64]string
+	// cursors oldest first, for forgetting them
+	order []uint64
+}
+
+func (c *respScanCursors) add(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys == nil {
+		c.keys = make(map[uint64]string)
+	}
+	if len(c.order) == respMaxScanCursors {
+		delete(c.keys, c.order[0])
+		c.order = c.order[1:]
+	}
+	// 0 starts and ends a scan, so is never handed out
+	c.next++
+	c.keys[c.next] = key
+	c.order = append(c.order, c.next)
+	return c.next
+}
+
+func (c *respScanCursors) get(cursor uint64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.keys[cursor]
+	return key, ok
+}
+
+// respServer serves a subset of the Redis protocol from the keyStore
+type respServer struct {
+	*tcpServer
+	cursors respScanCursors
+}
+
+func newRESPServer() *respServer {
+	s := &respServer{}
+	s.tcpServer = newTCPServer("RESP", s.handleConn)
+	return s
+}
+
+func (s *respServer) handleConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readRESPCommand(r)
+		if errors.Is(err, ErrorRESPProtocol) {
+			writeRESP(w, respError("ERR "+err.Error()))
+			_ = w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		cmd := strings.ToUpper(args[0])
+		writeRESP(w, s.execute(cmd, args[1:]))
+		// flush once a pipeline of commands has been answered
+		if r.Buffered() == 0 {
+			if err = w.Flush(); err != nil {
+				return
+			}
+		}
+		if cmd == "QUIT" {
+			_ = w.Flush()
+			return
+		}
+	}
+}
+
+// run one command, returning its reply
+func (s *respServer) execute(cmd string, args []string) interface{} {
+	switch cmd {
+	case "PING":
+		if len(args) > 1 {
+			return respWrongArgs(cmd)
+		}
+		if len(args) == 1 {
+			return args[0]
+		}
+		return respStatus("PONG")
+	case "QUIT", "SELECT":
+		return nil
+	case "COMMAND":
+		return []string{}
+	case "GET":
+		if len(args) != 1 {
+			return respWrongArgs(cmd)
+		}
+		value, err := Get(args[0])
+		if errors.Is(err, ErrorNoSuchKey) {
+			return respNull{}
+		}
+		if err != nil {
+			return respStoreError(err)
+		}
+		return *value
+	case "SET":
+		return respSet(args)
+	case "DEL", "EXISTS":
+		if len(args) == 0 {
+			return respWrongArgs(cmd)
+		}
+		n := 0
+		for _, key := range args {
+			var err error
+			if cmd == "DEL" {
+				err = Delete(key)
+			} else if _, err = Get(key); err != nil && !errors.Is(err, ErrorNoSuchKey) {
+				return respStoreError(err)
+			}
+			if err == nil {
+				n++
+			}
+		}
+		return n
+	case "KEYS":
+		if len(args) != 1 {
+			return respWrongArgs(cmd)
+		}
+		keys, _ := scanGlob(args[0], "", 0)
+		return keys
+	case "SCAN":
+		return s.scan(args)
+	case "EXPIRE":
+		if len(args) != 2 {
+			return respWrongArgs(cmd)
+		}
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return respError("ERR value is not an integer or out of range")
+		}
+		if seconds <= 0 {
+			// already expired
+			if Delete(args[0]) != nil {
+				return 0
+			}
+			return 1
+		}
+		if Expire(args[0], time.Now().Add(time.Duration(seconds)*time.Second)) != nil {
+			return 0
+		}
+		return 1
+	case "TTL":
+		if len(args) != 1 {
+			return respWrongArgs(cmd)
+		}
+		expiresAt, err := GetExpiry(args[0])
+		if errors.Is(err, ErrorNoSuchKey) {
+			return -2
+		}
+		if err != nil {
+			return respStoreError(err)
+		}
+		if expiresAt.IsZero() {
+			return -1
+		}
+		return int64((time.Until(expiresAt) + time.Second/2) / time.Second)
+	case "INFO":
+		return respInfo()
+	}
+	return respError(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(cmd)))
+}
+
+// SET key value [NX|XX] [EX seconds]
+func respSet(args []string) interface{} {
+	if len(args) < 2 {
+		return respWrongArgs("SET")
+	}
+	mode := SetAlways
+	var expiresAt time.Time
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			if mode != SetAlways {
+				return respError("ERR syntax error")
+			}
+			mode = SetIfAbsent
+		case "XX":
+			if mode != SetAlways {
+				return respError("ERR syntax error")
+			}
+			mode = SetIfPresent
+		case "EX":
+			if i+1 == len(args) || !expiresAt.IsZero() {
+				return respError("ERR syntax error")
+			}
+			i++
+			seconds, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || seconds <= 0 {
+				return respError("ERR invalid expire time in 'set' command")
+			}
+			expiresAt = time.Now().Add(time.Duration(seconds) * time.Second)
+		default:
+			return respError("ERR syntax error")
+		}
+	}
+
+	_, err := Set(args[0], args[1], expiresAt, mode)
+	if errors.Is(err, ErrorKeyExists) || errors.Is(err, ErrorNoSuchKey) {
+		// the NX or XX condition didn't hold
+		return respNull{}
+	}
+	if err != nil {
+		return respStoreError(err)
+	}
+	return nil
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+func (s *respServer) scan(args []string) interface{} {
+	if len(args) == 0 {
+		return respWrongArgs("SCAN")
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return respError("ERR invalid cursor")
+	}
+	after := ""
+	if cursor != 0 {
+		var ok bool
+		if after, ok = s.cursors.get(cursor); !ok {
+			return respError("ERR invalid cursor")
+		}
+	}
+
+	pattern := "*"
+	count := respDefaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return respError("ERR syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				return respError("ERR value is not an integer or out of range")
+			}
+		default:
+			return respError("ERR syntax error")
+		}
+	}
+
+	keys, last := scanGlob(pattern, after, count)
+	next := "0"
+	if last != "" {
+		next = strconv.FormatUint(s.cursors.add(last), 10)
+	}
+	return []interface{}{next, keys}
+}
+
+// scanGlob the keys after the key after matching the glob pattern, in order.
+// When limit is positive at most limit keys are examined, and the last one
+// examined is returned if more may follow, to resume from.
+func scanGlob(pattern string, after string, limit int) (keys []string, last string) {
+	keys = []string{}
+	prefix := globPrefix(pattern)
+	kvs, more := ScanPage(prefix, "", "", after, limit)
+	for _, kv := range kvs {
+		if globMatch(pattern, kv.Key) {
+			keys = append(keys, kv.Key)
+		}
+	}
+	if more {
+		last = kvs[len(kvs)-1].Key
+	}
+	return keys, last
+}
+
+// the literal text a glob pattern starts with, which every match shares
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// globMatch report whether s matches a Redis-style glob pattern: * matches
+// any run of bytes, ? any one byte, [abc], [^abc] and [a-z] classes of bytes,
+// and \ escapes the next byte. On a mismatch it backtracks only to the last
+// *, which takes one more byte, so a match takes O(len(pattern)·len(s)).
+func globMatch(pattern string, s string) bool {
+	p, i := 0, 0
+	// the pattern after the last *, and where in s it was tried from
+	star, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			p++
+			star, starI = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if ok, next := globByteMatch(pattern, p, s[i]); ok {
+				p, i = next, i+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starI++
+		p, i = star, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// whether c matches the pattern's single-byte token at p, and where the
+// token after it starts
+func globByteMatch(pattern string, p int, c byte) (bool, int) {
+	switch pattern[p] {
+	case '?':
+		return true, p + 1
+	case '[':
+		end := strings.IndexByte(pattern[p+1:], ']')
+		if end < 0 {
+			// unterminated; match the bracket literally
+			return c == '[', p + 1
+		}
+		class := pattern[p+1 : p+1+end]
+		negate := strings.HasPrefix(class, "^")
+		if negate {
+			class = class[1:]
+		}
+		return globClassMatch(class, c) != negate, p + end + 2
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+	}
+	return pattern[p] == c, p + 1
+}
+
+func globClassMatch(class string, c byte) bool {
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if lo <= c && c <= hi {
+				return true
+			}
+			i += 2
+			continue
+		}
+		if class[i] == c {
+			return true
+		}
+	}
+	return false
+}
+
+// the INFO reply, in Redis' section format
+func respInfo() string {
+	stats := GetStats()
+	return fmt.Sprintf("# Server\r\nredis_version:7.0.0\r\nredis_mode:standalone\r\nserver_name:goKVServer\r\nuptime_in_seconds:%d\r\n"+
+		"\r\n# Memory\r\nused_memory:%d\r\nmaxmemory:%d\r\nmaxkeys:%d\r\n"+
+		"\r\n# Keyspace\r\ndb0:keys=%d,expires=%d,revision=%d\r\n",
+		stats.UptimeSeconds, stats.Bytes, stats.MaxBytes, stats.MaxKeys, stats.Keys, stats.Expiring, stats.Revision)
+}
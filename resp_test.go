@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// start a RESP server on a local port and connect to it
+func dialTestRESP(t *testing.T) (net.Conn, *bufio.Reader) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newRESPServer()
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(func() { _ = s.Shutdown(contextWithTimeout(t, time.Second)) })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// send a command as a RESP array and return the raw reply
+func respCommand(t *testing.T, conn net.Conn, r *bufio.Reader, args ...string) string {
+	t.Helper()
+	w := bufio.NewWriter(conn)
+	writeRESP(w, args)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return readRESPReply(t, r)
+}
+
+// read one reply, nested arrays included, as its raw text
+func readRESPReply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Unable to read reply: %s", err)
+	}
+	switch line[0] {
+	case '$':
+		if line == "$-1\r\n" {
+			return line
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		rest := make([]byte, size+2)
+		if _, err = io.ReadFull(r, rest); err != nil {
+			t.Fatalf("Unable to read reply: %s", err)
+		}
+		return line + string(rest)
+	case '*':
+		reply := line
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		for i := 0; i < n; i++ {
+			reply += readRESPReply(t, r)
+		}
+		return reply
+	}
+	return line
+}
+
+func TestRESPCommands(t *testing.T) {
+	InitKeyStore()
+	conn, r := dialTestRESP(t)
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"ping", "hi"}, "$2\r\nhi\r\n"},
+		{[]string{"GET", "r1"}, "$-1\r\n"},
+		{[]string{"SET", "r1", "a"}, "+OK\r\n"},
+		{[]string{"SET", "r1", "b"}, "+OK\r\n"},
+		{[]string{"GET", "r1"}, "$1\r\nb\r\n"},
+		{[]string{"SET", "r1", "c", "NX"}, "$-1\r\n"},
+		{[]string{"SET", "r2", "c", "XX"}, "$-1\r\n"},
+		{[]string{"SET", "r2", "c", "NX", "EX", "100"}, "+OK\r\n"},
+		{[]string{"TTL", "r2"}, ":100\r\n"},
+		{[]string{"TTL", "r1"}, ":-1\r\n"},
+		{[]string{"TTL", "missing"}, ":-2\r\n"},
+		{[]string{"EXPIRE", "r1", "50"}, ":1\r\n"},
+		{[]string{"TTL", "r1"}, ":50\r\n"},
+		{[]string{"EXPIRE", "missing", "50"}, ":0\r\n"},
+		// a plain SET clears the expiry
+		{[]string{"SET", "r1", "d"}, "+OK\r\n"},
+		{[]string{"TTL", "r1"}, ":-1\r\n"},
+		{[]string{"EXISTS", "r1", "r2", "missing"}, ":2\r\n"},
+		{[]string{"KEYS", "r*"}, "*2\r\n$2\r\nr1\r\n$2\r\nr2\r\n"},
+		{[]string{"KEYS", "r[^1]"}, "*1\r\n$2\r\nr2\r\n"},
+		{[]string{"DEL", "r1", "r2", "missing"}, ":2\r\n"},
+		{[]string{"SET", "r1"}, "-ERR wrong number of arguments for 'set' command\r\n"},
+		{[]string{"SET", "r1", "a", "EX", "0"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"SET", "r1", "a", "NX", "XX"}, "-ERR syntax error\r\n"},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'flushall'\r\n"},
+	}
+	for _, tc := range tests {
+		if got := respCommand(t, conn, r, tc.args...); got != tc.expected {
+			t.Errorf("%v: expected %q, got %q", tc.args, tc.expected, got)
+		}
+	}
+
+	if info := respCommand(t, conn, r, "INFO"); !strings.Contains(info, "db0:keys=0") {
+		t.Errorf("Expected keyspace info, got %q", info)
+	}
+}
+
+func TestRESPStoreFull(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionReject, 1, 0)
+	conn, r := dialTestRESP(t)
+
+	respCommand(t, conn, r, "SET", "full1", "a")
+	if got := respCommand(t, conn, r, "SET", "full2", "a"); !strings.HasPrefix(got, "-OOM ") {
+		t.Errorf("Expected an OOM error, got %q", got)
+	}
+}
+
+func TestRESPInlineAndPipelined(t *testing.T) {
+	InitKeyStore()
+	conn, r := dialTestRESP(t)
+
+	// inline commands, pipelined in one write
+	if _, err := conn.Write([]byte("SET inline val\r\nGET inline\r\nPING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"+OK\r\n", "$3\r\nval\r\n", "+PONG\r\n"} {
+		if got := readRESPReply(t, r); got != expected {
+			t.Errorf("Expected %q, got %q", expected, got)
+		}
+	}
+}
+
+func TestRESPProtocolError(t *testing.T) {
+	InitKeyStore()
+	conn, r := dialTestRESP(t)
+
+	if _, err := conn.Write([]byte("*1\r\n+GET\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readRESPReply(t, r); !strings.HasPrefix(got, "-ERR protocol error") {
+		t.Errorf("Expected a protocol error, got %q", got)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("Expected the connection closed after a protocol error")
+	}
+}
+
+func TestRESPScan(t *testing.T) {
+	InitKeyStore()
+	keyStore.maxKeys = 0
+	t.Cleanup(InitKeyStore)
+	conn, r := dialTestRESP(t)
+
+	expected := []string{}
+	for _, key := range []string{"scan:a", "scan:b", "scan:c", "scan:d", "scan:e", "other"} {
+		_ = Put(key, "v")
+		if strings.HasPrefix(key, "scan:") {
+			expected = append(expected, key)
+		}
+	}
+
+	var seen []string
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("SCAN did not terminate")
+		}
+		reply := respCommand(t, conn, r, "SCAN", cursor, "MATCH", "scan:*", "COUNT", "2")
+		lines := strings.Split(strings.TrimSuffix(reply, "\r\n"), "\r\n")
+		// *2, $len, cursor, *n, then $len key pairs
+		cursor = lines[2]
+		for i := 5; i < len(lines); i += 2 {
+			seen = append(seen, lines[i])
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Expected SCAN to return %v, got %v", expected, seen)
+	}
+
+	if got := respCommand(t, conn, r, "SCAN", "12345"); got != "-ERR invalid cursor\r\n" {
+		t.Errorf("Expected unknown cursor rejected, got %q", got)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"cust:*:zip", "cust:123:zip", true},
+		{"cust:*:zip", "cust:123:city", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"h[llo", "h[llo", true},
+		{"a*", "", false},
+		{"**", "", true},
+		{"*a*b", "xaxxbyb", true},
+		{"*a*b", "xaxxby", false},
+		{"a*?c", "abc", true},
+		{"a*?c", "ac", false},
+		{`a*\*`, "ab*", true},
+		{"*[0-9]", "key7", true},
+		{"h[llo*", "h[llox", true},
+	}
+	for _, tc := range tests {
+		if got := globMatch(tc.pattern, tc.s); got != tc.match {
+			t.Errorf("%q against %q: expected %v, got %v", tc.pattern, tc.s, tc.match, got)
+		}
+	}
+}
+
+func TestGlobMatchManyStars(t *testing.T) {
+	pattern := strings.Repeat("*a", 20) + "*b"
+	s := strings.Repeat("a", 10000)
+	done := make(chan bool, 1)
+	go func() { done <- globMatch(pattern, s) }()
+	select {
+	case match := <-done:
+		if match {
+			t.Errorf("Expected no match without a b")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the match to finish quickly")
+	}
+}
@@ -219,3 +219,68 @@ func TestPostHandlerUpdate(t *testing.T) {
 		t.Errorf("Incorrect value returned for key: %s, got %s, expected %s", key, resBdy, updateVal)
 	}
 }
+
+func TestDeleteHandler(t *testing.T) {
+	InitKeyStore()
+	key := "DeleteKey"
+
+	router := mux.NewRouter()
+	router.HandleFunc("/keys/{key}", GetKeyHandlerFunc).Methods("GET")
+	router.HandleFunc("/keys/{key}", DeleteKeyHandlerFunc).Methods("DELETE")
+
+	err := Put(key, "DeleteVal")
+	if err != nil {
+		t.Fatalf("Failure adding test pair: %s", err)
+	}
+
+	reqDelete, err := http.NewRequest("DELETE", fmt.Sprintf("/keys/%s", key), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, reqDelete)
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("Error - Expected StatusCode NoContent %d, got %d", http.StatusNoContent, status)
+	}
+
+	if keyStore.kmh.idxOf(key) != -1 {
+		t.Errorf("Key %s still present in heap after DELETE", key)
+	}
+
+	reqGet, err := http.NewRequest("GET", fmt.Sprintf("/keys/%s", key), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, reqGet)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("Error - Expected StatusCode NotFound %d after DELETE, got %d", http.StatusNotFound, status)
+	}
+
+	// deleting again is a missing key
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, reqDelete)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("Error - Expected StatusCode NotFound %d, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestPostHandlerStoreFull(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionReject, 1, 0)
+	router := mux.NewRouter()
+	router.HandleFunc("/keys", AddKeyHandlerFunc).Methods("POST")
+
+	for i, expected := range []int{http.StatusCreated, http.StatusInsufficientStorage} {
+		reqBody := fmt.Sprintf(`{"key":"FullKey%d","value":"val"}`, i)
+		req, err := http.NewRequest("POST", "/keys", bytes.NewBuffer([]byte(reqBody)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != expected {
+			t.Errorf("Error - Expected StatusCode %d, got %d", expected, status)
+		}
+	}
+}
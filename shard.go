@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultShardVirtualNodes = 128
+	// keys moved to their owner per request while rebalancing
+	shardRebalanceBatch = 256
+	// how long rebalancing waits after failing to move keys
+	shardRebalanceRetry = time.Second
+	shardRequestTimeout = 10 * time.Second
+)
+
+// the header marking a request a shard forwarded to the key's owner, or a
+// membership change it passed on, which the receiver handles itself
+const shardForwardedHeader = "X-Shard-Forwarded"
+
+var ErrorCrossShard = errors.New("keys belong to different shards")
+var ErrorNotOwner = errors.New("key belongs to another shard")
+
+// one of a shard's points on the ring
+type ringPoint struct {
+	hash uint64
+	id   string
+}
+
+// HashRing a consistent-hash ring on which each shard has many points, its
+// virtual nodes, so keys spread evenly and adding or removing a shard only
+// moves the keys it gains or loses
+type HashRing struct {
+	points []ringPoint
+}
+
+// the position of s on the ring: FNV-1a, mixed so that similar strings, such
+// as one shard's virtual node names, land far apart
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// NewHashRing a ring with vnodes points for each of ids
+func NewHashRing(ids []string, vnodes int) *HashRing {
+	r := &HashRing{points: make([]ringPoint, 0, len(ids)*vnodes)}
+	for _, id := range ids {
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, ringPoint{hash: ringHash(id + "#" + strconv.Itoa(i)), id: id})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].id < r.points[j].id
+	})
+	return r
+}
+
+// Owner the shard owning key: the first point at or after the key's, wrapping
+// around; empty for an empty ring
+func (r *HashRing) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(shardKey(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].id
+}
+
+// the part of key that decides its shard: the text in braces, if any, as a
+// Redis cluster hash tag, so related keys can be kept together; otherwise a
+// customer's key prefix, so each customer's fields share a shard and its
+// transactions stay on one node; otherwise the whole key
+func shardKey(key string) string {
+	if open := strings.IndexByte(key, '{'); open >= 0 {
+		if end := strings.IndexByte(key[open+1:], '}'); end > 0 {
+			return key[open+1 : open+1+end]
+		}
+	}
+	if rest, ok := strings.CutPrefix(key, customerKeyPrefix); ok {
+		if id, _, ok := strings.Cut(rest, ":"); ok {
+			return customerKeyPrefix + id + ":"
+		}
+	}
+	return key
+}
+
+// Sharding this server's part in a sharded deployment: the keys it owns on
+// the ring of shards. Requests for other keys are forwarded to their owner,
+// and keys this server no longer owns after a membership change are moved to
+// their new owner in the background.
+type Sharding struct {
+	self   string
+	vnodes int
+	client *http.Client
+
+	mu      sync.RWMutex
+	members map[string]string
+	ring    *HashRing
+	// keys moved to other shards, and why the last attempt failed
+	moved       uint64
+	rebalancing bool
+	lastError   string
+
+	trigger chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// the shard this server runs as, if any
+var keyStoreShards *Sharding
+
+// StartSharding take part as self among members, moving away any keys this
+// server holds but doesn't own
+func StartSharding(self string, members map[string]string, vnodes int) *Sharding {
+	s := &Sharding{
+		self:    self,
+		vnodes:  vnodes,
+		client:  &http.Client{Timeout: shardRequestTimeout},
+		trigger: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	s.setMembers(members)
+	s.wg.Add(1)
+	go s.rebalanceLoop()
+	return s
+}
+
+// Shutdown stop rebalancing, waiting until ctx is done for a batch in flight
+func (s *Sharding) Shutdown(ctx context.Context) error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return errDrainTimeout
+	}
+}
+
+// replace the members and rebuild the ring, then rebalance
+func (s *Sharding) setMembers(members map[string]string) {
+	ids := make([]string, 0, len(members))
+	copied := make(map[string]string, len(members))
+	for id, url := range members {
+		ids = append(ids, id)
+		copied[id] = url
+	}
+	ring := NewHashRing(ids, s.vnodes)
+
+	s.mu.Lock()
+	s.members, s.ring = copied, ring
+	s.mu.Unlock()
+	logInfof("Sharding: %s has %d members", s.self, len(members))
+
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+		// a rebalance is already due
+	}
+}
+
+// Owner the ID and base URL of the shard owning key
+func (s *Sharding) Owner(key string) (string, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id := s.ring.Owner(key)
+	return id, s.members[id]
+}
+
+func (s *Sharding) rebalanceLoop() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.trigger:
+		case <-s.done:
+			return
+		}
+
+		for {
+			err := s.rebalance()
+			s.mu.Lock()
+			s.rebalancing = err != nil
+			if err != nil {
+				s.lastError = err.Error()
+			}
+			s.mu.Unlock()
+			if err == nil {
+				break
+			}
+			logWarnf("Sharding: unable to rebalance, retrying in %s: %s", shardRebalanceRetry, err)
+			select {
+			case <-time.After(shardRebalanceRetry):
+			case <-s.trigger:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// move every key this server doesn't own to its owner, a batch at a time
+func (s *Sharding) rebalance() error {
+	for {
+		select {
+		case <-s.done:
+			return nil
+		default:
+		}
+		batches, more := s.misplaced(shardRebalanceBatch)
+		if len(batches) == 0 {
+			return nil
+		}
+		s.mu.Lock()
+		s.rebalancing = true
+		s.mu.Unlock()
+
+		for url, entries := range batches {
+			if err := s.send(url, entries); err != nil {
+				return err
+			}
+			// the owner has them now, unless written here since
+			for _, e := range entries {
+				err := DeleteIf(e.Key, &Precondition{IfMatch: []uint64{e.Version}})
+				if err != nil && !errors.Is(err, ErrorVersionMismatch) && !errors.Is(err, ErrorNoSuchKey) {
+					return err
+				}
+			}
+			s.mu.Lock()
+			s.moved += uint64(len(entries))
+			s.mu.Unlock()
+			logInfof("Sharding: moved %d keys to %s", len(entries), url)
+		}
+		if !more {
+			// keys written here since are refused unless this shard owns
+			// them, until the members change and trigger another pass
+			return nil
+		}
+	}
+}
+
+// the ring and members, which are replaced, never changed, so a copy of
+// them lasts; commits check ownership holding the keyStore lock, so it's
+// taken without holding s.mu
+func (s *Sharding) view() (*HashRing, map[string]string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ring, s.members
+}
+
+// up to limit of the keys this server doesn't own, by their owner's URL,
+// and whether more remain
+func (s *Sharding) misplaced(limit int) (map[string][]snapshotEntry, bool) {
+	ring, members := s.view()
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+
+	now := time.Now()
+	batches := make(map[string][]snapshotEntry)
+	count := 0
+	for k, v := range keyStore.m {
+		owner := ring.Owner(k)
+		if owner == s.self || isExpired(k, now) {
+			continue
+		}
+		if count++; count > limit {
+			return batches, true
+		}
+		entry := snapshotEntry{Key: k, Value: v, Version: keyStore.versions[k]}
+		if meta, ok := keyStore.meta[k]; ok {
+			entry.Meta = &meta
+		}
+		if expiresAt, ok := keyStore.expires[k]; ok {
+			entry.ExpiresAt = &expiresAt
+		}
+		url := members[owner]
+		batches[url] = append(batches[url], entry)
+	}
+	return batches, false
+}
+
+// how many keys this server holds that it doesn't own
+func (s *Sharding) misplacedCount() int {
+	ring, _ := s.view()
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+
+	now := time.Now()
+	count := 0
+	for k := range keyStore.m {
+		if ring.Owner(k) != s.self && !isExpired(k, now) {
+			count++
+		}
+	}
+	return count
+}
+
+// import entries on the shard at url
+func (s *Sharding) send(url string, entries []snapshotEntry) error {
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(url, "/")+"/shards/import", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(shardForwardedHeader, s.self)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s responded %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// checkOwned ErrorNotOwner if entry writes a key another shard owns, so
+// writes over any protocol only land on the key's owner. Deletes are
+// allowed anywhere, clearing keys that are out of place.
+func (s *Sharding) checkOwned(entry walEntry) error {
+	if s == nil {
+		return nil
+	}
+	switch entry.Op {
+	case walOpPut, walOpUpdate:
+		return s.checkOwnedKey(entry.Key)
+	case walOpTxn:
+		for _, e := range entry.Batch {
+			if err := s.checkOwned(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ErrorNotOwner if another shard owns key, so it's neither read nor written
+// here
+func (s *Sharding) checkOwnedKey(key string) error {
+	if s == nil {
+		return nil
+	}
+	if id, url := s.Owner(key); id != s.self {
+		return fmt.Errorf("%w: %s is owned by %s at %s", ErrorNotOwner, key, id, url)
+	}
+	return nil
+}
+
+// ImportKeys store keys another shard moved here, keeping any written here
+// since the ring changed. ErrorNotOwner, storing none, if any belongs to
+// another shard, as when this server hasn't yet seen the membership change.
+func (s *Sharding) ImportKeys(entries []snapshotEntry) error {
+	s.mu.RLock()
+	for _, e := range entries {
+		if s.ring.Owner(e.Key) != s.self {
+			s.mu.RUnlock()
+			return fmt.Errorf("%w: %s", ErrorNotOwner, e.Key)
+		}
+	}
+	s.mu.RUnlock()
+
+	now := time.Now()
+	for _, e := range entries {
+		var expiresAt time.Time
+		if e.ExpiresAt != nil {
+			if !e.ExpiresAt.After(now) {
+				continue
+			}
+			expiresAt = *e.ExpiresAt
+		}
+		var meta KeyMeta
+		if e.Meta != nil {
+			meta = *e.Meta
+		}
+		if _, err := SetIf(e.Key, e.Value, meta, expiresAt, SetIfAbsent, nil); err != nil && !errors.Is(err, ErrorKeyExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShardStatus a shard's view of the deployment
+type ShardStatus struct {
+	ID           string            `json:"id"`
+	Members      map[string]string `json:"members"`
+	VirtualNodes int               `json:"virtualNodes"`
+	Keys         int               `json:"keys"`
+	// keys held here that belong to another shard, yet to be moved
+	Misplaced   int    `json:"misplaced"`
+	Rebalancing bool   `json:"rebalancing"`
+	Moved       uint64 `json:"moved"`
+	LastError   string `json:"lastError,omitempty"`
+}
+
+// Status the shard's view of the deployment
+func (s *Sharding) Status() ShardStatus {
+	misplaced := s.misplacedCount()
+	keyStore.RLock()
+	keys := lenKeyStore()
+	keyStore.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return ShardStatus{
+		ID: s.self, Members: s.members, VirtualNodes: s.vnodes, Keys: keys,
+		Misplaced: misplaced, Rebalancing: s.rebalancing || misplaced > 0, Moved: s.moved, LastError: s.lastError,
+	}
+}
+
+// ShardMembersResponse the reply to a membership change: the new status, and
+// the members that couldn't be told of it
+type ShardMembersResponse struct {
+	ShardStatus
+	Unreached []string `json:"unreached,omitempty"`
+}
+
+// tell every member, old and new, of the change
+func (s *Sharding) announce(old map[string]string, members map[string]string) []string {
+	body, err := json.Marshal(members)
+	if err != nil {
+		return nil
+	}
+	urls := make(map[string]string)
+	for _, m := range []map[string]string{old, members} {
+		for id, url := range m {
+			if id != s.self {
+				urls[id] = url
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var unreached []string
+	for id, url := range urls {
+		wg.Add(1)
+		go func(id string, url string) {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(url, "/")+"/shards/members", bytes.NewReader(body))
+			if err == nil {
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set(shardForwardedHeader, s.self)
+				var resp *http.Response
+				if resp, err = s.client.Do(req); err == nil {
+					_ = resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						err = fmt.Errorf("responded %s", resp.Status)
+					}
+				}
+			}
+			if err != nil {
+				logWarnf("Sharding: unable to tell %s of the membership change: %s", id, err)
+				mu.Lock()
+				unreached = append(unreached, id)
+				mu.Unlock()
+			}
+		}(id, url)
+	}
+	wg.Wait()
+	sort.Strings(unreached)
+	return unreached
+}
+
+func writeShardJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logErrorf("shardHandler - Error %s", err)
+	}
+}
+
+// ShardStatusHandlerFunc GET /shards
+func ShardStatusHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	if keyStoreShards == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeShardJSON(w, http.StatusOK, keyStoreShards.Status())
+}
+
+// ShardMembersHandlerFunc PUT /shards/members: replace the members, as
+// {"id": "url", ...}, on this shard and every other old and new member
+func ShardMembersHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	s := keyStoreShards
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+	var members map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&members); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(members) == 0 {
+		http.Error(w, "at least one member is required", http.StatusBadRequest)
+		return
+	}
+	for id, url := range members {
+		if err := checkPeer(id, url); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.RLock()
+	old := s.members
+	s.mu.RUnlock()
+	s.setMembers(members)
+	var resp ShardMembersResponse
+	if r.Header.Get(shardForwardedHeader) == "" {
+		resp.Unreached = s.announce(old, members)
+	}
+	resp.ShardStatus = s.Status()
+	writeShardJSON(w, http.StatusOK, resp)
+}
+
+// ShardImportHandlerFunc POST /shards/import: keys another shard is moving
+// here
+func ShardImportHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	if keyStoreShards == nil {
+		http.NotFound(w, r)
+		return
+	}
+	var entries []snapshotEntry
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := keyStoreShards.ImportKeys(entries); err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// the key deciding which shard handles the request, if any; for a txn, its
+// first key, once every key is found to share a shard
+func shardRequestKey(s *Sharding, w http.ResponseWriter, r *http.Request) (string, bool, error) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "", false, nil
+	}
+	template, _ := route.GetPathTemplate()
+	switch {
+	case template == "/keys/{key}" || template == "/keys/{key}/incr":
+		return pathVar(r, "key"), true, nil
+	case template == "/customers/{id}":
+		id, err := strconv.ParseInt(pathVar(r, "id"), 10, 64)
+		return genCustomerKey(id, ""), err == nil, nil
+	case r.Method == http.MethodGet:
+		// listings and watches cover this shard alone
+		return "", false, nil
+	}
+
+	// the key is in the body, which is left for the handler; it's no larger
+	// than a value's
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueBodyBytes))
+	if err != nil {
+		return "", false, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	switch template {
+	case "/keys":
+		var kv struct {
+			Key string `json:"key"`
+		}
+		err = json.Unmarshal(body, &kv)
+		return kv.Key, err == nil, nil
+	case "/customers":
+		var rec struct {
+			ID int64 `json:"id"`
+		}
+		err = json.Unmarshal(body, &rec)
+		return genCustomerKey(rec.ID, ""), err == nil, nil
+	case "/txn":
+		var req txnRequest
+		if err = json.Unmarshal(body, &req); err != nil || len(req.Ops) == 0 {
+			return "", false, nil
+		}
+		owner, _ := s.Owner(req.Ops[0].Key)
+		for _, op := range req.Ops[1:] {
+			if id, _ := s.Owner(op.Key); id != owner {
+				return "", false, fmt.Errorf("%w: %s and %s", ErrorCrossShard, req.Ops[0].Key, op.Key)
+			}
+		}
+		return req.Ops[0].Key, true, nil
+	}
+	return "", false, nil
+}
+
+// the status for a request shardForward can't route
+func shardErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrorCrossShard):
+		return http.StatusBadRequest
+	}
+	// the body couldn't be read
+	return storeErrorStatus(err, http.StatusBadRequest)
+}
+
+// shardForward proxy requests for keys another shard owns to that shard
+func shardForward(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := keyStoreShards
+		if s == nil || r.Header.Get(shardForwardedHeader) != "" || strings.HasPrefix(r.URL.Path, "/shards") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, ok, err := shardRequestKey(s, w, r)
+		if err != nil {
+			http.Error(w, err.Error(), shardErrorStatus(err))
+			return
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		owner, url := s.Owner(key)
+		if owner == s.self {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		target, err := neturl.Parse(url)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			logWarnf("Sharding: unable to forward %s %s to %s: %s", r.Method, r.URL.Path, owner, err)
+			http.Error(w, fmt.Sprintf("shard %s unreachable", owner), http.StatusBadGateway)
+		}
+		r.Header.Set(shardForwardedHeader, s.self)
+		proxy.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"goKVServer/kvpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// a shard that stores the keys moved to it and records other requests
+type fakeShard struct {
+	sync.Mutex
+	srv      *httptest.Server
+	imported map[string]snapshotEntry
+	requests []string
+}
+
+func startFakeShard(t *testing.T) *fakeShard {
+	f := &fakeShard{imported: make(map[string]snapshotEntry)}
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.Lock()
+		defer f.Unlock()
+		if r.URL.Path == "/shards/import" {
+			var entries []snapshotEntry
+			if err := json.Unmarshal(body, &entries); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for _, e := range entries {
+				f.imported[e.Key] = e
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		f.requests = append(f.requests, r.Method+" "+r.URL.Path+" "+r.Header.Get(shardForwardedHeader)+" "+string(body))
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeShard) lastRequest() string {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.requests) == 0 {
+		return ""
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+func (f *fakeShard) importedCount() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.imported)
+}
+
+// an endless run of one byte
+type testByteReader byte
+
+func (b testByteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(b)
+	}
+	return len(p), nil
+}
+
+// run the keyStore as shard "a" among members
+func startTestShard(t *testing.T, members map[string]string) *Sharding {
+	InitKeyStore()
+	keyStore.maxKeys = 0
+	s := StartSharding("a", members, defaultShardVirtualNodes)
+	keyStoreShards = s
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+		keyStoreShards = nil
+		InitKeyStore()
+	})
+	return s
+}
+
+// a key with the given prefix owned by id
+func keyOwnedBy(t *testing.T, s *Sharding, prefix string, id string) string {
+	for i := 0; i < 1000; i++ {
+		key := prefix + strconv.Itoa(i)
+		if owner, _ := s.Owner(key); owner == id {
+			return key
+		}
+	}
+	t.Fatalf("No key owned by %s", id)
+	return ""
+}
+
+func TestHashRingDistribution(t *testing.T) {
+	const keys = 30000
+	ring := NewHashRing([]string{"a", "b", "c"}, defaultShardVirtualNodes)
+	owners := make(map[string]string, keys)
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		key := "key" + strconv.Itoa(i)
+		owners[key] = ring.Owner(key)
+		counts[owners[key]]++
+	}
+	for id, n := range counts {
+		if share := float64(n) / keys; share < 0.25 || share > 0.42 {
+			t.Errorf("Expected about a third of the keys on %s, got %.2f", id, share)
+		}
+	}
+
+	// a new shard only takes keys, about a quarter of them
+	ring = NewHashRing([]string{"a", "b", "c", "d"}, defaultShardVirtualNodes)
+	moved := 0
+	for key, owner := range owners {
+		if now := ring.Owner(key); now != owner {
+			if now != "d" {
+				t.Fatalf("Expected %s to stay on %s or move to d, moved to %s", key, owner, now)
+			}
+			moved++
+		}
+	}
+	if share := float64(moved) / keys; share < 0.18 || share > 0.32 {
+		t.Errorf("Expected about a quarter of the keys moved, got %.2f", share)
+	}
+
+	if owner := NewHashRing(nil, defaultShardVirtualNodes).Owner("k"); owner != "" {
+		t.Errorf("Expected no owner on an empty ring, got %s", owner)
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	tests := map[string]string{
+		"plain":          "plain",
+		"user:{42}:name": "42",
+		"{}empty":        "{}empty",
+		"open{only":      "open{only",
+		"cust:7:zip":     "cust:7:",
+		"cust:7:":        "cust:7:",
+		"cust:nonsense":  "cust:nonsense",
+	}
+	for key, expected := range tests {
+		if got := shardKey(key); got != expected {
+			t.Errorf("%s: expected shard key %q, got %q", key, expected, got)
+		}
+	}
+	ring := NewHashRing([]string{"a", "b", "c"}, defaultShardVirtualNodes)
+	if ring.Owner(genCustomerKey(7, "zip")) != ring.Owner(genCustomerKey(7, "firstName")) {
+		t.Error("Expected a customer's fields on one shard")
+	}
+}
+
+func TestShardForwarding(t *testing.T) {
+	b := startFakeShard(t)
+	s := startTestShard(t, map[string]string{"a": "http://a.invalid", "b": b.srv.URL})
+	local := keyOwnedBy(t, s, "k", "a")
+	remote := keyOwnedBy(t, s, "k", "b")
+	remote2 := keyOwnedBy(t, s, remote, "b")
+
+	if rr := sendRequest(t, "PUT", "/keys/"+local, []byte("1"), nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected a key this shard owns stored, got %d", rr.Code)
+	}
+	tests := []struct {
+		method, path, body string
+		expected           string
+	}{
+		{"PUT", "/keys/" + remote, "2", "PUT /keys/" + remote + " a 2"},
+		{"GET", "/keys/" + remote, "", "GET /keys/" + remote + " a "},
+		{"POST", "/keys/" + remote + "/incr", "", "POST /keys/" + remote + "/incr a "},
+		{"POST", "/keys", `{"key":"` + remote + `","value":"3"}`, `POST /keys a {"key":"` + remote + `","value":"3"}`},
+		{"POST", "/txn", `{"ops":[{"op":"put","key":"` + remote + `"},{"op":"put","key":"` + remote2 + `"}]}`, ""},
+	}
+	for _, tc := range tests {
+		rr := sendRequest(t, tc.method, tc.path, []byte(tc.body), nil)
+		expected := tc.expected
+		if expected == "" {
+			expected = tc.method + " " + tc.path + " a " + tc.body
+		}
+		if rr.Code != http.StatusOK || b.lastRequest() != expected {
+			t.Errorf("%s %s: expected forwarded as %q, got %d %q", tc.method, tc.path, expected, rr.Code, b.lastRequest())
+		}
+	}
+	if _, err := Get(remote); err == nil {
+		t.Error("Expected nothing stored for a key another shard owns")
+	}
+
+	customer := 1
+	for ; ; customer++ {
+		if owner, _ := s.Owner(genCustomerKey(int64(customer), "")); owner == "b" {
+			break
+		}
+	}
+	path := "/customers/" + strconv.Itoa(customer)
+	if rr := sendRequest(t, "GET", path, nil, nil); rr.Code != http.StatusOK || b.lastRequest() != "GET "+path+" a " {
+		t.Errorf("Expected the customer forwarded to its shard, got %d %q", rr.Code, b.lastRequest())
+	}
+
+	rr := sendRequest(t, "POST", "/txn", []byte(`{"ops":[{"op":"put","key":"`+local+`"},{"op":"put","key":"`+remote+`"}]}`), nil)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), ErrorCrossShard.Error()) {
+		t.Errorf("Expected a txn across shards rejected, got %d %s", rr.Code, rr.Body.String())
+	}
+	// the body is read for its key only up to a value's limit
+	req := httptest.NewRequest("POST", "/keys", io.LimitReader(testByteReader('a'), maxValueBodyBytes+1))
+	rr = httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected an oversized body refused, got %d", rr.Code)
+	}
+
+	// a forwarded request is handled where it lands, never forwarded again;
+	// one for a key owned elsewhere, as while the shards disagree on their
+	// members, is refused rather than stored out of place
+	last := b.lastRequest()
+	if rr = sendRequest(t, "PUT", "/keys/"+remote, []byte("4"), map[string]string{shardForwardedHeader: "b"}); rr.Code != http.StatusConflict || b.lastRequest() != last {
+		t.Errorf("Expected a forwarded request for another shard's key refused here, got %d", rr.Code)
+	}
+	// listings cover this shard alone
+	if rr = sendRequest(t, "GET", "/keys", nil, nil); rr.Code != http.StatusOK || strings.Contains(b.lastRequest(), "GET /keys ") {
+		t.Errorf("Expected the listing served here, got %d", rr.Code)
+	}
+}
+
+func TestShardRebalance(t *testing.T) {
+	b := startFakeShard(t)
+	s := startTestShard(t, map[string]string{"a": "http://a.invalid"})
+	for i := 0; i < 100; i++ {
+		_ = Put("k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	_, _ = SetIf("k0", binaryValue, KeyMeta{ContentType: "image/png"}, time.Now().Add(time.Hour), SetAlways, nil)
+	if status := s.Status(); status.Keys != 100 || status.Misplaced != 0 {
+		t.Fatalf("Expected a lone shard to own every key, got %+v", status)
+	}
+
+	// b joins
+	body, _ := json.Marshal(map[string]string{"a": "http://a.invalid", "b": b.srv.URL})
+	rr := sendRequest(t, "PUT", "/shards/members", body, nil)
+	var resp ShardMembersResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil || rr.Code != http.StatusOK || len(resp.Members) != 2 || resp.Unreached != nil {
+		t.Fatalf("Expected the members replaced, got %d %+v, %v", rr.Code, resp, err)
+	}
+	if got := b.lastRequest(); got != "PUT /shards/members a "+string(body) {
+		t.Errorf("Expected b told of the change, got %q", got)
+	}
+	waitFor(t, "b's keys moved", func() bool { return s.Status().Misplaced == 0 })
+
+	moved := b.importedCount()
+	if moved == 0 || moved == 100 {
+		t.Fatalf("Expected some of the keys moved, got %d", moved)
+	}
+	for i := 0; i < 100; i++ {
+		key := "k" + strconv.Itoa(i)
+		owner, _ := s.Owner(key)
+		_, err := Get(key)
+		b.Lock()
+		e, imported := b.imported[key]
+		b.Unlock()
+		if (owner == "b") != imported || (owner == "a") != (err == nil) {
+			t.Errorf("%s: expected it on %s alone, got imported %v, local %v", key, owner, imported, err)
+		}
+		if key == "k0" && imported && (e.Value != binaryValue || e.Meta == nil || e.Meta.ContentType != "image/png" || e.ExpiresAt == nil) {
+			t.Errorf("Expected k0's value, metadata and expiry moved, got %+v", e)
+		}
+	}
+	if status := s.Status(); status.Moved != uint64(moved) || status.Keys != 100-moved {
+		t.Errorf("Expected %d keys reported moved, got %+v", moved, status)
+	}
+
+	// a leaves, as told by another member
+	body, _ = json.Marshal(map[string]string{"b": b.srv.URL})
+	sendRequest(t, "PUT", "/shards/members", body, map[string]string{shardForwardedHeader: "b"})
+	waitFor(t, "every key moved", func() bool { return s.Status().Keys == 0 })
+	if n := b.importedCount(); n != 100 {
+		t.Errorf("Expected b to hold every key, got %d", n)
+	}
+}
+
+func TestShardMisplacedBatches(t *testing.T) {
+	s := startTestShard(t, map[string]string{"a": "http://a.invalid"})
+	for i := 0; i < 100; i++ {
+		_ = Put("k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	// b joins without a rebalance
+	s.mu.Lock()
+	s.members = map[string]string{"a": "http://a.invalid", "b": "http://b.invalid"}
+	s.ring = NewHashRing([]string{"a", "b"}, s.vnodes)
+	s.mu.Unlock()
+
+	total := s.misplacedCount()
+	if total < 2 || total == 100 {
+		t.Fatalf("Expected some keys misplaced, got %d", total)
+	}
+	batches, more := s.misplaced(2)
+	if n := len(batches["http://b.invalid"]); n != 2 || !more {
+		t.Errorf("Expected a batch of 2 with more remaining, got %d, %v", n, more)
+	}
+	batches, more = s.misplaced(total)
+	if n := len(batches["http://b.invalid"]); n != total || more {
+		t.Errorf("Expected all %d in one batch, got %d, %v", total, n, more)
+	}
+}
+
+func TestShardImport(t *testing.T) {
+	s := startTestShard(t, map[string]string{"a": "http://a.invalid", "b": "http://b.invalid"})
+	mine := keyOwnedBy(t, s, "k", "a")
+	written := keyOwnedBy(t, s, mine, "a")
+	theirs := keyOwnedBy(t, s, "k", "b")
+	_ = Put(written, "new")
+
+	import_ := func(keys ...string) int {
+		var entries []snapshotEntry
+		for _, key := range keys {
+			entries = append(entries, snapshotEntry{Key: key, Value: "moved"})
+		}
+		body, _ := json.Marshal(entries)
+		return sendRequest(t, "POST", "/shards/import", body, map[string]string{shardForwardedHeader: "b"}).Code
+	}
+	if code := import_(mine, theirs); code != http.StatusConflict {
+		t.Errorf("Expected status 409 importing another shard's key, got %d", code)
+	}
+	if _, err := Get(mine); err == nil {
+		t.Error("Expected a rejected import to store nothing")
+	}
+	if code := import_(mine, written); code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", code)
+	}
+	if value, _ := Get(mine); value == nil || *value != "moved" {
+		t.Errorf("Expected the moved key stored, got %v", value)
+	}
+	if value, _ := Get(written); value == nil || *value != "new" {
+		t.Errorf("Expected the key written since the move kept, got %v", value)
+	}
+
+	if rr := sendRequest(t, "PUT", "/shards/members", []byte(`{"a":"a.invalid"}`), nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a member without a URL rejected, got %d", rr.Code)
+	}
+	if rr := sendRequest(t, "PUT", "/shards/members", []byte(`{}`), nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an empty membership rejected, got %d", rr.Code)
+	}
+}
+
+func TestShardOwnershipAcrossProtocols(t *testing.T) {
+	s := startTestShard(t, map[string]string{"a": "http://a.invalid", "b": "http://b.invalid"})
+	mine := keyOwnedBy(t, s, "k", "a")
+	theirs := keyOwnedBy(t, s, "k", "b")
+
+	// the store refuses writes to another shard's keys, whatever the protocol
+	if err := Put(mine, "v"); err != nil {
+		t.Errorf("Expected a write to an owned key, got %v", err)
+	}
+	if err := Put(theirs, "v"); !errors.Is(err, ErrorNotOwner) {
+		t.Errorf("Expected ErrorNotOwner writing another shard's key, got %v", err)
+	}
+	if reply := respSet([]string{theirs, "v"}); !strings.Contains(fmt.Sprint(reply), ErrorNotOwner.Error()) {
+		t.Errorf("Expected a RESP SET of another shard's key refused, got %v", reply)
+	}
+	if _, err := Txn([]TxnOp{{Op: TxnUpdate, Key: mine, Value: "w"}, {Op: TxnPut, Key: theirs, Value: "w"}}); !errors.Is(err, ErrorNotOwner) {
+		t.Errorf("Expected a txn writing another shard's key refused, got %v", err)
+	}
+	if value, _ := Get(mine); value == nil || *value != "v" {
+		t.Errorf("Expected a refused txn to change nothing, got %v", value)
+	}
+	if _, err := Get(theirs); !errors.Is(err, ErrorNotOwner) {
+		t.Errorf("Expected ErrorNotOwner reading another shard's key, got %v", err)
+	}
+
+	// nor is another shard's key reported absent
+	rs := &respServer{}
+	for _, cmd := range []string{"GET", "EXISTS", "TTL"} {
+		if reply := rs.execute(cmd, []string{theirs}); !strings.Contains(fmt.Sprint(reply), ErrorNotOwner.Error()) {
+			t.Errorf("Expected a RESP %s of another shard's key refused, got %v", cmd, reply)
+		}
+	}
+	if reply := memcachedGet([]string{mine, theirs}, false); !strings.HasPrefix(reply, "SERVER_ERROR "+ErrorNotOwner.Error()) {
+		t.Errorf("Expected a memcached get of another shard's key refused, got %q", reply)
+	}
+	_, err := (&grpcServer{}).Get(context.Background(), &kvpb.GetRequest{Key: theirs})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected a gRPC Get of another shard's key refused, got %v", err)
+	}
+	if rr := sendRequest(t, "GET", "/keys/"+theirs, nil, map[string]string{shardForwardedHeader: "b"}); rr.Code != http.StatusConflict {
+		t.Errorf("Expected a forwarded GET of another shard's key refused, got %d", rr.Code)
+	}
+
+	// keys out of place, as before a membership change, can still be deleted
+	s.setMembers(map[string]string{"b": "http://b.invalid"})
+	if err := Delete(mine); err != nil {
+		t.Errorf("Expected a key no longer owned deleted, got %v", err)
+	}
+}
+
+func TestShardEndpointsWithoutSharding(t *testing.T) {
+	InitKeyStore()
+	tests := []struct{ method, path, body string }{
+		{"GET", "/shards", ""},
+		{"PUT", "/shards/members", `{"a":"http://a:8000"}`},
+		{"POST", "/shards/import", "[]"},
+	}
+	for _, tc := range tests {
+		if rr := sendRequest(t, tc.method, tc.path, []byte(tc.body), nil); rr.Code != http.StatusNotFound {
+			t.Errorf("%s %s: expected status 404, got %d", tc.method, tc.path, rr.Code)
+		}
+	}
+}
+
+func TestValidateShards(t *testing.T) {
+	tests := []struct {
+		id, peers, raftID string
+		vnodes            int
+		problem           string
+	}{
+		{"a", "", "", 128, "together"},
+		{"a", "a=http://a:8000", "a", 128, "raftId"},
+		{"a", "b=http://b:8000", "", 128, "missing shardId"},
+		{"a", "a=a:8000", "", 128, "http or https"},
+		{"", "", "", 0, "shardVirtualNodes"},
+	}
+	for _, tc := range tests {
+		cfg := DefaultConfig()
+		cfg.ShardID, cfg.ShardPeers, cfg.ShardVirtualNodes = tc.id, tc.peers, tc.vnodes
+		if tc.raftID != "" {
+			cfg.RaftID, cfg.RaftPeers = tc.raftID, tc.peers
+		}
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tc.problem) {
+			t.Errorf("%s %s: expected %q, got %v", tc.id, tc.peers, tc.problem, err)
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.ShardID, cfg.ShardPeers = "a", "a=http://a:8000,b=http://b:8000"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected the shards accepted, got %v", err)
+	}
+}
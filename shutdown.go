@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// process exit codes, so supervisors can tell a clean shutdown from a failure
+const (
+	// requests drained and state flushed after SIGINT/SIGTERM
+	exitShutdown = 0
+	// the server failed to start or stopped unexpectedly
+	exitServerError = 1
+	// invalid configuration
+	exitConfigError = 2
+	// requests were still running at the drain deadline and were cut off
+	exitDrainTimeout = 3
+	// the persistence layer could not be flushed
+	exitFlushError = 4
+)
+
+var errDrainTimeout = errors.New("drain deadline exceeded")
+
+// serve handles requests on l until ctx is cancelled, then stops accepting
+// connections and waits up to drainTimeout for active requests to finish
+func serve(ctx context.Context, srv *http.Server, l net.Listener, drainTimeout time.Duration) error {
+	// request contexts are cancelled when shutdown begins, so long-lived
+	// requests such as watches end rather than holding up the drain
+	srv.BaseContext = func(net.Listener) context.Context { return ctx }
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	logInfof("Shutting down; draining active requests for up to %s", drainTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(drainCtx); err != nil {
+		// cut off whatever is still running
+		_ = srv.Close()
+		return fmt.Errorf("%w: %s", errDrainTimeout, err)
+	}
+	logInfof("All requests drained")
+	return nil
+}
+
+// flushPersistence write a final snapshot, when snapshots are enabled, then
+// sync and close the write-ahead log
+func flushPersistence(snapshot bool) error {
+	if keyStoreWAL == nil {
+		return nil
+	}
+
+	var err error
+	if snapshot {
+		err = keyStoreWAL.Snapshot()
+	}
+	if closeErr := keyStoreWAL.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// the exit code for a shutdown, given the results of serve and flushPersistence
+func shutdownExitCode(serveErr error, flushErr error) int {
+	switch {
+	case errors.Is(serveErr, errDrainTimeout):
+		return exitDrainTimeout
+	case serveErr != nil:
+		return exitServerError
+	case flushErr != nil:
+		return exitFlushError
+	}
+	return exitShutdown
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// start serving handler on a local port, returning its URL, the cancel
+// function that triggers shutdown and a channel receiving serve's result
+func startTestServer(t *testing.T, handler http.Handler, drainTimeout time.Duration) (string, context.CancelFunc, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	result := make(chan error, 1)
+	go func() {
+		result <- serve(ctx, &http.Server{Handler: handler}, l, drainTimeout)
+	}()
+	return "http://" + l.Addr().String(), cancel, result
+}
+
+func TestServeDrainsActiveRequests(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	})
+	url, cancel, result := startTestServer(t, handler, time.Second)
+
+	body := make(chan string, 1)
+	go func() {
+		res, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		body <- string(b)
+	}()
+
+	<-started
+	cancel()
+
+	if got := <-body; got != "done" {
+		t.Errorf("Expected in-flight request to complete, got %s", got)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("Expected clean shutdown, got %s", err)
+	}
+
+	// no new connections are accepted
+	if _, err := http.Get(url); err == nil {
+		t.Error("Expected request after shutdown to fail")
+	}
+}
+
+func TestServeDrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	url, cancel, result := startTestServer(t, handler, 20*time.Millisecond)
+
+	go func() {
+		res, err := http.Get(url)
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+
+	<-started
+	cancel()
+
+	err := <-result
+	if !errors.Is(err, errDrainTimeout) {
+		t.Errorf("Expected errDrainTimeout, got %v", err)
+	}
+}
+
+func TestFlushPersistence(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	openTestWAL(t, dir)
+	_ = Put("flushkey", "val")
+
+	if err := flushPersistence(true); err != nil {
+		t.Fatalf("Got error flushing: %s", err)
+	}
+	if snapshots, _ := snapshotFiles(dir); len(snapshots) != 1 {
+		t.Errorf("Expected a final snapshot, got %v", snapshots)
+	}
+	if err := Put("afterflush", "val"); !errors.Is(err, ErrorWALClosed) {
+		t.Errorf("Expected writes after flush to fail with ErrorWALClosed, got %v", err)
+	}
+}
+
+func TestShutdownExitCode(t *testing.T) {
+	tests := []struct {
+		serveErr error
+		flushErr error
+		expected int
+	}{
+		{nil, nil, exitShutdown},
+		{errDrainTimeout, nil, exitDrainTimeout},
+		{errors.New("listener closed"), nil, exitServerError},
+		{nil, errors.New("disk full"), exitFlushError},
+	}
+
+	for _, tc := range tests {
+		if code := shutdownExitCode(tc.serveErr, tc.flushErr); code != tc.expected {
+			t.Errorf("serve %v, flush %v: expected exit code %d, got %d", tc.serveErr, tc.flushErr, tc.expected, code)
+		}
+	}
+}
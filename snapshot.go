@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".json"
+)
+
+// snapshotEntry a key, its value and its KeyMinHeap insertion timestamp
+type snapshotEntry struct {
+	Key       string     `json:"key"`
+	Value     string     `json:"value"`
+	Encoding  string     `json:"encoding,omitempty"`
+	Timestamp time.Time  `json:"ts"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Version   uint64     `json:"version,omitempty"`
+	Meta      *KeyMeta   `json:"meta,omitempty"`
+}
+
+// snapshot the full keyStore as of WAL sequence Seq
+type snapshot struct {
+	Seq      uint64          `json:"seq"`
+	Revision uint64          `json:"rev"`
+	Created  time.Time       `json:"created"`
+	Entries  []snapshotEntry `json:"entries"`
+}
+
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("%s%020d%s", snapshotPrefix, seq, snapshotSuffix)
+}
+
+// list the snapshot files in dir, oldest first
+func snapshotFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// load the most recent snapshot in dir; nil if there isn't one
+func loadLatestSnapshot(dir string) (*snapshot, error) {
+	files, err := snapshotFiles(dir)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+
+	path := files[len(files)-1]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("corrupt snapshot %s: %w", path, err)
+	}
+	return &snap, nil
+}
+
+// capture the keyStore contents; caller holds the keyStore lock
+func captureSnapshot(seq uint64) *snapshot {
+	timestamps := make(map[string]time.Time, keyStore.kmh.Len())
+	for _, kd := range keyStore.kmh.items {
+		timestamps[kd.Key] = kd.timestamp
+	}
+
+	snap := &snapshot{Seq: seq, Revision: keyStore.revision, Created: time.Now(), Entries: make([]snapshotEntry, 0, len(keyStore.m))}
+	for k, v := range keyStore.m {
+		entry := snapshotEntry{Key: k, Value: v, Timestamp: timestamps[k], Version: keyStore.versions[k]}
+		if meta, ok := keyStore.meta[k]; ok {
+			entry.Meta = &meta
+		}
+		if expiresAt, ok := keyStore.expires[k]; ok {
+			entry.ExpiresAt = &expiresAt
+		}
+		snap.Entries = append(snap.Entries, entry)
+	}
+	return snap
+}
+
+// load the snapshot's entries into the keyStore in insertion order, so the
+// eviction policy sees them in the order they were originally added; caller
+// holds the keyStore lock
+func restoreSnapshot(snap *snapshot) {
+	sort.Slice(snap.Entries, func(i, j int) bool {
+		return snap.Entries[i].Timestamp.Before(snap.Entries[j].Timestamp)
+	})
+	for _, e := range snap.Entries {
+		var expiresAt time.Time
+		if e.ExpiresAt != nil {
+			expiresAt = *e.ExpiresAt
+		}
+		applyPut(e.Key, e.Value, e.Timestamp, expiresAt, e.Version)
+		if e.Meta != nil {
+			applyMeta(e.Key, *e.Meta)
+		}
+	}
+	keyStore.revision = snap.Revision
+}
+
+// write the snapshot to dir via a temporary file so a crash never leaves a
+// partial snapshot behind
+func writeSnapshot(dir string, snap *snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), filepath.Join(dir, snapshotName(snap.Seq))); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// fsync the directory so renames and removals within it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Snapshot dumps the keyStore to a new snapshot file, then removes the log
+// segments and snapshots it supersedes. Nothing is written if there have been
+// no mutations since the last snapshot.
+func (w *WAL) Snapshot() error {
+	// hold the keyStore lock so no mutation is appended between capturing the
+	// contents and rotating to a fresh segment
+	keyStore.RLock()
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		keyStore.RUnlock()
+		return ErrorWALClosed
+	}
+	if w.seq == w.snapSeq {
+		w.mu.Unlock()
+		keyStore.RUnlock()
+		return nil
+	}
+
+	seq := w.seq
+	snap := captureSnapshot(seq)
+	err := w.rotateLocked()
+	w.mu.Unlock()
+	keyStore.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err = writeSnapshot(w.dir, snap); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.snapSeq = seq
+	w.mu.Unlock()
+	logInfof("Snapshot: wrote %d keys at seq %d", len(snap.Entries), seq)
+
+	if err = w.compact(seq); err != nil {
+		return err
+	}
+	if keyStoreRaft != nil {
+		// a restart replays the Raft log only from the snapshot on
+		return keyStoreRaft.Compact(snap.Revision)
+	}
+	return nil
+}
+
+// remove segments holding only entries covered by the snapshot at seq, along
+// with any older snapshots
+func (w *WAL) compact(seq uint64) error {
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	// every segment before the one starting after seq is fully covered
+	current := filepath.Join(w.dir, walSegmentName(seq+1))
+	for _, segment := range segments {
+		if segment >= current {
+			break
+		}
+		if err = os.Remove(segment); err != nil {
+			return err
+		}
+	}
+
+	snapshots, err := snapshotFiles(w.dir)
+	if err != nil {
+		return err
+	}
+	latest := filepath.Join(w.dir, snapshotName(seq))
+	for _, snap := range snapshots {
+		if snap >= latest {
+			break
+		}
+		if err = os.Remove(snap); err != nil {
+			return err
+		}
+	}
+	return syncDir(w.dir)
+}
+
+// rewriteLocked snapshots the keyStore and removes the rest of the log, even if
+// nothing has changed since the last snapshot, so a keyStore replaced other
+// than by logged mutations is restored as it is now; caller holds the
+// keyStore lock
+func (w *WAL) rewriteLocked() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrorWALClosed
+	}
+	seq := w.seq
+	snap := captureSnapshot(seq)
+	err := w.rotateLocked()
+	if err == nil {
+		// written before the keyStore is unlocked, so a crash can't replay
+		// the log the snapshot replaces
+		err = writeSnapshot(w.dir, snap)
+	}
+	if err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	w.snapSeq = seq
+	w.mu.Unlock()
+	return w.compact(seq)
+}
+
+// StartSnapshots snapshots the keyStore every interval until the WAL is closed
+func (w *WAL) StartSnapshots(interval time.Duration) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := w.Snapshot(); err != nil {
+					logErrorf("Snapshot: failed: %s", err)
+				}
+			case <-w.done:
+				return
+			}
+		}
+	}()
+}
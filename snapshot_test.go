@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	w := openTestWAL(t, dir)
+
+	for i := 0; i < 4; i++ {
+		if err := Put(fmt.Sprintf("snapkey%d", i), fmt.Sprintf("snapval%d", i)); err != nil {
+			t.Fatalf("Got error during Put: %s", err)
+		}
+	}
+	firstTs := keyStore.kmh.At(0).timestamp
+
+	if err := w.Snapshot(); err != nil {
+		t.Fatalf("Got error taking snapshot: %s", err)
+	}
+
+	// mutations after the snapshot are only in the log
+	_ = Update("snapkey0", "newer")
+	_ = Delete("snapkey3")
+	_ = Put("snapkey4", "snapval4")
+
+	keyStoreWAL = nil
+	_ = w.Close()
+
+	InitKeyStore()
+	openTestWAL(t, dir)
+
+	expected := map[string]string{"snapkey0": "newer", "snapkey1": "snapval1", "snapkey2": "snapval2", "snapkey4": "snapval4"}
+	if len(keyStore.m) != len(expected) {
+		t.Errorf("Expected %d keys after restore, got %d", len(expected), len(keyStore.m))
+	}
+	for k, v := range expected {
+		if keyStore.m[k] != v {
+			t.Errorf("Key %s: expected %s after restore, got %s", k, v, keyStore.m[k])
+		}
+	}
+
+	// insertion order survives the restore
+	oldest := keyStore.kmh.At(0)
+	if oldest.Key != "snapkey0" || !oldest.timestamp.Equal(firstTs) {
+		t.Errorf("Expected snapkey0 inserted at %s as oldest, got %s at %s", firstTs, oldest.Key, oldest.timestamp)
+	}
+}
+
+func TestSnapshotCompaction(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	w := openTestWAL(t, dir)
+
+	_ = Put("compact1", "val")
+	if err := w.Snapshot(); err != nil {
+		t.Fatalf("Got error taking snapshot: %s", err)
+	}
+	_ = Put("compact2", "val")
+	if err := w.Snapshot(); err != nil {
+		t.Fatalf("Got error taking snapshot: %s", err)
+	}
+
+	snapshots, _ := snapshotFiles(dir)
+	if len(snapshots) != 1 {
+		t.Errorf("Expected only the latest snapshot to remain, got %v", snapshots)
+	}
+
+	// only the empty segment started by the last snapshot is left
+	segments, _ := walSegments(dir)
+	if len(segments) != 1 || segments[0] != filepath.Join(dir, walSegmentName(3)) {
+		t.Errorf("Expected a single segment starting at seq 3, got %v", segments)
+	}
+
+	// no mutations since the last snapshot, so nothing new is written
+	if err := w.Snapshot(); err != nil {
+		t.Fatalf("Got error taking snapshot: %s", err)
+	}
+	snapshots, _ = snapshotFiles(dir)
+	if len(snapshots) != 1 || snapshots[0] != filepath.Join(dir, snapshotName(2)) {
+		t.Errorf("Expected snapshot at seq 2, got %v", snapshots)
+	}
+}
+
+func TestStartSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	w := openTestWAL(t, dir)
+	w.StartSnapshots(10 * time.Millisecond)
+
+	_ = Put("periodic", "val")
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if snapshots, _ := snapshotFiles(dir); len(snapshots) == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("No snapshot written by background snapshotter")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Stats the keyStore's size, limits and revision
+type Stats struct {
+	Keys int `json:"keys"`
+	// keys with a TTL
+	Expiring int   `json:"expiring"`
+	Bytes    int64 `json:"bytes"`
+	// capacity limits; 0 is unlimited
+	MaxKeys       int    `json:"maxKeys"`
+	MaxBytes      int64  `json:"maxBytes"`
+	Revision      uint64 `json:"revision"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+}
+
+// GetStats the keyStore's current Stats
+func GetStats() Stats {
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+	return Stats{
+		Keys:          len(keyStore.m),
+		Expiring:      len(keyStore.expires),
+		Bytes:         keyStore.bytes,
+		MaxKeys:       keyStore.maxKeys,
+		MaxBytes:      keyStore.maxBytes,
+		Revision:      keyStore.revision,
+		UptimeSeconds: int64(getUptime() / time.Second),
+	}
+}
+
+func StatsHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(GetStats()); err != nil {
+		logErrorf("statsHandlerFunc - Error %s", err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStatsHandler(t *testing.T) {
+	InitKeyStore()
+	defer InitKeyStore()
+	_ = Put("a", "12345")
+	_ = Put("b", "123")
+	_ = PutWithExpiry("c", "1", time.Now().Add(time.Hour))
+
+	rr := sendRequest(t, "GET", "/stats", nil, nil)
+	var stats Stats
+	if err := json.NewDecoder(rr.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != 200 || rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected status 200 with JSON, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if stats.Keys != 3 || stats.Expiring != 1 || stats.Bytes != 9 || stats.Revision != 3 || stats.MaxKeys != keyStore.maxKeys {
+		t.Errorf("Expected 3 keys of 9 bytes, one expiring, got %+v", stats)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// tcpServer serves a protocol other than HTTP, such as RESP, on its own
+// listener, with one goroutine per connection running handle
+type tcpServer struct {
+	name   string
+	handle func(conn net.Conn)
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	shutdown bool
+	wg       sync.WaitGroup
+}
+
+func newTCPServer(name string, handle func(conn net.Conn)) *tcpServer {
+	return &tcpServer{name: name, handle: handle, conns: make(map[net.Conn]struct{})}
+}
+
+// Serve accept connections on l until Shutdown is called, when it returns
+// nil; otherwise it returns the error that stopped it
+func (s *tcpServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		_ = l.Close()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			shutdown := s.shutdown
+			s.mu.Unlock()
+			if shutdown {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+
+		s.mu.Lock()
+		if s.shutdown {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				_ = conn.Close()
+			}()
+			s.handle(conn)
+		}()
+	}
+}
+
+// Shutdown stop accepting connections and wait, until ctx is done, for
+// every connection to finish the command it's running. Connections waiting
+// for their next command are woken by an expired read deadline, so handlers
+// must treat a read error as the end of the connection.
+func (s *tcpServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			_ = conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return fmt.Errorf("%s: %w", s.name, errDrainTimeout)
+	}
+}
+
+// ListenAndServe listen on addr and serve in the background
+func (s *tcpServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logInfof("%s listening on %s", s.name, l.Addr())
+	go func() {
+		if err := s.Serve(l); err != nil {
+			logErrorf("%s stopped: %s", s.name, err)
+		}
+	}()
+	return nil
+}
+
+// protocolServer a listener for a protocol other than HTTP, stopped
+// alongside the HTTP server
+type protocolServer interface {
+	Shutdown(ctx context.Context) error
+}
+
+// shut every server down concurrently, all within drainTimeout, returning
+// the first error
+func shutdownProtocolServers(servers []protocolServer, drainTimeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s protocolServer) {
+			errs <- s.Shutdown(ctx)
+		}(s)
+	}
+	var err error
+	for range servers {
+		if serr := <-errs; err == nil {
+			err = serr
+		}
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func contextWithTimeout(t *testing.T, timeout time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// start an echo server whose handler takes delay per line
+func startEchoServer(t *testing.T, delay time.Duration) (*tcpServer, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTCPServer("echo", func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			time.Sleep(delay)
+			if _, err = conn.Write([]byte(line)); err != nil {
+				return
+			}
+		}
+	})
+	go func() { _ = s.Serve(l) }()
+	return s, l.Addr().String()
+}
+
+func TestTCPServerShutdownFinishesCommands(t *testing.T) {
+	s, addr := startEchoServer(t, 50*time.Millisecond)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	if _, err = conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if err = s.Shutdown(contextWithTimeout(t, time.Second)); err != nil {
+		t.Errorf("Expected clean shutdown, got %s", err)
+	}
+	// the running command completed before its connection closed
+	if line, err := bufio.NewReader(conn).ReadString('\n'); line != "hello\n" {
+		t.Errorf("Expected the echo, got %q, %v", line, err)
+	}
+	if _, err = net.Dial("tcp", addr); err == nil {
+		t.Error("Expected connections after shutdown to fail")
+	}
+}
+
+func TestTCPServerShutdownTimeout(t *testing.T) {
+	s, addr := startEchoServer(t, time.Second)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("slow\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if err = s.Shutdown(contextWithTimeout(t, 20*time.Millisecond)); !errors.Is(err, errDrainTimeout) {
+		t.Errorf("Expected errDrainTimeout, got %v", err)
+	}
+}
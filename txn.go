@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// the most operations accepted in one transaction
+const maxTxnOps = 128
+
+// TxnOpType the kind of a transaction operation
+type TxnOpType string
+
+const (
+	TxnPut    TxnOpType = "put"
+	TxnUpdate TxnOpType = "update"
+	TxnDelete TxnOpType = "delete"
+	// TxnCheck asserts the key's state without changing it
+	TxnCheck TxnOpType = "check"
+)
+
+// TxnOp a single operation in a transaction. Put, update and delete behave as
+// Put, Update and Delete. A check holds when the key exists, or when Absent
+// is set, when it doesn't.
+type TxnOp struct {
+	Op    TxnOpType `json:"op"`
+	Key   string    `json:"key"`
+	Value string    `json:"value,omitempty"`
+	// when set, the key must be at this version
+	Version uint64 `json:"version,omitempty"`
+	Absent  bool   `json:"absent,omitempty"`
+}
+
+// TxnResult the outcome of one operation. Writes report the key's new
+// version; checks report the key's current value and version.
+type TxnResult struct {
+	Op      TxnOpType `json:"op"`
+	Key     string    `json:"key"`
+	Value   string    `json:"value,omitempty"`
+	Version uint64    `json:"version,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+var ErrorInvalidTxn = errors.New("invalid transaction")
+
+// TxnError identifies the operation that aborted a transaction
+type TxnError struct {
+	Index int
+	Err   error
+}
+
+func (e *TxnError) Error() string {
+	return fmt.Sprintf("transaction aborted at operation %d: %s", e.Index, e.Err)
+}
+
+func (e *TxnError) Unwrap() error {
+	return e.Err
+}
+
+// a key's state as seen part way through a transaction
+type txnKeyState struct {
+	exists  bool
+	value   string
+	version uint64
+	// written earlier in the transaction, so version is provisional
+	written bool
+}
+
+// validate an operation against the state its key is in at that point of the
+// transaction, returning the state the operation leaves it in
+func (op TxnOp) apply(state txnKeyState, rev uint64) (txnKeyState, error) {
+	if op.Key == "" {
+		return state, fmt.Errorf("%w: empty key", ErrorInvalidTxn)
+	}
+	if op.Version != 0 && (!state.exists || state.version != op.Version) {
+		return state, ErrorVersionMismatch
+	}
+
+	switch op.Op {
+	case TxnPut:
+		if state.exists {
+			return state, ErrorKeyExists
+		}
+		return txnKeyState{exists: true, value: op.Value, version: rev, written: true}, nil
+	case TxnUpdate:
+		if !state.exists {
+			return state, ErrorNoSuchKey
+		}
+		return txnKeyState{exists: true, value: op.Value, version: rev, written: true}, nil
+	case TxnDelete:
+		if !state.exists {
+			return state, ErrorNoSuchKey
+		}
+		return txnKeyState{written: true}, nil
+	case TxnCheck:
+		if op.Absent && state.exists {
+			return state, ErrorKeyExists
+		}
+		if !op.Absent && !state.exists {
+			return state, ErrorNoSuchKey
+		}
+		return state, nil
+	}
+	return state, fmt.Errorf("%w: unknown op %q", ErrorInvalidTxn, op.Op)
+}
+
+// Txn apply ops atomically under one keyStore lock: either every operation
+// succeeds and all writes are applied, or none are and the returned
+// *TxnError identifies the operation that failed. Later operations see the
+// effects of earlier ones.
+func Txn(ops []TxnOp) ([]TxnResult, error) {
+	results := make([]TxnResult, len(ops))
+	for i, op := range ops {
+		results[i] = TxnResult{Op: op.Op, Key: op.Key}
+	}
+	if len(ops) == 0 || len(ops) > maxTxnOps {
+		return results, fmt.Errorf("%w: expected 1 to %d operations, got %d", ErrorInvalidTxn, maxTxnOps, len(ops))
+	}
+
+	lockWrites()
+	defer unlockWrites()
+
+	rev := keyStore.revision + 1
+	initial := make(map[string]txnKeyState)
+	current := make(map[string]txnKeyState)
+	var touched []string
+	// results whose version is only known once the transaction commits
+	var provisional []int
+
+	for i, op := range ops {
+		state, seen := current[op.Key]
+		if !seen && op.Key != "" {
+			if err := expireKey(op.Key); err != nil {
+				return results, &TxnError{Index: i, Err: err}
+			}
+			value, exists := keyStore.m[op.Key]
+			state = txnKeyState{exists: exists, value: value, version: keyStore.versions[op.Key]}
+			initial[op.Key] = state
+			touched = append(touched, op.Key)
+			// expiring keys may have moved the revision on
+			rev = keyStore.revision + 1
+		}
+
+		next, err := op.apply(state, rev)
+		if err != nil {
+			results[i].Error = err.Error()
+			return results, &TxnError{Index: i, Err: err}
+		}
+		current[op.Key] = next
+		results[i].Value = next.value
+		results[i].Version = next.version
+		if next.written {
+			provisional = append(provisional, i)
+		}
+	}
+
+	// make room for the transaction's net growth up front, so no write can
+	// fail once the first is applied
+	needKeys := 0
+	var needBytes int64
+	for _, key := range touched {
+		before, after := initial[key], current[key]
+		if after.exists && !before.exists {
+			needKeys++
+		} else if before.exists && !after.exists {
+			needKeys--
+		}
+		needBytes += int64(len(after.value)) - int64(len(before.value))
+	}
+	if needKeys > 0 || needBytes > 0 {
+		if err := makeRoom(needKeys, needBytes, touched...); err != nil {
+			return results, err
+		}
+		// making room purges expired keys, which may include one that
+		// expired since it was validated
+		for i, op := range ops {
+			if _, exists := keyStore.m[op.Key]; exists != initial[op.Key].exists {
+				results[i].Error = ErrorNoSuchKey.Error()
+				return results, &TxnError{Index: i, Err: ErrorNoSuchKey}
+			}
+		}
+	}
+
+	now := time.Now()
+	var batch []walEntry
+	for _, op := range ops {
+		switch op.Op {
+		case TxnPut:
+			batch = append(batch, walEntry{Op: walOpPut, Key: op.Key, Value: op.Value, Timestamp: now})
+		case TxnUpdate:
+			batch = append(batch, walEntry{Op: walOpUpdate, Key: op.Key, Value: op.Value, Timestamp: now})
+		case TxnDelete:
+			batch = append(batch, walEntry{Op: walOpDelete, Key: op.Key, Timestamp: now})
+		}
+	}
+	if len(batch) == 0 {
+		// only checks
+		return results, nil
+	}
+
+	committed, err := commit(walEntry{Op: walOpTxn, Timestamp: now, Batch: batch})
+	if err != nil {
+		return results, err
+	}
+	// evictions while making room can move the revision past the one the
+	// operations were validated with
+	for _, i := range provisional {
+		if results[i].Version != 0 {
+			results[i].Version = committed
+		}
+	}
+	return results, nil
+}
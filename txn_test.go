@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTxnCommitsAllOps(t *testing.T) {
+	InitKeyStore()
+	_ = Put("txnA", "a")
+	_ = Put("txnB", "b")
+	_, versionA, _ := GetWithVersion("txnA")
+
+	results, err := Txn([]TxnOp{
+		{Op: TxnCheck, Key: "txnA", Version: versionA},
+		{Op: TxnUpdate, Key: "txnA", Value: "a2"},
+		{Op: TxnDelete, Key: "txnB"},
+		{Op: TxnPut, Key: "txnC", Value: "c"},
+		{Op: TxnCheck, Key: "txnB", Absent: true},
+	})
+	if err != nil {
+		t.Fatalf("Got error committing transaction: %s", err)
+	}
+
+	assertKeys(t, []string{"txnA", "txnC"}, []string{"txnB"})
+	if keyStore.m["txnA"] != "a2" {
+		t.Errorf("Expected txnA updated to a2, got %s", keyStore.m["txnA"])
+	}
+
+	// every write shares the transaction's revision
+	_, versionC, _ := GetWithVersion("txnC")
+	if results[1].Version != versionC || results[3].Version != versionC {
+		t.Errorf("Expected writes at version %d, got %+v", versionC, results)
+	}
+	if results[0].Value != "a" || results[0].Version != versionA {
+		t.Errorf("Expected check to report txnA's state, got %+v", results[0])
+	}
+}
+
+func TestTxnAbortsAtomically(t *testing.T) {
+	InitKeyStore()
+	_ = Put("txnA", "a")
+	revision := keyStore.revision
+
+	results, err := Txn([]TxnOp{
+		{Op: TxnUpdate, Key: "txnA", Value: "a2"},
+		{Op: TxnPut, Key: "txnB", Value: "b"},
+		{Op: TxnPut, Key: "txnA", Value: "again"},
+	})
+
+	var txnErr *TxnError
+	if !errors.As(err, &txnErr) || txnErr.Index != 2 || !errors.Is(err, ErrorKeyExists) {
+		t.Fatalf("Expected ErrorKeyExists at operation 2, got %v", err)
+	}
+	if results[2].Error == "" {
+		t.Error("Expected the failed operation's result to carry the error")
+	}
+	assertKeys(t, []string{"txnA"}, []string{"txnB"})
+	if keyStore.m["txnA"] != "a" || keyStore.revision != revision {
+		t.Error("Expected an aborted transaction to leave the keyStore unchanged")
+	}
+}
+
+func TestTxnErrors(t *testing.T) {
+	InitKeyStore()
+	_ = Put("txnA", "a")
+
+	tests := []struct {
+		name     string
+		ops      []TxnOp
+		expected error
+	}{
+		{"no ops", nil, ErrorInvalidTxn},
+		{"too many ops", make([]TxnOp, maxTxnOps+1), ErrorInvalidTxn},
+		{"unknown op", []TxnOp{{Op: "swap", Key: "txnA"}}, ErrorInvalidTxn},
+		{"empty key", []TxnOp{{Op: TxnPut, Value: "v"}}, ErrorInvalidTxn},
+		{"update missing", []TxnOp{{Op: TxnUpdate, Key: "missing", Value: "v"}}, ErrorNoSuchKey},
+		{"delete missing", []TxnOp{{Op: TxnDelete, Key: "missing"}}, ErrorNoSuchKey},
+		{"check missing", []TxnOp{{Op: TxnCheck, Key: "missing"}}, ErrorNoSuchKey},
+		{"check absent", []TxnOp{{Op: TxnCheck, Key: "txnA", Absent: true}}, ErrorKeyExists},
+		{"stale version", []TxnOp{{Op: TxnUpdate, Key: "txnA", Value: "v", Version: 999}}, ErrorVersionMismatch},
+	}
+
+	for _, tc := range tests {
+		if _, err := Txn(tc.ops); !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestTxnStoreFull(t *testing.T) {
+	initKeyStoreWithPolicy(t, EvictionReject, 2, 0)
+	_ = Put("txnA", "a")
+
+	_, err := Txn([]TxnOp{
+		{Op: TxnPut, Key: "txnB", Value: "b"},
+		{Op: TxnPut, Key: "txnC", Value: "c"},
+	})
+	if !errors.Is(err, ErrorStoreFull) {
+		t.Fatalf("Expected ErrorStoreFull, got %v", err)
+	}
+	assertKeys(t, []string{"txnA"}, []string{"txnB", "txnC"})
+
+	// deleting in the same transaction frees the room
+	_, err = Txn([]TxnOp{
+		{Op: TxnDelete, Key: "txnA"},
+		{Op: TxnPut, Key: "txnB", Value: "b"},
+		{Op: TxnPut, Key: "txnC", Value: "c"},
+	})
+	if err != nil {
+		t.Fatalf("Got error committing transaction: %s", err)
+	}
+	assertKeys(t, []string{"txnB", "txnC"}, []string{"txnA"})
+}
+
+func TestTxnReplay(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	openTestWAL(t, dir)
+
+	_ = Put("txnA", "a")
+	_, err := Txn([]TxnOp{
+		{Op: TxnDelete, Key: "txnA"},
+		{Op: TxnPut, Key: "txnB", Value: "b"},
+	})
+	if err != nil {
+		t.Fatalf("Got error committing transaction: %s", err)
+	}
+	_, version, _ := GetWithVersion("txnB")
+	_ = keyStoreWAL.Close()
+	keyStoreWAL = nil
+
+	InitKeyStore()
+	openTestWAL(t, dir)
+
+	assertKeys(t, []string{"txnB"}, []string{"txnA"})
+	if _, replayed, _ := GetWithVersion("txnB"); replayed != version {
+		t.Errorf("Expected txnB at version %d after replay, got %d", version, replayed)
+	}
+}
+
+func TestTxnHandler(t *testing.T) {
+	InitKeyStore()
+	router := newRouter()
+
+	tests := []struct {
+		body      string
+		status    int
+		succeeded bool
+	}{
+		{`{"ops":[{"op":"put","key":"h1","value":"v1"},{"op":"put","key":"h2","value":"v2"}]}`, http.StatusOK, true},
+		{`{"ops":[{"op":"update","key":"h1","value":"v"},{"op":"put","key":"h2","value":"v"}]}`, http.StatusConflict, false},
+		{`{"ops":[]}`, http.StatusBadRequest, false},
+		{`not json`, http.StatusBadRequest, false},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest("POST", "/txn", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.body, tc.status, rr.Code)
+		}
+		if rr.Code == http.StatusBadRequest && tc.body == `not json` {
+			continue
+		}
+		var res txnResponse
+		if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+			t.Errorf("%s: unable to decode response: %s", tc.body, err)
+			continue
+		}
+		if res.Succeeded != tc.succeeded {
+			t.Errorf("%s: expected succeeded %v, got %+v", tc.body, tc.succeeded, res)
+		}
+	}
+
+	if keyStore.m["h1"] != "v1" || keyStore.m["h2"] != "v2" {
+		t.Error("Expected only the first transaction to be applied")
+	}
+}
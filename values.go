@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// values that aren't UTF-8 text are base64 encoded in JSON, with their
+// encoding field set to this
+const encodingBase64 = "base64"
+
+var ErrorInvalidEncoding = errors.New("invalid value encoding")
+
+// encode a value for JSON, returning it and its encoding
+func encodeValue(value string) (string, string) {
+	if utf8.ValidString(value) {
+		return value, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(value)), encodingBase64
+}
+
+// decode a value received in JSON with encoding
+func decodeValue(value string, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return value, nil
+	case encodingBase64:
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", ErrorInvalidEncoding, err)
+		}
+		return string(decoded), nil
+	}
+	return "", fmt.Errorf("%w: unknown encoding %q", ErrorInvalidEncoding, encoding)
+}
+
+func (kv KeyValEntry) MarshalJSON() ([]byte, error) {
+	type plain KeyValEntry
+	p := plain(kv)
+	p.Value, p.Encoding = encodeValue(kv.Value)
+	return json.Marshal(p)
+}
+
+func (kv *KeyValEntry) UnmarshalJSON(data []byte) error {
+	type plain KeyValEntry
+	if err := json.Unmarshal(data, (*plain)(kv)); err != nil {
+		return err
+	}
+	value, err := decodeValue(kv.Value, kv.Encoding)
+	if err != nil {
+		return err
+	}
+	kv.Value, kv.Encoding = value, ""
+	return nil
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	type plain Event
+	p := plain(e)
+	p.Value, p.Encoding = encodeValue(e.Value)
+	return json.Marshal(p)
+}
+
+func (m wsMessage) MarshalJSON() ([]byte, error) {
+	type plain wsMessage
+	p := plain(m)
+	p.Value, p.Encoding = encodeValue(m.Value)
+	return json.Marshal(p)
+}
+
+// log entries and snapshots are JSON too, so binary values are encoded there
+// the same way
+
+func (e walEntry) MarshalJSON() ([]byte, error) {
+	type plain walEntry
+	p := plain(e)
+	p.Value, p.Encoding = encodeValue(e.Value)
+	return json.Marshal(p)
+}
+
+func (e *walEntry) UnmarshalJSON(data []byte) error {
+	type plain walEntry
+	if err := json.Unmarshal(data, (*plain)(e)); err != nil {
+		return err
+	}
+	value, err := decodeValue(e.Value, e.Encoding)
+	if err != nil {
+		return err
+	}
+	e.Value, e.Encoding = value, ""
+	return nil
+}
+
+func (e snapshotEntry) MarshalJSON() ([]byte, error) {
+	type plain snapshotEntry
+	p := plain(e)
+	p.Value, p.Encoding = encodeValue(e.Value)
+	return json.Marshal(p)
+}
+
+func (e *snapshotEntry) UnmarshalJSON(data []byte) error {
+	type plain snapshotEntry
+	if err := json.Unmarshal(data, (*plain)(e)); err != nil {
+		return err
+	}
+	value, err := decodeValue(e.Value, e.Encoding)
+	if err != nil {
+		return err
+	}
+	e.Value, e.Encoding = value, ""
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// a value that isn't valid UTF-8
+const binaryValue = "\x89PNG\r\n\x1a\n\x00\xff"
+
+func sendRequest(t *testing.T, method string, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestValueJSONEncoding(t *testing.T) {
+	data, err := json.Marshal(KeyValEntry{Key: "text", Value: "héllo"})
+	if err != nil || string(data) != `{"key":"text","value":"héllo"}` {
+		t.Errorf("Expected text unencoded, got %s, %v", data, err)
+	}
+
+	data, err = json.Marshal(KeyValEntry{Key: "bin", Value: binaryValue})
+	if err != nil || !strings.Contains(string(data), `"encoding":"base64"`) {
+		t.Fatalf("Expected a base64 value, got %s, %v", data, err)
+	}
+	var kv KeyValEntry
+	if err = json.Unmarshal(data, &kv); err != nil || kv.Value != binaryValue || kv.Encoding != "" {
+		t.Errorf("Expected the value decoded, got %+v, %v", kv, err)
+	}
+
+	for _, body := range []string{`{"key":"k","value":"!!","encoding":"base64"}`, `{"key":"k","value":"v","encoding":"rot13"}`} {
+		if err = json.Unmarshal([]byte(body), &kv); !errors.Is(err, ErrorInvalidEncoding) {
+			t.Errorf("%s: expected ErrorInvalidEncoding, got %v", body, err)
+		}
+	}
+}
+
+func TestHandlerRawValues(t *testing.T) {
+	InitKeyStore()
+
+	rr := sendRequest(t, "PUT", "/keys/image", []byte(binaryValue), map[string]string{"Content-Type": "image/png"})
+	if rr.Code != http.StatusNoContent || rr.Header().Get("ETag") == "" {
+		t.Fatalf("Expected status 204 with an ETag, got %d", rr.Code)
+	}
+	rr = sendRequest(t, "GET", "/keys/image", nil, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != binaryValue || rr.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Expected the exact bytes as image/png, got %d %q %q", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+
+	// replacing, without a content type
+	sendRequest(t, "PUT", "/keys/image", []byte("raw"), nil)
+	rr = sendRequest(t, "GET", "/keys/image", nil, nil)
+	if rr.Body.String() != "raw" || rr.Header().Get("Content-Type") != defaultValueContentType {
+		t.Errorf("Expected raw as %s, got %q %q", defaultValueContentType, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+
+	// an update keeps the content type
+	_ = Update("image", "updated")
+	if rr = sendRequest(t, "GET", "/keys/image", nil, nil); rr.Header().Get("Content-Type") != defaultValueContentType {
+		t.Errorf("Expected the update to keep the content type, got %q", rr.Header().Get("Content-Type"))
+	}
+
+	if rr = sendRequest(t, "PUT", "/keys/image", []byte("x"), map[string]string{"If-None-Match": "*"}); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status 412 for If-None-Match on an existing key, got %d", rr.Code)
+	}
+	if rr = sendRequest(t, "PUT", "/keys/bad", []byte("x"), map[string]string{"Content-Type": "not a type"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid content type, got %d", rr.Code)
+	}
+	if rr = sendRequest(t, "PUT", "/keys/bad?ttl=-1", []byte("x"), nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a negative ttl, got %d", rr.Code)
+	}
+}
+
+func TestHandlerRawTextValue(t *testing.T) {
+	InitKeyStore()
+	_ = Put("text", "x")
+
+	rr := sendRequest(t, "GET", "/keys/text", nil, nil)
+	if rr.Body.String() != "x\n" {
+		t.Errorf("Expected a line of text, got %q", rr.Body.String())
+	}
+	rr = sendRequest(t, "GET", "/keys/text?raw=true", nil, nil)
+	if _, hasType := rr.Header()["Content-Type"]; rr.Body.String() != "x" || (hasType && rr.Header().Get("Content-Type") != "") {
+		t.Errorf("Expected the value as stored without a content type, got %q %q", rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+}
+
+func TestHandlerBinaryListing(t *testing.T) {
+	InitKeyStore()
+	sendRequest(t, "PUT", "/keys/bin", []byte(binaryValue), map[string]string{"Content-Type": "image/png"})
+
+	rr := sendRequest(t, "GET", "/keys?prefix=bin", nil, nil)
+	var kvs KVList
+	if err := json.NewDecoder(rr.Body).Decode(&kvs); err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 || kvs[0].Value != binaryValue || kvs[0].ContentType != "image/png" {
+		t.Errorf("Expected the binary value and its content type, got %+v", kvs)
+	}
+
+	// binary values can be written as JSON too
+	rr = sendRequest(t, "POST", "/keys", []byte(`{"key":"posted","value":"AP8=","encoding":"base64"}`), nil)
+	if value, _ := Get("posted"); rr.Code != http.StatusCreated || value == nil || *value != "\x00\xff" {
+		t.Errorf("Expected the decoded value stored, got %d", rr.Code)
+	}
+	rr = sendRequest(t, "POST", "/keys", []byte(`{"key":"bad","value":"v","encoding":"rot13"}`), nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown encoding, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrorVersionMismatch = errors.New("version mismatch")
+
+// Precondition restricts a write to the key's current version, following the
+// semantics of the HTTP If-Match and If-None-Match headers. A nil
+// Precondition always holds.
+type Precondition struct {
+	// the key must exist at one of these versions, or at any version when
+	// IfMatchAny is set
+	IfMatch    []uint64
+	IfMatchAny bool
+	// the key must not exist at any of these versions, or must not exist at
+	// all when IfNoneMatchAny is set
+	IfNoneMatch    []uint64
+	IfNoneMatchAny bool
+}
+
+func containsVersion(versions []uint64, version uint64) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// check the precondition against key's current version; caller holds the
+// keyStore lock
+func (p *Precondition) check(key string) error {
+	if p == nil {
+		return nil
+	}
+
+	version, exists := keyStore.versions[key]
+	if p.IfMatchAny && !exists {
+		return ErrorVersionMismatch
+	}
+	if len(p.IfMatch) > 0 && (!exists || !containsVersion(p.IfMatch, version)) {
+		return ErrorVersionMismatch
+	}
+	if p.IfNoneMatchAny && exists {
+		return ErrorVersionMismatch
+	}
+	if exists && containsVersion(p.IfNoneMatch, version) {
+		return ErrorVersionMismatch
+	}
+	return nil
+}
+
+// the ETag header value for a version
+func formatETag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+// parse an If-Match or If-None-Match header into the versions it lists, or
+// whether it is `*`. Weak tags compare as strong ones; tags that aren't a
+// version can never match and are skipped.
+func parseETags(header string) (versions []uint64, wildcard bool) {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil, true
+		}
+		tag = strings.TrimPrefix(tag, "W/")
+		unquoted, err := strconv.Unquote(tag)
+		if err != nil {
+			continue
+		}
+		version, err := strconv.ParseUint(unquoted, 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions, false
+}
+
+// build the Precondition from a request's If-Match and If-None-Match headers;
+// nil if it has neither
+func requestPrecondition(r *http.Request) *Precondition {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+
+	p := &Precondition{}
+	if ifMatch != "" {
+		p.IfMatch, p.IfMatchAny = parseETags(ifMatch)
+		if !p.IfMatchAny && len(p.IfMatch) == 0 {
+			// only unknown tags, which can never match
+			p.IfMatch = []uint64{0}
+		}
+	}
+	if ifNoneMatch != "" {
+		p.IfNoneMatch, p.IfNoneMatchAny = parseETags(ifNoneMatch)
+	}
+	return p
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVersionsIncrease(t *testing.T) {
+	InitKeyStore()
+
+	_ = Put("vkey", "one")
+	_, v1, _ := GetWithVersion("vkey")
+	_ = Update("vkey", "two")
+	_, v2, _ := GetWithVersion("vkey")
+	if v2 <= v1 {
+		t.Errorf("Expected version to increase on update, got %d then %d", v1, v2)
+	}
+
+	// re-creating a deleted key never reuses a version
+	_ = Delete("vkey")
+	_ = Put("vkey", "three")
+	_, v3, _ := GetWithVersion("vkey")
+	if v3 <= v2 {
+		t.Errorf("Expected version to increase after re-create, got %d then %d", v2, v3)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	InitKeyStore()
+	_ = Put("caskey", "one")
+	_, version, _ := GetWithVersion("caskey")
+
+	newVersion, err := CompareAndSwap("caskey", version, "two")
+	if err != nil {
+		t.Fatalf("Got error on CompareAndSwap with current version: %s", err)
+	}
+
+	// the loser of a race sees the stale version rejected
+	if _, err = CompareAndSwap("caskey", version, "three"); !errors.Is(err, ErrorVersionMismatch) {
+		t.Errorf("Expected ErrorVersionMismatch, got %v", err)
+	}
+	value, current, _ := GetWithVersion("caskey")
+	if value != "two" || current != newVersion {
+		t.Errorf("Expected two at version %d, got %s at %d", newVersion, value, current)
+	}
+
+	if _, err = CompareAndSwap("missing", 1, "val"); !errors.Is(err, ErrorVersionMismatch) {
+		t.Errorf("Expected ErrorVersionMismatch for missing key, got %v", err)
+	}
+}
+
+func TestPreconditionCheck(t *testing.T) {
+	InitKeyStore()
+	_ = Put("pkey", "val")
+	_, version, _ := GetWithVersion("pkey")
+
+	tests := []struct {
+		name  string
+		key   string
+		cond  *Precondition
+		holds bool
+	}{
+		{"nil", "pkey", nil, true},
+		{"if-match current", "pkey", &Precondition{IfMatch: []uint64{version + 5, version}}, true},
+		{"if-match stale", "pkey", &Precondition{IfMatch: []uint64{version + 5}}, false},
+		{"if-match any existing", "pkey", &Precondition{IfMatchAny: true}, true},
+		{"if-match any missing", "missing", &Precondition{IfMatchAny: true}, false},
+		{"if-none-match current", "pkey", &Precondition{IfNoneMatch: []uint64{version}}, false},
+		{"if-none-match stale", "pkey", &Precondition{IfNoneMatch: []uint64{version + 5}}, true},
+		{"if-none-match any existing", "pkey", &Precondition{IfNoneMatchAny: true}, false},
+		{"if-none-match any missing", "missing", &Precondition{IfNoneMatchAny: true}, true},
+	}
+
+	for _, tc := range tests {
+		if err := tc.cond.check(tc.key); (err == nil) != tc.holds {
+			t.Errorf("%s: expected holds %v, got %v", tc.name, tc.holds, err)
+		}
+	}
+}
+
+func TestParseETags(t *testing.T) {
+	versions, wildcard := parseETags(`"1", W/"2", "abc", 3`)
+	if wildcard || len(versions) != 2 || versions[0] != 1 || versions[1] != 2 {
+		t.Errorf("Expected versions [1 2], got %v", versions)
+	}
+	if _, wildcard = parseETags("*"); !wildcard {
+		t.Error("Expected * to be a wildcard")
+	}
+}
+
+func TestVersionsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	w := openTestWAL(t, dir)
+
+	_ = Put("rkey", "one")
+	_ = Put("snapped", "val")
+	_ = w.Snapshot()
+	_ = Update("rkey", "two")
+	_, version, _ := GetWithVersion("rkey")
+	_, snappedVersion, _ := GetWithVersion("snapped")
+	revision := keyStore.revision
+	keyStoreWAL = nil
+	_ = w.Close()
+
+	InitKeyStore()
+	openTestWAL(t, dir)
+	if _, got, _ := GetWithVersion("rkey"); got != version {
+		t.Errorf("Expected rkey at version %d after restart, got %d", version, got)
+	}
+	if _, got, _ := GetWithVersion("snapped"); got != snappedVersion {
+		t.Errorf("Expected snapped at version %d after restart, got %d", snappedVersion, got)
+	}
+	if keyStore.revision != revision {
+		t.Errorf("Expected revision %d after restart, got %d", revision, keyStore.revision)
+	}
+}
+
+func TestHandlerETags(t *testing.T) {
+	InitKeyStore()
+	router := newRouter()
+
+	send := func(method string, path string, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("POST", "/keys", `{"key":"etag","value":"one"}`, map[string]string{"If-None-Match": "*"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected create with If-None-Match * to succeed, got %d", rr.Code)
+	}
+	created := rr.Header().Get("ETag")
+
+	rr = send("GET", "/keys/etag", "", nil)
+	if etag := rr.Header().Get("ETag"); etag != created {
+		t.Errorf("Expected GET ETag %s, got %s", created, etag)
+	}
+	rr = send("GET", "/keys/etag", "", map[string]string{"If-None-Match": created})
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for current ETag, got %d", rr.Code)
+	}
+
+	rr = send("PUT", "/keys", `{"key":"etag","value":"two"}`, map[string]string{"If-Match": created})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected PUT with current ETag to succeed, got %d", rr.Code)
+	}
+	updated := rr.Header().Get("ETag")
+	if updated == created {
+		t.Error("Expected ETag to change on update")
+	}
+
+	// a writer still holding the old ETag loses
+	rr = send("PUT", "/keys", `{"key":"etag","value":"three"}`, map[string]string{"If-Match": created})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for stale If-Match on PUT, got %d", rr.Code)
+	}
+	rr = send("DELETE", "/keys/etag", "", map[string]string{"If-Match": created})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for stale If-Match on DELETE, got %d", rr.Code)
+	}
+	rr = send("POST", "/keys", `{"key":"etag","value":"four"}`, map[string]string{"If-None-Match": "*"})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for If-None-Match * on existing key, got %d", rr.Code)
+	}
+
+	rr = send("DELETE", "/keys/etag", "", map[string]string{"If-Match": updated})
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Expected DELETE with current ETag to succeed, got %d", rr.Code)
+	}
+	if _, err := Get("etag"); err == nil {
+		t.Error("Expected key etag to be deleted")
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WALSyncPolicy controls when appended log entries are fsync'd to disk
+type WALSyncPolicy string
+
+const (
+	// WALSyncAlways fsyncs after every appended entry
+	WALSyncAlways WALSyncPolicy = "always"
+	// WALSyncInterval fsyncs from a background goroutine on a fixed interval
+	WALSyncInterval WALSyncPolicy = "interval"
+	// WALSyncNever leaves flushing to the OS
+	WALSyncNever WALSyncPolicy = "never"
+)
+
+const (
+	walSegmentPrefix = "wal-"
+	walSegmentSuffix = ".log"
+)
+
+var ErrorWALClosed = errors.New("write-ahead log closed")
+
+type walOp string
+
+const (
+	walOpPut    walOp = "put"
+	walOpUpdate walOp = "update"
+	walOpDelete walOp = "delete"
+	// sets or, when ExpiresAt is nil, clears a key's expiry
+	walOpExpire walOp = "expire"
+	// a transaction's mutations, applied together
+	walOpTxn walOp = "txn"
+)
+
+// walEntry is a single mutation, stored as one JSON object per line
+type walEntry struct {
+	Seq       uint64    `json:"seq"`
+	Op        walOp     `json:"op"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	Encoding  string    `json:"encoding,omitempty"`
+	Timestamp time.Time `json:"ts"`
+	// set for puts of keys with a TTL
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// a put or update's new metadata; when unset a put has none and an
+	// update keeps the key's
+	Meta *KeyMeta `json:"meta,omitempty"`
+	// the keyStore revision the mutation created
+	Revision uint64 `json:"rev,omitempty"`
+	// the mutations of a txn entry, which share its revision
+	Batch []walEntry `json:"batch,omitempty"`
+	// why a key was deleted, for watchers; not logged
+	reason EventType
+}
+
+// WAL an append-only log of keyStore mutations split into segment files
+// named `wal-FIRST_SEQ.log` inside dir
+type WAL struct {
+	mu       sync.Mutex
+	dir      string
+	file     *os.File
+	w        *bufio.Writer
+	seq      uint64
+	snapSeq  uint64
+	policy   WALSyncPolicy
+	interval time.Duration
+	done     chan struct{}
+	wg       sync.WaitGroup
+	closed   bool
+}
+
+// the log the keyStore appends to; nil when persistence is disabled
+var keyStoreWAL *WAL
+
+// ParseWALSyncPolicy returns the policy named by s
+func ParseWALSyncPolicy(s string) (WALSyncPolicy, error) {
+	switch p := WALSyncPolicy(strings.ToLower(s)); p {
+	case WALSyncAlways, WALSyncInterval, WALSyncNever:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown WAL sync policy %q; expected one of always, interval, never", s)
+}
+
+func walSegmentName(firstSeq uint64) string {
+	return fmt.Sprintf("%s%020d%s", walSegmentPrefix, firstSeq, walSegmentSuffix)
+}
+
+// list the segment files in dir, ordered by their first sequence number
+func walSegments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		segments = append(segments, filepath.Join(dir, name))
+	}
+	// zero padded names sort in sequence order
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// read every entry in the segment at path, passing each to fn. A torn final
+// line (from a crash mid-write) is logged and ignored.
+func readWALSegment(path string, fn func(walEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				logWarnf("WAL: ignoring incomplete trailing entry in %s", path)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var entry walEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("corrupt entry in %s: %w", path, err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// OpenWAL restores the latest snapshot in dir and replays the log entries
+// written after it into the keyStore, then opens the log for appending.
+// Intervals only apply to WALSyncInterval.
+func OpenWAL(dir string, policy WALSyncPolicy, interval time.Duration) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	segments, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{dir: dir, policy: policy, interval: interval, done: make(chan struct{})}
+
+	snap, err := loadLatestSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keyStore.Lock()
+	if snap != nil {
+		restoreSnapshot(snap)
+		w.seq = snap.Seq
+		w.snapSeq = snap.Seq
+		logInfof("WAL: restored %d keys from snapshot at seq %d", len(snap.Entries), snap.Seq)
+	}
+	for _, segment := range segments {
+		err = readWALSegment(segment, func(entry walEntry) error {
+			if entry.Seq <= w.snapSeq {
+				// already reflected in the snapshot
+				return nil
+			}
+			applyWALEntry(entry)
+			w.seq = entry.Seq
+			return nil
+		})
+		if err != nil {
+			keyStore.Unlock()
+			return nil, err
+		}
+	}
+	keyStore.Unlock()
+	logInfof("WAL: replayed %d segment(s) from %s up to seq %d", len(segments), dir, w.seq)
+
+	if err := w.openSegment(); err != nil {
+		return nil, err
+	}
+
+	if policy == WALSyncInterval {
+		w.wg.Add(1)
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// start a new segment beginning at the next sequence number. An existing file
+// with that name can only hold a torn entry, so it is truncated.
+func (w *WAL) openSegment() error {
+	path := filepath.Join(w.dir, walSegmentName(w.seq+1))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.w = bufio.NewWriter(f)
+	return nil
+}
+
+// finish the current segment and continue in a new one
+func (w *WAL) rotateLocked() error {
+	if err := w.syncLocked(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return w.openSegment()
+}
+
+func (w *WAL) syncLoop() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				logErrorf("WAL: periodic sync failed: %s", err)
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Append assigns the entry the next sequence number and writes it to the
+// current segment, honouring the sync policy
+func (w *WAL) Append(entry walEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrorWALClosed
+	}
+
+	entry.Seq = w.seq + 1
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, err = w.w.Write(line); err != nil {
+		return err
+	}
+	w.seq = entry.Seq
+
+	if w.policy == WALSyncAlways {
+		return w.syncLocked()
+	}
+	if w.policy == WALSyncNever {
+		// hand the entry to the OS so it survives a process crash
+		return w.w.Flush()
+	}
+	return nil
+}
+
+// Sync flushes buffered entries and fsyncs the current segment
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrorWALClosed
+	}
+	return w.syncLocked()
+}
+
+func (w *WAL) syncLocked() error {
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// Close stops the background sync, then flushes and closes the log
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	err := w.syncLocked()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.done)
+	w.wg.Wait()
+	return err
+}
+
+// apply a logged mutation to the keyStore; caller holds the keyStore lock
+func applyWALEntry(entry walEntry) {
+	if entry.Revision == 0 {
+		// logged before revisions were recorded
+		entry.Revision = keyStore.revision + 1
+	}
+
+	switch entry.Op {
+	case walOpPut:
+		var expiresAt time.Time
+		if entry.ExpiresAt != nil {
+			expiresAt = *entry.ExpiresAt
+		}
+		applyPut(entry.Key, entry.Value, entry.Timestamp, expiresAt, entry.Revision)
+		if entry.Meta != nil {
+			applyMeta(entry.Key, *entry.Meta)
+		}
+	case walOpUpdate:
+		applyUpdate(entry.Key, entry.Value, entry.Revision)
+		if entry.Meta != nil {
+			applyMeta(entry.Key, *entry.Meta)
+		}
+	case walOpDelete:
+		applyDelete(entry.Key, entry.Revision)
+	case walOpExpire:
+		var expiresAt time.Time
+		if entry.ExpiresAt != nil {
+			expiresAt = *entry.ExpiresAt
+		}
+		applyExpire(entry.Key, expiresAt, entry.Revision)
+	case walOpTxn:
+		for _, op := range entry.Batch {
+			op.Revision = entry.Revision
+			applyWALEntry(op)
+		}
+	default:
+		logWarnf("WAL: skipping entry %d with unknown op %q", entry.Seq, entry.Op)
+	}
+}
+
+// append the mutation to the keyStore's log, if persistence is enabled;
+// caller holds the keyStore lock so log order matches apply order
+func logMutation(entry walEntry) error {
+	if keyStoreWAL == nil {
+		return nil
+	}
+	err := keyStoreWAL.Append(entry)
+	if err != nil {
+		logErrorf("WAL: failed to append %s for key %s: %s", entry.Op, entry.Key, err)
+	}
+	return err
+}
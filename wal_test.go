@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// open a WAL in dir and route keyStore mutations to it for the test
+func openTestWAL(t *testing.T, dir string) *WAL {
+	w, err := OpenWAL(dir, WALSyncAlways, time.Second)
+	if err != nil {
+		t.Fatalf("Got error opening WAL: %s", err)
+	}
+	keyStoreWAL = w
+	t.Cleanup(func() {
+		keyStoreWAL = nil
+		_ = w.Close()
+	})
+	return w
+}
+
+func TestParseWALSyncPolicy(t *testing.T) {
+	for _, s := range []string{"always", "INTERVAL", "never"} {
+		if _, err := ParseWALSyncPolicy(s); err != nil {
+			t.Errorf("Expected %s to parse, got %s", s, err)
+		}
+	}
+
+	if _, err := ParseWALSyncPolicy("sometimes"); err == nil {
+		t.Error("Expected error for unknown sync policy")
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	w := openTestWAL(t, dir)
+
+	for i := 0; i < 5; i++ {
+		if err := Put(fmt.Sprintf("walkey%d", i), fmt.Sprintf("walval%d", i)); err != nil {
+			t.Fatalf("Got error during Put: %s", err)
+		}
+	}
+	if err := Update("walkey1", "updated"); err != nil {
+		t.Fatalf("Got error during Update: %s", err)
+	}
+	if err := Delete("walkey2"); err != nil {
+		t.Fatalf("Got error during Delete: %s", err)
+	}
+
+	keyStoreWAL = nil
+	if err := w.Close(); err != nil {
+		t.Fatalf("Got error closing WAL: %s", err)
+	}
+
+	// simulate a restart
+	InitKeyStore()
+	openTestWAL(t, dir)
+
+	expected := map[string]string{"walkey0": "walval0", "walkey1": "updated", "walkey3": "walval3", "walkey4": "walval4"}
+	if len(keyStore.m) != len(expected) {
+		t.Errorf("Expected %d keys after replay, got %d", len(expected), len(keyStore.m))
+	}
+	for k, v := range expected {
+		if keyStore.m[k] != v {
+			t.Errorf("Key %s: expected %s after replay, got %s", k, v, keyStore.m[k])
+		}
+	}
+}
+
+func TestWALReplayEviction(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	openTestWAL(t, dir)
+
+	for i := 0; i < defaultMaxKeys+1; i++ {
+		_ = Put(fmt.Sprintf("evict%d", i), "val")
+	}
+	_ = keyStoreWAL.Close()
+	keyStoreWAL = nil
+
+	InitKeyStore()
+	openTestWAL(t, dir)
+
+	if _, contains := keyStore.m["evict0"]; contains {
+		t.Error("Evicted key evict0 present after replay")
+	}
+	if lenKeyStore() != defaultMaxKeys {
+		t.Errorf("Expected %d keys after replay, got %d", defaultMaxKeys, lenKeyStore())
+	}
+}
+
+func TestWALTornEntry(t *testing.T) {
+	dir := t.TempDir()
+	InitKeyStore()
+	w := openTestWAL(t, dir)
+
+	if err := Put("tornkey", "tornval"); err != nil {
+		t.Fatalf("Got error during Put: %s", err)
+	}
+	keyStoreWAL = nil
+	_ = w.Close()
+
+	// append half an entry as if the process died mid-write
+	f, err := os.OpenFile(filepath.Join(dir, walSegmentName(1)), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"seq":2,"op":"put","key":"half`)
+	_ = f.Close()
+
+	InitKeyStore()
+	openTestWAL(t, dir)
+
+	if keyStore.m["tornkey"] != "tornval" {
+		t.Error("Complete entry not replayed")
+	}
+	if _, contains := keyStore.m["half"]; contains {
+		t.Error("Torn entry should not be replayed")
+	}
+
+	// writes after the torn entry must survive another restart
+	if err := Put("afterkey", "afterval"); err != nil {
+		t.Fatalf("Got error during Put: %s", err)
+	}
+	_ = keyStoreWAL.Close()
+	keyStoreWAL = nil
+
+	InitKeyStore()
+	openTestWAL(t, dir)
+	if keyStore.m["afterkey"] != "afterval" {
+		t.Error("Entry written after torn entry not replayed")
+	}
+}
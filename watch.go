@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// how long a long-poll waits for an event when no timeout is given
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+	// how long a long-poll has to write its response once its wait ends
+	watchPollWriteWait = 10 * time.Second
+	// how often an idle event stream sends a comment to keep proxies from
+	// closing it
+	sseKeepAliveInterval = 15 * time.Second
+)
+
+var ErrorInvalidWatch = errors.New("invalid watch")
+
+// a long-poll's response; Revision is the revision to poll from next
+type watchResponse struct {
+	Revision uint64  `json:"rev"`
+	Events   []Event `json:"events"`
+}
+
+// parse the key or prefix a watch request is for
+func parseWatchFilter(query url.Values) (EventFilter, error) {
+	if query.Has("key") && query.Has("prefix") {
+		return EventFilter{}, fmt.Errorf("%w: key and prefix are exclusive", ErrorInvalidWatch)
+	}
+	if query.Has("key") && query.Get("key") == "" {
+		return EventFilter{}, fmt.Errorf("%w: empty key", ErrorInvalidWatch)
+	}
+	return EventFilter{Key: query.Get("key"), Prefix: query.Get("prefix")}, nil
+}
+
+// parse the revision to watch from, from the rev parameter or, when a stream
+// reconnects, its Last-Event-ID header; the current revision if neither
+func parseWatchRevision(r *http.Request) (uint64, error) {
+	s := r.URL.Query().Get("rev")
+	if s == "" {
+		s = r.Header.Get("Last-Event-ID")
+	}
+	if s == "" {
+		return CurrentRevision(), nil
+	}
+	rev, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad revision %q", ErrorInvalidWatch, s)
+	}
+	return rev, nil
+}
+
+// WatchHandlerFunc reports changes to a key, or keys with a prefix, after a
+// revision: as a Server-Sent Events stream when the client accepts one,
+// otherwise as a long-poll returning once there's at least one change
+func WatchHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseWatchFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	since, err := parseWatchRevision(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	streaming := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	timeout := defaultWatchTimeout
+	if s := r.URL.Query().Get("timeout"); s != "" && !streaming {
+		timeout, err = time.ParseDuration(s)
+		if err != nil || timeout <= 0 || timeout > maxWatchTimeout {
+			http.Error(w, fmt.Sprintf("%s: timeout must be a duration up to %s", ErrorInvalidWatch, maxWatchTimeout), http.StatusBadRequest)
+			return
+		}
+	}
+
+	watch, backlog, err := WatchKeys(filter, since)
+	if errors.Is(err, ErrorRevisionCompacted) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer watch.Close()
+
+	if streaming {
+		streamEvents(w, r, watch, backlog)
+	} else {
+		pollEvents(w, r, watch, backlog, since, timeout)
+	}
+}
+
+// wait for the first event, then return it with any others already queued
+func pollEvents(w http.ResponseWriter, r *http.Request, watch *Watch, events []Event, since uint64, timeout time.Duration) {
+	if len(events) == 0 {
+		// the wait may outlast the server's write timeout
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Now().Add(timeout + watchPollWriteWait)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			logWarnf("watchHandlerFunc - unable to extend write deadline: %s", err)
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case e, ok := <-watch.Events():
+			if ok {
+				events = append(events, e)
+			}
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+	}
+	if len(events) > 0 {
+	drain:
+		for {
+			select {
+			case e, ok := <-watch.Events():
+				if !ok {
+					break drain
+				}
+				events = append(events, e)
+			default:
+				break drain
+			}
+		}
+	}
+
+	res := watchResponse{Revision: since, Events: events}
+	if res.Events == nil {
+		res.Events = []Event{}
+	}
+	if len(events) > 0 {
+		res.Revision = events[len(events)-1].Revision
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		logErrorf("watchHandlerFunc - Error %s", err)
+	}
+}
+
+// write events as Server-Sent Events until the client goes away, the server
+// shuts down or the watcher falls behind; each event's id is its revision so
+// a reconnecting client resumes where it left off
+func streamEvents(w http.ResponseWriter, r *http.Request, watch *Watch, backlog []Event) {
+	rc := http.NewResponseController(w)
+	// the stream outlives the server's write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logWarnf("watchHandlerFunc - unable to clear write deadline: %s", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Revision, e.Type, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	for _, e := range backlog {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-watch.Events():
+			if !ok {
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
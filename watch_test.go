@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pollWatch(t *testing.T, query string) (int, watchResponse) {
+	req, err := http.NewRequest("GET", "/watch?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+
+	var res watchResponse
+	if rr.Code == http.StatusOK {
+		if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+			t.Fatalf("Unable to decode watch response: %s", err)
+		}
+	}
+	return rr.Code, res
+}
+
+func TestLongPollReturnsOnChange(t *testing.T) {
+	InitKeyStore()
+	_ = Put("poll", "a")
+	rev := keyStore.revision
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = Update("poll", "b")
+	}()
+
+	status, res := pollWatch(t, "key=poll&rev="+strconv.FormatUint(rev, 10))
+	if status != http.StatusOK || len(res.Events) != 1 {
+		t.Fatalf("Expected one event, got status %d, %+v", status, res)
+	}
+	if res.Events[0].Value != "b" || res.Revision != rev+1 {
+		t.Errorf("Expected the update at revision %d, got %+v", rev+1, res)
+	}
+}
+
+func TestLongPollPastRevision(t *testing.T) {
+	InitKeyStore()
+	_ = Put("poll", "a")
+	_ = Update("poll", "b")
+
+	// changes already made are returned straight away
+	_, res := pollWatch(t, "key=poll&rev=0&timeout=1s")
+	if len(res.Events) != 2 || res.Revision != 2 {
+		t.Errorf("Expected both changes up to revision 2, got %+v", res)
+	}
+}
+
+func TestLongPollTimeout(t *testing.T) {
+	InitKeyStore()
+	_ = Put("poll", "a")
+
+	status, res := pollWatch(t, "prefix=po&timeout=20ms")
+	if status != http.StatusOK || len(res.Events) != 0 || res.Revision != 1 {
+		t.Errorf("Expected no events at revision 1, got status %d, %+v", status, res)
+	}
+}
+
+func TestLongPollOutlastsWriteTimeout(t *testing.T) {
+	InitKeyStore()
+	srv := httptest.NewUnstartedServer(newRouter())
+	srv.Config.WriteTimeout = 50 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/watch?key=idle&timeout=200ms")
+	if err != nil {
+		t.Fatalf("Expected a response after the write timeout, got %s", err)
+	}
+	defer resp.Body.Close()
+	var res watchResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); resp.StatusCode != http.StatusOK || err != nil || len(res.Events) != 0 {
+		t.Errorf("Expected no events, got status %d, %+v, %v", resp.StatusCode, res, err)
+	}
+}
+
+func TestWatchHandlerErrors(t *testing.T) {
+	InitKeyStore()
+	keyStore.revision = 10
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"key=a&prefix=b", http.StatusBadRequest},
+		{"key=", http.StatusBadRequest},
+		{"rev=soon", http.StatusBadRequest},
+		{"timeout=forever", http.StatusBadRequest},
+		{"timeout=1h", http.StatusBadRequest},
+		{"rev=5", http.StatusGone},
+	}
+	for _, tc := range tests {
+		if status, _ := pollWatch(t, tc.query); status != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.query, tc.status, status)
+		}
+	}
+}
+
+func TestWatchStream(t *testing.T) {
+	InitKeyStore()
+	_ = Put("stream", "a")
+	url, cancel, result := startTestServer(t, newRouter(), time.Second)
+
+	req, err := http.NewRequest("GET", url+"/watch?key=stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	// resume after the put
+	req.Header.Set("Last-Event-ID", "1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", ct)
+	}
+
+	_ = Update("stream", "b")
+	_ = Delete("stream")
+
+	lines := bufio.NewScanner(res.Body)
+	var got []string
+	for len(got) < 6 && lines.Scan() {
+		if line := lines.Text(); line != "" {
+			got = append(got, line)
+		}
+	}
+	expected := []string{
+		"id: 2", "event: update", `data: {"type":"update","key":"stream","value":"b","rev":2}`,
+		"id: 3", "event: delete", `data: {"type":"delete","key":"stream","rev":3}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected stream\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+
+	// shutting down ends the stream rather than waiting out the drain
+	cancel()
+	if err := <-result; err != nil {
+		t.Errorf("Expected clean shutdown, got %s", err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// a connection that sends nothing, not even a pong, for this long is dead
+	wsPongWait = 60 * time.Second
+	// how often the server pings, comfortably inside wsPongWait
+	wsPingInterval = 30 * time.Second
+	wsWriteWait    = 10 * time.Second
+	// the largest message a client may send
+	wsMaxMessageSize = 1 << 20
+	// messages queued for a client before it's considered too slow and closed
+	wsSendBufferSize = 256
+)
+
+// wsRequest a client message. Every request carries an ID, echoed in its
+// response, so clients can have several in flight.
+type wsRequest struct {
+	ID    string `json:"id"`
+	Op    string `json:"op"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	// for put, seconds until the key expires
+	TTL int64 `json:"ttl,omitempty"`
+	// for update and delete, the version the key must be at
+	Version uint64 `json:"version,omitempty"`
+	// for subscribe, the prefix to watch and the revision to resume after
+	Prefix string  `json:"prefix,omitempty"`
+	Rev    *uint64 `json:"rev,omitempty"`
+	// for unsubscribe, the ID of the subscribe request
+	Subscription string `json:"subscription,omitempty"`
+}
+
+// wsMessage a server message: either a response to the request with ID, with
+// an HTTP-style status, or an event for the subscription Subscription, or
+// word that the server ended that subscription
+type wsMessage struct {
+	Type         string `json:"type"`
+	ID           string `json:"id,omitempty"`
+	Status       int    `json:"status,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Value        string `json:"value,omitempty"`
+	Encoding     string `json:"encoding,omitempty"`
+	Version      uint64 `json:"version,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	Event        *Event `json:"event,omitempty"`
+}
+
+const (
+	wsTypeResponse = "response"
+	wsTypeEvent    = "event"
+	wsTypeClosed   = "closed"
+)
+
+var ErrorInvalidWSRequest = errors.New("invalid request")
+
+// only same-origin browser pages may connect, the upgrader's default
+var wsUpgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+
+// wsConn one client connection and its subscriptions
+type wsConn struct {
+	conn *websocket.Conn
+	send chan wsMessage
+	// closed when the connection is done, stopping its goroutines
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	subs      map[string]*Watch
+}
+
+// WSHandlerFunc upgrades to a WebSocket carrying JSON get, put, update,
+// delete, subscribe and unsubscribe requests
+func WSHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied
+		logDebugf("wsHandlerFunc - upgrade failed: %s", err)
+		return
+	}
+
+	c := &wsConn{
+		conn: conn,
+		send: make(chan wsMessage, wsSendBufferSize),
+		done: make(chan struct{}),
+		subs: make(map[string]*Watch),
+	}
+	go c.writeLoop()
+	go func() {
+		// hijacked connections aren't drained on shutdown, so end them here
+		select {
+		case <-r.Context().Done():
+			c.close(websocket.CloseGoingAway, "server shutting down")
+		case <-c.done:
+		}
+	}()
+	c.readLoop()
+}
+
+// close the connection once, telling the client why, and end every
+// subscription
+func (c *wsConn) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		msg := websocket.FormatCloseMessage(code, reason)
+		_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+		close(c.done)
+		_ = c.conn.Close()
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for id, watch := range c.subs {
+			watch.Close()
+			delete(c.subs, id)
+		}
+	})
+}
+
+// queue msg for the client, closing a client too slow to keep up
+func (c *wsConn) queue(msg wsMessage) {
+	select {
+	case c.send <- msg:
+	case <-c.done:
+	default:
+		logWarnf("WebSocket client %s fell behind; closing it", c.conn.RemoteAddr())
+		go c.close(websocket.CloseTryAgainLater, "too slow")
+	}
+}
+
+func (c *wsConn) writeLoop() {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case msg := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				go c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				go c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wsConn) readLoop() {
+	defer c.close(websocket.CloseNormalClosure, "")
+
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) {
+				logDebugf("wsHandlerFunc - read failed: %s", err)
+			}
+			return
+		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		var req wsRequest
+		if err = json.Unmarshal(data, &req); err != nil {
+			c.queue(wsMessage{Type: wsTypeResponse, Status: http.StatusBadRequest, Error: fmt.Sprintf("%s: %s", ErrorInvalidWSRequest, err)})
+			continue
+		}
+		res, forward := c.handle(req)
+		c.queue(res)
+		if forward != nil {
+			// events follow the subscribe response
+			go forward()
+		}
+	}
+}
+
+// carry out a request, returning its response and, for a subscribe, the
+// function forwarding its events
+func (c *wsConn) handle(req wsRequest) (wsMessage, func()) {
+	res := wsMessage{Type: wsTypeResponse, ID: req.ID, Status: http.StatusOK}
+	fail := func(err error, fallback int) (wsMessage, func()) {
+		res.Status = wsErrorStatus(err, fallback)
+		res.Error = err.Error()
+		return res, nil
+	}
+	if req.ID == "" {
+		return fail(fmt.Errorf("%w: missing id", ErrorInvalidWSRequest), http.StatusBadRequest)
+	}
+
+	var cond *Precondition
+	if req.Version != 0 {
+		cond = &Precondition{IfMatch: []uint64{req.Version}}
+	}
+
+	var err error
+	var forward func()
+	switch req.Op {
+	case "get":
+		res.Value, res.Version, err = GetWithVersion(req.Key)
+	case "put":
+		if req.TTL < 0 {
+			return fail(fmt.Errorf("%w: negative ttl", ErrorInvalidWSRequest), http.StatusBadRequest)
+		}
+		expiresAt := entryExpiry(KeyValEntry{TTL: req.TTL}, time.Now())
+		res.Version, err = PutIf(req.Key, req.Value, expiresAt, nil)
+		res.Status = http.StatusCreated
+	case "update":
+		res.Version, err = UpdateIf(req.Key, req.Value, cond)
+	case "delete":
+		err = DeleteIf(req.Key, cond)
+	case "subscribe":
+		if forward, err = c.subscribe(req); err == nil {
+			res.Subscription = req.ID
+		}
+	case "unsubscribe":
+		err = c.unsubscribe(req.Subscription)
+	default:
+		err = fmt.Errorf("%w: unknown op %q", ErrorInvalidWSRequest, req.Op)
+	}
+	if err != nil {
+		return fail(err, http.StatusInternalServerError)
+	}
+	return res, forward
+}
+
+// map request errors to their HTTP-style status
+func wsErrorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, ErrorInvalidWSRequest), errors.Is(err, ErrorInvalidWatch):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrorNoSuchKey):
+		return http.StatusNotFound
+	case errors.Is(err, ErrorKeyExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrorRevisionCompacted):
+		return http.StatusGone
+	}
+	return storeErrorStatus(err, fallback)
+}
+
+// watch the request's key or prefix, returning the function that forwards
+// its events, tagged with the request's ID, until unsubscribed
+func (c *wsConn) subscribe(req wsRequest) (func(), error) {
+	if req.Key != "" && req.Prefix != "" {
+		return nil, fmt.Errorf("%w: key and prefix are exclusive", ErrorInvalidWatch)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.subs[req.ID]; exists {
+		return nil, fmt.Errorf("%w: subscription %s exists", ErrorInvalidWSRequest, req.ID)
+	}
+
+	since := CurrentRevision()
+	if req.Rev != nil {
+		since = *req.Rev
+	}
+	watch, backlog, err := WatchKeys(EventFilter{Key: req.Key, Prefix: req.Prefix}, since)
+	if err != nil {
+		return nil, err
+	}
+	c.subs[req.ID] = watch
+
+	return func() {
+		for i := range backlog {
+			c.queue(wsMessage{Type: wsTypeEvent, Subscription: req.ID, Event: &backlog[i]})
+		}
+		for e := range watch.Events() {
+			e := e
+			c.queue(wsMessage{Type: wsTypeEvent, Subscription: req.ID, Event: &e})
+		}
+
+		// unless unsubscribed, the watcher fell behind
+		c.mu.Lock()
+		ended := c.subs[req.ID] == watch
+		if ended {
+			delete(c.subs, req.ID)
+		}
+		c.mu.Unlock()
+		if ended {
+			c.queue(wsMessage{Type: wsTypeClosed, Subscription: req.ID, Status: http.StatusGone, Error: "watcher fell behind"})
+		}
+	}, nil
+}
+
+func (c *wsConn) unsubscribe(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	watch, ok := c.subs[id]
+	if !ok {
+		return fmt.Errorf("%w: no subscription %q", ErrorInvalidWSRequest, id)
+	}
+	watch.Close()
+	delete(c.subs, id)
+	return nil
+}
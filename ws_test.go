@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// connect a WebSocket client to a test server
+func dialTestWS(t *testing.T) (*websocket.Conn, func()) {
+	url, cancel, _ := startTestServer(t, newRouter(), time.Second)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn, cancel
+}
+
+// send req and read the next message
+func wsRoundTrip(t *testing.T, conn *websocket.Conn, req wsRequest) wsMessage {
+	t.Helper()
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatalf("Unable to send %+v: %s", req, err)
+	}
+	return readWS(t, conn)
+}
+
+func readWS(t *testing.T, conn *websocket.Conn) wsMessage {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	var msg wsMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("Unable to read message: %s", err)
+	}
+	return msg
+}
+
+func TestWSRequests(t *testing.T) {
+	InitKeyStore()
+	conn, _ := dialTestWS(t)
+
+	tests := []struct {
+		req    wsRequest
+		status int
+		value  string
+	}{
+		{wsRequest{ID: "1", Op: "put", Key: "ws", Value: "a"}, http.StatusCreated, ""},
+		{wsRequest{ID: "2", Op: "put", Key: "ws", Value: "a"}, http.StatusConflict, ""},
+		{wsRequest{ID: "3", Op: "get", Key: "ws"}, http.StatusOK, "a"},
+		{wsRequest{ID: "4", Op: "update", Key: "ws", Value: "b", Version: 99}, http.StatusPreconditionFailed, ""},
+		{wsRequest{ID: "5", Op: "update", Key: "ws", Value: "b", Version: 1}, http.StatusOK, ""},
+		{wsRequest{ID: "6", Op: "delete", Key: "ws"}, http.StatusOK, ""},
+		{wsRequest{ID: "7", Op: "get", Key: "ws"}, http.StatusNotFound, ""},
+		{wsRequest{ID: "8", Op: "swap", Key: "ws"}, http.StatusBadRequest, ""},
+		{wsRequest{Op: "get", Key: "ws"}, http.StatusBadRequest, ""},
+	}
+	for _, tc := range tests {
+		res := wsRoundTrip(t, conn, tc.req)
+		if res.Type != wsTypeResponse || res.ID != tc.req.ID || res.Status != tc.status || res.Value != tc.value {
+			t.Errorf("%+v: expected status %d value %q, got %+v", tc.req, tc.status, tc.value, res)
+		}
+	}
+
+	// malformed messages are answered without closing the connection
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	if res := readWS(t, conn); res.Status != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for malformed message, got %+v", res)
+	}
+	if res := wsRoundTrip(t, conn, wsRequest{ID: "9", Op: "put", Key: "ws", Value: "c"}); res.Status != http.StatusCreated {
+		t.Errorf("Expected connection usable after malformed message, got %+v", res)
+	}
+}
+
+func TestWSSubscribe(t *testing.T) {
+	InitKeyStore()
+	conn, _ := dialTestWS(t)
+
+	res := wsRoundTrip(t, conn, wsRequest{ID: "sub", Op: "subscribe", Prefix: "cust:"})
+	if res.Status != http.StatusOK || res.Subscription != "sub" {
+		t.Fatalf("Expected subscription sub, got %+v", res)
+	}
+
+	_ = Put("order:1", "skipped")
+	_ = Put("cust:1", "a")
+	event := readWS(t, conn)
+	if event.Type != wsTypeEvent || event.Subscription != "sub" || event.Event == nil || event.Event.Key != "cust:1" {
+		t.Fatalf("Expected put event for cust:1, got %+v", event)
+	}
+
+	if res := wsRoundTrip(t, conn, wsRequest{ID: "unsub", Op: "unsubscribe", Subscription: "sub"}); res.Status != http.StatusOK {
+		t.Fatalf("Expected unsubscribe to succeed, got %+v", res)
+	}
+	_ = Put("cust:2", "b")
+	// the next message is this response, not an event for cust:2
+	if res := wsRoundTrip(t, conn, wsRequest{ID: "get", Op: "get", Key: "cust:2"}); res.Type != wsTypeResponse || res.ID != "get" {
+		t.Errorf("Expected no events after unsubscribing, got %+v", res)
+	}
+	if res := wsRoundTrip(t, conn, wsRequest{ID: "again", Op: "unsubscribe", Subscription: "sub"}); res.Status != http.StatusBadRequest {
+		t.Errorf("Expected unknown subscription to fail, got %+v", res)
+	}
+}
+
+func TestWSSubscriberFallsBehind(t *testing.T) {
+	InitKeyStore()
+	conn, _ := dialTestWS(t)
+	if res := wsRoundTrip(t, conn, wsRequest{ID: "sub", Op: "subscribe", Prefix: "cust:"}); res.Status != http.StatusOK {
+		t.Fatalf("Expected subscription sub, got %+v", res)
+	}
+
+	// as publish does for a watcher that falls behind
+	keyStoreEvents.mu.Lock()
+	for w := range keyStoreEvents.watchers {
+		keyStoreEvents.removeLocked(w)
+	}
+	keyStoreEvents.mu.Unlock()
+
+	msg := readWS(t, conn)
+	if msg.Type != wsTypeClosed || msg.Subscription != "sub" || msg.Status != http.StatusGone || msg.Error == "" {
+		t.Fatalf("Expected the client told sub closed, got %+v", msg)
+	}
+	if res := wsRoundTrip(t, conn, wsRequest{ID: "sub", Op: "subscribe", Prefix: "cust:"}); res.Status != http.StatusOK {
+		t.Errorf("Expected the ID free to subscribe again, got %+v", res)
+	}
+	if res := wsRoundTrip(t, conn, wsRequest{ID: "unsub", Op: "unsubscribe", Subscription: "sub"}); res.Status != http.StatusOK {
+		t.Errorf("Expected the new subscription unsubscribed, got %+v", res)
+	}
+}
+
+func TestWSSubscribeFromRevision(t *testing.T) {
+	InitKeyStore()
+	_ = Put("hist", "a")
+	_ = Update("hist", "b")
+	conn, _ := dialTestWS(t)
+
+	rev := uint64(1)
+	if res := wsRoundTrip(t, conn, wsRequest{ID: "sub", Op: "subscribe", Key: "hist", Rev: &rev}); res.Status != http.StatusOK {
+		t.Fatalf("Expected subscription, got %+v", res)
+	}
+	if event := readWS(t, conn); event.Event == nil || event.Event.Value != "b" {
+		t.Errorf("Expected the update after revision 1, got %+v", event)
+	}
+}
+
+func TestWSShutdown(t *testing.T) {
+	InitKeyStore()
+	conn, cancel := dialTestWS(t)
+	cancel()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected the connection closed as going away, got %v", err)
+	}
+}